@@ -30,12 +30,13 @@ var (
 
 	address = flag.String("address", "0.0.0.0:43210", "The IP address and port to use for listening for client connections")
 	labels  = flag.String("labels", "", "Comma separated list of key=value pairs")
-	taints  = flag.String("taints", "", "Comma separated list of key=value pairs")
+	taints  = flag.String("taints", "", "Comma separated list of key=value[:effect] pairs, the effect is NoSchedule, PreferNoSchedule or NoExecute and defaults to NoSchedule")
 	poolId  = flag.String("pool-id", "", "The ID of the pool this agent belongs to")
 )
 
 type EventListener interface {
-	SessionClosed(id string)
+	// The reason is empty unless the session was canceled by the agent
+	SessionClosed(id string, reason string)
 
 	ConnectionCreated(sessionId string, connection restapi.ConnectionData)
 	ConnectionClosed(sessionId string, connection restapi.ConnectionData, exitCode int)
@@ -171,10 +172,10 @@ func (agent *Agent) getSession(sessionId string) (*Session, error) {
 	return session, nil
 }
 
-func (agent *Agent) addSession(sessionId string, version string, gpus *gpu.SelectedGpuSet) {
+func (agent *Agent) addSession(sessionId string, version string, gpus *gpu.SelectedGpuSet, maxDurationSeconds int64, idleTimeoutSeconds int64) {
 	logger.Debugf("Starting Session %s", sessionId)
 
-	session := newSession(agent.taskManager.Ctx(), sessionId, version, agent.JuicePath, gpus, agent)
+	session := newSession(agent.taskManager.Ctx(), sessionId, version, agent.JuicePath, gpus, maxDurationSeconds, idleTimeoutSeconds, agent)
 	agent.sessions.Set(sessionId, session)
 
 	agent.taskManager.Go(fmt.Sprintf("session %s", sessionId), session)
@@ -209,13 +210,19 @@ func (agent *Agent) connect(sessionId string, connectionData restapi.ConnectionD
 }
 
 func (agent *Agent) requestSession(sessionRequirements restapi.SessionRequirements) (string, error) {
-	selectedGpus, err := agent.Gpus.Find(sessionRequirements.Gpus)
+	selectedGpus, err := agent.Gpus.Find(sessionRequirements.Gpus, sessionRequirements.GpuSharing)
 	if err != nil {
 		return "", errors.New("unable to find a matching set of GPUs").Wrap(err)
 	}
 
+	// Persistent sessions are expected to remain without connections
+	idleTimeoutSeconds := sessionRequirements.IdleTimeoutSeconds
+	if sessionRequirements.Persistent {
+		idleTimeoutSeconds = 0
+	}
+
 	id := uuid.NewString()
-	agent.addSession(id, sessionRequirements.Version, selectedGpus)
+	agent.addSession(id, sessionRequirements.Version, selectedGpus, sessionRequirements.MaxDurationSeconds, idleTimeoutSeconds)
 	return id, nil
 }
 
@@ -225,7 +232,12 @@ func (agent *Agent) registerSession(session restapi.Session) error {
 		return errors.New("unable to select a matching set of GPUs").Wrap(err)
 	}
 
-	agent.addSession(session.Id, session.Version, selectedGpus)
+	idleTimeoutSeconds := session.IdleTimeoutSeconds
+	if session.Persistent {
+		idleTimeoutSeconds = 0
+	}
+
+	agent.addSession(session.Id, session.Version, selectedGpus, session.MaxDurationSeconds, idleTimeoutSeconds)
 	return nil
 }
 
@@ -240,15 +252,16 @@ func (agent *Agent) SessionActive(id string) {
 	}
 }
 
-func (agent *Agent) SessionClosed(id string) {
+func (agent *Agent) SessionClosed(id string, reason string) {
 	logger.Debugf("session %s closed", id)
 
 	agent.sessions.Delete(id)
 
 	if agent.sessionUpdates != nil {
 		agent.sessionUpdates <- sessionUpdate{
-			Id:    id,
-			State: restapi.SessionClosed,
+			Id:     id,
+			State:  restapi.SessionClosed,
+			Reason: reason,
 		}
 	}
 }
@@ -275,6 +288,7 @@ func (agent *Agent) ConnectionClosed(sessionId string, connection restapi.Connec
 			Connection: restapi.Connection{
 				ConnectionData: connection,
 				ExitCode:       exitCode,
+				Closed:         true,
 			},
 		}
 	}
@@ -26,8 +26,9 @@ var (
 )
 
 type sessionUpdate struct {
-	Id    string
-	State string
+	Id     string
+	State  string
+	Reason string
 }
 
 type connectionUpdate struct {
@@ -151,6 +152,9 @@ func (agent *Agent) ConnectToController(group task.Group, tlsConfig *tls.Config)
 							}
 
 							session.State = update.State
+							if update.Reason != "" {
+								session.Reason = update.Reason
+							}
 							sessionUpdates[update.Id] = session
 
 						case update := <-agent.connectionUpdates:
@@ -167,6 +171,15 @@ func (agent *Agent) ConnectToController(group task.Group, tlsConfig *tls.Config)
 						}
 					}
 
+					// Connections opening and closing are included above, so the controller learns whenever a session becomes idle
+					for id, update := range sessionUpdates {
+						session, found := agent.sessions.Get(id)
+						if found {
+							update.Idle = session.Idle()
+							sessionUpdates[id] = update
+						}
+					}
+
 					err = errors.Join(err, agent.api.UpdateAgentWithContext(group.Ctx(), restapi.AgentUpdate{
 						Id:             agent.Id,
 						State:          restapi.AgentActive,
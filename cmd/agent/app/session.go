@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/Xdevlab/Run/pkg/errors"
 	"github.com/Xdevlab/Run/pkg/gpu"
@@ -27,6 +28,16 @@ type Session struct {
 	juicePath string
 	gpus      *gpu.SelectedGpuSet
 
+	// Limits on the lifetime of the session, 0 is unlimited
+	maxDurationSeconds int64
+	idleTimeoutSeconds int64
+
+	created time.Time
+	// When the last connection closed, nil while connected
+	idleSince *utilities.ConcurrentVariable[*time.Time]
+	// Why the session was canceled by the agent
+	reason *utilities.ConcurrentVariable[string]
+
 	closed      *utilities.ConcurrentVariable[bool]
 	connections *utilities.ConcurrentMap[string, *Connection]
 
@@ -35,16 +46,23 @@ type Session struct {
 	eventListener EventListener
 }
 
-func newSession(ctx context.Context, id string, version string, juicePath string, gpus *gpu.SelectedGpuSet, eventListener EventListener) *Session {
+func newSession(ctx context.Context, id string, version string, juicePath string, gpus *gpu.SelectedGpuSet, maxDurationSeconds int64, idleTimeoutSeconds int64, eventListener EventListener) *Session {
+	now := time.Now()
+
 	return &Session{
-		Id:            id,
-		Version:       version,
-		juicePath:     juicePath,
-		gpus:          gpus,
-		closed:        utilities.NewConcurrentVariableD[bool](false),
-		connections:   utilities.NewConcurrentMap[string, *Connection](),
-		taskManager:   task.NewTaskManager(ctx),
-		eventListener: eventListener,
+		Id:                 id,
+		Version:            version,
+		juicePath:          juicePath,
+		gpus:               gpus,
+		maxDurationSeconds: maxDurationSeconds,
+		idleTimeoutSeconds: idleTimeoutSeconds,
+		created:            now,
+		idleSince:          utilities.NewConcurrentVariableD(&now),
+		reason:             utilities.NewConcurrentVariable[string](),
+		closed:             utilities.NewConcurrentVariableD[bool](false),
+		connections:        utilities.NewConcurrentMap[string, *Connection](),
+		taskManager:        task.NewTaskManager(ctx),
+		eventListener:      eventListener,
 	}
 }
 
@@ -67,16 +85,60 @@ func (session *Session) Session() restapi.Session {
 		}
 
 		return restapi.Session{
-			Id:          session.Id,
-			State:       state,
-			Version:     session.Version,
-			Gpus:        gpus,
-			Connections: connections,
+			Id:                 session.Id,
+			State:              state,
+			Version:            session.Version,
+			Reason:             session.reason.Get(),
+			MaxDurationSeconds: session.maxDurationSeconds,
+			IdleTimeoutSeconds: session.idleTimeoutSeconds,
+			AssignedAt:         &session.created,
+			IdleSince:          session.idleSince.Get(),
+			Gpus:               gpus,
+			Connections:        connections,
 		}
 	})
 }
 
+// Whether the session is without connections
+func (session *Session) Idle() bool {
+	return session.idleSince.Get() != nil
+}
+
+// Cancels the session once it exceeds its maximum duration or idle timeout
+func (session *Session) enforceLimits(group task.Group) error {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case now := <-ticker.C:
+			limits := restapi.Session{
+				MaxDurationSeconds: session.maxDurationSeconds,
+				IdleTimeoutSeconds: session.idleTimeoutSeconds,
+				AssignedAt:         &session.created,
+				IdleSince:          session.idleSince.Get(),
+			}
+
+			reason := limits.ExceededLimit(now)
+			if reason != "" {
+				logger.Infof("canceling session %s, %s", session.Id, reason)
+
+				session.reason.Set(reason)
+				session.Cancel()
+				return nil
+			}
+		}
+	}
+}
+
 func (session *Session) Run(group task.Group) error {
+	if session.maxDurationSeconds > 0 || session.idleTimeoutSeconds > 0 {
+		session.taskManager.GoFn(fmt.Sprintf("session %s limits", session.Id), session.enforceLimits)
+	}
+
 	group.GoFn(fmt.Sprintf("session %s close", session.Id), func(g task.Group) error {
 		select {
 		case <-group.Ctx().Done():
@@ -93,7 +155,7 @@ func (session *Session) Run(group task.Group) error {
 
 		session.gpus.Release()
 
-		session.eventListener.SessionClosed(session.Id)
+		session.eventListener.SessionClosed(session.Id, session.reason.Get())
 
 		return err
 	})
@@ -148,13 +210,22 @@ func (session *Session) addConnection(connectionData restapi.ConnectionData) (*C
 		}
 		close(exitCodeCh)
 
-		session.connections.Delete(connection.Id)
+		utilities.WithRef(session.idleSince, func(idleSince **time.Time) {
+			session.connections.Delete(connection.Id)
+			if session.connections.Empty() {
+				now := time.Now()
+				*idleSince = &now
+			}
+		})
 		session.eventListener.ConnectionClosed(session.Id, connection.ConnectionData, exitCode)
 
 		return nil
 	})
 
-	session.connections.Set(connection.Id, connection)
+	utilities.WithRef(session.idleSince, func(idleSince **time.Time) {
+		session.connections.Set(connection.Id, connection)
+		*idleSince = nil
+	})
 	session.eventListener.ConnectionCreated(session.Id, connection.ConnectionData)
 
 	return connection, nil
@@ -6,8 +6,11 @@ package backend
 import (
 	"context"
 	"errors"
+	"flag"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/Xdevlab/Run/cmd/controller/storage"
 	"github.com/Xdevlab/Run/pkg/gpu"
 	"github.com/Xdevlab/Run/pkg/logger"
@@ -15,31 +18,111 @@ import (
 	"github.com/Xdevlab/Run/pkg/task"
 )
 
+var (
+	schedulingStrategy = flag.String("scheduling-strategy", StrategyFirstFit, "The strategy used to choose between matching agents [first-fit, bin-pack, spread, least-loaded]")
+
+	enablePreemption      = flag.Bool("preemption", false, "Allows queued sessions to preempt assigned or active sessions with a lower priority when no capacity exists")
+	preemptionGracePeriod = flag.Duration("preemption-grace-period", 30*time.Second, "How long a session chosen for preemption keeps running before it is canceled")
+
+	reservationLeadTime = flag.Duration("reservation-lead-time", 15*time.Minute, "How long before a reservation starts its capacity is held free, allowing running sessions to end")
+
+	versionCompatibility = flag.String("version-compatibility", CompatibilityAny, "How the version of a client must match the version of an agent for the session to be scheduled on it [any, exact, minor, matrix]")
+	versionMatrix        = flag.String("version-matrix", "", "Path to a JSON object mapping patterns of client versions to the patterns of the agent versions compatible with them, used with --version-compatibility=matrix")
+
+	resyncInterval = flag.Duration("resync-interval", 5*time.Second, "How often the backend schedules sessions without being notified of a change, in case a notification was missed")
+
+	leaderLease = flag.Duration("leader-lease", 15*time.Second, "How long a backend remains the leader scheduling sessions without renewing its lease, standby backends take over once it expires")
+
+	requeueLimit = flag.Int("requeue-limit", 3, "How many times a session assigned to an agent that goes missing is returned to the queue before it is closed, sessions may set their own limit")
+
+	sessionLease = flag.Duration("session-lease", 0, "How long a session remains without a heartbeat from its client before it is canceled, pools may set their own lease. 0 disables leases for pools without one.")
+)
+
 type Backend struct {
-	storage storage.Storage
+	id            string
+	storage       storage.Storage
+	strategy      Strategy
+	compatibility Compatibility
+
+	preemption            bool
+	preemptionGracePeriod time.Duration
+
+	// Sessions chosen for preemption, by session id
+	preemptions map[string]preemption
+
+	reservationLeadTime time.Duration
+	// Capacity held for reservations, by reservation id
+	holds map[string]hold
+
+	// The lease of sessions whose pool does not set one
+	sessionLease time.Duration
+
+	// The requeue limit of sessions that do not set one
+	requeueLimit int
+
+	resyncInterval time.Duration
+
+	leaderLease time.Duration
+	// Whether the backend held the leader lease when last renewed
+	leader bool
 }
 
-func NewBackend(storage storage.Storage) *Backend {
-	return &Backend{
-		storage: storage,
+func NewBackend(storage storage.Storage) (*Backend, error) {
+	strategy, err := NewStrategy(*schedulingStrategy)
+	if err != nil {
+		return nil, err
 	}
+
+	compatibility, err := NewCompatibility(*versionCompatibility, *versionMatrix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{
+		id:                    uuid.NewString(),
+		storage:               storage,
+		strategy:              strategy,
+		compatibility:         compatibility,
+		preemption:            *enablePreemption,
+		preemptionGracePeriod: *preemptionGracePeriod,
+		preemptions:           map[string]preemption{},
+		reservationLeadTime:   *reservationLeadTime,
+		holds:                 map[string]hold{},
+		sessionLease:          *sessionLease,
+		requeueLimit:          *requeueLimit,
+		resyncInterval:        *resyncInterval,
+		leaderLease:           *leaderLease,
+	}, nil
 }
 
+// Schedules sessions whenever storage notifies a change. Changes notified while
+// scheduling are coalesced into a single pass once it completes.
 func (backend *Backend) Run(group task.Group) error {
-	err := backend.update(group.Ctx())
-	if err == nil {
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
-
-		for err == nil {
-			select {
-			case <-group.Ctx().Done():
-				return err
-
-			case <-ticker.C:
-				err = backend.update(group.Ctx())
-			}
+	defer backend.resign()
+
+	changes, unsubscribe := backend.storage.SubscribeChanges()
+	defer unsubscribe()
+
+	// The ticker also renews the leader lease before it expires
+	interval := backend.resyncInterval
+	if backend.leaderLease/3 > 0 && backend.leaderLease/3 < interval {
+		interval = backend.leaderLease / 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	err := backend.lead(group.Ctx())
+	for err == nil {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-changes:
+		case <-ticker.C:
 		}
+
+		err = backend.lead(group.Ctx())
 	}
 
 	return err
@@ -60,9 +143,40 @@ func matchesLabels(set, subset map[string]string) bool {
 	return isSubset(set, subset)
 }
 
+func matchesExpressions(labels map[string]string, expressions []restapi.LabelSelectorRequirement) bool {
+	return restapi.MatchesExpressions(labels, expressions)
+}
+
+// Only NoSchedule and NoExecute taints prevent sessions from being scheduled
 func canTolerate(taints, tolerates map[string]string) bool {
-	// tolerates must be a superset of taints to be acceptable
-	return isSubset(tolerates, taints)
+	for _, taint := range restapi.ParseTaints(taints) {
+		if taint.Effect != restapi.TaintEffectPreferNoSchedule && !taint.ToleratedBy(tolerates) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func untoleratedPreferences(taints, tolerates map[string]string) []restapi.Taint {
+	untolerated := []restapi.Taint{}
+	for _, taint := range restapi.ParseTaints(taints) {
+		if taint.Effect == restapi.TaintEffectPreferNoSchedule && !taint.ToleratedBy(tolerates) {
+			untolerated = append(untolerated, taint)
+		}
+	}
+
+	return untolerated
+}
+
+// Agents with fewer PreferNoSchedule taints the session does not tolerate are
+// always preferred, the strategy decides between the remaining agents
+func isPreferred(untolerated int, score float64, chosenUntolerated int, chosenScore float64) bool {
+	if untolerated != chosenUntolerated {
+		return untolerated < chosenUntolerated
+	}
+
+	return score > chosenScore
 }
 
 func matchesPool(poolId string, reqPoolId string) bool {
@@ -72,10 +186,16 @@ func matchesPool(poolId string, reqPoolId string) bool {
 	return poolId == reqPoolId
 }
 
-func agentMatches(agent restapi.Agent, requirements restapi.SessionRequirements) (*gpu.SelectedGpuSet, error) {
-	if matchesPool(agent.PoolId, requirements.PoolId) &&
+func agentEligible(agent restapi.Agent, requirements restapi.SessionRequirements) bool {
+	return agent.State != restapi.AgentDisabled &&
+		matchesPool(agent.PoolId, requirements.PoolId) &&
 		matchesLabels(agent.Labels, requirements.MatchLabels) &&
-		canTolerate(agent.Taints, requirements.Tolerates) {
+		matchesExpressions(agent.Labels, requirements.MatchExpressions) &&
+		canTolerate(agent.Taints, requirements.Tolerates)
+}
+
+func agentMatches(agent restapi.Agent, requirements restapi.SessionRequirements) (*gpu.SelectedGpuSet, error) {
+	if agentEligible(agent, requirements) {
 		var err error
 
 		// Need to ensure the agent has the GPU capacity to support this session
@@ -87,7 +207,7 @@ func agentMatches(agent restapi.Agent, requirements restapi.SessionRequirements)
 			err = errors.Join(err, err_)
 		}
 
-		selectedGpus, err_ := gpuSet.Find(requirements.Gpus)
+		selectedGpus, err_ := gpuSet.Find(requirements.Gpus, requirements.GpuSharing)
 		err = errors.Join(err, err_)
 		return selectedGpus, err
 	}
@@ -100,11 +220,35 @@ func validateSession(session storage.QueuedSession) error {
 		return errors.New("session must request at least one GPU")
 	}
 
-	return nil
+	err := gpu.ValidateSharing(session.Requirements.GpuSharing)
+	if err != nil {
+		return err
+	}
+
+	for _, requirement := range session.Requirements.Gpus {
+		err := requirement.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, expression := range session.Requirements.MatchExpressions {
+		err := expression.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return session.Requirements.ValidateLimits()
 }
 
 func (backend *Backend) update(ctx context.Context) error {
-	err := backend.storage.SetAgentsMissingIfNotUpdatedFor(30 * time.Second)
+	err := backend.storage.SetAgentsMissingIfNotUpdatedFor(missingAgentTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = backend.detachLostSessions()
 	if err != nil {
 		return err
 	}
@@ -114,11 +258,24 @@ func (backend *Backend) update(ctx context.Context) error {
 		return err
 	}
 
+	err = backend.expireSessionLeases()
+	if err != nil {
+		return err
+	}
+
 	sessionIterator, err := backend.storage.GetQueuedSessionsIterator()
 	if err != nil {
 		return err
 	}
 
+	pools := newPoolCache(backend.storage)
+
+	holds, err_ := computeHolds(backend.storage, backend.reservationLeadTime, backend.holds)
+	if err_ != nil {
+		return err_
+	}
+	backend.holds = holds
+
 	for sessionIterator.Next() {
 		select {
 		case <-ctx.Done():
@@ -128,34 +285,131 @@ func (backend *Backend) update(ctx context.Context) error {
 			session := sessionIterator.Value()
 			err_ := validateSession(session)
 			if err_ != nil {
-				err = errors.Join(err_, backend.storage.CancelSession(session.Id))
-				logger.Debugf("invalid session, %s", err.Error())
+				// An invalid session must not stop the backend, only the failure to cancel it
+				logger.Debugf("invalid session, %s", err_.Error())
+				err = errors.Join(err, backend.storage.CancelSession(session.Id))
+				continue
+			}
+
+			// Sessions no agent can ever serve are canceled rather than queued forever
+			err_ = unsatisfiableVersion(backend.compatibility, session.Requirements)
+			if err_ != nil {
+				logger.Debugf("canceling session %s, %s", session.Id, err_.Error())
+				err = errors.Join(err,
+					backend.storage.SetSessionReason(session.Id, err_.Error()),
+					backend.storage.CancelSession(session.Id))
 				continue
 			}
 
+			// Sessions over the quotas of their pool remain queued with the reason visible to the user
+			if session.Requirements.PoolId != "" {
+				pool, err_ := pools.get(session.Requirements.PoolId)
+				if err_ != nil {
+					err = errors.Join(err, err_)
+					continue
+				}
+
+				reason := exceedsQuota(pool, session.Requirements)
+				if reason != session.Reason {
+					err = errors.Join(err, backend.storage.SetSessionReason(session.Id, reason))
+				}
+
+				if reason != "" {
+					logger.Debugf("session %s remains queued, %s", session.Id, reason)
+					continue
+				}
+			}
+
+			// Sessions carrying a reservation are only scheduled within the capacity it holds
+			var reserved hold
+			if session.Requirements.ReservationId != "" {
+				var reason string
+				var cancel bool
+				reserved, reason, cancel, err_ = checkReservation(backend.storage, holds, session.Requirements)
+				if err_ != nil {
+					err = errors.Join(err, err_)
+					continue
+				}
+
+				if reason != session.Reason {
+					err = errors.Join(err, backend.storage.SetSessionReason(session.Id, reason))
+				}
+
+				if cancel {
+					logger.Debugf("canceling session %s, %s", session.Id, reason)
+					err = errors.Join(err, backend.storage.CancelSession(session.Id))
+					continue
+				} else if reason != "" {
+					logger.Debugf("session %s remains queued, %s", session.Id, reason)
+					continue
+				}
+			}
+
 			// Get an iterator of the agents matching a subset of the requirements
-			agentIterator, err_ := backend.storage.GetAvailableAgentsMatching(storage.TotalVramRequired(session.Requirements))
+			agentIterator, err_ := backend.storage.GetAvailableAgentsMatching(storage.AgentSelectorFromRequirements(session.Requirements))
 			err = errors.Join(err, err_)
 			if err_ == nil {
+				// Score every matching agent and choose the best one according to the strategy
+				var chosenAgent restapi.Agent
+				var chosenGpus *gpu.SelectedGpuSet
+				var chosenScore float64
+				var chosenUntolerated int
+
 				for agentIterator.Next() {
-					agent := agentIterator.Value()
+					agent := withHolds(agentIterator.Value(), holds, session.Requirements.ReservationId)
+					if session.Requirements.ReservationId != "" && agent.Id != reserved.agentId {
+						continue
+					}
+
+					if compatible, _ := checkVersion(backend.compatibility, agent, session.Requirements); !compatible {
+						continue
+					}
+
+					// Sessions without a pool count against the quotas of the pool of their agent
+					if session.Requirements.PoolId == "" && agent.PoolId != "" {
+						pool, err_ := pools.get(agent.PoolId)
+						if err_ != nil {
+							err = errors.Join(err, err_)
+							continue
+						}
+
+						if reason := exceedsQuota(pool, session.Requirements); reason != "" {
+							logger.Debugf("session %s is not assigned to agent %s, %s", session.Id, agent.Id, reason)
+							continue
+						}
+					}
 
 					selectedGpus, err_ := agentMatches(agent, session.Requirements)
-					err = err_
-					if err != nil {
-						logger.Debugf("unable to match agent, %s", err.Error())
+					if err_ != nil {
+						logger.Debugf("unable to match agent, %s", err_.Error())
 						continue
 					}
 
 					if selectedGpus != nil {
-						logger.Debugf("assigning %s to %s", session.Id, agent.Id)
-						err = errors.Join(err, backend.storage.AssignSession(session.Id, agent.Id, selectedGpus.GetGpus()))
-						break
+						score := backend.strategy.Score(agent, selectedGpus.GetGpus())
+						untolerated := len(untoleratedPreferences(agent.Taints, session.Requirements.Tolerates))
+						if chosenGpus == nil || isPreferred(untolerated, score, chosenUntolerated, chosenScore) {
+							chosenAgent = agent
+							chosenGpus = selectedGpus
+							chosenScore = score
+							chosenUntolerated = untolerated
+						}
+					}
+				}
+
+				if chosenGpus != nil {
+					logger.Debugf("assigning %s to %s", session.Id, chosenAgent.Id)
+					err_ = backend.storage.AssignSession(session.Id, chosenAgent.Id, chosenGpus.GetGpus())
+					if err_ == nil {
+						pools.assign(chargedPool(session.Requirements, chosenAgent), session.Requirements)
 					}
+					err = errors.Join(err, err_)
+				} else if backend.preemption {
+					err = errors.Join(err, backend.preempt(session))
 				}
 			}
 		}
 	}
 
-	return err
+	return errors.Join(err, backend.cancelPreemptedSessions(), backend.evictUntoleratedSessions(), backend.enforceSessionLimits(pools), backend.cancelDrainedSessions())
 }
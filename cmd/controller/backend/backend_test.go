@@ -6,17 +6,28 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/Xdevlab/Run/cmd/controller/storage"
 	"github.com/Xdevlab/Run/cmd/controller/storage/memdb"
 	"github.com/Xdevlab/Run/cmd/controller/storage/postgres"
+	"github.com/Xdevlab/Run/pkg/logger"
 	"github.com/Xdevlab/Run/pkg/restapi"
+	"github.com/Xdevlab/Run/pkg/task"
 )
 
 func openMemdb(t *testing.T) storage.Storage {
+	logger.Configure()
+
 	db, err := memdb.OpenStorage(context.Background())
 	if err != nil {
 		t.Log(err)
@@ -53,7 +64,6 @@ func defaultAgent(gpuVram uint64) restapi.Agent {
 		Labels:   map[string]string{},
 		Taints:   map[string]string{},
 		Sessions: make([]restapi.Session, 0),
-		PoolId:   "TestPool",
 	}
 }
 
@@ -78,7 +88,6 @@ func createAgent() restapi.Agent {
 		Version:  "Test",
 		Labels:   map[string]string{},
 		Taints:   map[string]string{},
-		PoolId:   "TestPool",
 		Sessions: make([]restapi.Session, 0),
 	}
 
@@ -182,9 +191,18 @@ func queueSession(t *testing.T, db storage.Storage, requirements restapi.Session
 	return sessionId
 }
 
+func newBackend(t *testing.T, db storage.Storage) *Backend {
+	backend, err := NewBackend(db)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return backend
+}
+
 func TestGetAvailableAgentsMatching(t *testing.T) {
 	run := func(t *testing.T, db storage.Storage) {
-		backend := NewBackend(db)
+		backend := newBackend(t, db)
 
 		agentIds := []string{
 			registerAgent(t, db, defaultAgent(24*1024*1024*1024)).Id,
@@ -246,3 +264,1411 @@ func TestGetAvailableAgentsMatching(t *testing.T) {
 		run(t, db)
 	})
 }
+
+func TestSchedulingStrategies(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage, strategy string, largeUtilization, smallUtilization uint32, expectLargeAgent bool) {
+		backend := newBackend(t, db)
+
+		var err error
+		backend.strategy, err = NewStrategy(strategy)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		largeAgent := defaultAgent(24 * 1024 * 1024 * 1024)
+		largeAgent.Gpus[0].Metrics.UtilizationGpu = largeUtilization
+		largeAgent = registerAgent(t, db, largeAgent)
+
+		smallAgent := defaultAgent(8 * 1024 * 1024 * 1024)
+		smallAgent.Gpus[0].Metrics.UtilizationGpu = smallUtilization
+		smallAgent = registerAgent(t, db, smallAgent)
+
+		sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		expected := smallAgent
+		if expectLargeAgent {
+			expected = largeAgent
+		}
+
+		agent, err := db.GetAgentById(expected.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Errorf("expected session %s to be assigned to agent %s using %s", sessionId, expected.Id, strategy)
+		}
+	}
+
+	for _, test := range []struct {
+		strategy         string
+		largeUtilization uint32
+		smallUtilization uint32
+		expectLargeAgent bool
+	}{
+		{StrategyBinPack, 0, 0, false},
+		{StrategySpread, 0, 0, true},
+		{StrategyLeastLoaded, 90, 10, false},
+		{StrategyLeastLoaded, 10, 90, true},
+	} {
+		name := fmt.Sprint(test.strategy, " ", test.largeUtilization, "/", test.smallUtilization)
+
+		t.Run(fmt.Sprint("memdb ", name), func(t *testing.T) {
+			db := openMemdb(t)
+			defer db.Close()
+			run(t, db, test.strategy, test.largeUtilization, test.smallUtilization, test.expectLargeAgent)
+		})
+
+		t.Run(fmt.Sprint("postgresql ", name), func(t *testing.T) {
+			db := openPostgres(t)
+			defer db.Close()
+			run(t, db, test.strategy, test.largeUtilization, test.smallUtilization, test.expectLargeAgent)
+		})
+	}
+}
+
+func TestPreemption(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+		backend.preemption = true
+		backend.preemptionGracePeriod = 0
+
+		registerAgent(t, db, defaultAgent(8*1024*1024*1024))
+
+		lowPriorityId := queueSession(t, db, defaultSessionRequirements(6*1024*1024*1024))
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		checkState := func(id string, state string) {
+			t.Helper()
+
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			if session.State != state {
+				t.Errorf("expected session %s to be %s, instead it is %s", id, state, session.State)
+			}
+		}
+
+		checkState(lowPriorityId, restapi.SessionAssigned)
+
+		// Sessions of the same priority must not preempt each other
+		samePriorityId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		checkState(lowPriorityId, restapi.SessionAssigned)
+		checkState(samePriorityId, restapi.SessionQueued)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Priority = 10
+		highPriorityId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		checkState(lowPriorityId, restapi.SessionCanceling)
+		checkState(samePriorityId, restapi.SessionQueued)
+		checkState(highPriorityId, restapi.SessionQueued)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPoolQuotasWithoutPool(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetPoolQuotas(pool.Id, restapi.PoolQuotas{
+			MaxSessions: 1,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.PoolId = pool.Id
+		registerAgent(t, db, agent)
+
+		// Sessions without a pool count against the quotas of the pool of their agent
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+
+		firstId := queueSession(t, db, requirements)
+		secondId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		first, err := db.GetSessionById(firstId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		second, err := db.GetSessionById(secondId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if first.State != restapi.SessionAssigned {
+			t.Errorf("expected session %s to be assigned, instead it is %s", first.Id, first.State)
+		}
+
+		if second.State != restapi.SessionQueued {
+			t.Errorf("expected session %s to be queued, instead it is %s", second.Id, second.State)
+		}
+
+		explanation, err := backend.Explain(requirements)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if explanation.ChosenAgentId != "" || len(explanation.Agents) != 1 || explanation.Agents[0].Matches {
+			t.Errorf("expected the agent of the pool at its quota not to match, instead received %+v", explanation)
+		}
+
+		pool, err = db.GetPool(pool.Id)
+		compare(t, restapi.PoolUsage{
+			Sessions: 1,
+			Vram:     4 * 1024 * 1024 * 1024,
+			Gpus:     1,
+		}, pool.Usage, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPoolQuotas(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetPoolQuotas(pool.Id, restapi.PoolQuotas{
+			MaxSessions: 1,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.PoolId = pool.Id
+		registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.PoolId = pool.Id
+
+		firstId := queueSession(t, db, requirements)
+		secondId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		first, err := db.GetSessionById(firstId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		second, err := db.GetSessionById(secondId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if first.State != restapi.SessionAssigned || first.Reason != "" {
+			t.Errorf("expected session %s to be assigned without a reason, instead it is %s, '%s'", first.Id, first.State, first.Reason)
+		}
+
+		if second.State != restapi.SessionQueued || second.Reason == "" {
+			t.Errorf("expected session %s to be queued with a reason, instead it is %s, '%s'", second.Id, second.State, second.Reason)
+		}
+
+		pool, err = db.GetPool(pool.Id)
+		compare(t, restapi.PoolUsage{
+			Sessions: 1,
+			Vram:     4 * 1024 * 1024 * 1024,
+			Gpus:     1,
+		}, pool.Usage, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestExplain(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Labels["Type"] = "Render"
+		matchingAgent := registerAgent(t, db, agent)
+
+		agent = defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Taints["Reserved"] = "Yes"
+		taintedAgent := registerAgent(t, db, agent)
+
+		smallAgent := registerAgent(t, db, defaultAgent(2*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchLabels["Type"] = "Render"
+
+		explanation, err := backend.Explain(requirements)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if explanation.ChosenAgentId != matchingAgent.Id {
+			t.Errorf("expected agent %s to be chosen, instead %s was chosen", matchingAgent.Id, explanation.ChosenAgentId)
+		}
+
+		failed := map[string][]string{}
+		for _, agent := range explanation.Agents {
+			for _, predicate := range agent.Predicates {
+				if !predicate.Passed {
+					failed[agent.AgentId] = append(failed[agent.AgentId], predicate.Name)
+				}
+			}
+		}
+
+		compare(t, map[string][]string{
+			taintedAgent.Id: {PredicateLabels, PredicateTaints},
+			smallAgent.Id:   {PredicateLabels, PredicateVram},
+		}, failed, nil)
+
+		sessionIterator, err := db.GetQueuedSessionsIterator()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if sessionIterator.Next() {
+			t.Error("expected explaining a schedule to not queue a session")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestMatchExpressions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Labels["Gpu"] = "A100"
+		agent.Labels["Cores"] = "64"
+		largeAgent := registerAgent(t, db, agent)
+
+		agent = defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Labels["Gpu"] = "T4"
+		agent.Labels["Cores"] = "16"
+		agent.Labels["Spot"] = "Yes"
+		smallAgent := registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchExpressions = []restapi.LabelSelectorRequirement{
+			{Key: "Gpu", Operator: restapi.SelectorOpIn, Values: []string{"A100", "H100"}},
+			{Key: "Cores", Operator: restapi.SelectorOpGt, Values: []string{"32"}},
+		}
+		largeSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchExpressions = []restapi.LabelSelectorRequirement{
+			{Key: "Gpu", Operator: restapi.SelectorOpNotIn, Values: []string{"A100"}},
+			{Key: "Spot", Operator: restapi.SelectorOpExists},
+		}
+		smallSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchExpressions = []restapi.LabelSelectorRequirement{
+			{Key: "Gpu", Operator: restapi.SelectorOpDoesNotExist},
+		}
+		unmatchedSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchExpressions = []restapi.LabelSelectorRequirement{
+			{Key: "Cores", Operator: restapi.SelectorOpLt, Values: []string{"many"}},
+		}
+		invalidSessionId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		for sessionId, agentId := range map[string]string{largeSessionId: largeAgent.Id, smallSessionId: smallAgent.Id} {
+			agent, err := db.GetAgentById(agentId)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+				t.Errorf("expected session %s to be assigned to agent %s", sessionId, agentId)
+			}
+		}
+
+		session, err := db.GetSessionById(unmatchedSessionId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		session, err = db.GetSessionById(invalidSessionId)
+		compare(t, restapi.SessionClosed, session.State, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestTaintEffects(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Taints["Spot"] = "Yes:PreferNoSchedule"
+		preferredAgent := registerAgent(t, db, agent)
+
+		agent = defaultAgent(8 * 1024 * 1024 * 1024)
+		agent.Labels["Reserved"] = "Yes"
+		agent.Taints["Reserved"] = "Yes:NoSchedule"
+		reservedAgent := registerAgent(t, db, agent)
+
+		// The session fits on the tainted agent, but an untainted agent is preferred
+		sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+		plainAgent := registerAgent(t, db, defaultAgent(8*1024*1024*1024))
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err = db.GetAgentById(plainAgent.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Errorf("expected session %s to be assigned to agent %s", sessionId, plainAgent.Id)
+		}
+
+		// Only the agent preferring not to schedule fits the session
+		requirements := defaultSessionRequirements(16 * 1024 * 1024 * 1024)
+		preferredSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchLabels["Reserved"] = "Yes"
+		requirements.Tolerates["Reserved"] = "Yes"
+		toleratingSessionId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(preferredSessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		session, err = db.GetSessionById(toleratingSessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		// Sessions not tolerating a NoExecute taint are canceled once it is added
+		err = db.SetAgentTaints(reservedAgent.Id, map[string]string{"Reserved": "Yes:NoExecute"})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetAgentTaints(plainAgent.Id, map[string]string{"Draining": "Yes:NoExecute"})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(toleratingSessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+
+		session, err = db.GetSessionById(preferredSessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		agent, err = db.GetAgentById(preferredAgent.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(agent.Sessions) != 1 || agent.Sessions[0].Id != preferredSessionId {
+			t.Errorf("expected session %s to be assigned to agent %s", preferredSessionId, preferredAgent.Id)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGpuAttributes(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Gpus[0].Uuid = "GPU-0a1b2c3d"
+		agent.Gpus[0].Vendor = "NVIDIA"
+		agent.Gpus[0].Model = "GeForce RTX 4090"
+		agent.Gpus[0].Driver = "545.29.06"
+		agent.Gpus[0].ComputeCapability = "8.9"
+		newAgent := registerAgent(t, db, agent)
+
+		agent = defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Gpus[0].Uuid = "GPU-4e5f6a7b"
+		agent.Gpus[0].Vendor = "NVIDIA"
+		agent.Gpus[0].Model = "GeForce RTX 3090"
+		agent.Gpus[0].Driver = "470.82.01"
+		agent.Gpus[0].ComputeCapability = "8.6"
+		oldAgent := registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Gpus[0].Vendor = "nvidia"
+		requirements.Gpus[0].MinDriverVersion = "535"
+		driverSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Gpus[0].Model = "*3090"
+		requirements.Gpus[0].MinComputeCapability = "8.6"
+		modelSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Gpus[0].Uuid = "GPU-0a1b2c3d"
+		uuidSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Gpus[0].MinComputeCapability = "9.0"
+		unmatchedSessionId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Gpus[0].Model = "[RTX"
+		invalidSessionId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		expected := map[string][]string{
+			newAgent.Id: {driverSessionId, uuidSessionId},
+			oldAgent.Id: {modelSessionId},
+		}
+
+		for agentId, sessionIds := range expected {
+			agent, err := db.GetAgentById(agentId)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			assigned := []string{}
+			for _, session := range agent.Sessions {
+				assigned = append(assigned, session.Id)
+			}
+			sort.Strings(assigned)
+			sort.Strings(sessionIds)
+
+			compare(t, sessionIds, assigned, nil)
+		}
+
+		session, err := db.GetSessionById(unmatchedSessionId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		session, err = db.GetSessionById(invalidSessionId)
+		compare(t, restapi.SessionClosed, session.State, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGpuSharing(t *testing.T) {
+	agent := defaultAgent(8 * 1024 * 1024 * 1024)
+	agent.Gpus = append(agent.Gpus,
+		restapi.Gpu{Index: 1, Name: "Test", Vram: 16 * 1024 * 1024 * 1024},
+		restapi.Gpu{Index: 2, Name: "Test", Vram: 12 * 1024 * 1024 * 1024},
+	)
+
+	// An existing session leaves 2GB free on the first GPU
+	agent.Sessions = append(agent.Sessions, restapi.Session{
+		Id:    "Existing",
+		State: restapi.SessionActive,
+		Gpus:  []restapi.SessionGpu{{Index: 0, VramRequired: 6 * 1024 * 1024 * 1024}},
+	})
+
+	indexes := func(sharing string, vramRequired ...uint64) []int {
+		requirements := defaultSessionRequirements(0)
+		requirements.GpuSharing = sharing
+		requirements.Gpus = []restapi.GpuRequirements{}
+		for _, vram := range vramRequired {
+			requirements.Gpus = append(requirements.Gpus, restapi.GpuRequirements{VramRequired: vram * 1024 * 1024 * 1024})
+		}
+
+		selectedGpus, err := agentMatches(agent, requirements)
+		if err != nil || selectedGpus == nil {
+			return nil
+		}
+
+		indexes := []int{}
+		for _, gpu := range selectedGpus.GetGpus() {
+			indexes = append(indexes, gpu.Index)
+		}
+		return indexes
+	}
+
+	for _, test := range []struct {
+		sharing      string
+		vramRequired []uint64
+		expected     []int
+	}{
+		// Best fit by free VRAM
+		{restapi.GpuSharingExclusive, []uint64{1}, []int{0}},
+		{restapi.GpuSharingExclusive, []uint64{10}, []int{2}},
+		{restapi.GpuSharingExclusive, []uint64{4, 4}, []int{2, 1}},
+		// Backtracks when the best fit for the first requirement starves the second
+		{restapi.GpuSharingExclusive, []uint64{11, 14}, []int{2, 1}},
+		{restapi.GpuSharingExclusive, []uint64{1, 1, 1, 1}, nil},
+		{restapi.GpuSharingWhenNeeded, []uint64{1, 1, 1}, []int{0, 2, 1}},
+		{restapi.GpuSharingWhenNeeded, []uint64{1, 1, 1, 1}, []int{0, 2, 1, 0}},
+		{restapi.GpuSharingAlways, []uint64{1, 1, 1}, []int{0, 0, 2}},
+		{restapi.GpuSharingAlways, []uint64{4, 4, 4}, []int{2, 2, 2}},
+		{"", []uint64{4, 4}, []int{2, 1}},
+		{"invalid", []uint64{4}, nil},
+	} {
+		// The selection must not depend on anything but the state of the agent
+		for i := 0; i < 10; i++ {
+			compare(t, test.expected, indexes(test.sharing, test.vramRequired...), nil)
+		}
+	}
+}
+
+func TestReservations(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := registerAgent(t, db, defaultAgent(8*1024*1024*1024))
+
+		current, err := db.CreateReservation(restapi.Reservation{
+			Gpus:  []restapi.GpuRequirements{{VramRequired: 6 * 1024 * 1024 * 1024}},
+			Start: time.Now().Add(-time.Minute),
+			End:   time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		future, err := db.CreateReservation(restapi.Reservation{
+			AgentId: agent.Id,
+			Gpus:    []restapi.GpuRequirements{{VramRequired: 1 * 1024 * 1024 * 1024}},
+			Start:   time.Now().Add(time.Hour),
+			End:     time.Now().Add(2 * time.Hour),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// The capacity held for the current reservation leaves 2GB for other sessions
+		unreservedId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(6 * 1024 * 1024 * 1024)
+		requirements.ReservationId = current.Id
+		currentId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		requirements.ReservationId = future.Id
+		futureId := queueSession(t, db, requirements)
+
+		requirements = defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		requirements.ReservationId = uuid.NewString()
+		missingId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(unreservedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		session, err = db.GetSessionById(currentId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		session, err = db.GetSessionById(futureId)
+		compare(t, restapi.SessionQueued, session.State, err)
+		if session.Reason == "" {
+			t.Error("expected a session waiting for its reservation to have a reason")
+		}
+
+		session, err = db.GetSessionById(missingId)
+		compare(t, restapi.SessionClosed, session.State, err)
+
+		// Once the reservation is removed its capacity is available again
+		err = db.DeleteReservation(current.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:             agent.Id,
+			State:          restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{currentId: {State: restapi.SessionClosed}},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(unreservedId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionLimits(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.PoolId = pool.Id
+		agent = registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		unlimitedId := queueSession(t, db, requirements)
+
+		requirements.MaxDurationSeconds = 1
+		durationId := queueSession(t, db, requirements)
+
+		requirements.MaxDurationSeconds = 0
+		requirements.IdleTimeoutSeconds = 1
+		idleId := queueSession(t, db, requirements)
+		connectedId := queueSession(t, db, requirements)
+
+		requirements.IdleTimeoutSeconds = 0
+		requirements.MaxDurationSeconds = 3600
+		requirements.PoolId = pool.Id
+		cappedId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{
+				unlimitedId: {State: restapi.SessionActive, Idle: true},
+				durationId:  {State: restapi.SessionActive},
+				idleId:      {State: restapi.SessionActive, Idle: true},
+				connectedId: {State: restapi.SessionActive},
+				cappedId:    {State: restapi.SessionActive},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Caps lowered after a session was assigned also apply to it
+		err = db.SetPoolSessionLimits(pool.Id, restapi.PoolSessionLimits{
+			MaxDurationCapSeconds: 1,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		for _, id := range []string{unlimitedId, connectedId} {
+			session, err := db.GetSessionById(id)
+			compare(t, restapi.SessionActive, session.State, err)
+		}
+
+		for _, id := range []string{durationId, idleId, cappedId} {
+			session, err := db.GetSessionById(id)
+			compare(t, restapi.SessionCanceling, session.State, err)
+			if session.Reason == "" {
+				t.Errorf("expected session %s to have the exceeded limit as its reason", id)
+			}
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionLeases(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+		backend.sessionLease = time.Hour
+
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetPoolSessionLimits(pool.Id, restapi.PoolSessionLimits{
+			LeaseSeconds: 1,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// No agent exists so every session remains queued until its lease expires
+		requirements := defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		defaultLeaseId := queueSession(t, db, requirements)
+
+		requirements.PoolId = pool.Id
+		abandonedId := queueSession(t, db, requirements)
+		renewedId := queueSession(t, db, requirements)
+
+		time.Sleep(1100 * time.Millisecond)
+
+		err = db.RenewSessionLease(renewedId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		for _, id := range []string{defaultLeaseId, renewedId} {
+			session, err := db.GetSessionById(id)
+			compare(t, restapi.SessionQueued, session.State, err)
+		}
+
+		session, err := db.GetSessionById(abandonedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		if session.Reason == "" {
+			t.Error("expected the abandoned session to have the expired lease as its reason")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPersistentSessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		requirements.IdleTimeoutSeconds = 1
+		idleId := queueSession(t, db, requirements)
+
+		requirements.Persistent = true
+		persistentId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{
+				idleId:       {State: restapi.SessionActive, Idle: true},
+				persistentId: {State: restapi.SessionActive, Idle: true},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Persistent sessions remain without connections
+		session, err := db.GetSessionById(persistentId)
+		compare(t, restapi.SessionActive, session.State, err)
+
+		session, err = db.GetSessionById(idleId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAgentDrain(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		agent := registerAgent(t, db, defaultAgent(2*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		runningId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(runningId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		err = db.SetAgentDisabled(agent.Id, true, nil)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Cordoned agents keep their sessions but are not scheduled on
+		queuedId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(runningId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		session, err = db.GetSessionById(queuedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		deadline := time.Now()
+		err = db.SetAgentDisabled(agent.Id, true, &deadline)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(runningId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+		if session.Reason == "" {
+			t.Error("expected the drained session to have a reason")
+		}
+
+		session, err = db.GetSessionById(queuedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		err = db.SetAgentDisabled(agent.Id, false, nil)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(queuedId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestVersionCompatibility(t *testing.T) {
+	matrixPath := filepath.Join(t.TempDir(), "matrix.json")
+	err := os.WriteFile(matrixPath, []byte(`{"1.2.*": ["1.3.*"]}`), 0644)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	run := func(t *testing.T, db storage.Storage, rule string, clientVersion string, expectedAgent int) {
+		backend := newBackend(t, db)
+
+		backend.compatibility, err = NewCompatibility(rule, matrixPath)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agents := []restapi.Agent{}
+		for _, version := range []string{"1.2.0", "1.3.0"} {
+			agent := defaultAgent(24 * 1024 * 1024 * 1024)
+			agent.Version = version
+			agents = append(agents, registerAgent(t, db, agent))
+		}
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Version = clientVersion
+		sessionId := queueSession(t, db, requirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Sessions no agent can ever serve are canceled instead of remaining queued
+		if expectedAgent < 0 {
+			compare(t, restapi.SessionClosed, session.State, nil)
+			if session.Reason == "" {
+				t.Error("expected the incompatible session to have a reason")
+			}
+			return
+		}
+
+		agent, err := db.GetAgentById(agents[expectedAgent].Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Errorf("expected session %s to be assigned to the agent with version %s using %s", sessionId, agent.Version, rule)
+		}
+	}
+
+	for _, test := range []struct {
+		rule          string
+		clientVersion string
+		expectedAgent int
+	}{
+		{CompatibilityExact, "1.3.0", 1},
+		{CompatibilityMinor, "1.2.7", 0},
+		{CompatibilityMinor, "Test", -1},
+		{CompatibilityMatrix, "1.2.7", 1},
+		{CompatibilityMatrix, "2.0.0", -1},
+	} {
+		t.Run(fmt.Sprint("memdb ", test.rule, " ", test.clientVersion), func(t *testing.T) {
+			db := openMemdb(t)
+			defer db.Close()
+			run(t, db, test.rule, test.clientVersion, test.expectedAgent)
+		})
+
+		t.Run(fmt.Sprint("postgresql ", test.rule, " ", test.clientVersion), func(t *testing.T) {
+			db := openPostgres(t)
+			defer db.Close()
+			run(t, db, test.rule, test.clientVersion, test.expectedAgent)
+		})
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		leader := newBackend(t, db)
+		standby := newBackend(t, db)
+
+		registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		err := leader.lead(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Only the leader schedules sessions
+		sessionId := queueSession(t, db, defaultSessionRequirements(1*1024*1024*1024))
+
+		err = standby.lead(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		err = leader.lead(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		// The standby takes over once the leader resigns
+		leader.resign()
+
+		sessionId = queueSession(t, db, defaultSessionRequirements(1*1024*1024*1024))
+
+		err = standby.lead(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		if leader.leader || !standby.leader {
+			t.Error("expected the standby to become the leader")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestEventDrivenScheduling(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+
+		// Only a notified change can schedule the session in time
+		backend.resyncInterval = time.Hour
+		backend.leaderLease = time.Hour
+
+		registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		group := task.NewTaskManager(context.Background())
+		group.Go("Backend", backend)
+
+		sessionId := queueSession(t, db, defaultSessionRequirements(1*1024*1024*1024))
+
+		var session restapi.Session
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			session, err = db.GetSessionById(sessionId)
+			if err != nil || session.State != restapi.SessionQueued {
+				break
+			}
+		}
+
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		group.Cancel()
+		err = group.Wait()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestLostAgents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := newBackend(t, db)
+		backend.requeueLimit = 0
+
+		agent := registerAgent(t, db, defaultAgent(4*1024*1024*1024))
+
+		requeueLimit := 1
+		requirements := defaultSessionRequirements(1 * 1024 * 1024 * 1024)
+		requirements.RequeueLimit = &requeueLimit
+		requeuedId := queueSession(t, db, requirements)
+
+		closedId := queueSession(t, db, defaultSessionRequirements(1*1024*1024*1024))
+		activeId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{
+				activeId: {State: restapi.SessionActive},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+
+		err = db.SetAgentsMissingIfNotUpdatedFor(0)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Assigned sessions are requeued until their limit, active sessions are closed
+		session, err := db.GetSessionById(requeuedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+		compare(t, 1, session.Requeues, nil)
+		if session.Reason == "" {
+			t.Error("expected the requeued session to have a reason")
+		}
+
+		session, err = db.GetSessionById(closedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		if session.Reason == "" {
+			t.Error("expected the closed session to have a reason")
+		}
+
+		session, err = db.GetSessionById(activeId)
+		compare(t, restapi.SessionClosed, session.State, err)
+
+		lostAgent, err := db.GetAgentById(agent.Id)
+		compare(t, 0, len(lostAgent.Sessions), err)
+
+		// Updates from the lost agent no longer change its detached sessions
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{
+				activeId: {State: restapi.SessionActive},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err = db.GetSessionById(activeId)
+		compare(t, restapi.SessionClosed, session.State, err)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(requeuedId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+
+		time.Sleep(1100 * time.Millisecond)
+
+		err = db.SetAgentsMissingIfNotUpdatedFor(0)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(requeuedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, 1, session.Requeues, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
@@ -0,0 +1,29 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+
+	"github.com/Xdevlab/Run/pkg/logger"
+)
+
+// Cancels the sessions remaining on draining agents once their deadline passes
+func (backend *Backend) cancelDrainedSessions() error {
+	ids, err := backend.storage.GetSessionsOfDrainedAgents()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		reason := "the agent of the session was drained"
+		logger.Infof("canceling session %s, %s", id, reason)
+
+		err = errors.Join(err,
+			backend.storage.SetSessionReason(id, reason),
+			backend.storage.CancelSession(id))
+	}
+
+	return err
+}
@@ -0,0 +1,368 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/gpu"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+const (
+	PredicateEnabled    = "enabled"
+	PredicatePool       = "pool"
+	PredicateLabels     = "labels"
+	PredicateTaints     = "taints"
+	PredicateGpuCount   = "gpuCount"
+	PredicateVram       = "vram"
+	PredicateAttributes = "attributes"
+	PredicatePciBus     = "pciBus"
+	PredicateVersion    = "version"
+	PredicateAllocation = "allocation"
+	PredicateQuota      = "quota"
+)
+
+type predicate struct {
+	name  string
+	check func(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string)
+}
+
+// The predicates an agent must pass to be considered for a session, in the
+// order they are reported
+var predicates = []predicate{
+	{PredicateEnabled, checkEnabled},
+	{PredicatePool, checkPool},
+	{PredicateLabels, checkLabels},
+	{PredicateTaints, checkTaints},
+	{PredicateGpuCount, checkGpuCount},
+	{PredicateVram, checkVram},
+	{PredicateAttributes, checkAttributes},
+	{PredicatePciBus, checkPciBus},
+}
+
+func sortedKeyValues(values map[string]string) string {
+	keyValues := make([]string, 0, len(values))
+	for key, value := range values {
+		keyValues = append(keyValues, fmt.Sprint(key, "=", value))
+	}
+	sort.Strings(keyValues)
+
+	return strings.Join(keyValues, ", ")
+}
+
+func checkEnabled(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	if agent.State != restapi.AgentDisabled {
+		return true, ""
+	}
+
+	if agent.DrainDeadline != nil {
+		return false, fmt.Sprint("agent is draining until ", agent.DrainDeadline.Format(time.RFC3339))
+	}
+
+	return false, "agent is cordoned"
+}
+
+func checkPool(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	if matchesPool(agent.PoolId, requirements.PoolId) {
+		return true, ""
+	}
+
+	return false, fmt.Sprintf("agent is in pool '%s', session requires pool '%s'", agent.PoolId, requirements.PoolId)
+}
+
+func checkLabels(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	missing := map[string]string{}
+	for key, value := range requirements.MatchLabels {
+		if !matchesLabels(agent.Labels, map[string]string{key: value}) {
+			missing[key] = value
+		}
+	}
+
+	unmatched := []string{}
+	for _, expression := range requirements.MatchExpressions {
+		if !expression.Matches(agent.Labels) {
+			unmatched = append(unmatched, expression.String())
+		}
+	}
+
+	if len(missing) == 0 && len(unmatched) == 0 {
+		return true, ""
+	}
+
+	messages := []string{}
+	if len(missing) > 0 {
+		messages = append(messages, fmt.Sprint("agent does not have the labels ", sortedKeyValues(missing)))
+	}
+	if len(unmatched) > 0 {
+		messages = append(messages, fmt.Sprint("agent labels do not match the expressions ", strings.Join(unmatched, ", ")))
+	}
+
+	return false, strings.Join(messages, ", ")
+}
+
+func joinTaints(taints []restapi.Taint) string {
+	strs := make([]string, 0, len(taints))
+	for _, taint := range taints {
+		strs = append(strs, taint.String())
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+func checkTaints(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	untolerated := []restapi.Taint{}
+	for _, taint := range restapi.ParseTaints(agent.Taints) {
+		if taint.Effect != restapi.TaintEffectPreferNoSchedule && !taint.ToleratedBy(requirements.Tolerates) {
+			untolerated = append(untolerated, taint)
+		}
+	}
+
+	if len(untolerated) > 0 {
+		return false, fmt.Sprint("session does not tolerate the taints ", joinTaints(untolerated))
+	}
+
+	preferences := untoleratedPreferences(agent.Taints, requirements.Tolerates)
+	if len(preferences) > 0 {
+		return true, fmt.Sprint("agent is only chosen when no other agent fits, session does not tolerate the taints ", joinTaints(preferences))
+	}
+
+	return true, ""
+}
+
+func checkGpuCount(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	if len(agent.Gpus) >= len(requirements.Gpus) {
+		return true, ""
+	}
+
+	// The requirements may share a single GPU
+	sharing := requirements.GpuSharing == restapi.GpuSharingWhenNeeded || requirements.GpuSharing == restapi.GpuSharingAlways
+	if sharing && len(agent.Gpus) > 0 {
+		return true, ""
+	}
+
+	return false, fmt.Sprintf("agent has %d GPUs, session requires %d", len(agent.Gpus), len(requirements.Gpus))
+}
+
+func checkVram(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	allocated := vramAllocated(agent)
+
+	var largest uint64
+	for _, gpu := range agent.Gpus {
+		if gpu.Vram > allocated[gpu.Index] && gpu.Vram-allocated[gpu.Index] > largest {
+			largest = gpu.Vram - allocated[gpu.Index]
+		}
+	}
+
+	for _, requirement := range requirements.Gpus {
+		if requirement.VramRequired > largest {
+			return false, fmt.Sprintf("the most VRAM available on a single GPU is %d bytes, session requires %d bytes", largest, requirement.VramRequired)
+		}
+	}
+
+	return true, ""
+}
+
+func checkAttributes(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	for index, requirement := range requirements.Gpus {
+		found := false
+		mismatches := []string{}
+		for _, gpu := range agent.Gpus {
+			mismatch := requirement.AttributeMismatch(gpu)
+			if mismatch == "" {
+				found = true
+				break
+			}
+			mismatches = append(mismatches, mismatch)
+		}
+
+		if !found && len(mismatches) > 0 {
+			return false, fmt.Sprintf("no GPU has the attributes of GPU requirement %d, %s", index, strings.Join(mismatches, ", "))
+		}
+	}
+
+	return true, ""
+}
+
+func checkPciBus(agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	for _, requirement := range requirements.Gpus {
+		if requirement.PciBus != "" {
+			required := gpu.NewPCIAddressFromString(requirement.PciBus)
+
+			found := false
+			for _, agentGpu := range agent.Gpus {
+				if gpu.NewPCIAddressFromString(agentGpu.PciBus) == required {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return false, fmt.Sprintf("agent does not have a GPU at PCI bus %s", requirement.PciBus)
+			}
+		}
+	}
+
+	return true, ""
+}
+
+func explainAgent(agent restapi.Agent, requirements restapi.SessionRequirements, strategy Strategy, compatibility Compatibility) (restapi.AgentExplanation, *gpu.SelectedGpuSet) {
+	explanation := restapi.AgentExplanation{
+		AgentId:    agent.Id,
+		Hostname:   agent.Hostname,
+		Predicates: make([]restapi.PredicateResult, 0, len(predicates)+2),
+	}
+
+	passed := true
+	for _, predicate := range predicates {
+		ok, message := predicate.check(agent, requirements)
+		explanation.Predicates = append(explanation.Predicates, restapi.PredicateResult{
+			Name:    predicate.name,
+			Passed:  ok,
+			Message: message,
+		})
+
+		passed = passed && ok
+	}
+
+	// The version depends on the compatibility rule of the controller
+	ok, message := checkVersion(compatibility, agent, requirements)
+	explanation.Predicates = append(explanation.Predicates, restapi.PredicateResult{
+		Name:    PredicateVersion,
+		Passed:  ok,
+		Message: message,
+	})
+	passed = passed && ok
+
+	// The predicates can pass individually while the GPUs cannot be allocated as a whole
+	var selectedGpus *gpu.SelectedGpuSet
+	if passed {
+		var err error
+		selectedGpus, err = agentMatches(agent, requirements)
+
+		allocation := restapi.PredicateResult{
+			Name:   PredicateAllocation,
+			Passed: err == nil && selectedGpus != nil,
+		}
+		if err != nil {
+			allocation.Message = err.Error()
+		}
+
+		explanation.Predicates = append(explanation.Predicates, allocation)
+
+		if allocation.Passed {
+			explanation.Matches = true
+			explanation.Score = strategy.Score(agent, selectedGpus.GetGpus())
+		} else {
+			selectedGpus = nil
+		}
+	}
+
+	return explanation, selectedGpus
+}
+
+// Explains how the requirements would be scheduled against the agents currently
+// available without creating a session
+func (backend *Backend) Explain(requirements restapi.SessionRequirements) (restapi.ScheduleExplanation, error) {
+	explanation := restapi.ScheduleExplanation{
+		Agents: make([]restapi.AgentExplanation, 0),
+	}
+
+	err := validateSession(storage.QueuedSession{Requirements: requirements})
+	if err != nil {
+		explanation.Reason = err.Error()
+		return explanation, nil
+	}
+
+	err = unsatisfiableVersion(backend.compatibility, requirements)
+	if err != nil {
+		explanation.Reason = err.Error()
+		return explanation, nil
+	}
+
+	pools := newPoolCache(backend.storage)
+	if requirements.PoolId != "" {
+		pool, err := pools.get(requirements.PoolId)
+		if err != nil {
+			return restapi.ScheduleExplanation{}, err
+		}
+
+		explanation.Reason = exceedsQuota(pool, requirements)
+	}
+
+	holds, err := computeHolds(backend.storage, backend.reservationLeadTime, nil)
+	if err != nil {
+		return restapi.ScheduleExplanation{}, err
+	}
+
+	var reserved hold
+	if requirements.ReservationId != "" && explanation.Reason == "" {
+		reserved, explanation.Reason, _, err = checkReservation(backend.storage, holds, requirements)
+		if err != nil {
+			return restapi.ScheduleExplanation{}, err
+		}
+	}
+
+	// Every available agent is explained, including those storage would filter out
+	agentIterator, err := backend.storage.GetAvailableAgentsMatching(storage.AgentSelector{IncludeDisabled: true})
+	if err != nil {
+		return restapi.ScheduleExplanation{}, err
+	}
+
+	var chosenGpus *gpu.SelectedGpuSet
+	var chosenScore float64
+	var chosenUntolerated int
+
+	for agentIterator.Next() {
+		agent := withHolds(agentIterator.Value(), holds, requirements.ReservationId)
+
+		agentExplanation, selectedGpus := explainAgent(agent, requirements, backend.strategy, backend.compatibility)
+
+		// Sessions without a pool count against the quotas of the pool of their agent
+		if requirements.PoolId == "" && agent.PoolId != "" && agentExplanation.Matches {
+			pool, err := pools.get(agent.PoolId)
+			if err != nil {
+				return restapi.ScheduleExplanation{}, err
+			}
+
+			reason := exceedsQuota(pool, requirements)
+			agentExplanation.Predicates = append(agentExplanation.Predicates, restapi.PredicateResult{
+				Name:    PredicateQuota,
+				Passed:  reason == "",
+				Message: reason,
+			})
+
+			if reason != "" {
+				agentExplanation.Matches = false
+				selectedGpus = nil
+			}
+		}
+
+		explanation.Agents = append(explanation.Agents, agentExplanation)
+
+		if requirements.ReservationId != "" && agent.Id != reserved.agentId {
+			continue
+		}
+
+		if selectedGpus != nil && explanation.Reason == "" {
+			untolerated := len(untoleratedPreferences(agent.Taints, requirements.Tolerates))
+			if chosenGpus == nil || isPreferred(untolerated, agentExplanation.Score, chosenUntolerated, chosenScore) {
+				explanation.ChosenAgentId = agent.Id
+				chosenGpus = selectedGpus
+				chosenScore = agentExplanation.Score
+				chosenUntolerated = untolerated
+			}
+		}
+	}
+
+	if chosenGpus != nil {
+		explanation.Gpus = chosenGpus.GetGpus()
+	}
+
+	return explanation, nil
+}
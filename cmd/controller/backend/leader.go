@@ -0,0 +1,53 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"context"
+
+	"github.com/Xdevlab/Run/pkg/logger"
+)
+
+// The name of the lease held by the backend scheduling sessions
+const leaderLeaseName = "backend"
+
+// Only the backend holding the lease schedules sessions, the others stand by
+// until the leader stops renewing it
+func (backend *Backend) lead(ctx context.Context) error {
+	leader, err := backend.storage.AcquireLease(leaderLeaseName, backend.id, backend.leaderLease)
+	if err != nil {
+		return err
+	}
+
+	if leader != backend.leader {
+		backend.leader = leader
+		if leader {
+			logger.Infof("backend %s is the leader", backend.id)
+		} else {
+			logger.Infof("backend %s is standing by, another backend is the leader", backend.id)
+		}
+
+		// Preemptions and holds chosen by a previous leader are not known, so
+		// they are chosen again from storage
+		backend.preemptions = map[string]preemption{}
+		backend.holds = map[string]hold{}
+	}
+
+	if !leader {
+		return nil
+	}
+
+	return backend.update(ctx)
+}
+
+func (backend *Backend) resign() {
+	if backend.leader {
+		err := backend.storage.ReleaseLease(leaderLeaseName, backend.id)
+		if err != nil {
+			logger.Warningf("unable to release the leader lease, %v", err)
+		}
+
+		backend.leader = false
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/logger"
+)
+
+// Returns the lease of the sessions of the pool, 0 when leases are disabled
+func (backend *Backend) SessionLease(poolId string) (time.Duration, error) {
+	if poolId != "" {
+		pool, err := backend.storage.GetPool(poolId)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return 0, err
+		}
+
+		if pool.SessionLimits.LeaseSeconds > 0 {
+			return time.Duration(pool.SessionLimits.LeaseSeconds) * time.Second, nil
+		}
+	}
+
+	return backend.sessionLease, nil
+}
+
+// Cancels the sessions whose client stopped renewing their lease, queued
+// sessions are closed before they are ever assigned
+func (backend *Backend) expireSessionLeases() error {
+	ids, err := backend.storage.GetSessionsWithExpiredLease(backend.sessionLease)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		reason := "the lease of the session expired without a heartbeat from its client"
+		logger.Infof("canceling session %s, %s", id, reason)
+
+		err = errors.Join(err,
+			backend.storage.SetSessionReason(id, reason),
+			backend.storage.CancelSession(id))
+	}
+
+	return err
+}
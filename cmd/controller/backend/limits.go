@@ -0,0 +1,60 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// Cancels the sessions that exceeded their maximum duration or idle timeout,
+// persistent sessions only have a maximum duration.
+// The limits of the pool are applied again so changes to the caps also apply
+// to the sessions already running.
+func (backend *Backend) enforceSessionLimits(pools *poolCache) error {
+	agentIterator, err := backend.storage.GetAvailableAgentsMatching(storage.AgentSelector{IncludeDisabled: true})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for agentIterator.Next() {
+		for _, session := range agentIterator.Value().Sessions {
+			if session.State != restapi.SessionAssigned && session.State != restapi.SessionActive {
+				continue
+			}
+
+			if session.PoolId != "" {
+				pool, err_ := pools.get(session.PoolId)
+				if err_ != nil {
+					err = errors.Join(err, err_)
+					continue
+				}
+
+				session.MaxDurationSeconds, session.IdleTimeoutSeconds =
+					pool.SessionLimits.Apply(session.MaxDurationSeconds, session.IdleTimeoutSeconds)
+			}
+
+			// Persistent sessions are expected to remain without connections
+			if session.Persistent {
+				session.IdleTimeoutSeconds = 0
+			}
+
+			reason := session.ExceededLimit(now)
+			if reason != "" {
+				logger.Infof("canceling session %s, %s", session.Id, reason)
+
+				err = errors.Join(err,
+					backend.storage.SetSessionReason(session.Id, reason),
+					backend.storage.CancelSession(session.Id))
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,70 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// How long an agent goes without updating before it is missing
+const missingAgentTimeout = 30 * time.Second
+
+// Detaches the sessions of agents that went missing, including the disabled
+// agents that stopped updating. Assigned sessions never
+// started on the agent, so they are returned to the queue until their requeue
+// limit is reached, while active sessions are closed as their work was lost.
+func (backend *Backend) detachLostSessions() error {
+	sessions, err := backend.storage.GetSessionsOfMissingAgents(missingAgentTimeout)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		requeue, reason, err_ := backend.requeueLostSession(session)
+		if err_ != nil {
+			err = errors.Join(err, err_)
+			continue
+		}
+
+		if requeue {
+			logger.Infof("requeuing session %s, %s", session.Id, reason)
+		} else {
+			logger.Infof("closing session %s, %s", session.Id, reason)
+		}
+
+		err = errors.Join(err,
+			backend.storage.SetSessionReason(session.Id, reason),
+			backend.storage.DetachSession(session.Id, requeue))
+	}
+
+	return err
+}
+
+// Returns whether the session of a lost agent is returned to the queue and why
+func (backend *Backend) requeueLostSession(session restapi.Session) (bool, string, error) {
+	if session.State != restapi.SessionAssigned {
+		return false, "the agent of the session was lost while the session was active", nil
+	}
+
+	requirements, err := backend.storage.GetSessionRequirements(session.Id)
+	if err != nil {
+		return false, "", err
+	}
+
+	limit := backend.requeueLimit
+	if requirements.RequeueLimit != nil {
+		limit = *requirements.RequeueLimit
+	}
+
+	if session.Requeues >= limit {
+		return false, fmt.Sprintf("the agent of the session was lost and the session reached its requeue limit of %d", limit), nil
+	}
+
+	return true, fmt.Sprintf("the agent of the session was lost, requeue %d of %d", session.Requeues+1, limit), nil
+}
@@ -0,0 +1,148 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/gpu"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+type preemption struct {
+	// The queued session that requires the capacity
+	preemptedBy string
+	deadline    time.Time
+}
+
+func isPreemptable(session restapi.Session, priority int) bool {
+	return (session.State == restapi.SessionAssigned || session.State == restapi.SessionActive) &&
+		session.Priority < priority
+}
+
+// Returns the sessions on the agent that must be preempted for the requirements
+// to fit. Sessions that are canceling or already chosen for preemption are
+// considered to have released their GPUs. Returns false if the requirements do
+// not fit even after preempting every session with a lower priority.
+func findPreemptionVictims(agent restapi.Agent, requirements restapi.SessionRequirements, pending map[string]preemption) ([]restapi.Session, bool) {
+	if !agentEligible(agent, requirements) {
+		return nil, false
+	}
+
+	gpuSet := gpu.NewGpuSet(agent.Gpus)
+
+	candidates := []restapi.Session{}
+	for _, session := range agent.Sessions {
+		_, isPending := pending[session.Id]
+		if isPending || session.State == restapi.SessionCanceling || len(session.Gpus) == 0 {
+			continue
+		}
+
+		if isPreemptable(session, requirements.Priority) {
+			candidates = append(candidates, session)
+		} else {
+			gpuSet.Select(session.Gpus)
+		}
+	}
+
+	selectedGpus, err := gpuSet.Find(requirements.Gpus, requirements.GpuSharing)
+	if err != nil {
+		return nil, false
+	}
+	selectedGpus.Release()
+
+	// Keep as many of the highest priority candidates as possible
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority > candidates[j].Priority
+	})
+
+	victims := []restapi.Session{}
+	for _, candidate := range candidates {
+		candidateGpus, _ := gpuSet.Select(candidate.Gpus)
+
+		selectedGpus, err := gpuSet.Find(requirements.Gpus, requirements.GpuSharing)
+		if err == nil {
+			selectedGpus.Release()
+		} else {
+			candidateGpus.Release()
+			victims = append(victims, candidate)
+		}
+	}
+
+	return victims, true
+}
+
+// Chooses the agent requiring the fewest sessions to be preempted and schedules
+// those sessions to be canceled once the grace period has passed
+func (backend *Backend) preempt(session storage.QueuedSession) error {
+	// The VRAM of preempted sessions is not available yet
+	selector := storage.AgentSelectorFromRequirements(session.Requirements)
+	selector.TotalAvailableVramAtLeast = 0
+
+	agentIterator, err := backend.storage.GetAvailableAgentsMatching(selector)
+	if err != nil {
+		return err
+	}
+
+	var chosenAgent restapi.Agent
+	var chosenVictims []restapi.Session
+	found := false
+
+	for agentIterator.Next() {
+		agent := withHolds(agentIterator.Value(), backend.holds, session.Requirements.ReservationId)
+		if compatible, _ := checkVersion(backend.compatibility, agent, session.Requirements); !compatible {
+			continue
+		}
+
+		victims, ok := findPreemptionVictims(agent, session.Requirements, backend.preemptions)
+		if ok && (!found || len(victims) < len(chosenVictims)) {
+			chosenAgent = agent
+			chosenVictims = victims
+			found = true
+		}
+	}
+
+	// When no victims are required, capacity is already being released for this session
+	if found {
+		deadline := time.Now().Add(backend.preemptionGracePeriod)
+		for _, victim := range chosenVictims {
+			logger.Infof("session %s on %s will be preempted by %s in %s", victim.Id, chosenAgent.Id, session.Id, backend.preemptionGracePeriod)
+
+			backend.preemptions[victim.Id] = preemption{
+				preemptedBy: session.Id,
+				deadline:    deadline,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Cancels the sessions chosen for preemption whose grace period has passed. A
+// preemption is dropped if the session it was made for is no longer queued.
+func (backend *Backend) cancelPreemptedSessions() error {
+	var err error
+
+	now := time.Now()
+	for id, preemption := range backend.preemptions {
+		preemptedBy, err_ := backend.storage.GetSessionById(preemption.preemptedBy)
+		if err_ != nil || preemptedBy.State != restapi.SessionQueued {
+			delete(backend.preemptions, id)
+			continue
+		}
+
+		if !now.Before(preemption.deadline) {
+			logger.Infof("preempting session %s for %s", id, preemption.preemptedBy)
+
+			err = errors.Join(err, backend.storage.CancelSession(id))
+			delete(backend.preemptions, id)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,86 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// Returns the reason the session would exceed the quotas of the pool if it was
+// assigned, or an empty string if it fits within the quotas
+func exceedsQuota(pool restapi.Pool, requirements restapi.SessionRequirements) string {
+	quotas := pool.Quotas
+
+	if quotas.MaxSessions > 0 && pool.Usage.Sessions+1 > quotas.MaxSessions {
+		return fmt.Sprintf("pool %s has reached its quota of %d sessions", pool.Id, quotas.MaxSessions)
+	}
+
+	if quotas.MaxGpus > 0 && pool.Usage.Gpus+len(requirements.Gpus) > quotas.MaxGpus {
+		return fmt.Sprintf("pool %s has reached its quota of %d GPUs", pool.Id, quotas.MaxGpus)
+	}
+
+	if quotas.MaxVram > 0 && pool.Usage.Vram+storage.TotalVramRequired(requirements) > quotas.MaxVram {
+		return fmt.Sprintf("pool %s has reached its quota of %d bytes of VRAM", pool.Id, quotas.MaxVram)
+	}
+
+	return ""
+}
+
+// Returns the pool whose quotas the session counts against once assigned to the
+// agent, sessions without a pool count against the pool of their agent
+func chargedPool(requirements restapi.SessionRequirements, agent restapi.Agent) string {
+	if requirements.PoolId != "" {
+		return requirements.PoolId
+	}
+
+	return agent.PoolId
+}
+
+// Caches the pools used during a single update so the usage can be tracked as
+// sessions are assigned without querying storage for every session
+type poolCache struct {
+	storage storage.Storage
+	pools   map[string]restapi.Pool
+}
+
+func newPoolCache(storage storage.Storage) *poolCache {
+	return &poolCache{
+		storage: storage,
+		pools:   map[string]restapi.Pool{},
+	}
+}
+
+func (cache *poolCache) get(id string) (restapi.Pool, error) {
+	pool, found := cache.pools[id]
+	if !found {
+		var err error
+		pool, err = cache.storage.GetPool(id)
+		if err != nil {
+			// Sessions referring to an unknown pool have no quotas to enforce
+			if !errors.Is(err, storage.ErrNotFound) {
+				return restapi.Pool{}, err
+			}
+
+			pool = restapi.Pool{Id: id}
+		}
+
+		cache.pools[id] = pool
+	}
+
+	return pool, nil
+}
+
+func (cache *poolCache) assign(id string, requirements restapi.SessionRequirements) {
+	pool, found := cache.pools[id]
+	if found {
+		pool.Usage.Sessions++
+		pool.Usage.Gpus += len(requirements.Gpus)
+		pool.Usage.Vram += storage.TotalVramRequired(requirements)
+		cache.pools[id] = pool
+	}
+}
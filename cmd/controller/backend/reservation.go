@@ -0,0 +1,169 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/gpu"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// Capacity held free on an agent for a reservation
+type hold struct {
+	agentId string
+	gpus    []restapi.SessionGpu
+}
+
+// Returns a copy of the agent with the capacity held for reservations other
+// than the one given added as sessions that can never be preempted
+func withHolds(agent restapi.Agent, holds map[string]hold, reservationId string) restapi.Agent {
+	sessions := make([]restapi.Session, len(agent.Sessions), len(agent.Sessions)+len(holds))
+	copy(sessions, agent.Sessions)
+
+	for id, hold := range holds {
+		if id != reservationId && hold.agentId == agent.Id {
+			sessions = append(sessions, restapi.Session{
+				Id:       fmt.Sprint("reservation-", id),
+				State:    restapi.SessionAssigned,
+				Priority: math.MaxInt,
+				Gpus:     hold.gpus,
+			})
+		}
+	}
+
+	agent.Sessions = sessions
+	return agent
+}
+
+// Returns the GPUs the reservation would hold on the agent, optionally
+// ignoring the sessions on the agent as they end before the window starts
+func findHold(agent restapi.Agent, holds map[string]hold, reservation restapi.Reservation, ignoreSessions bool) (*gpu.SelectedGpuSet, error) {
+	if reservation.AgentId != "" && reservation.AgentId != agent.Id {
+		return nil, nil
+	}
+
+	if !matchesPool(agent.PoolId, reservation.PoolId) {
+		return nil, nil
+	}
+
+	if ignoreSessions {
+		agent.Sessions = nil
+	}
+	agent = withHolds(agent, holds, reservation.Id)
+
+	gpuSet := gpu.NewGpuSet(agent.Gpus)
+	for _, session := range agent.Sessions {
+		_, err := gpuSet.Select(session.Gpus)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return gpuSet.Find(reservation.Gpus, restapi.GpuSharingExclusive)
+}
+
+// Places the capacity of every reservation within the lead time of its window
+// on an agent. An agent already holding a reservation keeps it while the
+// capacity fits, otherwise an agent where the capacity is free is preferred
+// over one where sessions must end first.
+func computeHolds(db storage.Storage, leadTime time.Duration, previous map[string]hold) (map[string]hold, error) {
+	now := time.Now()
+
+	reservationIterator, err := db.GetReservations(now)
+	if err != nil {
+		return nil, err
+	}
+
+	agentIterator, err := db.GetAvailableAgentsMatching(storage.AgentSelector{})
+	if err != nil {
+		return nil, err
+	}
+
+	agents := []restapi.Agent{}
+	for agentIterator.Next() {
+		agents = append(agents, agentIterator.Value())
+	}
+
+	holds := map[string]hold{}
+	for reservationIterator.Next() {
+		reservation := reservationIterator.Value()
+		if now.Before(reservation.Start.Add(-leadTime)) {
+			continue
+		}
+
+		var chosenAgent restapi.Agent
+		var chosenGpus *gpu.SelectedGpuSet
+
+		if previousHold, found := previous[reservation.Id]; found {
+			for _, agent := range agents {
+				if agent.Id == previousHold.agentId {
+					selectedGpus, err := findHold(agent, holds, reservation, true)
+					if err == nil && selectedGpus != nil {
+						chosenAgent, chosenGpus = agent, selectedGpus
+					}
+				}
+			}
+		}
+
+		for _, ignoreSessions := range []bool{false, true} {
+			for _, agent := range agents {
+				if chosenGpus != nil {
+					break
+				}
+
+				selectedGpus, err := findHold(agent, holds, reservation, ignoreSessions)
+				if err == nil && selectedGpus != nil {
+					chosenAgent, chosenGpus = agent, selectedGpus
+				}
+			}
+		}
+
+		if chosenGpus == nil {
+			logger.Warningf("unable to hold the capacity of reservation %s", reservation.Id)
+			continue
+		}
+
+		holds[reservation.Id] = hold{
+			agentId: chosenAgent.Id,
+			gpus:    chosenGpus.GetGpus(),
+		}
+	}
+
+	return holds, nil
+}
+
+// Checks the reservation of a queued session. Returns the hold the session
+// must be scheduled within, or the reason it cannot be scheduled and whether
+// the session must be canceled as the reservation will never be available.
+func checkReservation(db storage.Storage, holds map[string]hold, requirements restapi.SessionRequirements) (hold, string, bool, error) {
+	reservation, err := db.GetReservation(requirements.ReservationId)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return hold{}, fmt.Sprintf("reservation %s does not exist", requirements.ReservationId), true, nil
+		}
+		return hold{}, "", false, err
+	}
+
+	now := time.Now()
+	if !now.Before(reservation.End) {
+		return hold{}, fmt.Sprintf("reservation %s ended at %s", reservation.Id, reservation.End.Format(time.RFC3339)), true, nil
+	}
+
+	if now.Before(reservation.Start) {
+		return hold{}, fmt.Sprintf("reservation %s starts at %s", reservation.Id, reservation.Start.Format(time.RFC3339)), false, nil
+	}
+
+	reserved, found := holds[reservation.Id]
+	if !found {
+		return hold{}, fmt.Sprintf("the capacity of reservation %s is not available", reservation.Id), false, nil
+	}
+
+	return reserved, "", false, nil
+}
@@ -0,0 +1,146 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"fmt"
+
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+const (
+	StrategyFirstFit    = "first-fit"
+	StrategyBinPack     = "bin-pack"
+	StrategySpread      = "spread"
+	StrategyLeastLoaded = "least-loaded"
+)
+
+// A Strategy scores an agent for a session once the GPUs the session would use
+// on that agent are known. The agent with the highest score is chosen, ties go
+// to the agent returned first by storage.
+type Strategy interface {
+	Score(agent restapi.Agent, selectedGpus []restapi.SessionGpu) float64
+}
+
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case StrategyFirstFit:
+		return firstFitStrategy{}, nil
+	case StrategyBinPack:
+		return binPackStrategy{}, nil
+	case StrategySpread:
+		return spreadStrategy{}, nil
+	case StrategyLeastLoaded:
+		return leastLoadedStrategy{}, nil
+	}
+
+	return nil, fmt.Errorf("invalid scheduling strategy '%s', [%s, %s, %s, %s]", name,
+		StrategyFirstFit, StrategyBinPack, StrategySpread, StrategyLeastLoaded)
+}
+
+// Returns the VRAM already committed to sessions for each GPU index of the agent
+func vramAllocated(agent restapi.Agent) map[int]uint64 {
+	allocated := map[int]uint64{}
+	for _, session := range agent.Sessions {
+		for _, gpu := range session.Gpus {
+			allocated[gpu.Index] += gpu.VramRequired
+		}
+	}
+
+	return allocated
+}
+
+// Returns the VRAM that would remain free on each of the selected GPUs, in the
+// order of selectedGpus, if the selection was assigned to the agent
+func vramFreeAfter(agent restapi.Agent, selectedGpus []restapi.SessionGpu) []uint64 {
+	allocated := vramAllocated(agent)
+	for _, gpu := range selectedGpus {
+		allocated[gpu.Index] += gpu.VramRequired
+	}
+
+	free := make([]uint64, len(selectedGpus))
+	for index, selectedGpu := range selectedGpus {
+		gpu, found := findGpu(agent, selectedGpu.Index)
+		if found && gpu.Vram > allocated[gpu.Index] {
+			free[index] = gpu.Vram - allocated[gpu.Index]
+		}
+	}
+
+	return free
+}
+
+func findGpu(agent restapi.Agent, index int) (restapi.Gpu, bool) {
+	for _, gpu := range agent.Gpus {
+		if gpu.Index == index {
+			return gpu, true
+		}
+	}
+
+	return restapi.Gpu{}, false
+}
+
+// Chooses the first agent that matches, the original behavior of the backend
+type firstFitStrategy struct{}
+
+func (firstFitStrategy) Score(agent restapi.Agent, selectedGpus []restapi.SessionGpu) float64 {
+	return 0
+}
+
+// Prefers the GPUs with the least VRAM left over after placement so that
+// small sessions fill partially used GPUs and whole GPUs remain free for
+// large sessions
+type binPackStrategy struct{}
+
+func (binPackStrategy) Score(agent restapi.Agent, selectedGpus []restapi.SessionGpu) float64 {
+	var free uint64
+	for _, vram := range vramFreeAfter(agent, selectedGpus) {
+		free += vram
+	}
+
+	return -float64(free)
+}
+
+// Prefers the GPUs with the fewest sessions and the largest fraction of VRAM
+// left over after placement to minimize contention between sessions
+type spreadStrategy struct{}
+
+func (spreadStrategy) Score(agent restapi.Agent, selectedGpus []restapi.SessionGpu) float64 {
+	sessions := map[int]int{}
+	for _, session := range agent.Sessions {
+		for _, gpu := range session.Gpus {
+			sessions[gpu.Index]++
+		}
+	}
+
+	var score float64
+	for index, vram := range vramFreeAfter(agent, selectedGpus) {
+		gpu, found := findGpu(agent, selectedGpus[index].Index)
+		if found && gpu.Vram > 0 {
+			// A GPU without other sessions always beats one with, the free VRAM fraction breaks ties
+			score += float64(vram)/float64(gpu.Vram) - float64(sessions[gpu.Index])
+		}
+	}
+
+	return score / float64(len(selectedGpus))
+}
+
+// Prefers the GPUs with the lowest reported utilization and VRAM usage
+type leastLoadedStrategy struct{}
+
+func (leastLoadedStrategy) Score(agent restapi.Agent, selectedGpus []restapi.SessionGpu) float64 {
+	var load float64
+	for _, selectedGpu := range selectedGpus {
+		gpu, found := findGpu(agent, selectedGpu.Index)
+		if found {
+			vramUsed := 0.0
+			if gpu.Vram > 0 {
+				vramUsed = 100.0 * float64(gpu.Metrics.VramUsed) / float64(gpu.Vram)
+			}
+
+			load += (float64(gpu.Metrics.UtilizationGpu) + vramUsed) / 2.0
+		}
+	}
+
+	return -load / float64(len(selectedGpus))
+}
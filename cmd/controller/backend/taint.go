@@ -0,0 +1,63 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// Cancels the sessions on agents with NoExecute taints the sessions do not
+// tolerate, which includes taints added after the sessions were assigned
+func (backend *Backend) evictUntoleratedSessions() error {
+	agentIterator, err := backend.storage.GetAvailableAgentsMatching(storage.AgentSelector{IncludeDisabled: true})
+	if err != nil {
+		return err
+	}
+
+	for agentIterator.Next() {
+		agent := agentIterator.Value()
+
+		noExecute := []restapi.Taint{}
+		for _, taint := range restapi.ParseTaints(agent.Taints) {
+			if taint.Effect == restapi.TaintEffectNoExecute {
+				noExecute = append(noExecute, taint)
+			}
+		}
+
+		if len(noExecute) == 0 {
+			continue
+		}
+
+		for _, session := range agent.Sessions {
+			if session.State != restapi.SessionAssigned && session.State != restapi.SessionActive {
+				continue
+			}
+
+			requirements, err_ := backend.storage.GetSessionRequirements(session.Id)
+			if err_ != nil {
+				err = errors.Join(err, err_)
+				continue
+			}
+
+			for _, taint := range noExecute {
+				if !taint.ToleratedBy(requirements.Tolerates) {
+					reason := fmt.Sprintf("session does not tolerate the taint %s of agent %s", taint, agent.Id)
+					logger.Infof("canceling session %s, %s", session.Id, reason)
+
+					err = errors.Join(err,
+						backend.storage.SetSessionReason(session.Id, reason),
+						backend.storage.CancelSession(session.Id))
+					break
+				}
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,186 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+const (
+	CompatibilityAny    = "any"
+	CompatibilityExact  = "exact"
+	CompatibilityMinor  = "minor"
+	CompatibilityMatrix = "matrix"
+)
+
+var ErrIncompatibleVersion = errors.New("no agent is compatible with the client version")
+
+// A Compatibility decides whether the renderer of an agent can serve a client
+// of the version. Sessions without a client version match every agent.
+type Compatibility interface {
+	Compatible(clientVersion, agentVersion string) bool
+	// Returns why no agent can ever serve the client version, or an empty
+	// string when some agent version can
+	Unsatisfiable(clientVersion string) string
+}
+
+// The matrix maps patterns of client versions to the patterns of the agent
+// versions compatible with them, using the syntax of path.Match
+func NewCompatibility(rule string, matrixPath string) (Compatibility, error) {
+	switch rule {
+	case CompatibilityAny:
+		return anyCompatibility{}, nil
+	case CompatibilityExact:
+		return exactCompatibility{}, nil
+	case CompatibilityMinor:
+		return minorCompatibility{}, nil
+	case CompatibilityMatrix:
+		return loadMatrixCompatibility(matrixPath)
+	}
+
+	return nil, fmt.Errorf("invalid version compatibility '%s', [%s, %s, %s, %s]", rule,
+		CompatibilityAny, CompatibilityExact, CompatibilityMinor, CompatibilityMatrix)
+}
+
+// Returns ErrIncompatibleVersion when no agent can ever serve the client
+// version of the requirements
+func (backend *Backend) ValidateVersion(requirements restapi.SessionRequirements) error {
+	return unsatisfiableVersion(backend.compatibility, requirements)
+}
+
+func unsatisfiableVersion(compatibility Compatibility, requirements restapi.SessionRequirements) error {
+	if requirements.Version == "" {
+		return nil
+	}
+
+	reason := compatibility.Unsatisfiable(requirements.Version)
+	if reason != "" {
+		return fmt.Errorf("%w, %s", ErrIncompatibleVersion, reason)
+	}
+
+	return nil
+}
+
+func checkVersion(compatibility Compatibility, agent restapi.Agent, requirements restapi.SessionRequirements) (bool, string) {
+	if requirements.Version == "" || compatibility.Compatible(requirements.Version, agent.Version) {
+		return true, ""
+	}
+
+	return false, fmt.Sprintf("agent version '%s' is not compatible with client version '%s'", agent.Version, requirements.Version)
+}
+
+type anyCompatibility struct{}
+
+func (anyCompatibility) Compatible(clientVersion, agentVersion string) bool {
+	return true
+}
+
+func (anyCompatibility) Unsatisfiable(clientVersion string) string {
+	return ""
+}
+
+type exactCompatibility struct{}
+
+func (exactCompatibility) Compatible(clientVersion, agentVersion string) bool {
+	return clientVersion == agentVersion
+}
+
+func (exactCompatibility) Unsatisfiable(clientVersion string) string {
+	return ""
+}
+
+// Versions are compatible when their major and minor components are equal
+type minorCompatibility struct{}
+
+func majorMinor(version string) ([2]uint64, bool) {
+	components, ok := restapi.ParseVersion(version)
+	if !ok {
+		return [2]uint64{}, false
+	}
+
+	var majorMinor [2]uint64
+	copy(majorMinor[:], components)
+	return majorMinor, true
+}
+
+func (minorCompatibility) Compatible(clientVersion, agentVersion string) bool {
+	client, ok := majorMinor(clientVersion)
+	if !ok {
+		return false
+	}
+
+	agent, ok := majorMinor(agentVersion)
+	return ok && client == agent
+}
+
+func (minorCompatibility) Unsatisfiable(clientVersion string) string {
+	_, ok := majorMinor(clientVersion)
+	if !ok {
+		return fmt.Sprintf("client version '%s' has no major and minor version", clientVersion)
+	}
+
+	return ""
+}
+
+type matrixCompatibility map[string][]string
+
+func loadMatrixCompatibility(matrixPath string) (matrixCompatibility, error) {
+	if matrixPath == "" {
+		return nil, errors.New("the matrix version compatibility requires --version-matrix")
+	}
+
+	data, err := os.ReadFile(matrixPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the version matrix %s, %w", matrixPath, err)
+	}
+
+	var matrix matrixCompatibility
+	err = json.Unmarshal(data, &matrix)
+	if err != nil {
+		return nil, fmt.Errorf("the version matrix %s has errors, %w", matrixPath, err)
+	}
+
+	for clientPattern, agentPatterns := range matrix {
+		for _, pattern := range append([]string{clientPattern}, agentPatterns...) {
+			_, err = path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("the version matrix %s has an invalid pattern '%s', %w", matrixPath, pattern, err)
+			}
+		}
+	}
+
+	return matrix, nil
+}
+
+func (matrix matrixCompatibility) Compatible(clientVersion, agentVersion string) bool {
+	for clientPattern, agentPatterns := range matrix {
+		if matched, _ := path.Match(clientPattern, clientVersion); !matched {
+			continue
+		}
+
+		for _, agentPattern := range agentPatterns {
+			if matched, _ := path.Match(agentPattern, agentVersion); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (matrix matrixCompatibility) Unsatisfiable(clientVersion string) string {
+	for clientPattern, agentPatterns := range matrix {
+		if matched, _ := path.Match(clientPattern, clientVersion); matched && len(agentPatterns) > 0 {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("client version '%s' is not in the version matrix", clientVersion)
+}
@@ -0,0 +1,279 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/logger"
+	pkgnet "github.com/Xdevlab/Run/pkg/net"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+var superAdmins = flag.String("super-admins", "", "Comma separated ids of the users permitted every call on every pool, such as operators. Only super-admins may create pools. Calls without a pool, such as requesting a session without a pool, concern every pool so they are only permitted to super-admins once a pool exists, every user may make them while there are none. Users may always call on their own sessions.")
+
+var (
+	errForbidden      = errors.New("forbidden")
+	errInvalidRequest = errors.New("invalid request")
+)
+
+// Every permission, for calls that only read the pool
+var anyPermission = []restapi.Permission{restapi.PermissionCreateSession, restapi.PermissionRegisterAgent, restapi.PermissionAdmin}
+
+func parseSuperAdmins(value string) map[string]struct{} {
+	users := map[string]struct{}{}
+	for _, userId := range strings.Split(value, ",") {
+		userId = strings.TrimSpace(userId)
+		if userId != "" {
+			users[userId] = struct{}{}
+		}
+	}
+
+	return users
+}
+
+// Returns the pool the request concerns, empty when it concerns every pool.
+// Requests without a pool concern every pool since sessions without a pool
+// may be assigned to the agents of any pool.
+type poolOfRequest func(r *http.Request) (string, error)
+
+// Wraps the handler of an endpoint so the caller must hold one of the
+// permissions on the pool of the request. Admins of a pool hold every
+// permission on it. Requests are not checked when authentication is disabled.
+func (frontend *Frontend) authorize(handler http.HandlerFunc, poolOf poolOfRequest, permissions ...restapi.Permission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := frontend.checkPermission(r, poolOf, permissions)
+		if err != nil {
+			respondAuthorizationError(w, r, err)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Responds with the status of the error of an authorization: forbidden, an
+// invalid request, the object of the request not found or an internal error
+func respondAuthorizationError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, errForbidden) {
+		status = http.StatusForbidden
+	} else if errors.Is(err, errInvalidRequest) {
+		status = http.StatusBadRequest
+	} else if errors.Is(err, storage.ErrNotFound) {
+		status = http.StatusNotFound
+	}
+
+	err = fmt.Errorf("%s %s: %w", r.Method, r.URL.Path, err)
+	err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+	logger.Error(err)
+}
+
+func (frontend *Frontend) checkPermission(r *http.Request, poolOf poolOfRequest, permissions []restapi.Permission) error {
+	userId, authenticated := authenticatedUser(r)
+	if !authenticated {
+		return nil
+	}
+
+	if _, found := frontend.superAdmins[userId]; found {
+		return nil
+	}
+
+	poolId, err := poolOf(r)
+	if err != nil {
+		return err
+	}
+
+	if poolId == "" {
+		// Deployments without pools have no permissions to check
+		pools, err := frontend.storage.CountPools()
+		if err != nil || pools == 0 {
+			return err
+		}
+
+		return fmt.Errorf("%w, only super-admins may call on every pool", errForbidden)
+	}
+
+	poolPermissions, err := frontend.storage.GetPoolPermissions(poolId)
+	if err != nil {
+		return err
+	}
+
+	for _, held := range poolPermissions.UserIds[userId] {
+		if held == restapi.PermissionAdmin {
+			return nil
+		}
+
+		for _, permission := range permissions {
+			if held == permission {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w, user %s does not hold the %s permission on pool %s", errForbidden, userId, permissions[0], poolId)
+}
+
+// Wraps the handler of an endpoint concerning the session of the path, which
+// its owner and the admins of its pool may call. Owners keep access to their
+// sessions without a pool once pools exist.
+func (frontend *Frontend) authorizeSession(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := frontend.checkSessionOwner(r)
+		if err != nil {
+			respondAuthorizationError(w, r, err)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (frontend *Frontend) checkSessionOwner(r *http.Request) error {
+	userId, authenticated := authenticatedUser(r)
+	if !authenticated {
+		return nil
+	}
+
+	session, err := frontend.storage.GetSessionById(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	if session.UserId == userId {
+		return nil
+	}
+
+	poolOfSession := func(r *http.Request) (string, error) {
+		return session.PoolId, nil
+	}
+
+	return frontend.checkPermission(r, poolOfSession, []restapi.Permission{restapi.PermissionAdmin})
+}
+
+// Checks that the priority of the session requested is at most the maximum of
+// its pool, unless the caller administers the pool
+func (frontend *Frontend) checkPriority(r *http.Request, requirements restapi.SessionRequirements) error {
+	if requirements.PoolId == "" {
+		return nil
+	}
+
+	poolOfRequirements := func(r *http.Request) (string, error) {
+		return requirements.PoolId, nil
+	}
+
+	err := frontend.checkPermission(r, poolOfRequirements, []restapi.Permission{restapi.PermissionAdmin})
+	if !errors.Is(err, errForbidden) {
+		return err
+	}
+
+	pool, err := frontend.storage.GetPool(requirements.PoolId)
+	if err != nil {
+		return err
+	}
+
+	if requirements.Priority > pool.SessionLimits.MaxPriority {
+		return fmt.Errorf("%w, priority %d exceeds the maximum priority %d of pool %s", errForbidden, requirements.Priority, pool.SessionLimits.MaxPriority, pool.Id)
+	}
+
+	return nil
+}
+
+// Wraps the handler of an endpoint concerning the user of the path, which only
+// the user and super-admins may call
+func (frontend *Frontend) authorizeUser(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, authenticated := authenticatedUser(r)
+		_, superAdmin := frontend.superAdmins[userId]
+
+		if authenticated && !superAdmin && userId != mux.Vars(r)["id"] {
+			respondAuthorizationError(w, r, fmt.Errorf("%w, only super-admins may call on another user", errForbidden))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Wraps the handler of an endpoint only super-admins may call, even when no
+// pool exists, such as creating a pool which its creator administers
+func (frontend *Frontend) authorizeSuperAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, authenticated := authenticatedUser(r)
+		_, superAdmin := frontend.superAdmins[userId]
+
+		if authenticated && !superAdmin {
+			respondAuthorizationError(w, r, fmt.Errorf("%w, only super-admins may make this call", errForbidden))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Reads the pool from the pool_id of the query, every pool without one
+func poolOfQuery(r *http.Request) (string, error) {
+	return r.URL.Query().Get("pool_id"), nil
+}
+
+func poolOfPath(r *http.Request) (string, error) {
+	return mux.Vars(r)["id"], nil
+}
+
+// Reads the pool from the body of the request, which is kept for the handler
+func poolOfBody[T any](poolId func(T) string) poolOfRequest {
+	return func(r *http.Request) (string, error) {
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, pkgnet.MaxBodyLength))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return "", fmt.Errorf("%w, %v", errInvalidRequest, err)
+			}
+			return "", err
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var object T
+		err = json.Unmarshal(body, &object)
+		if err != nil {
+			return "", fmt.Errorf("%w, %v", errInvalidRequest, err)
+		}
+
+		return poolId(object), nil
+	}
+}
+
+var (
+	poolOfAgentRegistration          = poolOfBody(func(agent restapi.Agent) string { return agent.PoolId })
+	poolOfSessionRequirements        = poolOfBody(func(requirements restapi.SessionRequirements) string { return requirements.PoolId })
+	poolOfReservationRequest         = poolOfBody(func(reservation restapi.Reservation) string { return reservation.PoolId })
+	poolOfWebhookSubscriptionRequest = poolOfBody(func(subscription restapi.WebhookSubscription) string { return subscription.PoolId })
+	poolOfPermission                 = poolOfBody(func(params restapi.PermissionParams) string { return params.PoolId })
+)
+
+func (frontend *Frontend) poolOfAgent(r *http.Request) (string, error) {
+	agent, err := frontend.storage.GetAgentById(mux.Vars(r)["id"])
+	return agent.PoolId, err
+}
+
+func (frontend *Frontend) poolOfReservation(r *http.Request) (string, error) {
+	reservation, err := frontend.storage.GetReservation(mux.Vars(r)["id"])
+	return reservation.PoolId, err
+}
+
+func (frontend *Frontend) poolOfWebhookSubscription(r *http.Request) (string, error) {
+	subscription, err := frontend.storage.GetWebhookSubscription(mux.Vars(r)["id"])
+	return subscription.PoolId, err
+}
@@ -0,0 +1,397 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage/memdb"
+	"github.com/Xdevlab/Run/pkg/logger"
+	pkgnet "github.com/Xdevlab/Run/pkg/net"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+func newAuthorizationFrontend(t *testing.T) *Frontend {
+	logger.Configure()
+
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Frontend{
+		storage:     db,
+		superAdmins: parseSuperAdmins("root, operator"),
+	}
+}
+
+// A request of the user, unauthenticated when empty, with the variables of
+// its path and its body encoded as JSON when not nil
+func userRequest(t *testing.T, userId string, vars map[string]string, body any) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	if userId != "" {
+		r = r.WithContext(context.WithValue(r.Context(), jwtmiddleware.ContextKey{}, &validator.ValidatedClaims{
+			RegisteredClaims: validator.RegisteredClaims{Subject: userId},
+		}))
+	}
+
+	return mux.SetURLVars(r, vars)
+}
+
+// Responds with the pool of the session requirements of the body, which the
+// authorization must leave for the handler
+func requirementsHandler(w http.ResponseWriter, r *http.Request) {
+	requirements, err := pkgnet.ReadRequestBody[restapi.SessionRequirements](r)
+	if err != nil {
+		pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	pkgnet.RespondWithString(w, http.StatusOK, requirements.PoolId)
+}
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	pkgnet.RespondWithString(w, http.StatusOK, "")
+}
+
+func serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(recorder, r)
+	return recorder
+}
+
+func TestAuthorizeWithoutPools(t *testing.T) {
+	frontend := newAuthorizationFrontend(t)
+
+	requestSession := frontend.authorize(requirementsHandler, poolOfSessionRequirements, restapi.PermissionCreateSession)
+	createPool := frontend.authorizeSuperAdmin(okHandler)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		userId  string
+		status  int
+	}{
+		{"requesting a session without a pool", requestSession, "alice", http.StatusOK},
+		{"listing every agent", frontend.authorize(okHandler, poolOfQuery, anyPermission...), "alice", http.StatusOK},
+		{"creating a pool", createPool, "alice", http.StatusForbidden},
+		{"creating a pool as super-admin", createPool, "operator", http.StatusOK},
+		{"creating a pool without authentication", createPool, "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(test.handler, userRequest(t, test.userId, nil, restapi.SessionRequirements{}))
+			if response.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithPools(t *testing.T) {
+	frontend := newAuthorizationFrontend(t)
+	db := frontend.storage
+
+	pool, err := db.CreatePool("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "alice", restapi.PermissionCreateSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "bob", restapi.PermissionAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := testAgent()
+	agent.PoolId = pool.Id
+	agentId, err := db.RegisterAgent(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestSession := frontend.authorize(requirementsHandler, poolOfSessionRequirements, restapi.PermissionCreateSession)
+	setTaints := frontend.authorize(okHandler, frontend.poolOfAgent, restapi.PermissionAdmin)
+	getPermissions := frontend.authorizeUser(okHandler)
+
+	inPool := restapi.SessionRequirements{PoolId: pool.Id}
+	withoutPool := restapi.SessionRequirements{}
+	ofAgent := map[string]string{"id": agentId}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		userId  string
+		vars    map[string]string
+		body    any
+		status  int
+	}{
+		{"requesting a session in the pool", requestSession, "alice", nil, inPool, http.StatusOK},
+		{"requesting a session as admin of the pool", requestSession, "bob", nil, inPool, http.StatusOK},
+		{"requesting a session without the permission", requestSession, "carol", nil, inPool, http.StatusForbidden},
+		{"requesting a session without a pool", requestSession, "alice", nil, withoutPool, http.StatusForbidden},
+		{"requesting a session without a pool as super-admin", requestSession, "root", nil, withoutPool, http.StatusOK},
+		{"requesting a session without authentication", requestSession, "", nil, withoutPool, http.StatusOK},
+		{"requesting a session with an invalid body", requestSession, "alice", nil, "invalid", http.StatusBadRequest},
+		{"setting the taints as admin of the pool", setTaints, "bob", ofAgent, nil, http.StatusOK},
+		{"setting the taints without the permission", setTaints, "alice", ofAgent, nil, http.StatusForbidden},
+		{"setting the taints of an unknown agent", setTaints, "bob", map[string]string{"id": uuid.NewString()}, nil, http.StatusNotFound},
+		{"listing every agent", frontend.authorize(okHandler, poolOfQuery, anyPermission...), "alice", nil, nil, http.StatusForbidden},
+		{"getting the permissions of the user", getPermissions, "alice", map[string]string{"id": "alice"}, nil, http.StatusOK},
+		{"getting the permissions of another user", getPermissions, "alice", map[string]string{"id": "bob"}, nil, http.StatusForbidden},
+		{"getting the permissions of another user as super-admin", getPermissions, "root", map[string]string{"id": "bob"}, nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(test.handler, userRequest(t, test.userId, test.vars, test.body))
+			if response.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, response.Code, response.Body.String())
+			}
+		})
+	}
+
+	// The body read for the pool is left for the handler
+	response := serve(requestSession, userRequest(t, "alice", nil, inPool))
+	if response.Body.String() != pool.Id {
+		t.Errorf("expected the handler to read pool %s, got %s", pool.Id, response.Body.String())
+	}
+
+	// Bodies larger than those read by the handler are not read for the pool
+	request := userRequest(t, "alice", nil, nil)
+	request.Body = io.NopCloser(bytes.NewReader(make([]byte, pkgnet.MaxBodyLength+1)))
+	response = serve(requestSession, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a body over the limit, got %d", http.StatusBadRequest, response.Code)
+	}
+}
+
+func TestAuthorizeSession(t *testing.T) {
+	frontend := newAuthorizationFrontend(t)
+	db := frontend.storage
+
+	pool, err := db.CreatePool("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "alice", restapi.PermissionCreateSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "carol", restapi.PermissionCreateSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "bob", restapi.PermissionAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requirements := testSessionRequirements()
+	requirements.PoolId = pool.Id
+	requirements.UserId = "alice"
+	inPool, err := db.RequestSession(requirements)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requested before the pool existed
+	requirements.PoolId = ""
+	withoutPool, err := db.RequestSession(requirements)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := frontend.authorizeSession(okHandler)
+
+	tests := []struct {
+		name      string
+		userId    string
+		sessionId string
+		status    int
+	}{
+		{"the owner of the session", "alice", inPool, http.StatusOK},
+		{"another user of the pool", "carol", inPool, http.StatusForbidden},
+		{"an admin of the pool", "bob", inPool, http.StatusOK},
+		{"a super-admin", "root", inPool, http.StatusOK},
+		{"the owner of a session without a pool", "alice", withoutPool, http.StatusOK},
+		{"an admin of a pool on a session without a pool", "bob", withoutPool, http.StatusForbidden},
+		{"a super-admin on a session without a pool", "root", withoutPool, http.StatusOK},
+		{"an unknown session", "alice", uuid.NewString(), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(session, userRequest(t, test.userId, map[string]string{"id": test.sessionId}, nil))
+			if response.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizePoolQuery(t *testing.T) {
+	frontend := newAuthorizationFrontend(t)
+	db := frontend.storage
+
+	pool, err := db.CreatePool("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "alice", restapi.PermissionCreateSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "bob", restapi.PermissionAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscription, err := frontend.createWebhookSubscription(restapi.WebhookSubscription{
+		Url:    "https://example.com/pool",
+		PoolId: pool.Id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = frontend.createWebhookSubscription(restapi.WebhookSubscription{
+		Url: "https://example.com/everything",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getWebhooks := frontend.authorize(frontend.getWebhookSubscriptionsEp, poolOfQuery, restapi.PermissionAdmin)
+
+	request := func(userId string, poolId string) *http.Request {
+		r := userRequest(t, userId, nil, nil)
+		if poolId != "" {
+			r.URL.RawQuery = url.Values{"pool_id": {poolId}}.Encode()
+		}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		userId string
+		poolId string
+		status int
+		count  int
+	}{
+		{"listing the pool as its admin", "bob", pool.Id, http.StatusOK, 1},
+		{"listing the pool without the permission", "alice", pool.Id, http.StatusForbidden, 0},
+		{"listing every pool as admin of a pool", "bob", "", http.StatusForbidden, 0},
+		{"listing every pool as super-admin", "root", "", http.StatusOK, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(getWebhooks, request(test.userId, test.poolId))
+			if response.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, response.Code, response.Body.String())
+			}
+
+			if response.Code != http.StatusOK {
+				return
+			}
+
+			var subscriptions []restapi.WebhookSubscription
+			err := json.Unmarshal(response.Body.Bytes(), &subscriptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(subscriptions) != test.count {
+				t.Errorf("expected %d subscriptions, got %v", test.count, subscriptions)
+			}
+
+			if test.poolId != "" && subscriptions[0].Id != subscription.Id {
+				t.Errorf("expected the subscription of the pool, got %v", subscriptions)
+			}
+		})
+	}
+}
+
+func TestCheckPriority(t *testing.T) {
+	frontend := newAuthorizationFrontend(t)
+	db := frontend.storage
+
+	pool, err := db.CreatePool("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.SetPoolSessionLimits(pool.Id, restapi.PoolSessionLimits{MaxPriority: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "alice", restapi.PermissionCreateSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddPermission(pool.Id, "bob", restapi.PermissionAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		userId    string
+		priority  int
+		forbidden bool
+	}{
+		{"up to the maximum of the pool", "alice", 5, false},
+		{"above the maximum of the pool", "alice", 6, true},
+		{"above the maximum as admin of the pool", "bob", 100, false},
+		{"above the maximum as super-admin", "root", 100, false},
+		{"above the maximum without authentication", "", 100, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requirements := restapi.SessionRequirements{PoolId: pool.Id, Priority: test.priority}
+			err := frontend.checkPriority(userRequest(t, test.userId, nil, nil), requirements)
+			if errors.Is(err, errForbidden) != test.forbidden || (err != nil && !test.forbidden) {
+				t.Errorf("expected forbidden to be %v, got %v", test.forbidden, err)
+			}
+		})
+	}
+}
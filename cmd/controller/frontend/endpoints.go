@@ -4,15 +4,22 @@
 package frontend
 
 import (
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
 	"github.com/gorilla/mux"
 
+	"github.com/Xdevlab/Run/cmd/controller/backend"
+	"github.com/Xdevlab/Run/cmd/controller/storage"
 	"github.com/Xdevlab/Run/cmd/internal/build"
+	"github.com/Xdevlab/Run/pkg/gpu"
 	"github.com/Xdevlab/Run/pkg/logger"
 	pkgnet "github.com/Xdevlab/Run/pkg/net"
 	"github.com/Xdevlab/Run/pkg/restapi"
@@ -22,24 +29,66 @@ import (
 func (frontend *Frontend) initializeEndpoints(server *server.Server) {
 	server.AddEndpointFunc("GET", "/status", frontend.getStatusFormerEp, false)
 	server.AddEndpointFunc("GET", "/v1/status", frontend.getStatusEp, false)
-	server.AddEndpointFunc("POST", "/v1/register/agent", frontend.registerAgentEp, true)
-	server.AddEndpointFunc("GET", "/v1/agent/{id}", frontend.getAgentEp, true)
-	server.AddEndpointFunc("PUT", "/v1/agent/{id}", frontend.updateAgentEp, true)
-	server.AddEndpointFuncWithQuery("GET", "/v1/agents", frontend.getAgentsForPoolEp, true, []string{"pool_id", "{pool_id}"})
-	server.AddEndpointFunc("GET", "/v1/agents", frontend.getAgentsEp, true)
-	server.AddEndpointFunc("POST", "/v1/request/session", frontend.requestSessionEp, true)
-	server.AddEndpointFunc("GET", "/v1/session/{id}", frontend.getSessionEp, true)
-	server.AddEndpointFunc("DELETE", "/v1/session/{id}", frontend.cancelSessionEp, true)
+	server.AddEndpointFunc("POST", "/v1/register/agent", frontend.authorize(frontend.registerAgentEp, poolOfAgentRegistration, restapi.PermissionRegisterAgent), true)
+	server.AddEndpointFunc("GET", "/v1/agent/{id}", frontend.authorize(frontend.getAgentEp, frontend.poolOfAgent, restapi.PermissionRegisterAgent), true)
+	server.AddEndpointFunc("PUT", "/v1/agent/{id}", frontend.authorize(frontend.updateAgentEp, frontend.poolOfAgent, restapi.PermissionRegisterAgent), true)
+	server.AddEndpointFunc("PUT", "/v1/agent/{id}/taints", frontend.authorize(frontend.setAgentTaintsEp, frontend.poolOfAgent, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("POST", "/v1/agent/{id}/cordon", frontend.authorize(frontend.cordonAgentEp, frontend.poolOfAgent, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("POST", "/v1/agent/{id}/drain", frontend.authorize(frontend.drainAgentEp, frontend.poolOfAgent, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("POST", "/v1/agent/{id}/uncordon", frontend.authorize(frontend.uncordonAgentEp, frontend.poolOfAgent, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/agents", frontend.authorize(frontend.getAgentsEp, poolOfQuery, anyPermission...), true)
+	server.AddEndpointFunc("POST", "/v1/request/session", frontend.authorize(frontend.requestSessionEp, poolOfSessionRequirements, restapi.PermissionCreateSession), true)
+	server.AddEndpointFunc("POST", "/v1/schedule/explain", frontend.authorize(frontend.explainScheduleEp, poolOfSessionRequirements, restapi.PermissionCreateSession), true)
+	server.AddEndpointFunc("GET", "/v1/session/{id}", frontend.authorizeSession(frontend.getSessionEp), true)
+	server.AddEndpointFunc("GET", "/v1/session/{id}/queue", frontend.authorizeSession(frontend.getQueueStatusEp), true)
+	server.AddEndpointFunc("POST", "/v1/session/{id}/heartbeat", frontend.authorizeSession(frontend.renewSessionLeaseEp), true)
+	server.AddEndpointFunc("DELETE", "/v1/session/{id}", frontend.authorizeSession(frontend.cancelSessionEp), true)
+	server.AddEndpointFunc("POST", "/v1/release/session/{id}", frontend.authorizeSession(frontend.releaseSessionEp), true)
+	server.AddEndpointFunc("GET", "/v1/sessions", frontend.authorize(frontend.getSessionsEp, poolOfQuery, anyPermission...), true)
+	server.AddEndpointFunc("GET", "/v1/sessions/persistent", frontend.getPersistentSessionsEp, true)
+	server.AddEndpointFunc("GET", "/v1/usage", frontend.authorize(frontend.getUsageEp, poolOfQuery, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/watch", frontend.authorize(frontend.watchEp, poolOfQuery, anyPermission...), true)
+
+	server.AddEndpointFunc("POST", "/v1/reservation", frontend.authorize(frontend.createReservationEp, poolOfReservationRequest, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/reservation/{id}", frontend.authorize(frontend.getReservationEp, frontend.poolOfReservation, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("DELETE", "/v1/reservation/{id}", frontend.authorize(frontend.deleteReservationEp, frontend.poolOfReservation, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/reservations", frontend.authorize(frontend.getReservationsEp, poolOfQuery, restapi.PermissionAdmin), true)
+
+	server.AddEndpointFunc("POST", "/v1/webhook", frontend.authorize(frontend.createWebhookSubscriptionEp, poolOfWebhookSubscriptionRequest, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/webhook/{id}", frontend.authorize(frontend.getWebhookSubscriptionEp, frontend.poolOfWebhookSubscription, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/webhook/{id}/deliveries", frontend.authorize(frontend.getWebhookDeliveriesEp, frontend.poolOfWebhookSubscription, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("DELETE", "/v1/webhook/{id}", frontend.authorize(frontend.deleteWebhookSubscriptionEp, frontend.poolOfWebhookSubscription, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("GET", "/v1/webhooks", frontend.authorize(frontend.getWebhookSubscriptionsEp, poolOfQuery, restapi.PermissionAdmin), true)
+
+	server.AddEndpointFunc("PUT", "/v1/pool", frontend.authorizeSuperAdmin(frontend.createPoolEp), true)
+	server.AddEndpointFunc("GET", "/v1/pool/{id}", frontend.authorize(frontend.getPoolEp, poolOfPath, anyPermission...), true)
+	server.AddEndpointFunc("GET", "/v1/pool/{id}/permissions", frontend.authorize(frontend.getPoolPermissionsEp, poolOfPath, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("PUT", "/v1/pool/{id}/quotas", frontend.authorize(frontend.setPoolQuotasEp, poolOfPath, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("PUT", "/v1/pool/{id}/session_limits", frontend.authorize(frontend.setPoolSessionLimitsEp, poolOfPath, restapi.PermissionAdmin), true)
+
+	server.AddEndpointFunc("DELETE", "/v1/pool/{id}", frontend.authorize(frontend.deletePoolEp, poolOfPath, restapi.PermissionAdmin), true)
+
+	server.AddEndpointFunc("GET", "/v1/user/permissions/{id}", frontend.authorizeUser(frontend.getPermissionsEp), true)
+	server.AddEndpointFunc("DELETE", "/v1/user/permissions", frontend.authorize(frontend.deletePermissionEp, poolOfPermission, restapi.PermissionAdmin), true)
+	server.AddEndpointFunc("PUT", "/v1/user/permissions", frontend.authorize(frontend.addPermissionEp, poolOfPermission, restapi.PermissionAdmin), true)
+}
 
-	server.AddEndpointFunc("PUT", "/v1/pool", frontend.createPoolEp, true)
-	server.AddEndpointFunc("GET", "/v1/pool/{id}", frontend.getPoolEp, true)
-	server.AddEndpointFunc("GET", "/v1/pool/{id}/permissions", frontend.getPoolPermissionsEp, true)
+// Returns the subject of the access token of the request, empty when
+// authentication is disabled
+func userIdFromRequest(r *http.Request) string {
+	userId, _ := authenticatedUser(r)
+	return userId
+}
 
-	server.AddEndpointFunc("DELETE", "/v1/pool/{id}", frontend.deletePoolEp, true)
+// Returns the subject of the access token of the request and whether the
+// request carries one
+func authenticatedUser(r *http.Request) (string, bool) {
+	claims, ok := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	if !ok || claims == nil {
+		return "", false
+	}
 
-	server.AddEndpointFunc("GET", "/v1/user/permissions/{id}", frontend.getPermissionsEp, true)
-	server.AddEndpointFunc("DELETE", "/v1/user/permissions", frontend.deletePermissionEp, true)
-	server.AddEndpointFunc("PUT", "/v1/user/permissions", frontend.addPermissionEp, true)
+	return claims.RegisteredClaims.Subject, true
 }
 
 func (frontend *Frontend) getStatusEp(w http.ResponseWriter, r *http.Request) {
@@ -89,27 +138,109 @@ func (frontend *Frontend) getAgentEp(w http.ResponseWriter, r *http.Request) {
 	pkgnet.Respond(w, http.StatusOK, agent)
 }
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Parses the limit of a page from the query of the request
+func limitFromQuery(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		return 0, fmt.Errorf("%s: invalid limit '%s', expected 1 to %d", r.URL.Path, value, maxPageSize)
+	}
+
+	return limit, nil
+}
+
+var agentStates = []string{restapi.AgentActive, restapi.AgentDisabled, restapi.AgentMissing, restapi.AgentClosed}
+
+// Parses the filters and page of GET /v1/agents from the query of the request
+func agentQueryFromRequest(r *http.Request) (storage.AgentQuery, error) {
+	values := r.URL.Query()
+
+	query := storage.AgentQuery{
+		PoolId:         values.Get("pool_id"),
+		HostnamePrefix: values.Get("hostname_prefix"),
+		GpuName:        values.Get("gpu_name"),
+	}
+
+	if states := values.Get("state"); states != "" {
+		query.States = strings.Split(states, ",")
+		for _, state := range query.States {
+			valid := false
+			for _, agentState := range agentStates {
+				valid = valid || state == agentState
+			}
+
+			if !valid {
+				return storage.AgentQuery{}, fmt.Errorf("/v1/agents: invalid agent state '%s', expected one of %s", state, strings.Join(agentStates, ", "))
+			}
+		}
+	}
+
+	var err error
+	query.MatchLabels, query.MatchExpressions, err = restapi.ParseLabelSelector(values.Get("selector"))
+	if err != nil {
+		return storage.AgentQuery{}, fmt.Errorf("/v1/agents: %w", err)
+	}
+
+	if vram := values.Get("min_vram_available"); vram != "" {
+		query.VramAvailableAtLeast, err = strconv.ParseUint(vram, 10, 64)
+		if err != nil {
+			return storage.AgentQuery{}, fmt.Errorf("/v1/agents: invalid min_vram_available '%s', expected bytes", vram)
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := storage.ParseAgentCursor(cursor)
+		if err != nil {
+			return storage.AgentQuery{}, fmt.Errorf("/v1/agents: %w '%s'", err, cursor)
+		}
+		query.After = &after
+	}
+
+	// Every agent is listed unless a page is requested
+	if values.Has("limit") || values.Has("cursor") {
+		query.Limit, err = limitFromQuery(r)
+		if err != nil {
+			return storage.AgentQuery{}, err
+		}
+	}
+
+	return query, nil
+}
+
 func (frontend *Frontend) getAgentsEp(w http.ResponseWriter, r *http.Request) {
-	agents, err := frontend.getAgents("")
+	query, err := agentQueryFromRequest(r)
 	if err != nil {
-		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
 		logger.Error(err)
 		return
 	}
 
-	pkgnet.Respond(w, http.StatusOK, agents)
-}
-
-func (frontend *Frontend) getAgentsForPoolEp(w http.ResponseWriter, r *http.Request) {
-	poolID := r.URL.Query().Get("pool_id")
-	agents, err := frontend.getAgents(poolID)
+	page, err := frontend.getAgents(query)
 	if err != nil {
 		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
 		logger.Error(err)
 		return
 	}
 
-	pkgnet.Respond(w, http.StatusOK, agents)
+	// The plain array of agents is kept for clients that do not page
+	if query.Limit == 0 {
+		err = pkgnet.Respond(w, http.StatusOK, page.Agents)
+	} else {
+		err = pkgnet.Respond(w, http.StatusOK, page)
+	}
+
+	if err != nil {
+		logger.Error(err)
+	}
 }
 
 func (frontend *Frontend) updateAgentEp(w http.ResponseWriter, r *http.Request) {
@@ -147,6 +278,56 @@ func (frontend *Frontend) requestSessionEp(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	err = gpu.ValidateSharing(sessionRequirements.GpuSharing)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	for _, requirement := range sessionRequirements.Gpus {
+		err = requirement.Validate()
+		if err != nil {
+			err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+			logger.Error(err)
+			return
+		}
+	}
+
+	for _, expression := range sessionRequirements.MatchExpressions {
+		err = expression.Validate()
+		if err != nil {
+			err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+			logger.Error(err)
+			return
+		}
+	}
+
+	err = sessionRequirements.ValidateLimits()
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = frontend.checkPriority(r, sessionRequirements)
+	if err != nil {
+		respondAuthorizationError(w, r, err)
+		return
+	}
+
+	err = frontend.scheduler.ValidateVersion(sessionRequirements)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, backend.ErrIncompatibleVersion) {
+			status = http.StatusBadRequest
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
 	if sessionRequirements.PoolId == "" {
 		logger.Warning("Creating a session without a pool ID")
 		// TODO: At some point we should force pool IDs to be required
@@ -155,6 +336,8 @@ func (frontend *Frontend) requestSessionEp(w http.ResponseWriter, r *http.Reques
 		// 	return
 	}
 
+	sessionRequirements.UserId = userIdFromRequest(r)
+
 	id, err := frontend.requestSession(sessionRequirements)
 	if err != nil {
 		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
@@ -168,6 +351,27 @@ func (frontend *Frontend) requestSessionEp(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func (frontend *Frontend) explainScheduleEp(w http.ResponseWriter, r *http.Request) {
+	sessionRequirements, err := pkgnet.ReadRequestBody[restapi.SessionRequirements](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	explanation, err := frontend.explainSchedule(sessionRequirements)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, explanation)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
 func (frontend *Frontend) cancelSessionEp(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
@@ -184,6 +388,278 @@ func (frontend *Frontend) cancelSessionEp(w http.ResponseWriter, r *http.Request
 	}
 }
 
+func (frontend *Frontend) releaseSessionEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := frontend.releaseSession(id, userIdFromRequest(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, errNotPersistent) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, errNotSessionOwner) {
+			status = http.StatusForbidden
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, fmt.Sprintf("Session %s released", id))
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) getPersistentSessionsEp(w http.ResponseWriter, r *http.Request) {
+	sessions, err := frontend.getPersistentSessions(userIdFromRequest(r))
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, sessions)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// Parses the filters, order and page of GET /v1/sessions from the query of the request
+func sessionQueryFromRequest(r *http.Request) (storage.SessionQuery, error) {
+	values := r.URL.Query()
+
+	query := storage.SessionQuery{
+		SessionFilter: restapi.SessionFilter{
+			PoolId:  values.Get("pool_id"),
+			AgentId: values.Get("agent_id"),
+			UserId:  values.Get("user_id"),
+		},
+		Sort: values.Get("sort"),
+	}
+
+	if states := values.Get("state"); states != "" {
+		query.States = strings.Split(states, ",")
+	}
+
+	var err error
+	query.CreatedAfter, err = optionalTimeFromQuery(r, "created_after")
+	if err != nil {
+		return storage.SessionQuery{}, err
+	}
+
+	query.CreatedBefore, err = optionalTimeFromQuery(r, "created_before")
+	if err != nil {
+		return storage.SessionQuery{}, err
+	}
+
+	err = query.Validate()
+	if err != nil {
+		return storage.SessionQuery{}, fmt.Errorf("/v1/sessions: %w", err)
+	}
+
+	switch query.Sort {
+	case "":
+		query.Sort = restapi.SessionSortCreated
+	case restapi.SessionSortCreated, restapi.SessionSortPriority:
+	default:
+		return storage.SessionQuery{}, fmt.Errorf("/v1/sessions: invalid sort '%s', expected %s or %s", query.Sort, restapi.SessionSortCreated, restapi.SessionSortPriority)
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return storage.SessionQuery{}, fmt.Errorf("/v1/sessions: invalid order '%s', expected asc or desc", order)
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := storage.ParseSessionCursor(cursor)
+		if err != nil {
+			return storage.SessionQuery{}, fmt.Errorf("/v1/sessions: %w '%s'", err, cursor)
+		}
+		query.After = &after
+	}
+
+	query.Limit, err = limitFromQuery(r)
+	if err != nil {
+		return storage.SessionQuery{}, err
+	}
+
+	return query, nil
+}
+
+func (frontend *Frontend) getSessionsEp(w http.ResponseWriter, r *http.Request) {
+	query, err := sessionQueryFromRequest(r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	page, err := frontend.getSessions(query)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, page)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// Parses an optional RFC 3339 time from the query of the request
+func timeFromQuery(r *http.Request, key string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: invalid %s '%s', expected an RFC 3339 time", r.URL.Path, key, value)
+	}
+
+	return parsed, nil
+}
+
+func optionalTimeFromQuery(r *http.Request, key string) (*time.Time, error) {
+	if r.URL.Query().Get(key) == "" {
+		return nil, nil
+	}
+
+	parsed, err := timeFromQuery(r, key, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+func (frontend *Frontend) getUsageEp(w http.ResponseWriter, r *http.Request) {
+	end, err := timeFromQuery(r, "end", time.Now())
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	start, err := timeFromQuery(r, "start", end.Add(-30*24*time.Hour))
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	if !start.Before(end) {
+		err = fmt.Errorf("/v1/usage: start must be before end")
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	err = restapi.ValidateUsageGroupBy(groupBy)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		err = fmt.Errorf("/v1/usage: invalid format '%s', expected json or csv", format)
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	usage, err := frontend.getUsage(start, end, groupBy, r.URL.Query().Get("pool_id"))
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	if format == "csv" {
+		err = respondWithUsageCsv(w, usage)
+	} else {
+		err = pkgnet.Respond(w, http.StatusOK, usage)
+	}
+
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func formatCsvTime(value *time.Time) string {
+	if value == nil {
+		return ""
+	}
+
+	return value.UTC().Format(time.RFC3339)
+}
+
+// Writes the groups of the usage as CSV, or its records when it is not grouped
+func respondWithUsageCsv(w http.ResponseWriter, usage restapi.Usage) error {
+	rows := [][]string{}
+	if usage.GroupBy != "" {
+		rows = append(rows, []string{usage.GroupBy, "sessions", "gpu_seconds", "vram_gb_seconds"})
+		for _, group := range usage.Groups {
+			rows = append(rows, []string{
+				group.Key,
+				strconv.Itoa(group.Sessions),
+				strconv.FormatFloat(group.GpuSeconds, 'f', 0, 64),
+				strconv.FormatFloat(group.VramGBSeconds, 'f', 0, 64),
+			})
+		}
+	} else {
+		rows = append(rows, []string{"session_id", "user_id", "pool_id", "agent_id", "gpus", "vram_required",
+			"queued_at", "assigned_at", "active_at", "closed_at", "connections", "exit_codes", "gpu_seconds"})
+		for _, record := range usage.Records {
+			gpus := make([]string, 0, len(record.Gpus))
+			for _, gpu := range record.Gpus {
+				gpus = append(gpus, strconv.Itoa(gpu.Index))
+			}
+
+			exitCodes := make([]string, 0, len(record.ExitCodes))
+			for _, exitCode := range record.ExitCodes {
+				exitCodes = append(exitCodes, strconv.Itoa(exitCode))
+			}
+
+			gpuSeconds := float64(len(record.Gpus)) * record.HeldSeconds(usage.Start, usage.End)
+
+			rows = append(rows, []string{
+				record.SessionId,
+				record.UserId,
+				record.PoolId,
+				record.AgentId,
+				strings.Join(gpus, " "),
+				strconv.FormatUint(record.VramRequired, 10),
+				formatCsvTime(&record.QueuedAt),
+				formatCsvTime(record.AssignedAt),
+				formatCsvTime(record.ActiveAt),
+				formatCsvTime(record.ClosedAt),
+				strconv.Itoa(record.Connections),
+				strings.Join(exitCodes, " "),
+				strconv.FormatFloat(gpuSeconds, 'f', 0, 64),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	return writer.WriteAll(rows)
+}
+
 func (frontend *Frontend) getSessionEp(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
@@ -200,6 +676,242 @@ func (frontend *Frontend) getSessionEp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (frontend *Frontend) getQueueStatusEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	status, err := frontend.getQueueStatus(id)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, status)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) renewSessionLeaseEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	lease, err := frontend.renewSessionLease(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, errSessionEnded) {
+			status = http.StatusConflict
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, lease)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) createReservationEp(w http.ResponseWriter, r *http.Request) {
+	reservation, err := pkgnet.ReadRequestBody[restapi.Reservation](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = validateReservation(reservation)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	reservation, err = frontend.createReservation(reservation)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, reservation)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) getReservationEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	reservation, err := frontend.getReservation(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, reservation)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) getReservationsEp(w http.ResponseWriter, r *http.Request) {
+	reservations, err := frontend.getReservations(r.URL.Query().Get("pool_id"))
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, reservations)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) deleteReservationEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := frontend.deleteReservation(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.RespondWithString(w, http.StatusOK, id)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) createWebhookSubscriptionEp(w http.ResponseWriter, r *http.Request) {
+	subscription, err := pkgnet.ReadRequestBody[restapi.WebhookSubscription](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = subscription.Validate()
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	subscription, err = frontend.createWebhookSubscription(subscription)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, subscription)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) getWebhookSubscriptionEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	subscription, err := frontend.getWebhookSubscription(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, subscription)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) getWebhookSubscriptionsEp(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := frontend.getWebhookSubscriptions(r.URL.Query().Get("pool_id"))
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, subscriptions)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// Returns the latest deliveries of the subscription, newest first
+func (frontend *Frontend) getWebhookDeliveriesEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	limit, err := limitFromQuery(r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	deliveries, err := frontend.getWebhookDeliveries(id, limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, deliveries)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) deleteWebhookSubscriptionEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := frontend.deleteWebhookSubscription(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.RespondWithString(w, http.StatusOK, id)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
 func (frontend *Frontend) createPoolEp(w http.ResponseWriter, r *http.Request) {
 	poolParams, err := pkgnet.ReadRequestBody[restapi.CreatePoolParams](r)
 	if err != nil {
@@ -281,6 +993,167 @@ func (frontend *Frontend) getPoolEp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (frontend *Frontend) setPoolSessionLimitsEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	limits, err := pkgnet.ReadRequestBody[restapi.PoolSessionLimits](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = limits.Validate()
+	if err != nil {
+		err = fmt.Errorf("/v1/pool/%s/session_limits: %w", id, err)
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	pool, err := frontend.setPoolSessionLimits(id, limits)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, pool)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) setPoolQuotasEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	quotas, err := pkgnet.ReadRequestBody[restapi.PoolQuotas](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	if quotas.MaxSessions < 0 || quotas.MaxGpus < 0 {
+		err = fmt.Errorf("/v1/pool/%s/quotas: quotas must not be negative", id)
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	pool, err := frontend.setPoolQuotas(id, quotas)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, pool)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) setAgentTaintsEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	taints, err := pkgnet.ReadRequestBody[map[string]string](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	for key := range taints {
+		if key == "" {
+			err = fmt.Errorf("/v1/agent/%s/taints: taints must have a key", id)
+			err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+			logger.Error(err)
+			return
+		}
+	}
+
+	agent, err := frontend.setAgentTaints(id, taints)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, agent)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func respondWithAgent(w http.ResponseWriter, agent restapi.Agent, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, errAgentUnavailable) {
+			status = http.StatusConflict
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	err = pkgnet.Respond(w, http.StatusOK, agent)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (frontend *Frontend) cordonAgentEp(w http.ResponseWriter, r *http.Request) {
+	agent, err := frontend.setAgentDisabled(mux.Vars(r)["id"], true, nil)
+	respondWithAgent(w, agent, err)
+}
+
+func (frontend *Frontend) drainAgentEp(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	drain, err := pkgnet.ReadRequestBody[restapi.AgentDrain](r)
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	if drain.TimeoutSeconds < 0 {
+		err = fmt.Errorf("/v1/agent/%s/drain: timeout must not be negative", id)
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(drain.TimeoutSeconds) * time.Second)
+
+	agent, err := frontend.setAgentDisabled(id, true, &deadline)
+	respondWithAgent(w, agent, err)
+}
+
+func (frontend *Frontend) uncordonAgentEp(w http.ResponseWriter, r *http.Request) {
+	agent, err := frontend.setAgentDisabled(mux.Vars(r)["id"], false, nil)
+	respondWithAgent(w, agent, err)
+}
+
 func (frontend *Frontend) getPoolPermissionsEp(w http.ResponseWriter, r *http.Request) {
 
 	id := mux.Vars(r)["id"]
@@ -340,9 +1213,21 @@ func (frontend *Frontend) deletePermissionEp(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	err = permissionParams.Validate()
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
 	err = frontend.removePermission(permissionParams.PoolId, permissionParams.UserId, permissionParams.Permission)
 	if err != nil {
-		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+
+		err = errors.Join(err, pkgnet.RespondWithString(w, status, err.Error()))
 		logger.Error(err)
 		return
 	}
@@ -361,6 +1246,13 @@ func (frontend *Frontend) addPermissionEp(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	err = permissionParams.Validate()
+	if err != nil {
+		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+		logger.Error(err)
+		return
+	}
+
 	err = frontend.addPermission(permissionParams.PoolId, permissionParams.UserId, permissionParams.Permission)
 	if err != nil {
 		err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
@@ -0,0 +1,106 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage/memdb"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+func testAgent() restapi.Agent {
+	return restapi.Agent{
+		State:    restapi.AgentActive,
+		Hostname: "Test",
+		Address:  "127.0.0.1:43210",
+		Version:  "Test",
+		Gpus: []restapi.Gpu{
+			{
+				Index: 0,
+				Name:  "Test",
+				Vram:  24 * 1024 * 1024 * 1024,
+			},
+		},
+		Labels:   map[string]string{},
+		Taints:   map[string]string{},
+		Sessions: []restapi.Session{},
+	}
+}
+
+func TestGetAgentsEp(t *testing.T) {
+	logger.Configure()
+
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	frontend := &Frontend{storage: db}
+
+	for index := 0; index < 3; index++ {
+		_, err := frontend.storage.RegisterAgent(testAgent())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(frontend.getAgentsEp))
+	defer server.Close()
+
+	// Clients that do not page are returned the plain array of every agent
+	response, err := server.Client().Get(server.URL + "/v1/agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var agents []restapi.Agent
+	err = json.NewDecoder(response.Body).Decode(&agents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agents) != 3 {
+		t.Errorf("expected 3 agents, got %d", len(agents))
+	}
+
+	api := restapi.Client{
+		Client:  server.Client(),
+		Address: server.Listener.Addr().String(),
+	}
+
+	page, err := api.GetAgents(restapi.AgentListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Agents) != 3 || page.NextCursor != "" {
+		t.Errorf("expected every agent in a single page, got %d agents and cursor '%s'", len(page.Agents), page.NextCursor)
+	}
+
+	page, err = api.GetAgents(restapi.AgentListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Agents) != 2 || page.NextCursor == "" {
+		t.Fatalf("expected a page of 2 agents with a cursor, got %d agents and cursor '%s'", len(page.Agents), page.NextCursor)
+	}
+
+	page, err = api.GetAgents(restapi.AgentListOptions{Cursor: page.NextCursor, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Agents) != 1 || page.NextCursor != "" {
+		t.Errorf("expected the last page of 1 agent, got %d agents and cursor '%s'", len(page.Agents), page.NextCursor)
+	}
+}
@@ -11,9 +11,11 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/Xdevlab/Run/cmd/controller/storage"
 	"github.com/Xdevlab/Run/cmd/internal/build"
 	"github.com/Xdevlab/Run/pkg/logger"
 	pkgnet "github.com/Xdevlab/Run/pkg/net"
+	"github.com/Xdevlab/Run/pkg/restapi"
 )
 
 // Pulled from former Node version
@@ -59,8 +61,13 @@ type StatusFormer struct {
 }
 
 func (frontend *Frontend) getStatusFormerEp(w http.ResponseWriter, r *http.Request) {
-	agents, err := frontend.getAgents("")
+	agents := []restapi.Agent{}
+	iterator, err := frontend.storage.GetAgents(storage.AgentQuery{})
 	if err == nil {
+		for iterator.Next() {
+			agents = append(agents, iterator.Value())
+		}
+
 		hosts := make([]AgentData, len(agents))
 		for index, agent := range agents {
 			ip, portStr, err_ := net.SplitHostPort(agent.Address)
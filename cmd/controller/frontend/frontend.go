@@ -6,13 +6,12 @@ package frontend
 import (
 	"errors"
 	"flag"
-	"net/http"
+	"fmt"
 	"os"
-	"sync"
 	"time"
 
+	"github.com/Xdevlab/Run/cmd/controller/backend"
 	"github.com/Xdevlab/Run/cmd/controller/storage"
-	"github.com/Xdevlab/Run/pkg/logger"
 	"github.com/Xdevlab/Run/pkg/restapi"
 	"github.com/Xdevlab/Run/pkg/server"
 	"github.com/Xdevlab/Run/pkg/task"
@@ -20,7 +19,9 @@ import (
 
 var (
 	overrideHostname = flag.String("override-hostname", "", "")
-	webhook          = flag.String("webhook-url", "", "")
+	webhook          = flag.String("webhook-url", "", "Deprecated, subscribes the URL to the session.state events as a webhook subscription")
+
+	queueEstimateWindow = flag.Duration("queue-estimate-window", 15*time.Minute, "The window of recent session assignments used to estimate the wait time of queued sessions")
 )
 
 type Frontend struct {
@@ -28,8 +29,15 @@ type Frontend struct {
 
 	hostname string
 
-	webhookClient   restapi.Client
-	webhookMessages chan restapi.WebhookMessage
+	webhooks *webhookSender
+
+	events  *eventLog
+	watched *watchState
+
+	superAdmins map[string]struct{}
+
+	// Explains scheduling and validates versions with the configuration of the backend
+	scheduler *backend.Backend
 
 	storage storage.Storage
 }
@@ -45,18 +53,21 @@ func NewFrontend(server *server.Server, storage storage.Storage) (*Frontend, err
 		hostname = hostname_
 	}
 
+	scheduler, err := backend.NewBackend(storage)
+	if err != nil {
+		return nil, err
+	}
+
 	frontend := &Frontend{
 		startTime: time.Now(),
 		hostname:  hostname,
+		events:    newEventLog(*watchHistory),
+		watched:   newWatchState(),
+		webhooks:  newWebhookSender(storage),
 		storage:   storage,
-	}
 
-	if *webhook != "" {
-		frontend.webhookClient = restapi.Client{
-			Client:  &http.Client{},
-			Address: *webhook,
-		}
-		frontend.webhookMessages = make(chan restapi.WebhookMessage, 32)
+		superAdmins: parseSuperAdmins(*superAdmins),
+		scheduler:   scheduler,
 	}
 
 	frontend.initializeEndpoints(server)
@@ -65,68 +76,16 @@ func NewFrontend(server *server.Server, storage storage.Storage) (*Frontend, err
 }
 
 func (frontend *Frontend) Run(group task.Group) error {
-	if frontend.webhookMessages != nil {
-		var messages []restapi.WebhookMessage
-
-		messagesCond := sync.NewCond(&sync.Mutex{})
-
-		group.GoFn("Webhook Copying", func(group task.Group) error {
-			for {
-				select {
-				case <-group.Ctx().Done():
-					messagesCond.Signal()
-					return nil
-
-				case msg := <-frontend.webhookMessages:
-					messagesCond.L.Lock()
-					messages = append(messages, msg)
-					messagesCond.L.Unlock()
-					messagesCond.Signal()
-				}
-			}
-		})
-
-		group.GoFn("Webhook Calling", func(g task.Group) error {
-			for {
-				for len(messages) > 0 {
-					select {
-					case <-group.Ctx().Done():
-						return nil
-
-					default:
-						messagesCond.L.Lock()
-						msg := messages[0]
-						messages = messages[1:]
-						messagesCond.L.Unlock()
-
-						body, err := restapi.JsonReaderFromObject(msg)
-						if err == nil {
-							response, err_ := frontend.webhookClient.PostWithJson(group.Ctx(), *webhook, body)
-							if response != nil {
-								err = errors.Join(err_, response.Body.Close())
-							}
-						}
-
-						if err != nil {
-							logger.Error(err)
-						}
-					}
-				}
-
-				messagesCond.L.Lock()
-				for len(messages) == 0 {
-					select {
-					case <-group.Ctx().Done():
-						return nil
-
-					default:
-					}
-
-					messagesCond.Wait()
-				}
-				messagesCond.L.Unlock()
-			}
-		})
+	group.GoFn("Watch", frontend.watchStorage)
+
+	group.GoFn("Webhook Queueing", frontend.queueWebhookDeliveries)
+	group.GoFn("Webhook Sending", frontend.webhooks.Run)
+
+	if *webhook != "" {
+		err := frontend.subscribeWebhookUrl(*webhook)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -137,18 +96,33 @@ func (frontend *Frontend) registerAgent(agent restapi.Agent) (string, error) {
 	return frontend.storage.RegisterAgent(agent)
 }
 
-func (frontend *Frontend) getAgents(poolId string) ([]restapi.Agent, error) {
-	iterator, err := frontend.storage.GetAgents(poolId)
+// Retrieves a page of the agents matching the query, with the cursor of the
+// next page when more agents match, every agent when the query has no limit
+func (frontend *Frontend) getAgents(query storage.AgentQuery) (restapi.AgentPage, error) {
+	limit := query.Limit
+	// One agent past the page tells whether another page follows
+	if limit > 0 {
+		query.Limit++
+	}
+
+	iterator, err := frontend.storage.GetAgents(query)
 	if err != nil {
-		return nil, err
+		return restapi.AgentPage{}, err
 	}
 
-	agents := make([]restapi.Agent, 0)
+	page := restapi.AgentPage{
+		Agents: make([]restapi.Agent, 0),
+	}
 	for iterator.Next() {
-		agents = append(agents, iterator.Value())
+		page.Agents = append(page.Agents, iterator.Value())
+	}
+
+	if limit > 0 && len(page.Agents) > limit {
+		page.Agents = page.Agents[:limit]
+		page.NextCursor = storage.CursorOfAgent(page.Agents[limit-1]).String()
 	}
 
-	return agents, nil
+	return page, nil
 }
 
 func (frontend *Frontend) getAgentById(id string) (restapi.Agent, error) {
@@ -157,33 +131,213 @@ func (frontend *Frontend) getAgentById(id string) (restapi.Agent, error) {
 
 func (frontend *Frontend) updateAgent(update restapi.AgentUpdate) error {
 	err := frontend.storage.UpdateAgent(update)
-	if err == nil && len(update.SessionsUpdate) > 0 {
-		if frontend.webhookMessages != nil {
-			for sessionId, session := range update.SessionsUpdate {
-				frontend.webhookMessages <- restapi.WebhookMessage{
-					Agent:   update.Id,
-					Session: sessionId,
-					State:   session.State,
-				}
-			}
-		}
+	if err == nil {
+		frontend.publishConnections(update)
 	}
 
 	return err
 }
 
 func (frontend *Frontend) requestSession(sessionRequirements restapi.SessionRequirements) (string, error) {
+	// The limits of the pool are applied when the session is queued, so the
+	// agent running the session enforces the same limits as the backend
+	if sessionRequirements.PoolId != "" {
+		pool, err := frontend.storage.GetPool(sessionRequirements.PoolId)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return "", err
+		}
+
+		sessionRequirements.MaxDurationSeconds, sessionRequirements.IdleTimeoutSeconds =
+			pool.SessionLimits.Apply(sessionRequirements.MaxDurationSeconds, sessionRequirements.IdleTimeoutSeconds)
+	}
+
 	return frontend.storage.RequestSession(sessionRequirements)
 }
 
+func (frontend *Frontend) explainSchedule(sessionRequirements restapi.SessionRequirements) (restapi.ScheduleExplanation, error) {
+	return frontend.scheduler.Explain(sessionRequirements)
+}
+
+var errSessionEnded = errors.New("session has ended")
+
+func (frontend *Frontend) renewSessionLease(id string) (restapi.SessionLease, error) {
+	session, err := frontend.storage.GetSessionById(id)
+	if err != nil {
+		return restapi.SessionLease{}, err
+	}
+
+	if session.State == restapi.SessionCanceling || session.State == restapi.SessionClosed {
+		return restapi.SessionLease{}, fmt.Errorf("%w, session %s is %s", errSessionEnded, id, session.State)
+	}
+
+	err = frontend.storage.RenewSessionLease(id)
+	if err != nil {
+		return restapi.SessionLease{}, err
+	}
+
+	lease, err := frontend.scheduler.SessionLease(session.PoolId)
+	if err != nil {
+		return restapi.SessionLease{}, err
+	}
+
+	result := restapi.SessionLease{
+		LeaseSeconds: int64(lease.Seconds()),
+	}
+	if lease > 0 {
+		expiresAt := time.Now().Add(lease)
+		result.ExpiresAt = &expiresAt
+	}
+
+	return result, nil
+}
+
 func (frontend *Frontend) getSessionById(id string) (restapi.Session, error) {
 	return frontend.storage.GetSessionById(id)
 }
 
+func (frontend *Frontend) getQueueStatus(id string) (restapi.QueueStatus, error) {
+	session, err := frontend.storage.GetSessionById(id)
+	if err != nil {
+		return restapi.QueueStatus{}, err
+	}
+
+	if session.State != restapi.SessionQueued {
+		return restapi.QueueStatus{}, nil
+	}
+
+	ahead, err := frontend.storage.CountQueuedSessionsAhead(id)
+	if err != nil {
+		return restapi.QueueStatus{}, err
+	}
+
+	status := restapi.QueueStatus{
+		Position:             ahead + 1,
+		SessionsAhead:        ahead,
+		EstimatedWaitSeconds: -1,
+	}
+
+	assigned, err := frontend.storage.CountSessionsAssignedSince(session.PoolId, time.Now().Add(-*queueEstimateWindow))
+	if err != nil {
+		return restapi.QueueStatus{}, err
+	}
+
+	if assigned > 0 {
+		// Assume sessions keep being assigned at the recent rate
+		wait := *queueEstimateWindow * time.Duration(status.Position) / time.Duration(assigned)
+		status.EstimatedWaitSeconds = int64(wait.Seconds())
+	}
+
+	return status, nil
+}
+
 func (frontend *Frontend) cancelSession(id string) error {
 	return frontend.storage.CancelSession(id)
 }
 
+var (
+	errNotPersistent   = errors.New("session is not persistent")
+	errNotSessionOwner = errors.New("session belongs to another user")
+)
+
+// Ends a persistent session of the user, which is otherwise kept after its
+// clients disconnect
+func (frontend *Frontend) releaseSession(id string, userId string) error {
+	session, err := frontend.storage.GetSessionById(id)
+	if err != nil {
+		return err
+	}
+
+	if !session.Persistent {
+		return fmt.Errorf("%w, session %s", errNotPersistent, id)
+	}
+
+	if session.UserId != userId {
+		return fmt.Errorf("%w, session %s", errNotSessionOwner, id)
+	}
+
+	if session.State == restapi.SessionCanceling || session.State == restapi.SessionClosed {
+		return nil
+	}
+
+	return errors.Join(
+		frontend.storage.SetSessionReason(id, "session was released by its client"),
+		frontend.cancelSession(id))
+}
+
+func (frontend *Frontend) getPersistentSessions(userId string) ([]restapi.Session, error) {
+	iterator, err := frontend.storage.GetPersistentSessions(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []restapi.Session{}
+	for iterator.Next() {
+		sessions = append(sessions, iterator.Value())
+	}
+
+	return sessions, nil
+}
+
+// Retrieves a page of the sessions matching the query, with the cursor of the
+// next page when more sessions match
+func (frontend *Frontend) getSessions(query storage.SessionQuery) (restapi.SessionPage, error) {
+	limit := query.Limit
+	// One session past the page tells whether another page follows
+	query.Limit++
+
+	iterator, err := frontend.storage.GetSessions(query)
+	if err != nil {
+		return restapi.SessionPage{}, err
+	}
+
+	page := restapi.SessionPage{
+		Sessions: []restapi.SessionListItem{},
+	}
+	for iterator.Next() {
+		page.Sessions = append(page.Sessions, iterator.Value())
+	}
+
+	if len(page.Sessions) > limit {
+		page.Sessions = page.Sessions[:limit]
+		page.NextCursor = storage.CursorOfSession(page.Sessions[limit-1]).String()
+	}
+
+	return page, nil
+}
+
+// Retrieves the accounting records of the sessions within the time range,
+// summed by user or pool when grouped
+// Retrieves the usage of the pool between start and end, of every pool when
+// the pool is empty
+func (frontend *Frontend) getUsage(start, end time.Time, groupBy string, poolId string) (restapi.Usage, error) {
+	iterator, err := frontend.storage.GetUsageRecords(start, end)
+	if err != nil {
+		return restapi.Usage{}, err
+	}
+
+	records := []restapi.UsageRecord{}
+	for iterator.Next() {
+		record := iterator.Value()
+		if poolId == "" || record.PoolId == poolId {
+			records = append(records, record)
+		}
+	}
+
+	usage := restapi.Usage{
+		Start:   start,
+		End:     end,
+		GroupBy: groupBy,
+	}
+
+	if groupBy == "" {
+		usage.Records = records
+		return usage, nil
+	}
+
+	usage.Groups, err = restapi.GroupUsage(records, groupBy, start, end)
+	return usage, err
+}
+
 func (frontend *Frontend) deletePool(id string) error {
 	return frontend.storage.DeletePool(id)
 }
@@ -191,10 +345,113 @@ func (frontend *Frontend) getPool(id string) (restapi.Pool, error) {
 	return frontend.storage.GetPool(id)
 }
 
+func (frontend *Frontend) setAgentTaints(id string, taints map[string]string) (restapi.Agent, error) {
+	err := frontend.storage.SetAgentTaints(id, taints)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	return frontend.storage.GetAgentById(id)
+}
+
+var errAgentUnavailable = errors.New("agent is not active or disabled")
+
+// Cordons the agent when disabled, the sessions remaining on the agent are
+// canceled once the drain deadline passes unless it is nil
+func (frontend *Frontend) setAgentDisabled(id string, disabled bool, drainDeadline *time.Time) (restapi.Agent, error) {
+	agent, err := frontend.storage.GetAgentById(id)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	if agent.State != restapi.AgentActive && agent.State != restapi.AgentDisabled {
+		return restapi.Agent{}, fmt.Errorf("%w, agent %s is %s", errAgentUnavailable, id, agent.State)
+	}
+
+	err = frontend.storage.SetAgentDisabled(id, disabled, drainDeadline)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	return frontend.storage.GetAgentById(id)
+}
+
+func (frontend *Frontend) setPoolQuotas(id string, quotas restapi.PoolQuotas) (restapi.Pool, error) {
+	err := frontend.storage.SetPoolQuotas(id, quotas)
+	if err != nil {
+		return restapi.Pool{}, err
+	}
+
+	return frontend.storage.GetPool(id)
+}
+
+func (frontend *Frontend) setPoolSessionLimits(id string, limits restapi.PoolSessionLimits) (restapi.Pool, error) {
+	err := frontend.storage.SetPoolSessionLimits(id, limits)
+	if err != nil {
+		return restapi.Pool{}, err
+	}
+
+	return frontend.storage.GetPool(id)
+}
+
 func (frontend *Frontend) getPoolPermissions(id string) (restapi.PoolPermissions, error) {
 	return frontend.storage.GetPoolPermissions(id)
 }
 
+func validateReservation(reservation restapi.Reservation) error {
+	if len(reservation.Gpus) == 0 {
+		return errors.New("reservation must hold at least one GPU")
+	}
+
+	for _, requirement := range reservation.Gpus {
+		err := requirement.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !reservation.End.After(reservation.Start) {
+		return errors.New("reservation must end after it starts")
+	}
+
+	if !reservation.End.After(time.Now()) {
+		return errors.New("reservation must end in the future")
+	}
+
+	return nil
+}
+
+func (frontend *Frontend) createReservation(reservation restapi.Reservation) (restapi.Reservation, error) {
+	return frontend.storage.CreateReservation(reservation)
+}
+
+func (frontend *Frontend) getReservation(id string) (restapi.Reservation, error) {
+	return frontend.storage.GetReservation(id)
+}
+
+// Retrieves the reservations of the pool that have not ended, of every pool
+// when the pool is empty
+func (frontend *Frontend) getReservations(poolId string) ([]restapi.Reservation, error) {
+	iterator, err := frontend.storage.GetReservations(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := make([]restapi.Reservation, 0)
+	for iterator.Next() {
+		reservation := iterator.Value()
+		if poolId == "" || reservation.PoolId == poolId {
+			reservations = append(reservations, reservation)
+		}
+	}
+
+	return reservations, nil
+}
+
+func (frontend *Frontend) deleteReservation(id string) error {
+	return frontend.storage.DeleteReservation(id)
+}
+
 func (frontend *Frontend) createPool(name string) (restapi.Pool, error) {
 	return frontend.storage.CreatePool(name)
 }
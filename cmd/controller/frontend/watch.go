@@ -0,0 +1,557 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/logger"
+	pkgnet "github.com/Xdevlab/Run/pkg/net"
+	"github.com/Xdevlab/Run/pkg/restapi"
+	"github.com/Xdevlab/Run/pkg/task"
+)
+
+var (
+	watchResyncInterval = flag.Duration("watch-resync-interval", 5*time.Second, "How often every session and agent is compared for watchers, in case a change was not notified")
+	watchHistory        = flag.Int("watch-history", 4096, "How many events are kept for watchers resuming after an event id")
+)
+
+// A comment is sent on idle streams so proxies keep them open
+const watchKeepAliveInterval = 15 * time.Second
+
+var (
+	watchedSessionStates = []string{restapi.SessionQueued, restapi.SessionAssigned, restapi.SessionActive, restapi.SessionCanceling}
+	watchedAgentStates   = []string{restapi.AgentActive, restapi.AgentDisabled, restapi.AgentMissing}
+)
+
+// An event of the log. Derived events are derived from the changes of
+// storage, so every frontend publishes them, unlike the events only known to
+// the frontend publishing them such as connections.
+type loggedEvent struct {
+	restapi.Event
+	derived bool
+}
+
+// The recent events kept for watchers resuming after an event id. Ids start
+// from the time the log is created so they keep increasing across restarts.
+type eventLog struct {
+	mutex    sync.Mutex
+	events   []loggedEvent
+	capacity int
+	lastId   uint64
+
+	notifier storage.Notifier
+}
+
+func newEventLog(capacity int) *eventLog {
+	return &eventLog{
+		capacity: capacity,
+		lastId:   uint64(time.Now().UnixMicro()),
+	}
+}
+
+func (log *eventLog) publish(event restapi.Event, derived bool) {
+	log.mutex.Lock()
+	log.lastId++
+	event.Id = log.lastId
+	event.Time = time.Now()
+
+	log.events = append(log.events, loggedEvent{Event: event, derived: derived})
+	if len(log.events) > log.capacity {
+		log.events = log.events[len(log.events)-log.capacity:]
+	}
+	log.mutex.Unlock()
+
+	log.notifier.Notify()
+}
+
+// Returns the events after the id and the id of the last event. Returns false
+// when the events after the id are no longer kept or the id was not issued by
+// this log.
+func (log *eventLog) after(id uint64) ([]loggedEvent, uint64, bool) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	missed := log.lastId - id
+	if id > log.lastId || missed > uint64(len(log.events)) {
+		return nil, log.lastId, false
+	}
+
+	events := make([]loggedEvent, missed)
+	copy(events, log.events[len(log.events)-int(missed):])
+	return events, log.lastId, true
+}
+
+func (log *eventLog) last() uint64 {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	return log.lastId
+}
+
+// Sessions only move forward through their states, except when requeued
+var sessionStateOrder = map[string]int{
+	restapi.SessionQueued:    0,
+	restapi.SessionAssigned:  1,
+	restapi.SessionActive:    2,
+	restapi.SessionCanceling: 3,
+	restapi.SessionClosed:    4,
+}
+
+// How long closed sessions are remembered, so a session closing is not
+// published again by a later comparison
+const closedSessionRetention = time.Minute
+
+type watchedSession struct {
+	requeues int
+	order    int
+	agentId  string
+	poolId   string
+	closedAt time.Time
+}
+
+// The last state published of each session and agent. Only the goroutine
+// watching storage publishes them.
+type watchState struct {
+	sessions map[string]watchedSession
+	// The fields published of the agents
+	agents map[string]restapi.Agent
+	// Whether the sessions and agents were recorded, changes are only
+	// published from then on
+	recorded bool
+}
+
+func newWatchState() *watchState {
+	return &watchState{
+		sessions: map[string]watchedSession{},
+		agents:   map[string]restapi.Agent{},
+	}
+}
+
+// Records the state of the session unless it is not after the state already
+// published. Returns the agent of the session, which is kept from the state
+// published when not given until the session is requeued.
+func (state *watchState) advance(session restapi.Session, agentId string) (string, bool) {
+	order, found := sessionStateOrder[session.State]
+	if !found {
+		return "", false
+	}
+
+	previous, found := state.sessions[session.Id]
+	if found && (session.Requeues < previous.requeues || session.Requeues == previous.requeues && order <= previous.order) {
+		return "", false
+	}
+
+	if agentId == "" && session.Requeues == previous.requeues {
+		agentId = previous.agentId
+	}
+
+	record := watchedSession{
+		requeues: session.Requeues,
+		order:    order,
+		agentId:  agentId,
+		poolId:   session.PoolId,
+	}
+	if session.State == restapi.SessionClosed {
+		record.closedAt = time.Now()
+	}
+
+	state.sessions[session.Id] = record
+	return agentId, true
+}
+
+// The fields of an agent whose changes are published. GPU metrics change with
+// every update and sessions have their own events.
+func watchedAgentFields(agent restapi.Agent) restapi.Agent {
+	gpus := make([]restapi.Gpu, len(agent.Gpus))
+	for index, gpu := range agent.Gpus {
+		gpu.Metrics = restapi.GpuMetrics{}
+		gpus[index] = gpu
+	}
+
+	agent.Gpus = gpus
+	agent.Sessions = nil
+	return agent
+}
+
+func (frontend *Frontend) publishSession(session restapi.Session, agentId string) {
+	agentId, advanced := frontend.watched.advance(session, agentId)
+	if !advanced {
+		return
+	}
+
+	frontend.events.publish(restapi.Event{
+		Type:      restapi.EventSessionState,
+		SessionId: session.Id,
+		AgentId:   agentId,
+		PoolId:    session.PoolId,
+		Session:   &session,
+	}, true)
+}
+
+// Publishes the session as closed when it was removed from storage, such as
+// along with its agent
+func (frontend *Frontend) publishSessionRemoved(id string) {
+	record, found := frontend.watched.sessions[id]
+	if !found || !record.closedAt.IsZero() {
+		return
+	}
+
+	frontend.publishSession(restapi.Session{
+		Id:       id,
+		State:    restapi.SessionClosed,
+		PoolId:   record.poolId,
+		Requeues: record.requeues,
+	}, "")
+}
+
+func (frontend *Frontend) publishAgent(agent restapi.Agent) {
+	if agent.State == restapi.AgentClosed {
+		frontend.publishAgentRemoved(agent.Id)
+		return
+	}
+
+	fields := watchedAgentFields(agent)
+	previous, found := frontend.watched.agents[agent.Id]
+
+	eventType := restapi.EventAgentUpdated
+	if !found {
+		eventType = restapi.EventAgentRegistered
+	} else if agent.State == restapi.AgentMissing && previous.State != restapi.AgentMissing {
+		eventType = restapi.EventAgentMissing
+	} else if reflect.DeepEqual(previous, fields) {
+		return
+	}
+
+	frontend.watched.agents[agent.Id] = fields
+	frontend.events.publish(restapi.Event{
+		Type:    eventType,
+		AgentId: agent.Id,
+		PoolId:  agent.PoolId,
+		Agent:   &agent,
+	}, true)
+}
+
+// Publishes the agent as closed when it was closed or removed from storage
+func (frontend *Frontend) publishAgentRemoved(id string) {
+	agent, found := frontend.watched.agents[id]
+	if !found {
+		return
+	}
+
+	delete(frontend.watched.agents, id)
+
+	agent.State = restapi.AgentClosed
+	frontend.events.publish(restapi.Event{
+		Type:    restapi.EventAgentUpdated,
+		AgentId: agent.Id,
+		PoolId:  agent.PoolId,
+		Agent:   &agent,
+	}, true)
+}
+
+// Publishes the state of the session retrieved from storage. The agent is
+// the agent of the session when the change is known to have assigned it.
+func (frontend *Frontend) refreshSession(id string, agentId string) error {
+	session, err := frontend.storage.GetSessionById(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		frontend.publishSessionRemoved(id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	frontend.publishSession(session, agentId)
+	return nil
+}
+
+func (frontend *Frontend) refreshAgent(id string) error {
+	agent, err := frontend.storage.GetAgentById(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		frontend.publishAgentRemoved(id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	frontend.publishAgent(agent)
+	return nil
+}
+
+// Publishes the events of the sessions and agents changed, retrieving only
+// those from storage unless the changes are unknown
+func (frontend *Frontend) publishChanges(changes []storage.Change) error {
+	sessionIds := []string{}
+	sessionAgents := map[string]string{}
+	agentIds := []string{}
+	agents := map[string]struct{}{}
+
+	for _, change := range changes {
+		if change.SessionId != "" {
+			agentId, found := sessionAgents[change.SessionId]
+			if !found {
+				sessionIds = append(sessionIds, change.SessionId)
+			}
+			if !found || change.AgentId != "" {
+				agentId = change.AgentId
+			}
+			sessionAgents[change.SessionId] = agentId
+		} else if change.AgentId != "" {
+			if _, found := agents[change.AgentId]; !found {
+				agentIds = append(agentIds, change.AgentId)
+				agents[change.AgentId] = struct{}{}
+			}
+		} else {
+			return frontend.compareStorage()
+		}
+	}
+
+	var err error
+	for _, id := range sessionIds {
+		err = errors.Join(err, frontend.refreshSession(id, sessionAgents[id]))
+	}
+
+	for _, id := range agentIds {
+		err = errors.Join(err, frontend.refreshAgent(id))
+	}
+
+	return err
+}
+
+// Compares every session and agent of storage with those published, for
+// changes that were not notified. The first comparison records them without
+// publishing every session and agent as new.
+func (frontend *Frontend) compareStorage() error {
+	sessions, err := frontend.storage.GetSessions(storage.SessionQuery{
+		SessionFilter: restapi.SessionFilter{States: watchedSessionStates},
+	})
+	if err != nil {
+		return err
+	}
+
+	current := map[string]struct{}{}
+	for sessions.Next() {
+		session := sessions.Value()
+		current[session.Id] = struct{}{}
+
+		if frontend.watched.recorded {
+			frontend.publishSession(session.Session, session.AgentId)
+		} else {
+			frontend.watched.advance(session.Session, session.AgentId)
+		}
+	}
+
+	agents, err := frontend.storage.GetAgents(storage.AgentQuery{States: watchedAgentStates})
+	if err != nil {
+		return err
+	}
+
+	currentAgents := map[string]struct{}{}
+	for agents.Next() {
+		agent := agents.Value()
+		currentAgents[agent.Id] = struct{}{}
+
+		if frontend.watched.recorded {
+			frontend.publishAgent(agent)
+		} else {
+			frontend.watched.agents[agent.Id] = watchedAgentFields(agent)
+		}
+	}
+
+	recorded := frontend.watched.recorded
+	frontend.watched.recorded = true
+	if !recorded {
+		return nil
+	}
+
+	// Closed sessions and agents are no longer among those compared
+	for id, record := range frontend.watched.sessions {
+		if !record.closedAt.IsZero() {
+			if time.Since(record.closedAt) > closedSessionRetention {
+				delete(frontend.watched.sessions, id)
+			}
+		} else if _, found := current[id]; !found {
+			err = errors.Join(err, frontend.refreshSession(id, ""))
+		}
+	}
+
+	for id := range frontend.watched.agents {
+		if _, found := currentAgents[id]; !found {
+			err = errors.Join(err, frontend.refreshAgent(id))
+		}
+	}
+
+	return err
+}
+
+// Publishes the events of the sessions and agents storage notifies as
+// changed, including the changes made outside of the frontend such as
+// sessions assigned by the backend, for watchers. Every session and agent is
+// compared periodically in case a change was not notified.
+func (frontend *Frontend) watchStorage(group task.Group) error {
+	watcher, unwatch := frontend.storage.WatchChanges()
+	defer unwatch()
+
+	ticker := time.NewTicker(*watchResyncInterval)
+	defer ticker.Stop()
+
+	err := frontend.compareStorage()
+	if err != nil {
+		logger.Error(err)
+	}
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-watcher.Signal():
+			err = frontend.publishChanges(watcher.Changes())
+
+		case <-ticker.C:
+			err = frontend.compareStorage()
+		}
+
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// Publishes the connections created and closed within the update of an
+// agent. The connections are only known to the frontend receiving the update,
+// unlike the session states every frontend publishes from storage.
+func (frontend *Frontend) publishConnections(update restapi.AgentUpdate) {
+	for sessionId, sessionUpdate := range update.SessionsUpdate {
+		if len(sessionUpdate.Connections) == 0 {
+			continue
+		}
+
+		// The pool is only used to filter the events, so an unknown session is published without one
+		var poolId string
+		session, err := frontend.storage.GetSessionById(sessionId)
+		if err == nil {
+			poolId = session.PoolId
+		}
+
+		for _, connection := range sessionUpdate.Connections {
+			eventType := restapi.EventConnectionCreated
+			if connection.Closed {
+				eventType = restapi.EventConnectionClosed
+			}
+
+			connection := connection
+			frontend.events.publish(restapi.Event{
+				Type:       eventType,
+				SessionId:  sessionId,
+				AgentId:    update.Id,
+				PoolId:     poolId,
+				Connection: &connection,
+			}, false)
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event restapi.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
+
+// Streams the events matching the filter of the request as server-sent events,
+// after the Last-Event-ID header or last_event_id query when resuming
+func (frontend *Frontend) watchEp(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	filter := restapi.WatchFilter{
+		SessionId: values.Get("session_id"),
+		AgentId:   values.Get("agent_id"),
+		PoolId:    values.Get("pool_id"),
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = values.Get("last_event_id")
+	}
+
+	// Subscribed first so events published while the stream starts are not missed
+	published, unsubscribe := frontend.events.notifier.Subscribe()
+	defer unsubscribe()
+
+	after := frontend.events.last()
+	if lastEventId != "" {
+		var err error
+		after, err = strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("/v1/watch: invalid last event id '%s'", lastEventId)
+			err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+			logger.Error(err)
+			return
+		}
+	}
+
+	controller := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		events, lastId, resumed := frontend.events.after(after)
+		if !resumed {
+			events = []loggedEvent{
+				{
+					Event: restapi.Event{
+						Id:   lastId,
+						Type: restapi.EventResync,
+						Time: time.Now(),
+					},
+				},
+			}
+		}
+		after = lastId
+
+		var err error
+		for _, event := range events {
+			if filter.Matches(event.Event) {
+				err = errors.Join(err, writeEvent(w, event.Event))
+			}
+		}
+
+		err = errors.Join(err, controller.Flush())
+		if err != nil {
+			logger.Debug(err)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-published:
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				logger.Debug(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,320 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/cmd/controller/storage/memdb"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+func newWatchFrontend(t *testing.T) *Frontend {
+	logger.Configure()
+
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Frontend{
+		events:  newEventLog(*watchHistory),
+		watched: newWatchState(),
+		storage: db,
+	}
+}
+
+func testSessionRequirements() restapi.SessionRequirements {
+	return restapi.SessionRequirements{
+		Version: "Test",
+		Gpus: []restapi.GpuRequirements{
+			{
+				VramRequired: 4 * 1024 * 1024 * 1024,
+			},
+		},
+		MatchLabels: map[string]string{},
+		Tolerates:   map[string]string{},
+	}
+}
+
+// Describes the events published after the id, by type, session state and
+// whether an agent is set
+func publishedAfter(frontend *Frontend, id uint64) ([]string, uint64) {
+	events, lastId, _ := frontend.events.after(id)
+
+	published := []string{}
+	for _, event := range events {
+		description := event.Type
+		if event.Session != nil {
+			description = fmt.Sprint(description, " ", event.Session.State)
+		}
+		if event.Agent != nil {
+			description = fmt.Sprint(description, " ", event.Agent.State)
+		}
+		if event.AgentId != "" {
+			description = fmt.Sprint(description, " on agent")
+		}
+		published = append(published, description)
+	}
+
+	return published, lastId
+}
+
+func TestEventLog(t *testing.T) {
+	log := newEventLog(3)
+	first := log.last()
+
+	for index := 0; index < 5; index++ {
+		log.publish(restapi.Event{Type: restapi.EventSessionState}, true)
+	}
+
+	events, lastId, resumed := log.after(first + 3)
+	if !resumed || len(events) != 2 || events[0].Id != first+4 || lastId != first+5 {
+		t.Errorf("expected to resume with 2 events, got %v, %d and %v", events, lastId, resumed)
+	}
+
+	events, _, resumed = log.after(lastId)
+	if !resumed || len(events) != 0 {
+		t.Errorf("expected to resume without events, got %v and %v", events, resumed)
+	}
+
+	// The events after the id are no longer kept
+	_, lastId, resumed = log.after(first + 1)
+	if resumed || lastId != first+5 {
+		t.Errorf("expected not to resume from an event no longer kept, got %d and %v", lastId, resumed)
+	}
+
+	// The id was not issued by this log, such as before a restart
+	_, _, resumed = log.after(first + 6)
+	if resumed {
+		t.Error("expected not to resume from an event not issued")
+	}
+}
+
+func TestPublishChanges(t *testing.T) {
+	frontend := newWatchFrontend(t)
+
+	watcher, unwatch := frontend.storage.WatchChanges()
+	defer unwatch()
+
+	err := frontend.compareStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastId := frontend.events.last()
+	expect := func(expected ...string) {
+		t.Helper()
+
+		select {
+		case <-watcher.Signal():
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the changes")
+		}
+
+		err := frontend.publishChanges(watcher.Changes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var published []string
+		published, lastId = publishedAfter(frontend, lastId)
+		if strings.Join(published, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("expected %v, got %v", expected, published)
+		}
+	}
+
+	agent := testAgent()
+	agent.Id, err = frontend.storage.RegisterAgent(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("agent.registered active on agent")
+
+	sessionId, err := frontend.storage.RequestSession(testSessionRequirements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("session.state queued")
+
+	err = frontend.storage.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{{Index: 0, VramRequired: 4 * 1024 * 1024 * 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("session.state assigned on agent")
+
+	err = frontend.storage.UpdateAgent(restapi.AgentUpdate{
+		Id:    agent.Id,
+		State: restapi.AgentActive,
+		SessionsUpdate: map[string]restapi.SessionUpdate{
+			sessionId: {State: restapi.SessionActive},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("session.state active on agent")
+
+	err = frontend.storage.SetAgentTaints(agent.Id, map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("agent.updated active on agent")
+
+	err = frontend.storage.CancelSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("session.state canceling on agent")
+
+	// A session is not published again unless its state moved forward
+	err = frontend.publishChanges([]storage.Change{storage.SessionChanged(sessionId), storage.AgentChanged(agent.Id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published, _ := publishedAfter(frontend, lastId)
+	if len(published) != 0 {
+		t.Errorf("expected no events, got %v", published)
+	}
+}
+
+func TestCompareStorage(t *testing.T) {
+	frontend := newWatchFrontend(t)
+
+	agent := testAgent()
+	var err error
+	agent.Id, err = frontend.storage.RegisterAgent(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastId := frontend.events.last()
+	compare := func(expected ...string) {
+		t.Helper()
+
+		// The changes are compared without their notifications, as if they were missed
+		err := frontend.compareStorage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var published []string
+		published, lastId = publishedAfter(frontend, lastId)
+		if strings.Join(published, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("expected %v, got %v", expected, published)
+		}
+	}
+
+	// The sessions and agents already in storage are recorded without being published
+	compare()
+
+	sessionId, err := frontend.storage.RequestSession(testSessionRequirements())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = frontend.storage.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{{Index: 0, VramRequired: 4 * 1024 * 1024 * 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare("session.state assigned on agent")
+
+	err = frontend.storage.SetAgentDisabled(agent.Id, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare("agent.updated disabled on agent")
+
+	compare()
+
+	// The session closes along with its agent
+	err = frontend.storage.UpdateAgent(restapi.AgentUpdate{
+		Id:    agent.Id,
+		State: restapi.AgentClosed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare("session.state closed on agent", "agent.updated closed on agent")
+}
+
+func TestWatchResume(t *testing.T) {
+	frontend := newWatchFrontend(t)
+
+	server := httptest.NewServer(http.HandlerFunc(frontend.watchEp))
+	defer server.Close()
+
+	api := restapi.Client{
+		Client:  server.Client(),
+		Address: server.Listener.Addr().String(),
+	}
+
+	first := frontend.events.last()
+	for _, poolId := range []string{"a", "b", "a"} {
+		frontend.events.publish(restapi.Event{
+			Type:      restapi.EventSessionState,
+			SessionId: poolId,
+			PoolId:    poolId,
+		}, true)
+	}
+
+	// Reads the events of the stream until the expected count
+	watch := func(filter restapi.WatchFilter, lastEventId uint64, count int) []restapi.Event {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		events := []restapi.Event{}
+		_, err := api.WatchWithContext(ctx, filter, lastEventId, func(event restapi.Event) error {
+			events = append(events, event)
+			if len(events) == count {
+				cancel()
+			}
+			return nil
+		})
+		if len(events) != count {
+			t.Fatalf("expected %d events, got %v and %v", count, events, err)
+		}
+
+		return events
+	}
+
+	events := watch(restapi.WatchFilter{PoolId: "a"}, first, 2)
+	if events[0].Id != first+1 || events[1].Id != first+3 {
+		t.Errorf("expected the events of pool a after %d, got %v", first, events)
+	}
+
+	events = watch(restapi.WatchFilter{}, first+1, 2)
+	if events[0].Id != first+2 || events[1].Id != first+3 {
+		t.Errorf("expected the events after %d, got %v", first+1, events)
+	}
+
+	// Events published while watching are streamed
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		frontend.events.publish(restapi.Event{Type: restapi.EventAgentRegistered}, true)
+	}()
+
+	events = watch(restapi.WatchFilter{}, first+3, 1)
+	if events[0].Id != first+4 || events[0].Type != restapi.EventAgentRegistered {
+		t.Errorf("expected the event published while watching, got %v", events)
+	}
+
+	// Watchers resuming from an event not issued are told to resync
+	events = watch(restapi.WatchFilter{SessionId: "a"}, first+10, 1)
+	if events[0].Type != restapi.EventResync || events[0].Id != first+4 {
+		t.Errorf("expected to resync, got %v", events)
+	}
+}
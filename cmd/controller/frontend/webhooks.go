@@ -0,0 +1,455 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+	"github.com/Xdevlab/Run/pkg/task"
+)
+
+var (
+	webhookMaxAttempts  = flag.Int("webhook-max-attempts", 10, "How many times a webhook delivery is attempted before it fails")
+	webhookRetryBackoff = flag.Duration("webhook-retry-backoff", 10*time.Second, "The delay before the first retry of a webhook delivery, doubling with every retry")
+	webhookMaxBackoff   = flag.Duration("webhook-max-backoff", time.Hour, "The longest delay between the retries of a webhook delivery")
+	webhookTimeout      = flag.Duration("webhook-timeout", 10*time.Second, "How long a webhook has to respond to a delivery")
+	webhookRetention    = flag.Duration("webhook-delivery-retention", 7*24*time.Hour, "How long the succeeded and failed webhook deliveries are kept in the delivery log")
+	webhookLease        = flag.Duration("webhook-lease", 15*time.Second, "How long a frontend remains the one sending webhook deliveries without renewing its lease, other frontends take over once it expires")
+)
+
+const (
+	// The name of the lease held by the frontend sending webhook deliveries
+	webhookLeaseName = "webhooks"
+
+	// How often due retries are looked for
+	webhookPollInterval  = time.Second
+	webhookBatchSize     = 32
+	webhookPruneInterval = time.Hour
+)
+
+// Sends the pending webhook deliveries. Only the frontend holding the lease
+// sends them and persists the deliveries of the events every frontend derives
+// from storage, each frontend persists those of the events only it knows.
+type webhookSender struct {
+	id      string
+	storage storage.Storage
+	client  *http.Client
+
+	// Signaled when deliveries are persisted
+	queued storage.Notifier
+
+	// Read by the queueing of deliveries
+	leader       atomic.Bool
+	leaseRenewed time.Time
+	lastPruned   time.Time
+}
+
+func newWebhookSender(storage storage.Storage) *webhookSender {
+	return &webhookSender{
+		id:      uuid.NewString(),
+		storage: storage,
+		client: &http.Client{
+			Timeout: *webhookTimeout,
+		},
+	}
+}
+
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+func (frontend *Frontend) createWebhookSubscription(subscription restapi.WebhookSubscription) (restapi.WebhookSubscription, error) {
+	if subscription.Secret == "" {
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			return restapi.WebhookSubscription{}, err
+		}
+
+		subscription.Secret = secret
+	}
+
+	return frontend.storage.CreateWebhookSubscription(subscription)
+}
+
+// The secret of a subscription is only returned when it is created
+func (frontend *Frontend) getWebhookSubscription(id string) (restapi.WebhookSubscription, error) {
+	subscription, err := frontend.storage.GetWebhookSubscription(id)
+	subscription.Secret = ""
+	return subscription, err
+}
+
+// Retrieves the subscriptions of the pool without their secrets, of every
+// pool when the pool is empty
+func (frontend *Frontend) getWebhookSubscriptions(poolId string) ([]restapi.WebhookSubscription, error) {
+	iterator, err := frontend.storage.GetWebhookSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]restapi.WebhookSubscription, 0)
+	for iterator.Next() {
+		subscription := iterator.Value()
+		if poolId != "" && subscription.PoolId != poolId {
+			continue
+		}
+
+		subscription.Secret = ""
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, nil
+}
+
+func (frontend *Frontend) deleteWebhookSubscription(id string) error {
+	return frontend.storage.DeleteWebhookSubscription(id)
+}
+
+func (frontend *Frontend) getWebhookDeliveries(subscriptionId string, limit int) ([]restapi.WebhookDelivery, error) {
+	_, err := frontend.storage.GetWebhookSubscription(subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := frontend.storage.GetWebhookDeliveries(subscriptionId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]restapi.WebhookDelivery, 0)
+	for iterator.Next() {
+		deliveries = append(deliveries, iterator.Value())
+	}
+
+	return deliveries, nil
+}
+
+// Subscribes the URL of --webhook-url to the session states in the legacy
+// format it was posted before subscriptions, unless a subscription already
+// delivers to it
+func (frontend *Frontend) subscribeWebhookUrl(url string) error {
+	iterator, err := frontend.storage.GetWebhookSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for iterator.Next() {
+		if iterator.Value().Url == url {
+			return nil
+		}
+	}
+
+	subscription, err := frontend.createWebhookSubscription(restapi.WebhookSubscription{
+		Url:        url,
+		EventTypes: []string{restapi.EventSessionState},
+		Format:     restapi.WebhookFormatLegacy,
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("webhook subscription %s delivers the session states to %s", subscription.Id, url)
+	return nil
+}
+
+// Persists a delivery of every event published to each subscription matching
+// it, so the deliveries are not lost when the frontend restarts. The events
+// derived from storage are only persisted by the frontend holding the lease,
+// since every frontend publishes them.
+func (frontend *Frontend) queueWebhookDeliveries(group task.Group) error {
+	published, unsubscribe := frontend.events.notifier.Subscribe()
+	defer unsubscribe()
+
+	after := frontend.events.last()
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-published:
+		}
+
+		events, lastId, resumed := frontend.events.after(after)
+		if !resumed {
+			logger.Warningf("webhook deliveries of the events up to %d were missed, the events are no longer kept", lastId)
+		}
+
+		err := frontend.queueWebhookEvents(events)
+		if err != nil {
+			// The events are queued once storage is available again
+			logger.Error(err)
+			continue
+		}
+		after = lastId
+	}
+}
+
+func (frontend *Frontend) queueWebhookEvents(events []loggedEvent) error {
+	// The frontend holding the lease is the one persisting derived events
+	leader := frontend.webhooks.leader.Load()
+
+	subscriptions, err := frontend.storage.GetWebhookSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	queued := false
+	for subscriptions.Next() {
+		subscription := subscriptions.Value()
+		for _, event := range events {
+			if event.derived && !leader || !subscription.Matches(event.Event) {
+				continue
+			}
+
+			_, err = frontend.storage.CreateWebhookDelivery(restapi.WebhookDelivery{
+				SubscriptionId: subscription.Id,
+				Event:          event.Event,
+			})
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				logger.Error(err)
+			}
+			queued = queued || err == nil
+		}
+	}
+
+	if queued {
+		frontend.webhooks.queued.Notify()
+	}
+
+	return nil
+}
+
+func (sender *webhookSender) Run(group task.Group) error {
+	defer sender.resign()
+
+	queued, unsubscribe := sender.queued.Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-queued:
+		case <-ticker.C:
+		}
+
+		err := sender.update(group.Ctx())
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// Only the frontend holding the lease sends deliveries, the others stand by
+// until it stops renewing it
+func (sender *webhookSender) lead() error {
+	if time.Since(sender.leaseRenewed) < *webhookLease/3 {
+		return nil
+	}
+
+	leader, err := sender.storage.AcquireLease(webhookLeaseName, sender.id, *webhookLease)
+	if err != nil {
+		return err
+	}
+
+	if sender.leader.Swap(leader) != leader {
+		if leader {
+			logger.Infof("frontend %s is sending the webhook deliveries", sender.id)
+		}
+	}
+
+	sender.leaseRenewed = time.Now()
+	return nil
+}
+
+func (sender *webhookSender) resign() {
+	if sender.leader.Swap(false) {
+		err := sender.storage.ReleaseLease(webhookLeaseName, sender.id)
+		if err != nil {
+			logger.Warningf("unable to release the webhook lease, %v", err)
+		}
+	}
+}
+
+func (sender *webhookSender) update(ctx context.Context) error {
+	err := sender.lead()
+	if err != nil || !sender.leader.Load() {
+		return err
+	}
+
+	if time.Since(sender.lastPruned) > webhookPruneInterval {
+		err = sender.storage.DeleteWebhookDeliveriesBefore(time.Now().Add(-*webhookRetention))
+		if err != nil {
+			return err
+		}
+
+		sender.lastPruned = time.Now()
+	}
+
+	for {
+		iterator, err := sender.storage.GetDueWebhookDeliveries(time.Now(), webhookBatchSize)
+		if err != nil {
+			return err
+		}
+
+		deliveries := []restapi.WebhookDelivery{}
+		for iterator.Next() {
+			deliveries = append(deliveries, iterator.Value())
+		}
+
+		if len(deliveries) == 0 {
+			return nil
+		}
+
+		subscriptions := map[string]restapi.WebhookSubscription{}
+		subscriptionIterator, err := sender.storage.GetWebhookSubscriptions()
+		if err != nil {
+			return err
+		}
+
+		for subscriptionIterator.Next() {
+			subscription := subscriptionIterator.Value()
+			subscriptions[subscription.Id] = subscription
+		}
+
+		var waitGroup sync.WaitGroup
+		for _, delivery := range deliveries {
+			// The deliveries of deleted subscriptions are deleted along with them
+			subscription, found := subscriptions[delivery.SubscriptionId]
+			if !found {
+				continue
+			}
+
+			waitGroup.Add(1)
+			go func(delivery restapi.WebhookDelivery) {
+				defer waitGroup.Done()
+
+				err := sender.storage.UpdateWebhookDelivery(sender.attempt(ctx, subscription, delivery))
+				if err != nil && !errors.Is(err, storage.ErrNotFound) {
+					logger.Error(err)
+				}
+			}(delivery)
+		}
+		waitGroup.Wait()
+
+		if len(deliveries) < webhookBatchSize || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// The delay before the retry following the attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := *webhookRetryBackoff
+	for attempt := 1; attempt < attempts && backoff < *webhookMaxBackoff; attempt++ {
+		backoff *= 2
+	}
+
+	if backoff > *webhookMaxBackoff {
+		backoff = *webhookMaxBackoff
+	}
+
+	return backoff
+}
+
+// Attempts the delivery, returning it with the outcome of the attempt
+func (sender *webhookSender) attempt(ctx context.Context, subscription restapi.WebhookSubscription, delivery restapi.WebhookDelivery) restapi.WebhookDelivery {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+
+	statusCode, err := sender.post(ctx, subscription, delivery)
+	delivery.StatusCode = statusCode
+	delivery.Error = ""
+
+	if err == nil {
+		delivery.State = restapi.WebhookDeliverySucceeded
+		return delivery
+	}
+
+	delivery.Error = err.Error()
+	if delivery.Attempts >= *webhookMaxAttempts {
+		delivery.State = restapi.WebhookDeliveryFailed
+		logger.Warningf("webhook delivery %s to %s failed after %d attempts, %v", delivery.Id, subscription.Url, delivery.Attempts, err)
+	} else {
+		delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+	}
+
+	return delivery
+}
+
+// The payload of the delivery in the format of the subscription
+func webhookPayload(subscription restapi.WebhookSubscription, delivery restapi.WebhookDelivery) ([]byte, error) {
+	if subscription.Format == restapi.WebhookFormatLegacy {
+		return json.Marshal(restapi.WebhookMessageFromEvent(delivery.Event))
+	}
+
+	return json.Marshal(delivery.Event)
+}
+
+// Posts the payload of the delivery signed with the secret of the
+// subscription, returning the status code of the response
+func (sender *webhookSender) post(ctx context.Context, subscription restapi.WebhookSubscription, delivery restapi.WebhookDelivery) (int, error) {
+	body, err := webhookPayload(subscription, delivery)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(restapi.WebhookDeliveryHeader, delivery.Id)
+	request.Header.Set(restapi.WebhookEventHeader, delivery.Event.Type)
+	request.Header.Set(restapi.WebhookTimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	request.Header.Set(restapi.WebhookSignatureHeader, restapi.SignWebhook(subscription.Secret, timestamp, body))
+
+	response, err := sender.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// The body is drained so the connection is reused
+	_, err = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		logger.Debug(err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook responded with %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
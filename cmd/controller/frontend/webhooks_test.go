@@ -0,0 +1,201 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Xdevlab/Run/cmd/controller/storage"
+	"github.com/Xdevlab/Run/cmd/controller/storage/memdb"
+	"github.com/Xdevlab/Run/pkg/logger"
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// Frontends sharing storage, as replicas of the controller
+func newWebhookFrontends(t *testing.T, count int) []*Frontend {
+	logger.Configure()
+
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	frontends := make([]*Frontend, count)
+	for index := range frontends {
+		frontends[index] = &Frontend{
+			events:   newEventLog(*watchHistory),
+			watched:  newWatchState(),
+			webhooks: newWebhookSender(db),
+			storage:  db,
+		}
+	}
+
+	return frontends
+}
+
+func queuedEventTypes(t *testing.T, db storage.Storage, subscriptionId string) []string {
+	iterator, err := db.GetWebhookDeliveries(subscriptionId, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventTypes := []string{}
+	for iterator.Next() {
+		eventTypes = append(eventTypes, iterator.Value().Event.Type)
+	}
+
+	return eventTypes
+}
+
+func TestQueueWebhookEventsOnce(t *testing.T) {
+	frontends := newWebhookFrontends(t, 3)
+	db := frontends[0].storage
+
+	subscription, err := frontends[0].createWebhookSubscription(restapi.WebhookSubscription{
+		Url: "https://example.com/everything",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frontend := range frontends {
+		err = frontend.webhooks.lead()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every frontend derives the session state from storage, only the
+	// connection is known to a single frontend
+	for index, frontend := range frontends {
+		events := []loggedEvent{
+			{
+				Event: restapi.Event{
+					Id:        1,
+					Type:      restapi.EventSessionState,
+					SessionId: "session",
+				},
+				derived: true,
+			},
+		}
+
+		if index == 1 {
+			events = append(events, loggedEvent{
+				Event: restapi.Event{
+					Id:        2,
+					Type:      restapi.EventConnectionCreated,
+					SessionId: "session",
+				},
+			})
+		}
+
+		err = frontend.queueWebhookEvents(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventTypes := queuedEventTypes(t, db, subscription.Id)
+	if len(eventTypes) != 2 {
+		t.Errorf("expected the session state and the connection to be queued once, got %v", eventTypes)
+	}
+
+	// The derived events are queued by another frontend once it holds the lease
+	frontends[0].webhooks.resign()
+	frontends[2].webhooks.leaseRenewed = time.Time{}
+	err = frontends[2].webhooks.lead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = frontends[2].queueWebhookEvents([]loggedEvent{
+		{
+			Event: restapi.Event{
+				Id:   3,
+				Type: restapi.EventAgentRegistered,
+			},
+			derived: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventTypes = queuedEventTypes(t, db, subscription.Id)
+	if len(eventTypes) != 3 {
+		t.Errorf("expected the agent to be queued by the new leader, got %v", eventTypes)
+	}
+}
+
+func TestPostLegacyWebhook(t *testing.T) {
+	logger.Configure()
+
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	sender := newWebhookSender(nil)
+
+	delivery := restapi.WebhookDelivery{
+		Id: "delivery",
+		Event: restapi.Event{
+			Type:      restapi.EventSessionState,
+			SessionId: "session",
+			AgentId:   "agent",
+			Session: &restapi.Session{
+				Id:    "session",
+				State: restapi.SessionActive,
+			},
+		},
+	}
+
+	// Subscriptions of --webhook-url are posted the message they were before subscriptions
+	_, err := sender.post(context.Background(), restapi.WebhookSubscription{
+		Url:    server.URL,
+		Format: restapi.WebhookFormatLegacy,
+		Secret: "secret",
+	}, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message restapi.WebhookMessage
+	err = json.Unmarshal(<-bodies, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := restapi.WebhookMessage{Agent: "agent", Session: "session", State: restapi.SessionActive}
+	if message != expected {
+		t.Errorf("expected %v, got %v", expected, message)
+	}
+
+	_, err = sender.post(context.Background(), restapi.WebhookSubscription{
+		Url:    server.URL,
+		Secret: "secret",
+	}, delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event restapi.Event
+	err = json.Unmarshal(<-bodies, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Type != restapi.EventSessionState || event.Session == nil || event.Session.State != restapi.SessionActive {
+		t.Errorf("expected the event, got %v", event)
+	}
+}
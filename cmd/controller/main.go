@@ -162,7 +162,11 @@ func main() {
 				if *enableBackend {
 					logger.Infof("Starting backend on %s", *address)
 
-					group.Go("Backend", backend.NewBackend(storage))
+					backend, err_ := backend.NewBackend(storage)
+					err = err_
+					if err == nil {
+						group.Go("Backend", backend)
+					}
 				}
 			}
 
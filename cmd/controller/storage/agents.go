@@ -0,0 +1,101 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"strings"
+
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// The position of an agent within a listing, agents are listed by id
+type AgentCursor struct {
+	Id string `json:"id"`
+}
+
+func CursorOfAgent(agent restapi.Agent) AgentCursor {
+	return AgentCursor{
+		Id: agent.Id,
+	}
+}
+
+func (cursor AgentCursor) String() string {
+	return encodeCursor(cursor)
+}
+
+func ParseAgentCursor(value string) (AgentCursor, error) {
+	var cursor AgentCursor
+	err := decodeCursor(value, &cursor)
+	if err != nil || cursor.Id == "" {
+		return AgentCursor{}, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+type AgentQuery struct {
+	PoolId string
+	// The active and disabled agents when empty
+	States           []string
+	MatchLabels      map[string]string
+	MatchExpressions []restapi.LabelSelectorRequirement
+	HostnamePrefix   string
+	// Agents with at least one GPU of the name
+	GpuName              string
+	VramAvailableAtLeast uint64
+
+	// Lists the agents with ids after the cursor, from the first when nil
+	After *AgentCursor
+	// Every agent when 0
+	Limit int
+}
+
+func (query AgentQuery) StatesOrDefault() []string {
+	if len(query.States) == 0 {
+		return []string{restapi.AgentActive, restapi.AgentDisabled}
+	}
+
+	return query.States
+}
+
+// The selector of the pool, labels and VRAM of the query
+func (query AgentQuery) Selector() AgentSelector {
+	return AgentSelector{
+		TotalAvailableVramAtLeast: query.VramAvailableAtLeast,
+		PoolId:                    query.PoolId,
+		MatchLabels:               query.MatchLabels,
+		MatchExpressions:          query.MatchExpressions,
+	}
+}
+
+// Whether the agent, with the VRAM available on it, matches the filters of the query, ignoring the cursor
+func (query AgentQuery) Matches(agent restapi.Agent, vramAvailable uint64) bool {
+	found := false
+	for _, state := range query.StatesOrDefault() {
+		found = found || state == agent.State
+	}
+	if !found {
+		return false
+	}
+
+	if query.PoolId != "" && query.PoolId != agent.PoolId {
+		return false
+	}
+
+	if !strings.HasPrefix(agent.Hostname, query.HostnamePrefix) || vramAvailable < query.VramAvailableAtLeast {
+		return false
+	}
+
+	if query.GpuName != "" {
+		found = false
+		for _, gpu := range agent.Gpus {
+			found = found || gpu.Name == query.GpuName
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return query.Selector().MatchesLabels(agent.Labels)
+}
@@ -6,14 +6,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Xdevlab/Run/cmd/controller/storage"
 	"github.com/Xdevlab/Run/cmd/controller/storage/gorm/models"
 	"github.com/Xdevlab/Run/pkg/logger"
 	"github.com/Xdevlab/Run/pkg/restapi"
+	"github.com/lib/pq"
 	uuid "github.com/satori/go.uuid"
 
+	"gorm.io/datatypes"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -22,7 +29,15 @@ import (
 )
 
 type gormDriver struct {
-	db *gorm.DB
+	ctx context.Context
+	db  *gorm.DB
+	// The connection of a postgres database, whose changes are notified to every
+	// process using it. Changes of other databases are only notified within the process.
+	connection string
+
+	changes    storage.Notifier
+	listenOnce sync.Once
+	listener   *pq.Listener
 }
 
 func mapError(err error) error {
@@ -42,7 +57,13 @@ func restAgentFromAgent(dbAgent models.Agent) (restapi.Agent, error) {
 		Labels:   make(map[string]string),
 		Taints:   make(map[string]string),
 		Sessions: []restapi.Session{},
-		PoolId:   dbAgent.PoolID.String(),
+
+		DrainDeadline: dbAgent.DrainDeadline,
+	}
+
+	// Agents without a pool have the nil UUID
+	if dbAgent.PoolID != uuid.Nil {
+		agent.PoolId = dbAgent.PoolID.String()
 	}
 
 	for _, taint := range dbAgent.Taints {
@@ -59,10 +80,24 @@ func restAgentFromAgent(dbAgent models.Agent) (restapi.Agent, error) {
 
 	for _, dbSession := range dbAgent.Sessions {
 		session := restapi.Session{
-			Id:      dbSession.UUID.String(),
-			State:   dbSession.State.String(),
-			Address: dbSession.Address,
-			Version: dbSession.Version,
+			Id:       dbSession.UUID.String(),
+			State:    dbSession.State.String(),
+			Address:  dbSession.Address,
+			Version:  dbSession.Version,
+			Priority: dbSession.Priority,
+			Reason:   dbSession.Reason,
+
+			Persistent: dbSession.Persistent,
+			UserId:     dbSession.UserID,
+
+			MaxDurationSeconds: dbSession.MaxDuration,
+			IdleTimeoutSeconds: dbSession.IdleTimeout,
+			AssignedAt:         dbSession.AssignedAt,
+			IdleSince:          dbSession.IdleSince,
+			Requeues:           dbSession.Requeues,
+		}
+		if dbSession.PoolID.Valid {
+			session.PoolId = dbSession.PoolID.UUID.String()
 		}
 
 		if err := json.Unmarshal(dbSession.GPUs, &session.Gpus); err != nil {
@@ -88,17 +123,31 @@ func restAgentFromAgent(dbAgent models.Agent) (restapi.Agent, error) {
 
 func restSessionFromSession(dbSession models.Session) (restapi.Session, error) {
 	session := restapi.Session{
-		Id:      dbSession.UUID.String(),
-		State:   dbSession.State.String(),
-		Address: dbSession.Address,
-		Version: dbSession.Version,
+		Id:       dbSession.UUID.String(),
+		State:    dbSession.State.String(),
+		Address:  dbSession.Address,
+		Version:  dbSession.Version,
+		Priority: dbSession.Priority,
+		Reason:   dbSession.Reason,
+
+		Persistent: dbSession.Persistent,
+		UserId:     dbSession.UserID,
+
+		MaxDurationSeconds: dbSession.MaxDuration,
+		IdleTimeoutSeconds: dbSession.IdleTimeout,
+		AssignedAt:         dbSession.AssignedAt,
+		IdleSince:          dbSession.IdleSince,
+		Requeues:           dbSession.Requeues,
 	}
 	if dbSession.PoolID.Valid {
 		session.PoolId = dbSession.PoolID.UUID.String()
 	}
 
-	if err := json.Unmarshal(dbSession.GPUs, &session.Gpus); err != nil {
-		return restapi.Session{}, nil
+	// Queued sessions have no GPUs
+	if dbSession.GPUs != nil {
+		if err := json.Unmarshal(dbSession.GPUs, &session.Gpus); err != nil {
+			return restapi.Session{}, err
+		}
 	}
 
 	for _, dbConnection := range dbSession.Connections {
@@ -118,11 +167,113 @@ func restPoolFromPool(dbPool models.Pool) restapi.Pool {
 	pool := restapi.Pool{
 		Id:   dbPool.ID.String(),
 		Name: dbPool.PoolName,
+		Quotas: restapi.PoolQuotas{
+			MaxSessions: dbPool.MaxSessions,
+			MaxVram:     dbPool.MaxVram,
+			MaxGpus:     dbPool.MaxGpus,
+		},
+		SessionLimits: restapi.PoolSessionLimits{
+			DefaultMaxDurationSeconds: dbPool.DefaultMaxDuration,
+			MaxDurationCapSeconds:     dbPool.MaxDurationCap,
+			DefaultIdleTimeoutSeconds: dbPool.DefaultIdleTimeout,
+			IdleTimeoutCapSeconds:     dbPool.IdleTimeoutCap,
+			LeaseSeconds:              dbPool.LeaseDuration,
+			MaxPriority:               dbPool.MaxPriority,
+		},
 	}
 
 	return pool
 }
 
+func nullUUIDFromString(id string) uuid.NullUUID {
+	if id == "" {
+		return uuid.NullUUID{}
+	}
+
+	return uuid.NullUUID{
+		UUID:  uuid.FromStringOrNil(id),
+		Valid: true,
+	}
+}
+
+func stringFromNullUUID(id uuid.NullUUID) string {
+	if !id.Valid {
+		return ""
+	}
+
+	return id.UUID.String()
+}
+
+func restReservationFromReservation(dbReservation models.Reservation) (restapi.Reservation, error) {
+	reservation := restapi.Reservation{
+		Id:      dbReservation.UUID.String(),
+		PoolId:  stringFromNullUUID(dbReservation.PoolID),
+		AgentId: stringFromNullUUID(dbReservation.AgentID),
+		Start:   dbReservation.StartsAt,
+		End:     dbReservation.EndsAt,
+	}
+
+	err := json.Unmarshal(dbReservation.Gpus, &reservation.Gpus)
+	if err != nil {
+		return restapi.Reservation{}, err
+	}
+
+	return reservation, nil
+}
+
+func restWebhookSubscriptionFromWebhookSubscription(dbSubscription models.WebhookSubscription) (restapi.WebhookSubscription, error) {
+	subscription := restapi.WebhookSubscription{
+		Id:        dbSubscription.UUID.String(),
+		Url:       dbSubscription.Url,
+		PoolId:    stringFromNullUUID(dbSubscription.PoolID),
+		Format:    dbSubscription.Format,
+		Secret:    dbSubscription.Secret,
+		CreatedAt: dbSubscription.CreatedAt,
+	}
+
+	err := json.Unmarshal(dbSubscription.EventTypes, &subscription.EventTypes)
+	if err != nil {
+		return restapi.WebhookSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+func restWebhookDeliveryFromWebhookDelivery(dbDelivery models.WebhookDelivery) (restapi.WebhookDelivery, error) {
+	delivery := restapi.WebhookDelivery{
+		Id:             dbDelivery.UUID.String(),
+		SubscriptionId: dbDelivery.SubscriptionID.String(),
+		State:          dbDelivery.State,
+		Attempts:       dbDelivery.Attempts,
+		CreatedAt:      dbDelivery.CreatedAt,
+		NextAttemptAt:  dbDelivery.NextAttemptAt,
+		LastAttemptAt:  dbDelivery.LastAttemptAt,
+		StatusCode:     dbDelivery.StatusCode,
+		Error:          dbDelivery.Error,
+	}
+
+	err := json.Unmarshal(dbDelivery.Event, &delivery.Event)
+	if err != nil {
+		return restapi.WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+func restWebhookDeliveriesFromWebhookDeliveries(dbDeliveries []models.WebhookDelivery) []restapi.WebhookDelivery {
+	deliveries := []restapi.WebhookDelivery{}
+	for _, dbDelivery := range dbDeliveries {
+		delivery, err := restWebhookDeliveryFromWebhookDelivery(dbDelivery)
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries
+}
+
 func dbPermissionTypeToRestPermissionType(dbPermissionType models.PermissionType) (restapi.Permission, error) {
 	switch dbPermissionType {
 	case models.CreateSession:
@@ -153,6 +304,7 @@ func OpenStorage(ctx context.Context, driver string, dsn string) (storage.Storag
 
 	var db *gorm.DB
 	var err error
+	connection := ""
 
 	config := &gorm.Config{
 		Logger: NewLogger(glogger.Config{
@@ -165,6 +317,7 @@ func OpenStorage(ctx context.Context, driver string, dsn string) (storage.Storag
 		db, err = gorm.Open(sqlite.Open(dsn), config)
 	case "postgres":
 		db, err = gorm.Open(postgres.Open(dsn), config)
+		connection = dsn
 	default:
 		err = fmt.Errorf("invalid GORM driver specified, %s", driver)
 	}
@@ -180,6 +333,11 @@ func OpenStorage(ctx context.Context, driver string, dsn string) (storage.Storag
 		&models.Agent{},
 		&models.Permission{},
 		&models.Pool{},
+		&models.Reservation{},
+		&models.Lease{},
+		&models.UsageRecord{},
+		&models.WebhookSubscription{},
+		&models.WebhookDelivery{},
 	)
 
 	if err != nil {
@@ -187,16 +345,228 @@ func OpenStorage(ctx context.Context, driver string, dsn string) (storage.Storag
 	}
 
 	return &gormDriver{
-		db: db,
+		ctx:        ctx,
+		db:         db,
+		connection: connection,
 	}, err
 }
 
 func (g *gormDriver) Close() error {
-	return nil
+	// Waits for a listener being started
+	g.listenOnce.Do(func() {})
+
+	var err error
+	if g.listener != nil {
+		err = g.listener.Close()
+	}
+
+	db, err_ := g.db.DB()
+	if err_ != nil {
+		return errors.Join(err, err_)
+	}
+
+	return errors.Join(err, db.Close())
+}
+
+func (g *gormDriver) SubscribeChanges() (<-chan struct{}, func()) {
+	if g.connection != "" {
+		g.listenOnce.Do(g.listen)
+	}
+
+	return g.changes.Subscribe()
+}
+
+func (g *gormDriver) WatchChanges() (*storage.ChangeWatcher, func()) {
+	if g.connection != "" {
+		g.listenOnce.Do(g.listen)
+	}
+
+	return g.changes.Watch()
+}
+
+func (g *gormDriver) listen() {
+	g.listener = pq.NewListener(g.connection, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Warningf("unable to listen for changes, %v", err)
+		}
+	})
+
+	err := g.listener.Listen(storage.ChangesChannel)
+	if err != nil {
+		logger.Warningf("unable to listen for changes, %v", err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-g.ctx.Done():
+				return
+
+			case notification, ok := <-g.listener.Notify:
+				if !ok {
+					return
+				}
+
+				// A nil notification follows a reconnection, changes may have been missed meanwhile
+				if notification == nil {
+					g.changes.Notify(storage.Change{})
+				} else {
+					g.changes.Notify(storage.DecodeChanges(notification.Extra)...)
+				}
+			}
+		}
+	}()
+}
+
+// Notifies the subscribers of the changes when they succeeded
+func (g *gormDriver) notifyChanges(err error, changes ...storage.Change) error {
+	if err == nil {
+		g.notify(changes...)
+	}
+
+	return err
+}
+
+func (g *gormDriver) notify(changes ...storage.Change) {
+	if g.connection == "" {
+		g.changes.Notify(changes...)
+		return
+	}
+
+	err := g.db.WithContext(g.ctx).Exec("SELECT pg_notify(?, ?)", storage.ChangesChannel, storage.EncodeChanges(changes)).Error
+	if err != nil {
+		logger.Warningf("unable to notify changes, %v", err)
+	}
+}
+
+// The GPUs of the agents as rows, with the expressions of the name and of the
+// numeric fields of a GPU at a path, in the dialect of the database
+func agentGpus(dialect string) (string, string, func(path ...string) string) {
+	if dialect == "sqlite" {
+		return "agents, json_each(agents.gpus) AS gpu", "json_extract(gpu.value, '$.name')", func(path ...string) string {
+			return "COALESCE(json_extract(gpu.value, '$." + strings.Join(path, ".") + "'), 0)"
+		}
+	}
+
+	return "agents CROSS JOIN LATERAL jsonb_array_elements(agents.gpus::jsonb) AS gpu(value)", "gpu.value->>'name'", func(path ...string) string {
+		return "COALESCE((gpu.value #>> '{" + strings.Join(path, ",") + "}')::bigint, 0)"
+	}
 }
 
 func (g *gormDriver) AggregateData() (storage.AggregatedData, error) {
-	panic("not implemented") // TODO: Implement
+	var agentCounts []struct {
+		State models.AgentState
+		Count int
+	}
+	result := g.db.Model(&models.Agent{}).Select("state, COUNT(*) AS count").Group("state").Scan(&agentCounts)
+	if result.Error != nil {
+		return storage.AggregatedData{}, mapError(result.Error)
+	}
+
+	var sessionCounts []struct {
+		State models.SessionState
+		Count int
+	}
+	result = g.db.Model(&models.Session{}).Select("state, COUNT(*) AS count").Group("state").Scan(&sessionCounts)
+	if result.Error != nil {
+		return storage.AggregatedData{}, mapError(result.Error)
+	}
+
+	data := storage.AggregatedData{
+		AgentsByStatus:           map[string]int{},
+		SessionsByStatus:         map[string]int{},
+		GpusByGpuName:            map[string]int{},
+		VramByGpuName:            map[string]uint64{},
+		VramUsedByGpuName:        map[string]uint64{},
+		VramGBAvailableByGpuName: map[string]storage.Percentile[int]{},
+		UtilizationByGpuName:     map[string]float64{},
+		PowerDrawByGpuName:       map[string]float64{},
+	}
+
+	for _, count := range agentCounts {
+		data.Agents += count.Count
+		data.AgentsByStatus[count.State.String()] = count.Count
+	}
+
+	for _, count := range sessionCounts {
+		data.Sessions += count.Count
+		data.SessionsByStatus[count.State.String()] = count.Count
+	}
+
+	from, name, field := agentGpus(g.db.Dialector.Name())
+	vram, vramUsed := field("vram"), field("metrics", "vramUsed")
+
+	var gpuSums []struct {
+		Name           string
+		Gpus           int
+		Vram           uint64
+		VramUsed       uint64
+		UtilizationGpu uint64
+		PowerDraw      uint64
+	}
+	result = g.db.Raw("SELECT "+name+" AS name, COUNT(*) AS gpus, "+
+		"SUM("+vram+") AS vram, SUM("+vramUsed+") AS vram_used, "+
+		"SUM("+field("metrics", "utilizationGpu")+") AS utilization_gpu, SUM("+field("metrics", "powerDraw")+") AS power_draw "+
+		"FROM "+from+" WHERE agents.state = ? AND agents.deleted_at IS NULL GROUP BY "+name, models.AgentStateActive).
+		Scan(&gpuSums)
+	if result.Error != nil {
+		return storage.AggregatedData{}, mapError(result.Error)
+	}
+
+	// The whole GB of VRAM available on the GPUs, the used VRAM reported may exceed the VRAM of the GPU
+	var gbCounts []struct {
+		Name  string
+		Gb    int
+		Count int
+	}
+	result = g.db.Raw("SELECT "+name+" AS name, "+
+		"(CASE WHEN "+vram+" > "+vramUsed+" THEN "+vram+" - "+vramUsed+" ELSE 0 END) / 1073741824 AS gb, COUNT(*) AS count "+
+		"FROM "+from+" WHERE agents.state = ? AND agents.deleted_at IS NULL GROUP BY 1, 2", models.AgentStateActive).
+		Scan(&gbCounts)
+	if result.Error != nil {
+		return storage.AggregatedData{}, mapError(result.Error)
+	}
+
+	var utilization, powerDraw uint64
+	for _, sums := range gpuSums {
+		data.Gpus += sums.Gpus
+		data.GpusByGpuName[sums.Name] += sums.Gpus
+		data.Vram += sums.Vram
+		data.VramByGpuName[sums.Name] += sums.Vram
+		data.VramUsed += sums.VramUsed
+		data.VramUsedByGpuName[sums.Name] += sums.VramUsed
+		utilization += sums.UtilizationGpu
+		powerDraw += sums.PowerDraw
+		data.PowerDrawByGpuName[sums.Name] = float64(sums.PowerDraw) / 1000.0
+	}
+
+	data.PowerDraw = float64(powerDraw) / 1000.0
+
+	if data.Gpus > 0 {
+		data.Utilization = float64(utilization) / float64(data.Gpus)
+		for _, sums := range gpuSums {
+			data.UtilizationByGpuName[sums.Name] = float64(sums.UtilizationGpu) / float64(data.Gpus)
+		}
+
+		vramGBAvailable := map[int]int{}
+		vramGBAvailableByGpuName := map[string]map[int]int{}
+		for _, count := range gbCounts {
+			vramGBAvailable[count.Gb] += count.Count
+
+			if _, ok := vramGBAvailableByGpuName[count.Name]; !ok {
+				vramGBAvailableByGpuName[count.Name] = map[int]int{}
+			}
+
+			vramGBAvailableByGpuName[count.Name][count.Gb] += count.Count
+		}
+
+		data.VramGBAvailable = storage.PercentilesOfCounts(vramGBAvailable, data.Gpus)
+		for key, gbAvailable := range vramGBAvailableByGpuName {
+			data.VramGBAvailableByGpuName[key] = storage.PercentilesOfCounts(gbAvailable, data.GpusByGpuName[key])
+		}
+	}
+
+	return data, nil
 }
 
 func (g *gormDriver) RegisterAgent(agent restapi.Agent) (string, error) {
@@ -234,6 +604,7 @@ func (g *gormDriver) RegisterAgent(agent restapi.Agent) (string, error) {
 		return "", mapError(err)
 	}
 
+	g.notify(storage.AgentChanged(dbAgent.UUID.String()))
 	return dbAgent.UUID.String(), nil
 }
 
@@ -253,6 +624,80 @@ func (g *gormDriver) GetAgentById(id string) (restapi.Agent, error) {
 	return restAgentFromAgent(dbAgent)
 }
 
+func (g *gormDriver) SetAgentTaints(agentId string, taints map[string]string) error {
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		dbAgent := models.Agent{
+			UUID: uuid.FromStringOrNil(agentId),
+		}
+
+		result := tx.Where(&dbAgent, "UUID").First(&dbAgent)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		dbTaints := []models.KeyValue{}
+		for k, v := range taints {
+			dbTaints = append(dbTaints, models.KeyValue{Key: k, Value: v})
+		}
+
+		return tx.Model(&dbAgent).Association("Taints").Replace(dbTaints)
+	})
+
+	return g.notifyChanges(mapError(err), storage.AgentChanged(agentId))
+}
+
+func (g *gormDriver) SetAgentDisabled(agentId string, disabled bool, drainDeadline *time.Time) error {
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		dbAgent := models.Agent{
+			UUID: uuid.FromStringOrNil(agentId),
+		}
+
+		result := tx.Where(&dbAgent, "UUID").First(&dbAgent)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if dbAgent.State != models.AgentStateActive && dbAgent.State != models.AgentStateDisabled {
+			return nil
+		}
+
+		state := models.AgentStateActive
+		if disabled {
+			state = models.AgentStateDisabled
+		} else {
+			drainDeadline = nil
+		}
+
+		// Updates skips nil fields, so the deadline is set separately
+		return tx.Model(&dbAgent).Updates(map[string]interface{}{
+			"state":          state,
+			"drain_deadline": drainDeadline,
+		}).Error
+	})
+
+	return g.notifyChanges(mapError(err), storage.AgentChanged(agentId))
+}
+
+func (g *gormDriver) GetSessionsOfDrainedAgents() ([]string, error) {
+	var ids []uuid.UUID
+	result := g.db.Model(&models.Session{}).
+		Joins("JOIN agents ON agents.id = sessions.agent_id").
+		Where("agents.state = ?", models.AgentStateDisabled).
+		Where("agents.drain_deadline <= ?", time.Now()).
+		Where("sessions.state IN ?", []models.SessionState{models.SessionStateAssigned, models.SessionStateActive}).
+		Pluck("sessions.uuid", &ids)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	sessionIds := []string{}
+	for _, id := range ids {
+		sessionIds = append(sessionIds, id.String())
+	}
+
+	return sessionIds, nil
+}
+
 func (g *gormDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	err := g.db.Transaction(func(tx *gorm.DB) error {
 		var err error
@@ -265,7 +710,10 @@ func (g *gormDriver) UpdateAgent(update restapi.AgentUpdate) error {
 			return result.Error
 		}
 
-		dbAgent.State = models.AgentStateFromString(update.State)
+		state := models.AgentStateFromString(update.State)
+		if dbAgent.State != models.AgentStateDisabled || state != models.AgentStateActive {
+			dbAgent.State = state
+		}
 
 		// Update GPU metrics
 
@@ -296,6 +744,11 @@ func (g *gormDriver) UpdateAgent(update restapi.AgentUpdate) error {
 				return mapError(result.Error)
 			}
 
+			// The session may have been detached from the agent while it was lost
+			if dbSession.AgentID == nil || *dbSession.AgentID != dbAgent.ID {
+				continue
+			}
+
 			state := models.SessionStateFromString(sessionUpdate.State)
 			if state != dbSession.State {
 				if dbSession.State == models.SessionStateClosed {
@@ -304,6 +757,19 @@ func (g *gormDriver) UpdateAgent(update restapi.AgentUpdate) error {
 				dbSession.State = state
 			}
 
+			if sessionUpdate.Reason != "" {
+				dbSession.Reason = sessionUpdate.Reason
+			}
+
+			// Updates skips nil fields, so clearing the idle time is done separately
+			if !sessionUpdate.Idle {
+				dbSession.IdleSince = nil
+				tx.Model(&dbSession).Update("idle_since", nil)
+			} else if dbSession.IdleSince == nil {
+				idleSince := time.Now()
+				dbSession.IdleSince = &idleSince
+			}
+
 			for _, connectionUpdate := range sessionUpdate.Connections {
 				var dbConnection models.Connection
 				tx.Where(models.Connection{UUID: uuid.FromStringOrNil(connectionUpdate.Id)}).
@@ -319,6 +785,11 @@ func (g *gormDriver) UpdateAgent(update restapi.AgentUpdate) error {
 			}
 
 			tx.Updates(dbSession)
+
+			err = updateUsage(tx, dbSession.UUID, state, sessionUpdate.Connections)
+			if err != nil {
+				return err
+			}
 		}
 
 		tx.Updates(dbAgent)
@@ -326,7 +797,7 @@ func (g *gormDriver) UpdateAgent(update restapi.AgentUpdate) error {
 		return nil
 	})
 
-	return mapError(err)
+	return g.notifyChanges(mapError(err), storage.AgentUpdateChanges(update)...)
 }
 
 func (g *gormDriver) RequestSession(sessionRequirements restapi.SessionRequirements) (string, error) {
@@ -353,8 +824,15 @@ func (g *gormDriver) RequestSession(sessionRequirements restapi.SessionRequireme
 			Agent:        nil,
 			Version:      sessionRequirements.Version,
 			State:        models.SessionStateQueued,
+			Priority:     sessionRequirements.Priority,
 			Requirements: requirements,
 			VramRequired: storage.TotalVramRequired(sessionRequirements),
+			MaxDuration:  sessionRequirements.MaxDurationSeconds,
+			IdleTimeout:  sessionRequirements.IdleTimeoutSeconds,
+			Persistent:   sessionRequirements.Persistent,
+			UserID:       sessionRequirements.UserId,
+
+			LeaseRenewedAt: time.Now(),
 
 			Labels:    labels,
 			Tolerates: tolerates,
@@ -372,16 +850,27 @@ func (g *gormDriver) RequestSession(sessionRequirements restapi.SessionRequireme
 			}
 		}
 
-		tx.Create(dbSession)
+		err = tx.Create(dbSession).Error
+		if err != nil {
+			return err
+		}
 
-		return nil
+		return tx.Create(&models.UsageRecord{
+			SessionID:    dbSession.UUID,
+			UserID:       sessionRequirements.UserId,
+			PoolID:       sessionRequirements.PoolId,
+			VramRequired: dbSession.VramRequired,
+			QueuedAt:     dbSession.CreatedAt,
+			ExitCodes:    datatypes.JSON("{}"),
+		}).Error
 	})
 
-	if dbSession != nil {
-		return dbSession.UUID.String(), nil
+	if err != nil {
+		return "", mapError(err)
 	}
 
-	return "", mapError(err)
+	g.notify(storage.SessionChanged(dbSession.UUID.String()))
+	return dbSession.UUID.String(), nil
 }
 
 func (g *gormDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu) error {
@@ -415,15 +904,26 @@ func (g *gormDriver) AssignSession(sessionId string, agentId string, gpus []rest
 		// TODO why?
 		dbSession.Address = dbAgent.Address
 		dbSession.State = models.SessionStateAssigned
+		assignedAt := time.Now()
+		dbSession.AssignedAt = &assignedAt
 		dbAgent.VramAvailable -= dbSession.VramRequired
 
+		// Updates() skips zero values so the reason must be cleared explicitly
+		tx.Model(&dbSession).Update("reason", "")
 		tx.Updates(&dbSession)
 		tx.Updates(&dbAgent)
 
-		return nil
+		return tx.Model(&models.UsageRecord{}).
+			Where("session_id = ?", dbSession.UUID).
+			Updates(map[string]interface{}{
+				"agent_id":    agentId,
+				"gpus":        gpusData,
+				"assigned_at": assignedAt,
+				"active_at":   nil,
+			}).Error
 	})
 
-	return mapError(err)
+	return g.notifyChanges(mapError(err), storage.SessionOfAgentChanged(sessionId, agentId))
 }
 
 func (g *gormDriver) CancelSession(sessionId string) error {
@@ -445,70 +945,479 @@ func (g *gormDriver) CancelSession(sessionId string) error {
 
 		tx.Updates(&dbSession)
 
+		if dbSession.State == models.SessionStateClosed {
+			return closeUsage(tx, dbSession.UUID)
+		}
+
 		return nil
 	})
 
-	return mapError(err)
+	return g.notifyChanges(mapError(err), storage.SessionChanged(sessionId))
 }
 
-func (g *gormDriver) GetSessionById(id string) (restapi.Session, error) {
-	dbSession := models.Session{
-		UUID: uuid.FromStringOrNil(id),
+func (g *gormDriver) GetSessionsOfMissingAgents(duration time.Duration) ([]restapi.Session, error) {
+	var dbSessions []models.Session
+	result := g.db.Preload("Connections").
+		Joins("JOIN agents ON agents.id = sessions.agent_id").
+		Where("agents.state = ? OR (agents.state = ? AND agents.updated_at <= ?)",
+			models.AgentStateMissing, models.AgentStateDisabled, time.Now().Add(-duration)).
+		Where("sessions.state IN ?", []models.SessionState{models.SessionStateAssigned, models.SessionStateActive}).
+		Find(&dbSessions)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
 	}
 
-	result := g.db.Preload("Connections").Where(&dbSession, "UUID").First(&dbSession)
-	if result.Error != nil {
-		return restapi.Session{}, mapError(result.Error)
+	sessions := []restapi.Session{}
+	for _, dbSession := range dbSessions {
+		session, err := restSessionFromSession(dbSession)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
 	}
 
-	return restSessionFromSession(dbSession)
+	return sessions, nil
 }
 
-func (g *gormDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
-	dbSession := models.Session{
-		UUID:  uuid.FromStringOrNil(id),
-		State: models.SessionStateQueued,
-	}
+func (g *gormDriver) DetachSession(sessionId string, requeue bool) error {
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		dbSession := models.Session{
+			UUID: uuid.FromStringOrNil(sessionId),
+		}
 
-	result := g.db.Model(&models.Session{}).Where(&dbSession, "UUID", "State").First(&dbSession)
-	if result.Error != nil {
-		return storage.QueuedSession{}, mapError(result.Error)
-	}
+		result := tx.Preload("Agent").Clauses(clause.Locking{Strength: "UPDATE"}).Where(&dbSession, "UUID").First(&dbSession)
+		if result.Error != nil {
+			return result.Error
+		}
 
-	queuedSession := storage.QueuedSession{
-		Id: dbSession.UUID.String(),
-	}
+		if dbSession.Agent == nil {
+			return nil
+		}
 
-	err := json.Unmarshal(dbSession.Requirements, &queuedSession.Requirements)
-	if err != nil {
-		return storage.QueuedSession{}, err
-	}
+		if dbSession.State != models.SessionStateClosed {
+			result = tx.Model(dbSession.Agent).Update("vram_available", dbSession.Agent.VramAvailable+dbSession.VramRequired)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
 
-	return queuedSession, nil
-}
+		state := models.SessionStateClosed
+		requeues := dbSession.Requeues
+		if requeue {
+			state = models.SessionStateQueued
+			requeues++
+		}
 
-func (g *gormDriver) GetAgents(poolId string) (storage.Iterator[restapi.Agent], error) {
-	// TODO pagination should be passed in through storage interface
-	var dbAgents []models.Agent
-	query := g.db.Model(&models.Agent{}).
-		Preload("Labels").Preload("Taints").
-		Where("state = ?", models.AgentStateActive).
-		Limit(20)
+		// Updates skips nil fields, so the assignment is cleared with a map
+		result = tx.Model(&dbSession).Updates(map[string]interface{}{
+			"agent_id":    nil,
+			"address":     "",
+			"gp_us":       nil,
+			"assigned_at": nil,
+			"idle_since":  nil,
+			"state":       state,
+			"requeues":    requeues,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
 
-	if poolId != "" {
-		query = query.Where("pool_id = ?", poolId)
-	}
+		if !requeue {
+			return closeUsage(tx, dbSession.UUID)
+		}
 
-	result := query.Find(&dbAgents)
+		return nil
+	})
 
-	if result.Error != nil {
+	return g.notifyChanges(mapError(err), storage.SessionChanged(sessionId))
+}
+
+// Records the session becoming active or closing and the exit codes of its
+// connections
+func updateUsage(tx *gorm.DB, sessionId uuid.UUID, state models.SessionState, connections map[string]restapi.Connection) error {
+	now := time.Now()
+
+	switch state {
+	case models.SessionStateActive:
+		result := tx.Model(&models.UsageRecord{}).
+			Where("session_id = ? AND active_at IS NULL", sessionId).
+			Update("active_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+	case models.SessionStateClosed:
+		err := closeUsage(tx, sessionId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(connections) == 0 {
+		return nil
+	}
+
+	var records []models.UsageRecord
+	result := tx.Where("session_id = ?", sessionId).Limit(1).Find(&records)
+	if result.Error != nil || len(records) == 0 {
+		return result.Error
+	}
+
+	exitCodes := map[string]int{}
+	err := json.Unmarshal(records[0].ExitCodes, &exitCodes)
+	if err != nil {
+		return err
+	}
+
+	for id, connection := range connections {
+		exitCodes[id] = connection.ExitCode
+	}
+
+	data, err := json.Marshal(exitCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&models.UsageRecord{}).
+		Where("session_id = ?", sessionId).
+		Update("exit_codes", datatypes.JSON(data)).Error
+}
+
+func closeUsage(tx *gorm.DB, sessionId uuid.UUID) error {
+	return tx.Model(&models.UsageRecord{}).
+		Where("session_id = ? AND closed_at IS NULL", sessionId).
+		Update("closed_at", time.Now()).Error
+}
+
+func restUsageFromUsage(dbRecord models.UsageRecord) (restapi.UsageRecord, error) {
+	record := restapi.UsageRecord{
+		SessionId:    dbRecord.SessionID.String(),
+		UserId:       dbRecord.UserID,
+		PoolId:       dbRecord.PoolID,
+		AgentId:      dbRecord.AgentID,
+		VramRequired: dbRecord.VramRequired,
+		QueuedAt:     dbRecord.QueuedAt,
+		AssignedAt:   dbRecord.AssignedAt,
+		ActiveAt:     dbRecord.ActiveAt,
+		ClosedAt:     dbRecord.ClosedAt,
+	}
+
+	if dbRecord.GPUs != nil {
+		err := json.Unmarshal(dbRecord.GPUs, &record.Gpus)
+		if err != nil {
+			return restapi.UsageRecord{}, err
+		}
+	}
+
+	exitCodes := map[string]int{}
+	err := json.Unmarshal(dbRecord.ExitCodes, &exitCodes)
+	if err != nil {
+		return restapi.UsageRecord{}, err
+	}
+
+	ids := make([]string, 0, len(exitCodes))
+	for id := range exitCodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	record.Connections = len(ids)
+	record.ExitCodes = make([]int, 0, len(ids))
+	for _, id := range ids {
+		record.ExitCodes = append(record.ExitCodes, exitCodes[id])
+	}
+
+	return record, nil
+}
+
+func (g *gormDriver) GetUsageRecords(start time.Time, end time.Time) (storage.Iterator[restapi.UsageRecord], error) {
+	var dbRecords []models.UsageRecord
+	result := g.db.
+		Where("queued_at < ?", end).
+		Where("closed_at IS NULL OR closed_at >= ?", start).
+		Order("queued_at ASC").
+		Find(&dbRecords)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	records := []restapi.UsageRecord{}
+	for _, dbRecord := range dbRecords {
+		record, err := restUsageFromUsage(dbRecord)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return storage.NewDefaultIterator(records), nil
+}
+
+func (g *gormDriver) SetSessionReason(sessionId string, reason string) error {
+	result := g.db.Model(&models.Session{}).
+		Where("uuid = ?", uuid.FromStringOrNil(sessionId)).
+		Update("reason", reason)
+	return mapError(result.Error)
+}
+
+func (g *gormDriver) GetSessionById(id string) (restapi.Session, error) {
+	dbSession := models.Session{
+		UUID: uuid.FromStringOrNil(id),
+	}
+
+	result := g.db.Preload("Connections").Where(&dbSession, "UUID").First(&dbSession)
+	if result.Error != nil {
+		return restapi.Session{}, mapError(result.Error)
+	}
+
+	return restSessionFromSession(dbSession)
+}
+
+func (g *gormDriver) RenewSessionLease(sessionId string) error {
+	result := g.db.Model(&models.Session{}).
+		Where("uuid = ?", uuid.FromStringOrNil(sessionId)).
+		Update("lease_renewed_at", time.Now())
+	if result.Error == nil && result.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return mapError(result.Error)
+}
+
+func (g *gormDriver) GetSessionsWithExpiredLease(defaultLease time.Duration) ([]string, error) {
+	var rows []struct {
+		UUID           uuid.UUID
+		LeaseRenewedAt time.Time
+		LeaseDuration  *int64
+	}
+
+	// The lease of each session depends on its pool, which is simpler to compare here than portably in SQL
+	result := g.db.Model(&models.Session{}).
+		Select("sessions.uuid, sessions.lease_renewed_at, pools.lease_duration").
+		Joins("LEFT JOIN pools ON pools.id = sessions.pool_id").
+		Where("sessions.state IN ?", []models.SessionState{models.SessionStateQueued, models.SessionStateAssigned, models.SessionStateActive}).
+		Where("sessions.persistent = ?", false).
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	now := time.Now()
+	ids := []string{}
+	for _, row := range rows {
+		lease := defaultLease
+		if row.LeaseDuration != nil && *row.LeaseDuration > 0 {
+			lease = time.Duration(*row.LeaseDuration) * time.Second
+		}
+
+		if lease > 0 && now.Sub(row.LeaseRenewedAt) >= lease {
+			ids = append(ids, row.UUID.String())
+		}
+	}
+
+	return ids, nil
+}
+
+func (g *gormDriver) GetPersistentSessions(userId string) (storage.Iterator[restapi.Session], error) {
+	var dbSessions []models.Session
+	result := g.db.Preload("Connections").
+		Where("persistent = ?", true).
+		Where("user_id = ?", userId).
+		Where("state != ?", models.SessionStateClosed).
+		Order("created_at ASC").
+		Find(&dbSessions)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	sessions := []restapi.Session{}
+	for _, dbSession := range dbSessions {
+		session, err := restSessionFromSession(dbSession)
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (g *gormDriver) GetSessions(query storage.SessionQuery) (storage.Iterator[restapi.SessionListItem], error) {
+	tx := g.db.Preload("Connections").Preload("Agent")
+
+	if len(query.States) > 0 {
+		states := make([]models.SessionState, 0, len(query.States))
+		for _, state := range query.States {
+			states = append(states, models.SessionStateFromString(state))
+		}
+		tx = tx.Where("state IN ?", states)
+	}
+	if query.PoolId != "" {
+		tx = tx.Where("pool_id = ?", uuid.FromStringOrNil(query.PoolId))
+	}
+	if query.AgentId != "" {
+		tx = tx.Where("agent_id IN (?)", g.db.Model(&models.Agent{}).Select("id").Where("uuid = ?", uuid.FromStringOrNil(query.AgentId)))
+	}
+	if query.UserId != "" {
+		tx = tx.Where("user_id = ?", query.UserId)
+	}
+	if query.CreatedAfter != nil {
+		tx = tx.Where("created_at > ?", *query.CreatedAfter)
+	}
+	if query.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *query.CreatedBefore)
+	}
+
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if query.After != nil {
+		after := query.After
+		createdAfter := g.db.Where("created_at "+comparison+" ?", after.CreatedAt).
+			Or("created_at = ? AND uuid "+comparison+" ?", after.CreatedAt, uuid.FromStringOrNil(after.Id))
+
+		if query.Sort == restapi.SessionSortPriority {
+			tx = tx.Where(g.db.Where("priority "+comparison+" ?", after.Priority).
+				Or(g.db.Where("priority = ?", after.Priority).Where(createdAfter)))
+		} else {
+			tx = tx.Where(createdAfter)
+		}
+	}
+
+	if query.Sort == restapi.SessionSortPriority {
+		tx = tx.Order("priority " + direction)
+	}
+	tx = tx.Order("created_at " + direction).Order("uuid " + direction)
+
+	if query.Limit > 0 {
+		tx = tx.Limit(query.Limit)
+	}
+
+	var dbSessions []models.Session
+	result := tx.Find(&dbSessions)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	sessions := []restapi.SessionListItem{}
+	for _, dbSession := range dbSessions {
+		session, err := restSessionFromSession(dbSession)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+
+		item := restapi.SessionListItem{
+			Session:   session,
+			CreatedAt: dbSession.CreatedAt,
+		}
+		if dbSession.Agent != nil {
+			item.AgentId = dbSession.Agent.UUID.String()
+		}
+
+		sessions = append(sessions, item)
+	}
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (g *gormDriver) GetSessionRequirements(id string) (restapi.SessionRequirements, error) {
+	dbSession := models.Session{
+		UUID: uuid.FromStringOrNil(id),
+	}
+
+	result := g.db.Model(&models.Session{}).Where(&dbSession, "UUID").First(&dbSession)
+	if result.Error != nil {
+		return restapi.SessionRequirements{}, mapError(result.Error)
+	}
+
+	var requirements restapi.SessionRequirements
+	err := json.Unmarshal(dbSession.Requirements, &requirements)
+	if err != nil {
+		return restapi.SessionRequirements{}, err
+	}
+
+	return requirements, nil
+}
+
+func (g *gormDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	dbSession := models.Session{
+		UUID:  uuid.FromStringOrNil(id),
+		State: models.SessionStateQueued,
+	}
+
+	result := g.db.Model(&models.Session{}).Where(&dbSession, "UUID", "State").First(&dbSession)
+	if result.Error != nil {
+		return storage.QueuedSession{}, mapError(result.Error)
+	}
+
+	queuedSession := storage.QueuedSession{
+		Id:     dbSession.UUID.String(),
+		Reason: dbSession.Reason,
+	}
+
+	err := json.Unmarshal(dbSession.Requirements, &queuedSession.Requirements)
+	if err != nil {
+		return storage.QueuedSession{}, err
+	}
+
+	return queuedSession, nil
+}
+
+// Agents with a GPU of the name, the JSON of the GPUs is queried in the dialect of the database
+func gpuNameCondition(dialect string) string {
+	if dialect == "sqlite" {
+		return "EXISTS (SELECT 1 FROM json_each(agents.gpus) WHERE json_extract(json_each.value, '$.name') = ?)"
+	}
+
+	return "EXISTS (SELECT 1 FROM jsonb_array_elements(agents.gpus::jsonb) gpu WHERE gpu->>'name' = ?)"
+}
+
+func (g *gormDriver) GetAgents(agentQuery storage.AgentQuery) (storage.Iterator[restapi.Agent], error) {
+	states := []models.AgentState{}
+	for _, state := range agentQuery.StatesOrDefault() {
+		states = append(states, models.AgentStateFromString(state))
+	}
+
+	query := g.db.Model(&models.Agent{}).
+		Preload("Labels").Preload("Taints").
+		Where("state IN ?", states).
+		Where("vram_available >= ?", agentQuery.VramAvailableAtLeast)
+
+	if agentQuery.PoolId != "" {
+		query = query.Where("pool_id = ?", agentQuery.PoolId)
+	}
+
+	if agentQuery.HostnamePrefix != "" {
+		query = query.Where("substr(hostname, 1, ?) = ?", utf8.RuneCountInString(agentQuery.HostnamePrefix), agentQuery.HostnamePrefix)
+	}
+
+	if agentQuery.GpuName != "" {
+		query = query.Where(gpuNameCondition(g.db.Dialector.Name()), agentQuery.GpuName)
+	}
+
+	if agentQuery.After != nil {
+		query = query.Where("uuid > ?", uuid.FromStringOrNil(agentQuery.After.Id))
+	}
+
+	selector := agentQuery.Selector()
+	query = whereLabelsMatch(query, selector).Order("uuid ASC")
+
+	if agentQuery.Limit > 0 {
+		query = query.Limit(agentQuery.Limit)
+	}
+
+	var dbAgents []models.Agent
+	result := query.Find(&dbAgents)
+	if result.Error != nil {
 		return nil, mapError(result.Error)
 	}
 
 	agents := []restapi.Agent{}
 	for _, dbAgent := range dbAgents {
 		agent, err := restAgentFromAgent(dbAgent)
-
 		if err != nil {
 			logger.Warning(err)
 		} else {
@@ -519,14 +1428,73 @@ func (g *gormDriver) GetAgents(poolId string) (storage.Iterator[restapi.Agent],
 	return storage.NewDefaultIterator[restapi.Agent](agents), nil
 }
 
-func (g *gormDriver) GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
-	// TODO pagination should be passed in through storage interface
+const agentHasLabel = "EXISTS (SELECT 1 FROM agent_labels JOIN key_values ON key_values.id = agent_labels.key_value_id " +
+	"WHERE agent_labels.agent_id = agents.id AND key_values.key = ?"
+
+// Label values that are integers cast to one, in the dialect of the database
+func integerLabelValue(dialect string) string {
+	if dialect == "sqlite" {
+		return "(CASE WHEN (key_values.value GLOB '[0-9]*' AND key_values.value NOT GLOB '*[^0-9]*') OR " +
+			"(key_values.value GLOB '-[0-9]*' AND substr(key_values.value, 2) NOT GLOB '*[^0-9]*') " +
+			"THEN CAST(key_values.value AS INTEGER) END)"
+	}
+
+	return "(CASE WHEN key_values.value ~ '^-?[0-9]+$' THEN key_values.value::bigint END)"
+}
+
+// Restricts the agents to those with labels matching the selector, Gt and Lt
+// only match label values that are integers
+func whereLabelsMatch(query *gorm.DB, selector storage.AgentSelector) *gorm.DB {
+	for key, value := range selector.MatchLabels {
+		query = query.Where(agentHasLabel+" AND key_values.value = ?)", key, value)
+	}
+
+	for _, expression := range selector.MatchExpressions {
+		switch expression.Operator {
+		case restapi.SelectorOpIn:
+			query = query.Where(agentHasLabel+" AND key_values.value IN ?)", expression.Key, expression.Values)
+		case restapi.SelectorOpNotIn:
+			query = query.Where("NOT "+agentHasLabel+" AND key_values.value IN ?)", expression.Key, expression.Values)
+		case restapi.SelectorOpExists:
+			query = query.Where(agentHasLabel+")", expression.Key)
+		case restapi.SelectorOpGt, restapi.SelectorOpLt:
+			operator := ">"
+			if expression.Operator == restapi.SelectorOpLt {
+				operator = "<"
+			}
+
+			var value int64
+			if len(expression.Values) > 0 {
+				value, _ = strconv.ParseInt(expression.Values[0], 10, 64)
+			}
+
+			query = query.Where(agentHasLabel+" AND "+integerLabelValue(query.Dialector.Name())+" "+operator+" ?)", expression.Key, value)
+		case restapi.SelectorOpDoesNotExist:
+			query = query.Where("NOT "+agentHasLabel+")", expression.Key)
+		}
+	}
+
+	return query
+}
+
+// Returns every matching agent, the scheduling strategies rank all of them
+func (g *gormDriver) GetAvailableAgentsMatching(selector storage.AgentSelector) (storage.Iterator[restapi.Agent], error) {
 	var dbAgents []models.Agent
-	result := g.db.Model(&models.Agent{}).
-		Preload("Labels").Preload("Taints").
-		Where("state = ?", models.AgentStateActive).
-		Where("vram_available >= ?", totalAvailableVramAtLeast).
-		Limit(20).
+	query := g.db.Model(&models.Agent{}).
+		Preload("Labels").Preload("Taints").Preload("Sessions", "state NOT IN (?)", models.SessionStateClosed).
+		Where("vram_available >= ?", selector.TotalAvailableVramAtLeast)
+
+	if selector.IncludeDisabled {
+		query = query.Where("state IN ?", []models.AgentState{models.AgentStateActive, models.AgentStateDisabled})
+	} else {
+		query = query.Where("state = ?", models.AgentStateActive)
+	}
+
+	if selector.PoolId != "" {
+		query = query.Where("pool_id = ?", selector.PoolId)
+	}
+
+	result := whereLabelsMatch(query, selector).
 		Find(&dbAgents)
 
 	if result.Error != nil {
@@ -547,21 +1515,49 @@ func (g *gormDriver) GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64
 
 }
 
-func (g *gormDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
-	// TODO pagination should be passed in through storage interface
+// The number of queued sessions retrieved at a time
+const queuedSessionsPage = 20
+
+// Pages through the queued sessions in the order they are scheduled. Every page
+// continues after the last session retrieved, so sessions assigned while
+// iterating do not move the sessions after them between pages.
+type queuedSessionsIterator struct {
+	db *gorm.DB
+
+	page  []storage.QueuedSession
+	index int
+	last  *models.Session
+	done  bool
+}
+
+func (iterator *queuedSessionsIterator) retrievePage() error {
+	query := iterator.db.Model(&models.Session{}).
+		Where("state = ?", models.SessionStateQueued)
+
+	if iterator.last != nil {
+		query = query.Where("priority < ? OR (priority = ? AND id > ?)", iterator.last.Priority, iterator.last.Priority, iterator.last.ID)
+	}
+
 	var dbSessions []models.Session
-	result := g.db.Model(&models.Session{}).
-		Where("state = ?", models.SessionStateQueued).
-		Limit(20).
+	result := query.
+		Order("priority DESC, id ASC").
+		Limit(queuedSessionsPage).
 		Find(&dbSessions)
 	if result.Error != nil {
-		return nil, mapError(result.Error)
+		return mapError(result.Error)
+	}
+
+	iterator.page = []storage.QueuedSession{}
+	iterator.index = 0
+	iterator.done = len(dbSessions) < queuedSessionsPage
+	if len(dbSessions) > 0 {
+		iterator.last = &dbSessions[len(dbSessions)-1]
 	}
 
-	queuedSessions := []storage.QueuedSession{}
 	for _, dbSession := range dbSessions {
 		queuedSession := storage.QueuedSession{
-			Id: dbSession.UUID.String(),
+			Id:     dbSession.UUID.String(),
+			Reason: dbSession.Reason,
 		}
 
 		if err := json.Unmarshal(dbSession.Requirements, &queuedSession.Requirements); err != nil {
@@ -569,11 +1565,75 @@ func (g *gormDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.Queue
 			continue
 		}
 
-		queuedSessions = append(queuedSessions, queuedSession)
+		iterator.page = append(iterator.page, queuedSession)
+	}
+
+	return nil
+}
+
+func (iterator *queuedSessionsIterator) Next() bool {
+	iterator.index++
+
+	for iterator.index >= len(iterator.page) && !iterator.done {
+		err := iterator.retrievePage()
+		if err != nil {
+			logger.Debugf("unable to retrieve queued sessions, %s", err.Error())
+			return false
+		}
+	}
+
+	return iterator.index < len(iterator.page)
+}
+
+func (iterator *queuedSessionsIterator) Value() storage.QueuedSession {
+	return iterator.page[iterator.index]
+}
+
+func (g *gormDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	iterator := &queuedSessionsIterator{db: g.db}
+
+	err := iterator.retrievePage()
+	if err != nil {
+		return nil, err
+	}
+
+	// The first call to Next moves to the first session
+	iterator.index = -1
+	return iterator, nil
+}
+
+func (g *gormDriver) CountQueuedSessionsAhead(sessionId string) (int, error) {
+	dbSession := models.Session{}
+
+	result := g.db.Where("uuid = ?", uuid.FromStringOrNil(sessionId)).First(&dbSession)
+	if result.Error != nil {
+		return 0, mapError(result.Error)
+	}
+
+	query := g.db.Model(&models.Session{}).
+		Where("state = ?", models.SessionStateQueued).
+		Where("priority > ? OR (priority = ? AND created_at < ?)", dbSession.Priority, dbSession.Priority, dbSession.CreatedAt)
+
+	if dbSession.PoolID.Valid {
+		query = query.Where("pool_id = ?", dbSession.PoolID.UUID)
 	}
 
-	return storage.NewDefaultIterator[storage.QueuedSession](queuedSessions), nil
+	var count int64
+	result = query.Count(&count)
+	return int(count), mapError(result.Error)
+}
+
+func (g *gormDriver) CountSessionsAssignedSince(poolId string, since time.Time) (int, error) {
+	query := g.db.Model(&models.Session{}).
+		Where("assigned_at >= ?", since)
 
+	if poolId != "" {
+		query = query.Where("pool_id = ?", poolId)
+	}
+
+	var count int64
+	result := query.Count(&count)
+	return int(count), mapError(result.Error)
 }
 
 func (g *gormDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
@@ -582,15 +1642,25 @@ func (g *gormDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) err
 		Where("state = ?", models.AgentStateActive).
 		Where("updated_at <= ?", time.Now().Add(-duration)).
 		Updates(models.Agent{State: models.AgentStateMissing})
+	if result.Error == nil && result.RowsAffected > 0 {
+		// The agents missing are unknown
+		g.notify(storage.Change{})
+	}
+
 	return mapError(result.Error)
 }
 
 func (g *gormDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
 	// Soft-deletes agent
 	result := g.db.
-		Where("state = ?", models.AgentStateMissing).
+		Where("state IN ?", []models.AgentState{models.AgentStateMissing, models.AgentStateDisabled}).
 		Where("updated_at <= ?", time.Now().Add(-duration)).
 		Delete(&models.Agent{})
+	if result.Error == nil && result.RowsAffected > 0 {
+		// The agents removed are unknown
+		g.notify(storage.Change{})
+	}
+
 	return mapError(result.Error)
 }
 
@@ -599,19 +1669,359 @@ func (g *gormDriver) DeletePool(id string) error {
 	return mapError(result.Error)
 }
 
+func (g *gormDriver) CountPools() (int, error) {
+	var count int64
+	result := g.db.Model(&models.Pool{}).Count(&count)
+	return int(count), mapError(result.Error)
+}
+
 func (g *gormDriver) GetPool(id string) (restapi.Pool, error) {
 	dbPool := models.Pool{}
 
-	result := g.db.Where(&dbPool, "ID").First(&dbPool)
+	result := g.db.Where("id = ?", id).First(&dbPool)
 	if result.Error != nil {
 		return restapi.Pool{}, mapError(result.Error)
 	}
 
-	return restPoolFromPool(dbPool), nil
+	pool := restPoolFromPool(dbPool)
+
+	var dbSessions []models.Session
+	result = g.db.Model(&models.Session{}).
+		Select("vram_required", "gp_us").
+		// Sessions without a pool count towards the pool of their agent
+		Where("pool_id = ? OR (pool_id IS NULL AND agent_id IN (SELECT id FROM agents WHERE pool_id = ?))", id, id).
+		Where("state IN (?)", []models.SessionState{models.SessionStateAssigned, models.SessionStateActive, models.SessionStateCanceling}).
+		Find(&dbSessions)
+	if result.Error != nil {
+		return restapi.Pool{}, mapError(result.Error)
+	}
+
+	for _, dbSession := range dbSessions {
+		var gpus []restapi.SessionGpu
+		if err := json.Unmarshal(dbSession.GPUs, &gpus); err != nil {
+			logger.Warning(err)
+		}
+
+		pool.Usage.Sessions++
+		pool.Usage.Vram += dbSession.VramRequired
+		pool.Usage.Gpus += len(gpus)
+	}
+
+	return pool, nil
+}
+
+func (g *gormDriver) SetPoolQuotas(id string, quotas restapi.PoolQuotas) error {
+	result := g.db.Model(&models.Pool{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"max_sessions": quotas.MaxSessions,
+			"max_vram":     quotas.MaxVram,
+			"max_gpus":     quotas.MaxGpus,
+		})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return mapError(result.Error)
+}
+
+func (g *gormDriver) SetPoolSessionLimits(id string, limits restapi.PoolSessionLimits) error {
+	result := g.db.Model(&models.Pool{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"default_max_duration": limits.DefaultMaxDurationSeconds,
+			"max_duration_cap":     limits.MaxDurationCapSeconds,
+			"default_idle_timeout": limits.DefaultIdleTimeoutSeconds,
+			"idle_timeout_cap":     limits.IdleTimeoutCapSeconds,
+			"lease_duration":       limits.LeaseSeconds,
+			"max_priority":         limits.MaxPriority,
+		})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return mapError(result.Error)
+}
+
+func (g *gormDriver) CreateReservation(reservation restapi.Reservation) (restapi.Reservation, error) {
+	gpus, err := json.Marshal(reservation.Gpus)
+	if err != nil {
+		return restapi.Reservation{}, err
+	}
+
+	dbReservation := models.Reservation{
+		UUID:     uuid.NewV4(),
+		PoolID:   nullUUIDFromString(reservation.PoolId),
+		AgentID:  nullUUIDFromString(reservation.AgentId),
+		Gpus:     gpus,
+		StartsAt: reservation.Start,
+		EndsAt:   reservation.End,
+	}
+
+	result := g.db.Create(&dbReservation)
+	if result.Error != nil {
+		return restapi.Reservation{}, mapError(result.Error)
+	}
+
+	return restReservationFromReservation(dbReservation)
+}
+
+func (g *gormDriver) GetReservation(id string) (restapi.Reservation, error) {
+	dbReservation := models.Reservation{
+		UUID: uuid.FromStringOrNil(id),
+	}
+
+	result := g.db.Where(&dbReservation, "UUID").First(&dbReservation)
+	if result.Error != nil {
+		return restapi.Reservation{}, mapError(result.Error)
+	}
+
+	return restReservationFromReservation(dbReservation)
+}
+
+func (g *gormDriver) GetReservations(endingAfter time.Time) (storage.Iterator[restapi.Reservation], error) {
+	var dbReservations []models.Reservation
+	result := g.db.Where("ends_at > ?", endingAfter).
+		Order("starts_at ASC").
+		Find(&dbReservations)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	reservations := []restapi.Reservation{}
+	for _, dbReservation := range dbReservations {
+		reservation, err := restReservationFromReservation(dbReservation)
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			reservations = append(reservations, reservation)
+		}
+	}
+
+	return storage.NewDefaultIterator(reservations), nil
+}
+
+func (g *gormDriver) DeleteReservation(id string) error {
+	result := g.db.Where("uuid = ?", uuid.FromStringOrNil(id)).Delete(&models.Reservation{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return mapError(result.Error)
+}
+
+func (g *gormDriver) CreateWebhookSubscription(subscription restapi.WebhookSubscription) (restapi.WebhookSubscription, error) {
+	eventTypes, err := json.Marshal(subscription.EventTypes)
+	if err != nil {
+		return restapi.WebhookSubscription{}, err
+	}
+
+	dbSubscription := models.WebhookSubscription{
+		UUID:       uuid.NewV4(),
+		Url:        subscription.Url,
+		EventTypes: eventTypes,
+		PoolID:     nullUUIDFromString(subscription.PoolId),
+		Format:     subscription.Format,
+		Secret:     subscription.Secret,
+	}
+
+	result := g.db.Create(&dbSubscription)
+	if result.Error != nil {
+		return restapi.WebhookSubscription{}, mapError(result.Error)
+	}
+
+	return restWebhookSubscriptionFromWebhookSubscription(dbSubscription)
+}
+
+func (g *gormDriver) GetWebhookSubscription(id string) (restapi.WebhookSubscription, error) {
+	dbSubscription := models.WebhookSubscription{
+		UUID: uuid.FromStringOrNil(id),
+	}
+
+	result := g.db.Where(&dbSubscription, "UUID").First(&dbSubscription)
+	if result.Error != nil {
+		return restapi.WebhookSubscription{}, mapError(result.Error)
+	}
+
+	return restWebhookSubscriptionFromWebhookSubscription(dbSubscription)
+}
+
+func (g *gormDriver) GetWebhookSubscriptions() (storage.Iterator[restapi.WebhookSubscription], error) {
+	var dbSubscriptions []models.WebhookSubscription
+	result := g.db.Order("created_at ASC").Find(&dbSubscriptions)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	subscriptions := []restapi.WebhookSubscription{}
+	for _, dbSubscription := range dbSubscriptions {
+		subscription, err := restWebhookSubscriptionFromWebhookSubscription(dbSubscription)
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+
+	return storage.NewDefaultIterator(subscriptions), nil
+}
+
+func (g *gormDriver) DeleteWebhookSubscription(id string) error {
+	subscriptionId := uuid.FromStringOrNil(id)
+
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("uuid = ?", subscriptionId).Delete(&models.WebhookSubscription{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return storage.ErrNotFound
+		}
+
+		return tx.Unscoped().Where("subscription_id = ?", subscriptionId).Delete(&models.WebhookDelivery{}).Error
+	})
+
+	return mapError(err)
+}
+
+func (g *gormDriver) CreateWebhookDelivery(delivery restapi.WebhookDelivery) (restapi.WebhookDelivery, error) {
+	event, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return restapi.WebhookDelivery{}, err
+	}
+
+	subscriptionId := uuid.FromStringOrNil(delivery.SubscriptionId)
+
+	var count int64
+	result := g.db.Model(&models.WebhookSubscription{}).Where("uuid = ?", subscriptionId).Count(&count)
+	if result.Error != nil {
+		return restapi.WebhookDelivery{}, mapError(result.Error)
+	}
+
+	if count == 0 {
+		return restapi.WebhookDelivery{}, storage.ErrNotFound
+	}
+
+	dbDelivery := models.WebhookDelivery{
+		UUID:           uuid.NewV4(),
+		SubscriptionID: subscriptionId,
+		Event:          event,
+		State:          restapi.WebhookDeliveryPending,
+		NextAttemptAt:  delivery.NextAttemptAt,
+	}
+	if dbDelivery.NextAttemptAt.IsZero() {
+		dbDelivery.NextAttemptAt = time.Now()
+	}
+
+	result = g.db.Create(&dbDelivery)
+	if result.Error != nil {
+		return restapi.WebhookDelivery{}, mapError(result.Error)
+	}
+
+	return restWebhookDeliveryFromWebhookDelivery(dbDelivery)
+}
+
+func (g *gormDriver) UpdateWebhookDelivery(delivery restapi.WebhookDelivery) error {
+	result := g.db.Model(&models.WebhookDelivery{}).
+		Where("uuid = ?", uuid.FromStringOrNil(delivery.Id)).
+		Updates(map[string]interface{}{
+			"state":           delivery.State,
+			"attempts":        delivery.Attempts,
+			"next_attempt_at": delivery.NextAttemptAt,
+			"last_attempt_at": delivery.LastAttemptAt,
+			"status_code":     delivery.StatusCode,
+			"error":           delivery.Error,
+		})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return mapError(result.Error)
+}
+
+func (g *gormDriver) GetDueWebhookDeliveries(now time.Time, limit int) (storage.Iterator[restapi.WebhookDelivery], error) {
+	var dbDeliveries []models.WebhookDelivery
+	result := g.db.Where("state = ? AND next_attempt_at <= ?", restapi.WebhookDeliveryPending, now).
+		Order("next_attempt_at ASC").
+		Limit(limit).
+		Find(&dbDeliveries)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	return storage.NewDefaultIterator(restWebhookDeliveriesFromWebhookDeliveries(dbDeliveries)), nil
+}
+
+func (g *gormDriver) GetWebhookDeliveries(subscriptionId string, limit int) (storage.Iterator[restapi.WebhookDelivery], error) {
+	var dbDeliveries []models.WebhookDelivery
+	result := g.db.Where("subscription_id = ?", uuid.FromStringOrNil(subscriptionId)).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&dbDeliveries)
+	if result.Error != nil {
+		return nil, mapError(result.Error)
+	}
+
+	return storage.NewDefaultIterator(restWebhookDeliveriesFromWebhookDeliveries(dbDeliveries)), nil
+}
+
+func (g *gormDriver) DeleteWebhookDeliveriesBefore(before time.Time) error {
+	// Deliveries are removed for good, rather than soft deleted, as they are only kept for a while
+	result := g.db.Unscoped().
+		Where("state <> ? AND created_at < ?", restapi.WebhookDeliveryPending, before).
+		Delete(&models.WebhookDelivery{})
+	return mapError(result.Error)
+}
+
+// The current time of the database and the time a duration in seconds after
+// it, in the dialect of the database. Leases are timed by the clock of the
+// database so replicas with skewed clocks agree on when a lease expires.
+func databaseTime(dialect string) (string, string) {
+	if dialect == "sqlite" {
+		return "strftime('%Y-%m-%d %H:%M:%f', 'now')", "strftime('%Y-%m-%d %H:%M:%f', 'now', printf('%+f seconds', ?))"
+	}
+
+	return "now()", "now() + make_interval(secs => ?)"
+}
+
+func (g *gormDriver) AcquireLease(name string, holder string, duration time.Duration) (bool, error) {
+	now, after := databaseTime(g.db.Dialector.Name())
+	expiresAt := gorm.Expr(after, duration.Seconds())
+
+	// Both statements only succeed when the lease is free, so competing holders cannot both acquire it
+	result := g.db.Model(&models.Lease{}).
+		Where("name = ?", name).
+		Where("holder = ? OR expires_at < "+now, holder).
+		Updates(map[string]any{"holder": holder, "expires_at": expiresAt})
+	if result.Error != nil {
+		return false, mapError(result.Error)
+	}
+
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	result = g.db.Model(&models.Lease{}).Clauses(clause.OnConflict{DoNothing: true}).Create(map[string]any{
+		"name":       name,
+		"holder":     holder,
+		"expires_at": expiresAt,
+	})
+	if result.Error != nil {
+		return false, mapError(result.Error)
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+func (g *gormDriver) ReleaseLease(name string, holder string) error {
+	result := g.db.Where("name = ? AND holder = ?", name, holder).Delete(&models.Lease{})
+	return mapError(result.Error)
 }
 
 func (g *gormDriver) CreatePool(name string) (restapi.Pool, error) {
 	dbPool := models.Pool{
+		ID:       uuid.NewV4(),
 		PoolName: name,
 	}
 
@@ -625,6 +2035,7 @@ func (g *gormDriver) CreatePool(name string) (restapi.Pool, error) {
 
 func (g *gormDriver) AddPermission(poolId string, userId string, permission restapi.Permission) error {
 	dbPermission := models.Permission{
+		ID:         uuid.NewV4(),
 		UserID:     userId,
 		PoolID:     uuid.FromStringOrNil(poolId),
 		Permission: models.PermissionTypeFromString(string(permission)),
@@ -636,10 +2047,15 @@ func (g *gormDriver) AddPermission(poolId string, userId string, permission rest
 }
 
 func (g *gormDriver) RemovePermission(poolId string, userId string, permission restapi.Permission) error {
-	result := g.db.Where("pool_id = ?", poolId).Where("user_id = ?", userId).Delete(&models.Permission{})
+	result := g.db.Where("pool_id = ?", poolId).
+		Where("user_id = ?", userId).
+		Where("permission = ?", models.PermissionTypeFromString(string(permission))).
+		Delete(&models.Permission{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
 
 	return mapError(result.Error)
-
 }
 
 type UserPermissionRow struct {
@@ -663,7 +2079,7 @@ func (g *gormDriver) GetPermissions(userId string) (restapi.UserPermissions, err
 			JOIN pools ON pools.id = permissions.pool_id
 			LEFT JOIN agents ON agents.pool_id = pools.id AND agents.state = @agentState
 			LEFT JOIN sessions ON sessions.agent_id = agents.id AND sessions.state = @sessionState
-		WHERE user_id = @userId AND permissions.deleted_at IS NULL
+		WHERE permissions.user_id = @userId AND permissions.deleted_at IS NULL
 		GROUP BY permissions.pool_id, permissions.permission, pools.pool_name`,
 		sql.Named("userId", userId), sql.Named("sessionState", models.SessionStateActive), sql.Named("agentState", models.AgentStateActive)).Rows()
 
@@ -0,0 +1,11 @@
+package models
+
+import (
+	"time"
+)
+
+type Lease struct {
+	Name      string `gorm:"primaryKey"`
+	Holder    string `gorm:"notnull"`
+	ExpiresAt time.Time
+}
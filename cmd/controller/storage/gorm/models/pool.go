@@ -8,10 +8,21 @@ import (
 )
 
 type Pool struct {
-	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
 	PoolName  string    `gorm:"type:varchar(255);not null"`
 	MaxAgents int       `gorm:"default:0"`
 
+	MaxSessions int    `gorm:"default:0"`
+	MaxVram     uint64 `gorm:"default:0"`
+	MaxGpus     int    `gorm:"default:0"`
+
+	DefaultMaxDuration int64 `gorm:"default:0"`
+	MaxDurationCap     int64 `gorm:"default:0"`
+	DefaultIdleTimeout int64 `gorm:"default:0"`
+	IdleTimeoutCap     int64 `gorm:"default:0"`
+	LeaseDuration      int64 `gorm:"default:0"`
+	MaxPriority        int   `gorm:"default:0"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type Reservation struct {
+	gorm.Model
+
+	UUID    uuid.UUID     `gorm:"type:uuid;notnull;unique"`
+	PoolID  uuid.NullUUID `gorm:"type:uuid;"`
+	AgentID uuid.NullUUID `gorm:"type:uuid;"`
+	Gpus    datatypes.JSON
+
+	StartsAt time.Time
+	EndsAt   time.Time `gorm:"index"`
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"gorm.io/datatypes"
@@ -60,16 +61,25 @@ func (ss SessionState) String() string {
 type Session struct {
 	gorm.Model
 
-	UUID         uuid.UUID `gorm:"type:uuid;notnull;unique"`
-	AgentID      *uint
-	Agent        *Agent
-	State        SessionState
-	Address      string
-	Version      string
-	Persistent   bool
-	GPUs         datatypes.JSON
-	VramRequired uint64
-	Requirements datatypes.JSON
+	UUID           uuid.UUID `gorm:"type:uuid;notnull;unique"`
+	AgentID        *uint
+	Agent          *Agent
+	State          SessionState
+	Address        string
+	Version        string
+	Persistent     bool
+	UserID         string `gorm:"index"`
+	Priority       int    `gorm:"index"`
+	Reason         string
+	AssignedAt     *time.Time `gorm:"index"`
+	IdleSince      *time.Time
+	Requeues       int
+	LeaseRenewedAt time.Time
+	MaxDuration    int64
+	IdleTimeout    int64
+	GPUs           datatypes.JSON
+	VramRequired   uint64
+	Requirements   datatypes.JSON
 
 	Connections []Connection
 
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+)
+
+// The accounting record of a session, it references neither the session nor
+// its agent so it outlives both
+type UsageRecord struct {
+	SessionID    uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID       string    `gorm:"index"`
+	PoolID       string    `gorm:"index"`
+	AgentID      string
+	GPUs         datatypes.JSON `gorm:"column:gpus"`
+	VramRequired uint64
+	QueuedAt     time.Time `gorm:"index"`
+	AssignedAt   *time.Time
+	ActiveAt     *time.Time
+	ClosedAt     *time.Time `gorm:"index"`
+	// The exit code of every connection, by connection id
+	ExitCodes datatypes.JSON
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type WebhookSubscription struct {
+	gorm.Model
+
+	UUID       uuid.UUID `gorm:"type:uuid;notnull;unique"`
+	Url        string
+	EventTypes datatypes.JSON
+	PoolID     uuid.NullUUID `gorm:"type:uuid;"`
+	Format     string
+	Secret     string
+}
+
+type WebhookDelivery struct {
+	gorm.Model
+
+	UUID           uuid.UUID `gorm:"type:uuid;notnull;unique"`
+	SubscriptionID uuid.UUID `gorm:"type:uuid;index"`
+	Event          datatypes.JSON
+	State          string `gorm:"index"`
+	Attempts       int
+	NextAttemptAt  time.Time `gorm:"index"`
+	LastAttemptAt  *time.Time
+	StatusCode     int
+	Error          string
+}
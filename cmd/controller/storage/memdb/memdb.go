@@ -32,12 +32,52 @@ type Session struct {
 	Requirements restapi.SessionRequirements
 	VramRequired uint64
 
-	LastUpdated int64
+	Created      time.Time
+	LeaseRenewed time.Time
+	LastUpdated  int64
+}
+
+type UsageRecord struct {
+	restapi.UsageRecord
+
+	// The exit code of every connection, by connection id
+	ConnectionExitCodes map[string]int
+}
+
+type Pool struct {
+	restapi.Pool
+}
+
+type Reservation struct {
+	restapi.Reservation
+}
+
+type Permission struct {
+	Id         string
+	PoolId     string
+	UserId     string
+	Permission restapi.Permission
+}
+
+type WebhookSubscription struct {
+	restapi.WebhookSubscription
+}
+
+type WebhookDelivery struct {
+	restapi.WebhookDelivery
+}
+
+type Lease struct {
+	Name      string
+	Holder    string
+	ExpiresAt time.Time
 }
 
 type storageDriver struct {
 	ctx context.Context
 	db  *memdb.MemDB
+
+	changes storage.Notifier
 }
 
 func OpenStorage(ctx context.Context) (storage.Storage, error) {
@@ -83,6 +123,96 @@ func OpenStorage(ctx context.Context) (storage.Storage, error) {
 					},
 				},
 			},
+			"pools": {
+				Name: "pools",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+				},
+			},
+			"permissions": {
+				Name: "permissions",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+					"pool": {
+						Name:    "pool",
+						Unique:  false,
+						Indexer: &memdb.StringFieldIndex{Field: "PoolId"},
+					},
+					"user": {
+						Name:    "user",
+						Unique:  false,
+						Indexer: &memdb.StringFieldIndex{Field: "UserId"},
+					},
+				},
+			},
+			"reservations": {
+				Name: "reservations",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+				},
+			},
+			"usage": {
+				Name: "usage",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "SessionId"},
+					},
+				},
+			},
+			"webhooks": {
+				Name: "webhooks",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+				},
+			},
+			"webhook_deliveries": {
+				Name: "webhook_deliveries",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+					"subscription": {
+						Name:    "subscription",
+						Unique:  false,
+						Indexer: &memdb.UUIDFieldIndex{Field: "SubscriptionId"},
+					},
+					"state": {
+						Name:    "state",
+						Unique:  false,
+						Indexer: &memdb.StringFieldIndex{Field: "State"},
+					},
+				},
+			},
+			"leases": {
+				Name: "leases",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+					},
+				},
+			},
 		},
 	}
 
@@ -101,6 +231,14 @@ func (driver *storageDriver) Close() error {
 	return nil
 }
 
+func (driver *storageDriver) SubscribeChanges() (<-chan struct{}, func()) {
+	return driver.changes.Subscribe()
+}
+
+func (driver *storageDriver) WatchChanges() (*storage.ChangeWatcher, func()) {
+	return driver.changes.Watch()
+}
+
 func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 	txn := driver.db.Snapshot().Txn(false)
 	defer txn.Abort()
@@ -149,7 +287,7 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 			data.VramUsed += gpu.Metrics.VramUsed
 			data.VramUsedByGpuName[gpu.Name] += gpu.Metrics.VramUsed
 
-			gb := int((gpu.Vram - gpu.Metrics.VramUsed) / (1024 * 1024 * 1024))
+			gb := storage.VramGBAvailable(gpu)
 			vramGBAvailable[gb]++
 
 			if _, ok := vramGBAvailableByGpuName[gpu.Name]; !ok {
@@ -166,68 +304,9 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 	}
 
 	if data.Gpus > 0 {
-		calculatePercentiles := func(counts map[int]int, total int) storage.Percentile[int] {
-			sortedKeys := []int{}
-			for key := range counts {
-				sortedKeys = append(sortedKeys, key)
-			}
-			sort.Ints(sortedKeys)
-
-			indexP90 := int(float64(total) * 0.90)
-			indexP75 := int(float64(total) * 0.75)
-			indexP50 := int(float64(total) * 0.50)
-			indexP25 := int(float64(total) * 0.25)
-			indexP10 := int(float64(total) * 0.10)
-
-			percentile := storage.Percentile[int]{
-				P100: sortedKeys[len(sortedKeys)-1],
-			}
-
-			index := 0
-			keysIndex := 0
-			key := 0
-
-			for keysIndex < len(sortedKeys) && index < indexP10 {
-				key = sortedKeys[keysIndex]
-				index += counts[key]
-				keysIndex++
-			}
-			percentile.P10 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP25 {
-				key = sortedKeys[keysIndex]
-				index += counts[key]
-				keysIndex++
-			}
-			percentile.P25 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP50 {
-				key = sortedKeys[keysIndex]
-				index += counts[key]
-				keysIndex++
-			}
-			percentile.P50 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP75 {
-				key = sortedKeys[keysIndex]
-				index += counts[key]
-				keysIndex++
-			}
-			percentile.P75 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP90 {
-				key = sortedKeys[keysIndex]
-				index += counts[key]
-				keysIndex++
-			}
-			percentile.P90 = key
-
-			return percentile
-		}
-
-		data.VramGBAvailable = calculatePercentiles(vramGBAvailable, data.Gpus)
+		data.VramGBAvailable = storage.PercentilesOfCounts(vramGBAvailable, data.Gpus)
 		for key, gbAvailable := range vramGBAvailableByGpuName {
-			data.VramGBAvailableByGpuName[key] = calculatePercentiles(gbAvailable, data.GpusByGpuName[key])
+			data.VramGBAvailableByGpuName[key] = storage.PercentilesOfCounts(gbAvailable, data.GpusByGpuName[key])
 		}
 
 		data.Utilization = float64(utilization) / float64(data.Gpus)
@@ -261,6 +340,8 @@ func (driver *storageDriver) RegisterAgent(apiAgent restapi.Agent) (string, erro
 	}
 
 	txn.Commit()
+	driver.changes.Notify(storage.AgentChanged(agent.Id))
+
 	return agent.Id, nil
 }
 
@@ -280,6 +361,117 @@ func (driver *storageDriver) GetAgentById(id string) (restapi.Agent, error) {
 	return utilities.Require[Agent](obj).Agent, nil
 }
 
+func (driver *storageDriver) SetAgentTaints(agentId string, taints map[string]string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	agent := utilities.Require[Agent](obj)
+	agent.Taints = map[string]string{}
+	for key, value := range taints {
+		agent.Taints[key] = value
+	}
+
+	err = txn.Insert("agents", agent)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	driver.changes.Notify(storage.AgentChanged(agentId))
+
+	return nil
+}
+
+func (driver *storageDriver) SetAgentDisabled(agentId string, disabled bool, drainDeadline *time.Time) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	agent := utilities.Require[Agent](obj)
+	if agent.State != restapi.AgentActive && agent.State != restapi.AgentDisabled {
+		txn.Abort()
+		return nil
+	}
+
+	if disabled {
+		agent.State = restapi.AgentDisabled
+		agent.DrainDeadline = drainDeadline
+	} else {
+		agent.State = restapi.AgentActive
+		agent.DrainDeadline = nil
+	}
+
+	err = txn.Insert("agents", agent)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	driver.changes.Notify(storage.AgentChanged(agentId))
+
+	return nil
+}
+
+func (driver *storageDriver) GetSessionsOfDrainedAgents() ([]string, error) {
+	now := time.Now()
+
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("agents", "state", restapi.AgentDisabled)
+	if err != nil {
+		return nil, err
+	}
+
+	drained := map[string]bool{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.DrainDeadline != nil && !now.Before(*agent.DrainDeadline) {
+			drained[agent.Id] = true
+		}
+	}
+
+	ids := []string{}
+	if len(drained) == 0 {
+		return ids, nil
+	}
+
+	iterator, err = txn.Get("sessions", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		if drained[session.AgentId] && (session.State == restapi.SessionAssigned || session.State == restapi.SessionActive) {
+			ids = append(ids, session.Id)
+		}
+	}
+
+	return ids, nil
+}
+
 func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	now := time.Now().Unix()
 
@@ -292,7 +484,7 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	}
 
 	agent := utilities.Require[Agent](obj)
-	if update.State != "" {
+	if update.State != "" && (agent.State != restapi.AgentDisabled || update.State != restapi.AgentActive) {
 		agent.State = update.State
 	}
 
@@ -321,6 +513,17 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 				session.State = sessionUpdate.State
 				session.LastUpdated = now
 
+				if sessionUpdate.Reason != "" {
+					session.Reason = sessionUpdate.Reason
+				}
+
+				if !sessionUpdate.Idle {
+					session.IdleSince = nil
+				} else if session.IdleSince == nil {
+					idleSince := time.Unix(now, 0)
+					session.IdleSince = &idleSince
+				}
+
 				if session.State == restapi.SessionClosed {
 					agent.VramAvailable += session.VramRequired
 				} else {
@@ -333,6 +536,25 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 					txn.Abort()
 					return err
 				}
+
+				err = updateUsage(txn, sessionId, func(record *UsageRecord) {
+					updatedAt := time.Unix(now, 0)
+					if session.State == restapi.SessionActive && record.ActiveAt == nil {
+						record.ActiveAt = &updatedAt
+					}
+
+					if session.State == restapi.SessionClosed && record.ClosedAt == nil {
+						record.ClosedAt = &updatedAt
+					}
+
+					for id, connection := range sessionUpdate.Connections {
+						record.ConnectionExitCodes[id] = connection.ExitCode
+					}
+				})
+				if err != nil {
+					txn.Abort()
+					return err
+				}
 			} else {
 				sessionIds = append(sessionIds, sessionId)
 				sessions = append(sessions, agent.Sessions[index])
@@ -363,6 +585,14 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 			return err
 		}
 
+		for _, id := range agent.SessionIds {
+			err = closeUsage(txn, id)
+			if err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+
 		_, err = txn.DeleteAll("agents", "id", agent.Id)
 		if err != nil {
 			txn.Abort()
@@ -371,19 +601,33 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	}
 
 	txn.Commit()
+	driver.changes.Notify(storage.AgentUpdateChanges(update)...)
+
 	return nil
 }
 
 func (driver *storageDriver) RequestSession(requirements restapi.SessionRequirements) (string, error) {
+	now := time.Now()
+
 	session := Session{
 		Session: restapi.Session{
-			Id:      uuid.NewString(),
-			Version: requirements.Version,
-			State:   restapi.SessionQueued,
+			Id:       uuid.NewString(),
+			Version:  requirements.Version,
+			State:    restapi.SessionQueued,
+			PoolId:   requirements.PoolId,
+			Priority: requirements.Priority,
+
+			Persistent: requirements.Persistent,
+			UserId:     requirements.UserId,
+
+			MaxDurationSeconds: requirements.MaxDurationSeconds,
+			IdleTimeoutSeconds: requirements.IdleTimeoutSeconds,
 		},
 		Requirements: requirements,
 		VramRequired: storage.TotalVramRequired(requirements),
-		LastUpdated:  time.Now().Unix(),
+		Created:      now,
+		LeaseRenewed: now,
+		LastUpdated:  now.Unix(),
 	}
 
 	txn := driver.db.Txn(true)
@@ -394,7 +638,24 @@ func (driver *storageDriver) RequestSession(requirements restapi.SessionRequirem
 		return "", err
 	}
 
+	err = txn.Insert("usage", UsageRecord{
+		UsageRecord: restapi.UsageRecord{
+			SessionId:    session.Id,
+			UserId:       requirements.UserId,
+			PoolId:       requirements.PoolId,
+			VramRequired: session.VramRequired,
+			QueuedAt:     now,
+		},
+		ConnectionExitCodes: map[string]int{},
+	})
+	if err != nil {
+		txn.Abort()
+		return "", err
+	}
+
 	txn.Commit()
+	driver.changes.Notify(storage.SessionChanged(session.Id))
+
 	return session.Id, nil
 }
 
@@ -416,6 +677,9 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 	}
 	session := utilities.Require[Session](obj)
 	session.State = restapi.SessionAssigned
+	session.Reason = ""
+	assignedAt := time.Now()
+	session.AssignedAt = &assignedAt
 	// session.ExitStatus = restapi.ExitStatusUnknown
 	session.AgentId = agentId
 	session.Address = agent.Address
@@ -439,7 +703,20 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 		return err
 	}
 
+	err = updateUsage(txn, sessionId, func(record *UsageRecord) {
+		record.AgentId = agentId
+		record.Gpus = gpus
+		record.AssignedAt = &assignedAt
+		record.ActiveAt = nil
+	})
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
 	txn.Commit()
+	driver.changes.Notify(storage.SessionOfAgentChanged(sessionId, agentId))
+
 	return nil
 }
 
@@ -458,134 +735,1145 @@ func (driver *storageDriver) CancelSession(sessionId string) error {
 	} else {
 		session.State = restapi.SessionCanceling
 	}
+	session.LastUpdated = time.Now().Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if session.State == restapi.SessionClosed {
+		err = closeUsage(txn, sessionId)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	if session.AgentId != "" {
+		// Keep the copy of the session within the agent structure in sync
+		obj, err = txn.First("agents", "id", session.AgentId)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+
+		if obj != nil {
+			agent := utilities.Require[Agent](obj)
+			for index := range agent.Sessions {
+				if agent.Sessions[index].Id == sessionId {
+					agent.Sessions[index].State = session.State
+				}
+			}
+
+			err = txn.Insert("agents", agent)
+			if err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+	}
 
 	txn.Commit()
+	driver.changes.Notify(storage.SessionChanged(sessionId))
+
 	return nil
 }
 
-func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
+func (driver *storageDriver) GetSessionsOfMissingAgents(duration time.Duration) ([]restapi.Session, error) {
+	since := time.Now().Add(-duration).Unix()
+
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	obj, err := txn.First("sessions", "id", id)
+	iterator, err := txn.Get("agents", "state", restapi.AgentMissing)
 	if err != nil {
-		return restapi.Session{}, err
+		return nil, err
+	}
+
+	missing := map[string]bool{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		missing[utilities.Require[Agent](obj).Id] = true
+	}
+
+	iterator, err = txn.Get("agents", "state", restapi.AgentDisabled)
+	if err != nil {
+		return nil, err
+	}
+
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.LastUpdated <= since {
+			missing[agent.Id] = true
+		}
+	}
+
+	sessions := []restapi.Session{}
+	if len(missing) == 0 {
+		return sessions, nil
+	}
+
+	iterator, err = txn.Get("sessions", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		if missing[session.AgentId] && (session.State == restapi.SessionAssigned || session.State == restapi.SessionActive) {
+			sessions = append(sessions, session.Session)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (driver *storageDriver) DetachSession(sessionId string, requeue bool) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", sessionId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	if session.AgentId == "" {
+		txn.Abort()
+		return nil
+	}
+
+	obj, err = txn.First("agents", "id", session.AgentId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj != nil {
+		agent := utilities.Require[Agent](obj)
+
+		sessionIds := make([]string, 0, len(agent.SessionIds))
+		sessions := make([]restapi.Session, 0, len(agent.Sessions))
+		for index, id := range agent.SessionIds {
+			if id != sessionId {
+				sessionIds = append(sessionIds, id)
+				sessions = append(sessions, agent.Sessions[index])
+			}
+		}
+
+		agent.SessionIds = sessionIds
+		agent.Sessions = sessions
+		if session.State != restapi.SessionClosed {
+			agent.VramAvailable += session.VramRequired
+		}
+
+		err = txn.Insert("agents", agent)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	if requeue {
+		session.State = restapi.SessionQueued
+		session.Requeues++
+	} else {
+		session.State = restapi.SessionClosed
+	}
+
+	session.AgentId = ""
+	session.Address = ""
+	session.Gpus = nil
+	session.AssignedAt = nil
+	session.IdleSince = nil
+	session.LastUpdated = time.Now().Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if !requeue {
+		err = closeUsage(txn, sessionId)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	txn.Commit()
+	driver.changes.Notify(storage.SessionChanged(sessionId))
+
+	return nil
+}
+
+// Applies the update to the accounting record of the session, sessions
+// without a record are ignored
+func updateUsage(txn *memdb.Txn, sessionId string, update func(record *UsageRecord)) error {
+	obj, err := txn.First("usage", "id", sessionId)
+	if err != nil || obj == nil {
+		return err
+	}
+
+	record := utilities.Require[UsageRecord](obj)
+
+	// Records are stored by value, so the map is copied before it is modified
+	exitCodes := make(map[string]int, len(record.ConnectionExitCodes))
+	for id, exitCode := range record.ConnectionExitCodes {
+		exitCodes[id] = exitCode
+	}
+	record.ConnectionExitCodes = exitCodes
+
+	update(&record)
+
+	return txn.Insert("usage", record)
+}
+
+func closeUsage(txn *memdb.Txn, sessionId string) error {
+	return updateUsage(txn, sessionId, func(record *UsageRecord) {
+		if record.ClosedAt == nil {
+			closedAt := time.Now()
+			record.ClosedAt = &closedAt
+		}
+	})
+}
+
+func (driver *storageDriver) GetUsageRecords(start time.Time, end time.Time) (storage.Iterator[restapi.UsageRecord], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("usage", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	records := []restapi.UsageRecord{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		record := utilities.Require[UsageRecord](obj)
+		if !record.QueuedAt.Before(end) || (record.ClosedAt != nil && record.ClosedAt.Before(start)) {
+			continue
+		}
+
+		ids := make([]string, 0, len(record.ConnectionExitCodes))
+		for id := range record.ConnectionExitCodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		record.Connections = len(ids)
+		record.ExitCodes = make([]int, 0, len(ids))
+		for _, id := range ids {
+			record.ExitCodes = append(record.ExitCodes, record.ConnectionExitCodes[id])
+		}
+
+		records = append(records, record.UsageRecord)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].QueuedAt.Before(records[j].QueuedAt)
+	})
+
+	return storage.NewDefaultIterator(records), nil
+}
+
+func (driver *storageDriver) SetSessionReason(sessionId string, reason string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", sessionId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	session.Reason = reason
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		return restapi.Session{}, err
 	}
 
 	if obj == nil {
 		return restapi.Session{}, storage.ErrNotFound
 	}
 
-	return utilities.Require[Session](obj).Session, nil
+	return utilities.Require[Session](obj).Session, nil
+}
+
+func (driver *storageDriver) RenewSessionLease(sessionId string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", sessionId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	session.LeaseRenewed = time.Now()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetSessionsWithExpiredLease(defaultLease time.Duration) ([]string, error) {
+	now := time.Now()
+
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("sessions", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		if session.Persistent || (session.State != restapi.SessionQueued && session.State != restapi.SessionAssigned && session.State != restapi.SessionActive) {
+			continue
+		}
+
+		lease := defaultLease
+		if session.PoolId != "" {
+			obj, err := txn.First("pools", "id", session.PoolId)
+			if err != nil {
+				return nil, err
+			}
+
+			if obj != nil {
+				pool := utilities.Require[Pool](obj)
+				if pool.SessionLimits.LeaseSeconds > 0 {
+					lease = time.Duration(pool.SessionLimits.LeaseSeconds) * time.Second
+				}
+			}
+		}
+
+		if lease > 0 && now.Sub(session.LeaseRenewed) >= lease {
+			ids = append(ids, session.Id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (driver *storageDriver) GetPersistentSessions(userId string) (storage.Iterator[restapi.Session], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("sessions", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		if session.Persistent && session.UserId == userId && session.State != restapi.SessionClosed {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+
+	restSessions := make([]restapi.Session, len(sessions))
+	for index, session := range sessions {
+		restSessions[index] = session.Session
+	}
+
+	return storage.NewDefaultIterator(restSessions), nil
+}
+
+func (driver *storageDriver) GetSessions(query storage.SessionQuery) (storage.Iterator[restapi.SessionListItem], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("sessions", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []restapi.SessionListItem{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		item := restapi.SessionListItem{
+			Session:   session.Session,
+			AgentId:   session.AgentId,
+			CreatedAt: session.Created,
+		}
+
+		if !query.Matches(item) {
+			continue
+		}
+
+		if query.After != nil && query.Compare(storage.CursorOfSession(item), *query.After) <= 0 {
+			continue
+		}
+
+		sessions = append(sessions, item)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return query.Compare(storage.CursorOfSession(sessions[i]), storage.CursorOfSession(sessions[j])) < 0
+	})
+
+	if query.Limit > 0 && len(sessions) > query.Limit {
+		sessions = sessions[:query.Limit]
+	}
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (driver *storageDriver) GetSessionRequirements(id string) (restapi.SessionRequirements, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		return restapi.SessionRequirements{}, err
+	}
+
+	if obj == nil {
+		return restapi.SessionRequirements{}, storage.ErrNotFound
+	}
+
+	return utilities.Require[Session](obj).Requirements, nil
+}
+
+func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		return storage.QueuedSession{}, err
+	}
+
+	if obj == nil {
+		return storage.QueuedSession{}, storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+
+	return storage.QueuedSession{
+		Id:           session.Id,
+		Requirements: session.Requirements,
+		Reason:       session.Reason,
+	}, nil
+}
+
+func (driver *storageDriver) GetAgents(query storage.AgentQuery) (storage.Iterator[restapi.Agent], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("agents", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []restapi.Agent
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if query.After != nil && agent.Id <= query.After.Id {
+			continue
+		}
+
+		if query.Matches(agent.Agent, agent.VramAvailable) {
+			agents = append(agents, agent.Agent)
+		}
+	}
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Id < agents[j].Id
+	})
+
+	if query.Limit > 0 && len(agents) > query.Limit {
+		agents = agents[:query.Limit]
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+func (driver *storageDriver) GetAvailableAgentsMatching(selector storage.AgentSelector) (storage.Iterator[restapi.Agent], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("agents", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []restapi.Agent
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.State != restapi.AgentActive && (!selector.IncludeDisabled || agent.State != restapi.AgentDisabled) {
+			continue
+		}
+
+		if agent.VramAvailable >= selector.TotalAvailableVramAtLeast &&
+			(selector.PoolId == "" || agent.PoolId == selector.PoolId) &&
+			selector.MatchesLabels(agent.Labels) {
+			agents = append(agents, agent.Agent)
+		}
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("sessions", "state", restapi.SessionQueued)
+	if err != nil {
+		return nil, err
+	}
+
+	var queuedSessions []Session
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		queuedSessions = append(queuedSessions, utilities.Require[Session](obj))
+	}
+
+	// Highest priority first, then oldest first
+	sort.SliceStable(queuedSessions, func(i, j int) bool {
+		if queuedSessions[i].Priority != queuedSessions[j].Priority {
+			return queuedSessions[i].Priority > queuedSessions[j].Priority
+		}
+		return queuedSessions[i].Created.Before(queuedSessions[j].Created)
+	})
+
+	var sessions []storage.QueuedSession
+	for _, session := range queuedSessions {
+		sessions = append(sessions, storage.QueuedSession{
+			Id:           session.Id,
+			Requirements: session.Requirements,
+			Reason:       session.Reason,
+		})
+	}
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (driver *storageDriver) CountQueuedSessionsAhead(sessionId string) (int, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("sessions", "id", sessionId)
+	if err != nil {
+		return 0, err
+	}
+
+	if obj == nil {
+		return 0, storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+
+	iterator, err := txn.Get("sessions", "state", restapi.SessionQueued)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		queued := utilities.Require[Session](obj)
+		if session.PoolId != "" && queued.PoolId != session.PoolId {
+			continue
+		}
+
+		if queued.Priority > session.Priority ||
+			(queued.Priority == session.Priority && queued.Created.Before(session.Created)) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (driver *storageDriver) CountSessionsAssignedSince(poolId string, since time.Time) (int, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("sessions", "id")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		if poolId != "" && session.PoolId != poolId {
+			continue
+		}
+
+		if session.AssignedAt != nil && !session.AssignedAt.Before(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
+	nowTime := time.Now()
+	now := nowTime.Unix()
+	since := nowTime.Add(-duration).Unix()
+
+	txn := driver.db.Txn(true)
+
+	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	changes := []storage.Change{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.State == restapi.AgentActive {
+			changes = append(changes, storage.AgentChanged(agent.Id))
+
+			agent.State = restapi.AgentMissing
+			agent.LastUpdated = now
+
+			err = txn.Insert("agents", agent)
+			if err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+	}
+
+	txn.Commit()
+	if len(changes) > 0 {
+		driver.changes.Notify(changes...)
+	}
+
+	return nil
+}
+
+func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
+	since := time.Now().Add(-duration).Unix()
+
+	txn := driver.db.Txn(true)
+
+	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	agentIds := make([]interface{}, 0)
+	changes := []storage.Change{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.State == restapi.AgentMissing || agent.State == restapi.AgentDisabled {
+			agentIds = append(agentIds, agent.Id)
+			changes = append(changes, storage.AgentChanged(agent.Id))
+		}
+	}
+
+	if len(agentIds) > 0 {
+		_, err = txn.DeleteAll("agents", "id", agentIds...)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+
+		txn.Commit()
+		driver.changes.Notify(changes...)
+	} else {
+		txn.Abort()
+	}
+
+	return nil
+}
+
+func (driver *storageDriver) DeletePool(id string) error {
+	txn := driver.db.Txn(true)
+
+	_, err := txn.DeleteAll("pools", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	_, err = txn.DeleteAll("permissions", "pool", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) CountPools() (int, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("pools", "id")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		count++
+	}
+
+	return count, nil
+}
+
+func (driver *storageDriver) GetPool(id string) (restapi.Pool, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("pools", "id", id)
+	if err != nil {
+		return restapi.Pool{}, err
+	}
+
+	if obj == nil {
+		return restapi.Pool{}, storage.ErrNotFound
+	}
+
+	pool := utilities.Require[Pool](obj).Pool
+
+	// Sessions without a pool count towards the pool of their agent
+	agentIds := map[string]struct{}{}
+	agentIterator, err := txn.Get("agents", "id")
+	if err != nil {
+		return restapi.Pool{}, err
+	}
+
+	for obj := agentIterator.Next(); obj != nil; obj = agentIterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.PoolId == id {
+			agentIds[agent.Id] = struct{}{}
+		}
+	}
+
+	iterator, err := txn.Get("sessions", "id")
+	if err != nil {
+		return restapi.Pool{}, err
+	}
+
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		_, onPoolAgent := agentIds[session.AgentId]
+		if (session.PoolId == id || (session.PoolId == "" && onPoolAgent)) && storage.IsSessionAllocated(session.State) {
+			pool.Usage.Sessions++
+			pool.Usage.Vram += session.VramRequired
+			pool.Usage.Gpus += len(session.Gpus)
+		}
+	}
+
+	return pool, nil
+}
+
+func (driver *storageDriver) SetPoolQuotas(id string, quotas restapi.PoolQuotas) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("pools", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	pool := utilities.Require[Pool](obj)
+	pool.Quotas = quotas
+
+	err = txn.Insert("pools", pool)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) SetPoolSessionLimits(id string, limits restapi.PoolSessionLimits) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("pools", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	pool := utilities.Require[Pool](obj)
+	pool.SessionLimits = limits
+
+	err = txn.Insert("pools", pool)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) CreatePool(name string) (restapi.Pool, error) {
+	pool := Pool{
+		Pool: restapi.Pool{
+			Id:   uuid.NewString(),
+			Name: name,
+		},
+	}
+
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("pools", pool)
+	if err != nil {
+		txn.Abort()
+		return restapi.Pool{}, err
+	}
+
+	txn.Commit()
+	return pool.Pool, nil
+}
+
+func (driver *storageDriver) CreateReservation(reservation restapi.Reservation) (restapi.Reservation, error) {
+	reservation.Id = uuid.NewString()
+
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("reservations", Reservation{Reservation: reservation})
+	if err != nil {
+		txn.Abort()
+		return restapi.Reservation{}, err
+	}
+
+	txn.Commit()
+	return reservation, nil
+}
+
+func (driver *storageDriver) GetReservation(id string) (restapi.Reservation, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("reservations", "id", id)
+	if err != nil {
+		return restapi.Reservation{}, err
+	}
+
+	if obj == nil {
+		return restapi.Reservation{}, storage.ErrNotFound
+	}
+
+	return utilities.Require[Reservation](obj).Reservation, nil
+}
+
+func (driver *storageDriver) GetReservations(endingAfter time.Time) (storage.Iterator[restapi.Reservation], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("reservations", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := []restapi.Reservation{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		reservation := utilities.Require[Reservation](obj)
+		if reservation.End.After(endingAfter) {
+			reservations = append(reservations, reservation.Reservation)
+		}
+	}
+
+	sort.SliceStable(reservations, func(i, j int) bool {
+		return reservations[i].Start.Before(reservations[j].Start)
+	})
+
+	return storage.NewDefaultIterator(reservations), nil
+}
+
+func (driver *storageDriver) DeleteReservation(id string) error {
+	txn := driver.db.Txn(true)
+
+	count, err := txn.DeleteAll("reservations", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if count == 0 {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	txn.Commit()
+	return nil
 }
 
-func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+func (driver *storageDriver) CreateWebhookSubscription(subscription restapi.WebhookSubscription) (restapi.WebhookSubscription, error) {
+	subscription.Id = uuid.NewString()
+	subscription.CreatedAt = time.Now()
+
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("webhooks", WebhookSubscription{WebhookSubscription: subscription})
+	if err != nil {
+		txn.Abort()
+		return restapi.WebhookSubscription{}, err
+	}
+
+	txn.Commit()
+	return subscription, nil
+}
+
+func (driver *storageDriver) GetWebhookSubscription(id string) (restapi.WebhookSubscription, error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	obj, err := txn.First("sessions", "id", id)
+	obj, err := txn.First("webhooks", "id", id)
 	if err != nil {
-		return storage.QueuedSession{}, err
+		return restapi.WebhookSubscription{}, err
 	}
 
 	if obj == nil {
-		return storage.QueuedSession{}, storage.ErrNotFound
+		return restapi.WebhookSubscription{}, storage.ErrNotFound
 	}
 
-	session := utilities.Require[Session](obj)
-
-	return storage.QueuedSession{
-		Id:           session.Id,
-		Requirements: session.Requirements,
-	}, nil
+	return utilities.Require[WebhookSubscription](obj).WebhookSubscription, nil
 }
 
-func (driver *storageDriver) GetAgents(poolId string) (storage.Iterator[restapi.Agent], error) {
+func (driver *storageDriver) GetWebhookSubscriptions() (storage.Iterator[restapi.WebhookSubscription], error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	iterator, err := txn.Get("agents", "id")
+	iterator, err := txn.Get("webhooks", "id")
 	if err != nil {
 		return nil, err
 	}
 
-	var agents []restapi.Agent
+	subscriptions := []restapi.WebhookSubscription{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-		if agent.State == restapi.AgentActive {
-			agents = append(agents, agent.Agent)
-		}
+		subscriptions = append(subscriptions, utilities.Require[WebhookSubscription](obj).WebhookSubscription)
 	}
 
-	return storage.NewDefaultIterator(agents), nil
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+
+	return storage.NewDefaultIterator(subscriptions), nil
+}
+
+func (driver *storageDriver) DeleteWebhookSubscription(id string) error {
+	txn := driver.db.Txn(true)
+
+	count, err := txn.DeleteAll("webhooks", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if count == 0 {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	_, err = txn.DeleteAll("webhook_deliveries", "subscription", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) CreateWebhookDelivery(delivery restapi.WebhookDelivery) (restapi.WebhookDelivery, error) {
+	delivery.Id = uuid.NewString()
+	delivery.State = restapi.WebhookDeliveryPending
+	delivery.CreatedAt = time.Now()
+	if delivery.NextAttemptAt.IsZero() {
+		delivery.NextAttemptAt = delivery.CreatedAt
+	}
+
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("webhooks", "id", delivery.SubscriptionId)
+	if err != nil {
+		txn.Abort()
+		return restapi.WebhookDelivery{}, err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return restapi.WebhookDelivery{}, storage.ErrNotFound
+	}
+
+	err = txn.Insert("webhook_deliveries", WebhookDelivery{WebhookDelivery: delivery})
+	if err != nil {
+		txn.Abort()
+		return restapi.WebhookDelivery{}, err
+	}
+
+	txn.Commit()
+	return delivery, nil
+}
+
+func (driver *storageDriver) UpdateWebhookDelivery(delivery restapi.WebhookDelivery) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("webhook_deliveries", "id", delivery.Id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	stored := utilities.Require[WebhookDelivery](obj)
+	stored.State = delivery.State
+	stored.Attempts = delivery.Attempts
+	stored.NextAttemptAt = delivery.NextAttemptAt
+	stored.LastAttemptAt = delivery.LastAttemptAt
+	stored.StatusCode = delivery.StatusCode
+	stored.Error = delivery.Error
+
+	err = txn.Insert("webhook_deliveries", stored)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
 }
 
-func (driver *storageDriver) GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+func (driver *storageDriver) GetDueWebhookDeliveries(now time.Time, limit int) (storage.Iterator[restapi.WebhookDelivery], error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	iterator, err := txn.Get("agents", "state", restapi.AgentActive)
+	iterator, err := txn.Get("webhook_deliveries", "state", restapi.WebhookDeliveryPending)
 	if err != nil {
 		return nil, err
 	}
 
-	var agents []restapi.Agent
+	deliveries := []restapi.WebhookDelivery{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-
-		if agent.VramAvailable >= totalAvailableVramAtLeast {
-			agents = append(agents, agent.Agent)
+		delivery := utilities.Require[WebhookDelivery](obj)
+		if !delivery.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, delivery.WebhookDelivery)
 		}
 	}
 
-	return storage.NewDefaultIterator(agents), nil
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttemptAt.Before(deliveries[j].NextAttemptAt)
+	})
+
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return storage.NewDefaultIterator(deliveries), nil
 }
 
-func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+func (driver *storageDriver) GetWebhookDeliveries(subscriptionId string, limit int) (storage.Iterator[restapi.WebhookDelivery], error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	iterator, err := txn.Get("sessions", "state", restapi.SessionQueued)
+	iterator, err := txn.Get("webhook_deliveries", "subscription", subscriptionId)
 	if err != nil {
 		return nil, err
 	}
 
-	var sessions []storage.QueuedSession
+	deliveries := []restapi.WebhookDelivery{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		session := utilities.Require[Session](obj)
-		sessions = append(sessions, storage.QueuedSession{
-			Id:           session.Id,
-			Requirements: session.Requirements,
-		})
+		deliveries = append(deliveries, utilities.Require[WebhookDelivery](obj).WebhookDelivery)
 	}
 
-	return storage.NewDefaultIterator(sessions), nil
-}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
 
-func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
-	nowTime := time.Now()
-	now := nowTime.Unix()
-	since := nowTime.Add(-duration).Unix()
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return storage.NewDefaultIterator(deliveries), nil
+}
 
+func (driver *storageDriver) DeleteWebhookDeliveriesBefore(before time.Time) error {
 	txn := driver.db.Txn(true)
 
-	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	iterator, err := txn.Get("webhook_deliveries", "id")
 	if err != nil {
 		txn.Abort()
 		return err
 	}
 
+	// The iterator must not be used once the table is modified
+	expired := []WebhookDelivery{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-		if agent.State == restapi.AgentActive {
-			agent.State = restapi.AgentMissing
-			agent.LastUpdated = now
+		delivery := utilities.Require[WebhookDelivery](obj)
+		if delivery.State != restapi.WebhookDeliveryPending && delivery.CreatedAt.Before(before) {
+			expired = append(expired, delivery)
+		}
+	}
 
-			err = txn.Insert("agents", agent)
-			if err != nil {
-				txn.Abort()
-				return err
-			}
+	for _, delivery := range expired {
+		err = txn.Delete("webhook_deliveries", delivery)
+		if err != nil {
+			txn.Abort()
+			return err
 		}
 	}
 
@@ -593,72 +1881,207 @@ func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Durat
 	return nil
 }
 
-func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
-	since := time.Now().Add(-duration).Unix()
+func (driver *storageDriver) AddPermission(poolId string, userId string, permission restapi.Permission) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("pools", "id", poolId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	err = txn.Insert("permissions", Permission{
+		Id:         uuid.NewString(),
+		PoolId:     poolId,
+		UserId:     userId,
+		Permission: permission,
+	})
+	if err != nil {
+		txn.Abort()
+		return err
+	}
 
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) RemovePermission(poolId string, userId string, permission restapi.Permission) error {
 	txn := driver.db.Txn(true)
 
-	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	iterator, err := txn.Get("permissions", "pool", poolId)
 	if err != nil {
 		txn.Abort()
 		return err
 	}
 
-	agentIds := make([]interface{}, 0)
+	// The iterator must not be used once the table is modified
+	removed := []Permission{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-		if agent.State == restapi.AgentMissing {
-			agentIds = append(agentIds, agent.Id)
+		userPermission := utilities.Require[Permission](obj)
+		if userPermission.UserId == userId && userPermission.Permission == permission {
+			removed = append(removed, userPermission)
 		}
 	}
 
-	if len(agentIds) > 0 {
-		_, err = txn.DeleteAll("agents", "id", agentIds...)
+	if len(removed) == 0 {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	for _, userPermission := range removed {
+		err = txn.Delete("permissions", userPermission)
 		if err != nil {
 			txn.Abort()
 			return err
 		}
-
-		txn.Commit()
-	} else {
-		txn.Abort()
 	}
 
+	txn.Commit()
 	return nil
 }
 
-func (driver *storageDriver) DeletePool(id string) error {
-	// TODO
-	return nil
-}
+func (driver *storageDriver) GetPermissions(userId string) (restapi.UserPermissions, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
 
-func (driver *storageDriver) GetPool(id string) (restapi.Pool, error) {
-	// TODO
-	return restapi.Pool{}, nil
-}
+	iterator, err := txn.Get("permissions", "user", userId)
+	if err != nil {
+		return restapi.UserPermissions{}, err
+	}
 
-func (driver *storageDriver) CreatePool(name string) (restapi.Pool, error) {
-	// TODO
-	return restapi.Pool{}, nil
-}
+	result := restapi.UserPermissions{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		userPermission := utilities.Require[Permission](obj)
 
-func (driver *storageDriver) AddPermission(poolId string, userId string, permission restapi.Permission) error {
-	// todo
-	return nil
+		poolObj, err := txn.First("pools", "id", userPermission.PoolId)
+		if err != nil {
+			return restapi.UserPermissions{}, err
+		}
+
+		if poolObj == nil {
+			continue
+		}
+
+		pool := utilities.Require[Pool](poolObj).Pool
+
+		users := map[string]struct{}{}
+		poolIterator, err := txn.Get("permissions", "pool", pool.Id)
+		if err != nil {
+			return restapi.UserPermissions{}, err
+		}
+
+		for obj := poolIterator.Next(); obj != nil; obj = poolIterator.Next() {
+			users[utilities.Require[Permission](obj).UserId] = struct{}{}
+		}
+		pool.UserCount = len(users)
+
+		agentIterator, err := txn.Get("agents", "id")
+		if err != nil {
+			return restapi.UserPermissions{}, err
+		}
+
+		for obj := agentIterator.Next(); obj != nil; obj = agentIterator.Next() {
+			agent := utilities.Require[Agent](obj)
+			if agent.PoolId != pool.Id || agent.State != restapi.AgentActive {
+				continue
+			}
+
+			pool.AgentCount++
+			for _, session := range agent.Sessions {
+				if session.State == restapi.SessionActive {
+					pool.SessionCount++
+				}
+			}
+		}
+
+		if result.Permissions == nil {
+			result.Permissions = make(map[restapi.Permission][]restapi.Pool)
+		}
+		result.Permissions[userPermission.Permission] = append(result.Permissions[userPermission.Permission], pool)
+	}
+
+	return result, nil
 }
 
-func (driver *storageDriver) RemovePermission(poolId string, userId string, permission restapi.Permission) error {
-	// TODO
-	return nil
+func (driver *storageDriver) GetPoolPermissions(id string) (restapi.PoolPermissions, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("permissions", "pool", id)
+	if err != nil {
+		return restapi.PoolPermissions{}, err
+	}
+
+	result := restapi.PoolPermissions{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		userPermission := utilities.Require[Permission](obj)
+		if result.UserIds == nil {
+			result.UserIds = make(map[string][]restapi.Permission)
+		}
+		result.UserIds[userPermission.UserId] = append(result.UserIds[userPermission.UserId], userPermission.Permission)
+	}
 
+	return result, nil
 }
 
-func (driver *storageDriver) GetPermissions(userId string) (restapi.UserPermissions, error) {
-	// TODO
-	return restapi.UserPermissions{}, nil
+func (driver *storageDriver) AcquireLease(name string, holder string, duration time.Duration) (bool, error) {
+	now := time.Now()
+
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("leases", "id", name)
+	if err != nil {
+		txn.Abort()
+		return false, err
+	}
+
+	if obj != nil {
+		lease := utilities.Require[Lease](obj)
+		if lease.Holder != holder && !lease.ExpiresAt.Before(now) {
+			txn.Abort()
+			return false, nil
+		}
+	}
+
+	err = txn.Insert("leases", Lease{
+		Name:      name,
+		Holder:    holder,
+		ExpiresAt: now.Add(duration),
+	})
+	if err != nil {
+		txn.Abort()
+		return false, err
+	}
+
+	txn.Commit()
+	return true, nil
 }
 
-func (driver *storageDriver) GetPoolPermissions(id string) (restapi.PoolPermissions, error) {
-	// TODO
-	return restapi.PoolPermissions{}, nil
+func (driver *storageDriver) ReleaseLease(name string, holder string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("leases", "id", name)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil || utilities.Require[Lease](obj).Holder != holder {
+		txn.Abort()
+		return nil
+	}
+
+	err = txn.Delete("leases", obj)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
 }
@@ -0,0 +1,190 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// The channel of the database notified of changes, so every process using a
+// postgres database is notified of them
+const ChangesChannel = "juice_changes"
+
+// A change of a session or of an agent. The agent of a session changed is set
+// when the change assigned the session to it or was reported by it. Neither
+// is set when the sessions and agents changed are unknown, such as when
+// notifications were missed, so every session and agent may have changed.
+type Change struct {
+	SessionId string `json:"sessionId,omitempty"`
+	AgentId   string `json:"agentId,omitempty"`
+}
+
+func SessionChanged(id string) Change {
+	return Change{SessionId: id}
+}
+
+func SessionOfAgentChanged(id string, agentId string) Change {
+	return Change{SessionId: id, AgentId: agentId}
+}
+
+func AgentChanged(id string) Change {
+	return Change{AgentId: id}
+}
+
+// The changes of the update of an agent, the sessions of an agent closing
+// are unknown
+func AgentUpdateChanges(update restapi.AgentUpdate) []Change {
+	changes := []Change{AgentChanged(update.Id)}
+	if update.State == restapi.AgentClosed {
+		return append(changes, Change{})
+	}
+
+	for id := range update.SessionsUpdate {
+		changes = append(changes, SessionOfAgentChanged(id, update.Id))
+	}
+
+	return changes
+}
+
+// The longest payload of a notification of postgres is just under 8000 bytes
+const maxChangesPayload = 7900
+
+// Encodes the changes as the payload of a notification of the database, which
+// is empty when they do not fit
+func EncodeChanges(changes []Change) string {
+	payload, err := json.Marshal(changes)
+	if err != nil || len(payload) > maxChangesPayload {
+		return ""
+	}
+
+	return string(payload)
+}
+
+// Decodes the changes of the payload of a notification, an empty or invalid
+// payload is a change of every session and agent
+func DecodeChanges(payload string) []Change {
+	var changes []Change
+	err := json.Unmarshal([]byte(payload), &changes)
+	if err != nil || len(changes) == 0 {
+		return []Change{{}}
+	}
+
+	return changes
+}
+
+// How many changes are kept for a watcher that has not retrieved them, beyond
+// which they are replaced by a change of every session and agent
+const maxPendingChanges = 1024
+
+// The changes notified to a watcher that it has not retrieved yet
+type ChangeWatcher struct {
+	signal chan struct{}
+
+	mutex   sync.Mutex
+	changes []Change
+}
+
+// Returns the channel signaled when changes are pending
+func (watcher *ChangeWatcher) Signal() <-chan struct{} {
+	return watcher.signal
+}
+
+// Returns the changes notified since they were last retrieved, in order
+func (watcher *ChangeWatcher) Changes() []Change {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	changes := watcher.changes
+	watcher.changes = nil
+	return changes
+}
+
+func (watcher *ChangeWatcher) add(changes []Change) {
+	watcher.mutex.Lock()
+	watcher.changes = append(watcher.changes, changes...)
+	if len(watcher.changes) > maxPendingChanges {
+		watcher.changes = []Change{{}}
+	}
+	watcher.mutex.Unlock()
+
+	select {
+	case watcher.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Signals the subscribers of a storage that it changed. Signals are coalesced,
+// a subscriber woken once may have missed several changes. Watchers receive
+// every change instead. The zero value is ready to use.
+type Notifier struct {
+	mutex       sync.Mutex
+	subscribers map[chan struct{}]struct{}
+	watchers    map[*ChangeWatcher]struct{}
+}
+
+// Returns the channel signaled on changes and the function ending the
+// subscription
+func (notifier *Notifier) Subscribe() (<-chan struct{}, func()) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	if notifier.subscribers == nil {
+		notifier.subscribers = map[chan struct{}]struct{}{}
+	}
+
+	channel := make(chan struct{}, 1)
+	notifier.subscribers[channel] = struct{}{}
+
+	return channel, func() {
+		notifier.mutex.Lock()
+		defer notifier.mutex.Unlock()
+
+		delete(notifier.subscribers, channel)
+	}
+}
+
+// Returns the watcher of the changes notified from now on and the function
+// ending the watch
+func (notifier *Notifier) Watch() (*ChangeWatcher, func()) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	if notifier.watchers == nil {
+		notifier.watchers = map[*ChangeWatcher]struct{}{}
+	}
+
+	watcher := &ChangeWatcher{
+		signal: make(chan struct{}, 1),
+	}
+	notifier.watchers[watcher] = struct{}{}
+
+	return watcher, func() {
+		notifier.mutex.Lock()
+		defer notifier.mutex.Unlock()
+
+		delete(notifier.watchers, watcher)
+	}
+}
+
+func (notifier *Notifier) Notify(changes ...Change) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	for channel := range notifier.subscribers {
+		// A signal already pending covers this change
+		select {
+		case channel <- struct{}{}:
+		default:
+		}
+	}
+
+	if len(changes) > 0 {
+		for watcher := range notifier.watchers {
+			watcher.add(changes)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/lib/pq"
@@ -21,8 +22,13 @@ import (
 )
 
 type storageDriver struct {
-	ctx context.Context
-	db  *sql.DB
+	ctx        context.Context
+	db         *sql.DB
+	connection string
+
+	changes    storage.Notifier
+	listenOnce sync.Once
+	listener   *pq.Listener
 }
 
 type sqlRow interface {
@@ -36,18 +42,21 @@ type tableIterator[T any] struct {
 
 	statement *sql.Stmt
 	offset    int
+	// Bound after the offset, starting at $2
+	args []any
 
 	unmarshal unmarshalFn[T]
 
 	iterator storage.Iterator[T]
 }
 
-func newIterator[T any](ctx context.Context, statement *sql.Stmt, unmarshal unmarshalFn[T]) (storage.Iterator[T], error) {
+func newIterator[T any](ctx context.Context, statement *sql.Stmt, unmarshal unmarshalFn[T], args ...any) (storage.Iterator[T], error) {
 	iterator := &tableIterator[T]{
 		ctx: ctx,
 
 		statement: statement,
 		offset:    0,
+		args:      args,
 
 		unmarshal: unmarshal,
 	}
@@ -63,7 +72,7 @@ func newIterator[T any](ctx context.Context, statement *sql.Stmt, unmarshal unma
 }
 
 func (iterator *tableIterator[T]) retrieveRows() ([]T, error) {
-	rows, err := iterator.statement.QueryContext(iterator.ctx, iterator.offset)
+	rows, err := iterator.statement.QueryContext(iterator.ctx, append([]any{iterator.offset}, iterator.args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +118,11 @@ func (iterator *tableIterator[T]) Value() T {
 }
 
 const (
-	selectAgents = `SELECT id, state, hostname, address, version, pool_id, gpus, 
+	// Times are selected as seconds since the epoch as composite rows cannot be scanned into time.Time
+	sessionColumns = "id, state, address, version, pool_id, priority, reason, persistent, user_id, max_duration_seconds, idle_timeout_seconds, " +
+		"EXTRACT(EPOCH FROM assigned_at::timestamptz)::bigint, EXTRACT(EPOCH FROM idle_since)::bigint, requeues, gpus"
+
+	selectAgents = `SELECT id, state, hostname, address, version, pool_id, drain_deadline, gpus, 
 			( SELECT ARRAY (
 				SELECT ( SELECT row(key, value) FROM key_values WHERE id = agent_labels.key_value_id ) FROM agent_labels WHERE agent_id = agents.id
 			) ) labels, 
@@ -117,14 +130,15 @@ const (
 				SELECT ( SELECT row(key, value) FROM key_values WHERE id = agent_taints.key_value_id ) FROM agent_taints WHERE agent_id = agents.id
 			) ) taints, 
 			( SELECT ARRAY (
-				SELECT row(id, state, address, version, pool_id, gpus) FROM sessions tab WHERE tab.agent_id = agents.id AND tab.state != 'closed'
+				SELECT row(` + sessionColumns + `) FROM sessions tab WHERE tab.agent_id = agents.id AND tab.state != 'closed'
 			) ) sessions
 		FROM agents`
-	selectSessions       = "SELECT id, state, address, version, pool_id, gpus FROM sessions"
-	selectQueuedSessions = "SELECT id, requirements FROM sessions WHERE state = 'queued'"
+	selectSessions       = "SELECT " + sessionColumns + " FROM sessions"
+	selectQueuedSessions = "SELECT id, requirements, reason FROM sessions WHERE state = 'queued'"
 
-	orderBy     = " ORDER BY created_at ASC"
-	offsetLimit = " OFFSET $1 LIMIT "
+	orderBy       = " ORDER BY created_at ASC"
+	queuedOrderBy = " ORDER BY priority DESC, created_at ASC"
+	offsetLimit   = " OFFSET $1 LIMIT "
 )
 
 func selectAgentsWhere(where string) string {
@@ -141,6 +155,7 @@ func selectAgentsIteratorWhere(where string, limit int) string {
 
 func unmarshalAgent(row sqlRow) (restapi.Agent, error) {
 	var gpus []byte
+	var drainDeadline sql.NullTime
 	var labels, taints, sessions pq.ByteaArray
 
 	agent := restapi.Agent{
@@ -149,7 +164,7 @@ func unmarshalAgent(row sqlRow) (restapi.Agent, error) {
 		Sessions: make([]restapi.Session, 0),
 	}
 
-	err := row.Scan(&agent.Id, &agent.State, &agent.Hostname, &agent.Address, &agent.Version, &agent.PoolId, &gpus, &labels, &taints, &sessions)
+	err := row.Scan(&agent.Id, &agent.State, &agent.Hostname, &agent.Address, &agent.Version, &agent.PoolId, &drainDeadline, &gpus, &labels, &taints, &sessions)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = storage.ErrNotFound
@@ -158,6 +173,10 @@ func unmarshalAgent(row sqlRow) (restapi.Agent, error) {
 		return restapi.Agent{}, err
 	}
 
+	if drainDeadline.Valid {
+		agent.DrainDeadline = &drainDeadline.Time
+	}
+
 	err = json.Unmarshal(gpus, &agent.Gpus)
 	if err != nil {
 		return restapi.Agent{}, err
@@ -199,14 +218,17 @@ func selectSessionsWhere(where string) string {
 	return fmt.Sprint(selectSessions, " WHERE ", where, orderBy)
 }
 
-func unmarshalSession(row sqlRow) (restapi.Session, error) {
+// Scans the session columns followed by any extra columns into the destinations
+func unmarshalSession(row sqlRow, extra ...any) (restapi.Session, error) {
 	var session restapi.Session
 	var address []byte
 	var gpus []byte
 
 	var poolId sql.NullString
+	var assignedAt, idleSince *int64
 
-	err := row.Scan(&session.Id, &session.State, &address, &session.Version, &poolId, &gpus)
+	err := row.Scan(append([]any{&session.Id, &session.State, &address, &session.Version, &poolId, &session.Priority, &session.Reason,
+		&session.Persistent, &session.UserId, &session.MaxDurationSeconds, &session.IdleTimeoutSeconds, &assignedAt, &idleSince, &session.Requeues, &gpus}, extra...)...)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -217,6 +239,8 @@ func unmarshalSession(row sqlRow) (restapi.Session, error) {
 	}
 
 	session.PoolId = poolId.String
+	session.AssignedAt = timeFromUnix(assignedAt)
+	session.IdleSince = timeFromUnix(idleSince)
 
 	if address == nil {
 		session.Address = ""
@@ -236,19 +260,28 @@ func unmarshalSession(row sqlRow) (restapi.Session, error) {
 	return session, nil
 }
 
+func timeFromUnix(seconds *int64) *time.Time {
+	if seconds == nil {
+		return nil
+	}
+
+	value := time.Unix(*seconds, 0)
+	return &value
+}
+
 func selectQueuedSessionsWhere(where string) string {
 	return fmt.Sprint(selectQueuedSessions, " AND ", where, orderBy)
 }
 
 func selectQueuedSessionsIteratorWhere(where string, limit int) string {
-	return fmt.Sprint(selectQueuedSessions, " AND ", where, orderBy, offsetLimit, limit)
+	return fmt.Sprint(selectQueuedSessions, " AND ", where, queuedOrderBy, offsetLimit, limit)
 }
 
 func unmarshalQueuedSession(row sqlRow) (storage.QueuedSession, error) {
 	session := storage.QueuedSession{}
 
 	var requirements string
-	err := row.Scan(&session.Id, &requirements)
+	err := row.Scan(&session.Id, &requirements, &session.Reason)
 	if err != nil {
 		return storage.QueuedSession{}, err
 	}
@@ -268,13 +301,78 @@ func OpenStorage(ctx context.Context, connection string) (storage.Storage, error
 	}
 
 	return &storageDriver{
-		ctx: ctx,
-		db:  db,
+		ctx:        ctx,
+		db:         db,
+		connection: connection,
 	}, nil
 }
 
 func (driver *storageDriver) Close() error {
-	return driver.db.Close()
+	// Waits for a listener being started
+	driver.listenOnce.Do(func() {})
+
+	var err error
+	if driver.listener != nil {
+		err = driver.listener.Close()
+	}
+
+	return errors.Join(err, driver.db.Close())
+}
+
+func (driver *storageDriver) SubscribeChanges() (<-chan struct{}, func()) {
+	driver.listenOnce.Do(driver.listen)
+	return driver.changes.Subscribe()
+}
+
+func (driver *storageDriver) WatchChanges() (*storage.ChangeWatcher, func()) {
+	driver.listenOnce.Do(driver.listen)
+	return driver.changes.Watch()
+}
+
+func (driver *storageDriver) listen() {
+	driver.listener = pq.NewListener(driver.connection, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Warningf("unable to listen for changes, %v", err)
+		}
+	})
+
+	err := driver.listener.Listen(storage.ChangesChannel)
+	if err != nil {
+		logger.Warningf("unable to listen for changes, %v", err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-driver.ctx.Done():
+				return
+
+			case notification, ok := <-driver.listener.Notify:
+				if !ok {
+					return
+				}
+
+				// A nil notification follows a reconnection, changes may have been missed meanwhile
+				if notification == nil {
+					driver.changes.Notify(storage.Change{})
+				} else {
+					driver.changes.Notify(storage.DecodeChanges(notification.Extra)...)
+				}
+			}
+		}
+	}()
+}
+
+// Notifies every listener of the changes when they succeeded
+func (driver *storageDriver) notifyChanges(err error, changes ...storage.Change) error {
+	if err == nil {
+		_, err_ := driver.db.ExecContext(driver.ctx, "SELECT pg_notify($1, $2)", storage.ChangesChannel, storage.EncodeChanges(changes))
+		if err_ != nil {
+			logger.Warningf("unable to notify changes, %v", err_)
+		}
+	}
+
+	return err
 }
 
 func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
@@ -357,7 +455,7 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 			data.VramUsed += gpu.Metrics.VramUsed
 			data.VramUsedByGpuName[gpu.Name] += gpu.Metrics.VramUsed
 
-			gb := int((gpu.Vram - gpu.Metrics.VramUsed) / (1024 * 1024 * 1024))
+			gb := storage.VramGBAvailable(gpu)
 			vramGBAvailable[gb]++
 
 			if _, ok := vramGBAvailableByGpuName[gpu.Name]; !ok {
@@ -384,71 +482,9 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 			data.UtilizationByGpuName[key] = float64(value) / float64(data.Gpus)
 		}
 
-		calculatePercentiles := func(counts map[int]int, total int) storage.Percentile[int] {
-			if len(counts) > 0 {
-				sortedKeys := []int{}
-				for key := range counts {
-					sortedKeys = append(sortedKeys, key)
-				}
-				sort.Ints(sortedKeys)
-
-				indexP90 := int(float64(total) * 0.90)
-				indexP75 := int(float64(total) * 0.75)
-				indexP50 := int(float64(total) * 0.50)
-				indexP25 := int(float64(total) * 0.25)
-				indexP10 := int(float64(total) * 0.10)
-
-				percentile := storage.Percentile[int]{
-					P100: sortedKeys[len(sortedKeys)-1],
-				}
-
-				index := 0
-				keysIndex := 0
-				key := sortedKeys[keysIndex]
-				for keysIndex < len(sortedKeys) && index < indexP10 {
-					key = sortedKeys[keysIndex]
-					index += counts[key]
-					keysIndex++
-				}
-				percentile.P10 = key
-
-				for keysIndex < len(sortedKeys) && index < indexP25 {
-					key = sortedKeys[keysIndex]
-					index += counts[key]
-					keysIndex++
-				}
-				percentile.P25 = key
-
-				for keysIndex < len(sortedKeys) && index < indexP50 {
-					key = sortedKeys[keysIndex]
-					index += counts[key]
-					keysIndex++
-				}
-				percentile.P50 = key
-
-				for keysIndex < len(sortedKeys) && index < indexP75 {
-					key = sortedKeys[keysIndex]
-					index += counts[key]
-					keysIndex++
-				}
-				percentile.P75 = key
-
-				for keysIndex < len(sortedKeys) && index < indexP90 {
-					key = sortedKeys[keysIndex]
-					index += counts[key]
-					keysIndex++
-				}
-				percentile.P90 = key
-
-				return percentile
-			}
-
-			return storage.Percentile[int]{}
-		}
-
-		data.VramGBAvailable = calculatePercentiles(vramGBAvailable, data.Gpus)
+		data.VramGBAvailable = storage.PercentilesOfCounts(vramGBAvailable, data.Gpus)
 		for key, gbAvailable := range vramGBAvailableByGpuName {
-			data.VramGBAvailableByGpuName[key] = calculatePercentiles(gbAvailable, data.GpusByGpuName[key])
+			data.VramGBAvailableByGpuName[key] = storage.PercentilesOfCounts(gbAvailable, data.GpusByGpuName[key])
 		}
 	}
 
@@ -518,13 +554,96 @@ func (driver *storageDriver) RegisterAgent(agent restapi.Agent) (string, error)
 		}
 	}
 
-	return id, tx.Commit()
+	return id, driver.notifyChanges(tx.Commit(), storage.AgentChanged(id))
 }
 
 func (driver *storageDriver) GetAgentById(id string) (restapi.Agent, error) {
 	return unmarshalAgent(driver.db.QueryRowContext(driver.ctx, selectAgentsWhere("id = $1"), id))
 }
 
+func (driver *storageDriver) SetAgentTaints(agentId string, taints map[string]string) error {
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var id string
+	err = tx.QueryRowContext(driver.ctx, "SELECT id FROM agents WHERE id = $1 FOR UPDATE", agentId).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, "DELETE FROM agent_taints WHERE agent_id = $1", id)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	for key, value := range taints {
+		_, err = tx.ExecContext(driver.ctx, "INSERT INTO key_values ("+
+			"key, value"+
+			") VALUES ("+
+			"$1, $2"+
+			") ON CONFLICT DO NOTHING", key, value)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		_, err = tx.ExecContext(driver.ctx, "INSERT INTO agent_taints ("+
+			"agent_id, key_value_id"+
+			") VALUES ("+
+			"$1, (SELECT id FROM key_values WHERE key = $2 AND value = $3)"+
+			")", id, key, value)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+
+	return driver.notifyChanges(tx.Commit(), storage.AgentChanged(agentId))
+}
+
+func (driver *storageDriver) SetAgentDisabled(agentId string, disabled bool, drainDeadline *time.Time) error {
+	state := restapi.AgentActive
+	if disabled {
+		state = restapi.AgentDisabled
+	} else {
+		drainDeadline = nil
+	}
+
+	var id string
+	err := driver.db.QueryRowContext(driver.ctx, `UPDATE agents SET state = CASE WHEN state IN ('active', 'disabled') THEN $1::agent_state ELSE state END,
+		drain_deadline = CASE WHEN state IN ('active', 'disabled') THEN $2 ELSE drain_deadline END
+		WHERE id = $3 RETURNING id`, state, drainDeadline, agentId).Scan(&id)
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+
+	return driver.notifyChanges(err, storage.AgentChanged(agentId))
+}
+
+func (driver *storageDriver) GetSessionsOfDrainedAgents() ([]string, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, `SELECT s.id FROM sessions s JOIN agents a ON a.id = s.agent_id
+		WHERE a.state = 'disabled' AND a.drain_deadline <= now() AND s.state IN ('assigned', 'active')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	var gpusData []byte
 	err := driver.db.QueryRowContext(driver.ctx, "SELECT gpus FROM agents WHERE id = $1", update.Id).Scan(&gpusData)
@@ -554,7 +673,18 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 
 	for id, sessionUpdate := range update.SessionsUpdate {
 
-		_, err = tx.ExecContext(driver.ctx, "UPDATE sessions SET state = $1 WHERE id = $2", sessionUpdate.State, id)
+		_, err = tx.ExecContext(driver.ctx, `UPDATE sessions SET state = $1,
+			reason = CASE WHEN $2 = '' THEN reason ELSE $2 END,
+			idle_since = CASE WHEN $3 THEN COALESCE(idle_since, now()) ELSE NULL END
+			WHERE id = $4 AND agent_id = $5`, sessionUpdate.State, sessionUpdate.Reason, sessionUpdate.Idle, id, update.Id)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		_, err = tx.ExecContext(driver.ctx, `UPDATE usage_records SET
+			active_at = CASE WHEN $1 = 'active' THEN COALESCE(active_at, now()) ELSE active_at END,
+			closed_at = CASE WHEN $1 = 'closed' THEN COALESCE(closed_at, now()) ELSE closed_at END
+			WHERE session_id = $2 AND agent_id = $3`, sessionUpdate.State, id, update.Id)
 		if err != nil {
 			return errors.Join(err, tx.Rollback())
 		}
@@ -569,11 +699,19 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 			if err != nil {
 				return errors.Join(err, tx.Rollback())
 			}
+
+			_, err = tx.ExecContext(driver.ctx, `UPDATE usage_records SET exit_codes = exit_codes || jsonb_build_object($1::text, $2::int)
+				WHERE session_id = $3`, connectionUpdate.Id, connectionUpdate.ExitCode, id)
+			if err != nil {
+				return errors.Join(err, tx.Rollback())
+			}
 		}
 	}
 
 	if update.State != "" {
-		_, err = tx.ExecContext(driver.ctx, "UPDATE agents SET state = $1, gpus = $2, updated_at = now() WHERE id = $3", update.State, gpusData, update.Id)
+		_, err = tx.ExecContext(driver.ctx, `UPDATE agents SET
+			state = CASE WHEN state = 'disabled' AND $1::agent_state = 'active' THEN state ELSE $1::agent_state END,
+			gpus = $2, updated_at = now() WHERE id = $3`, update.State, gpusData, update.Id)
 	} else {
 		_, err = tx.ExecContext(driver.ctx, "UPDATE agents SET gpus = $1, updated_at = now() WHERE id = $2", gpusData, update.Id)
 	}
@@ -582,7 +720,7 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 		return errors.Join(err, tx.Rollback())
 	}
 
-	return tx.Commit()
+	return driver.notifyChanges(tx.Commit(), storage.AgentUpdateChanges(update)...)
 }
 
 func NewNullString(s string) sql.NullString {
@@ -608,12 +746,20 @@ func (driver *storageDriver) RequestSession(sessionRequirements restapi.SessionR
 
 	var id string
 	err = tx.QueryRowContext(driver.ctx, "INSERT INTO sessions ("+
-		"state, version, pool_id, requirements, vram_required, updated_at"+
+		"state, version, pool_id, priority, requirements, vram_required, max_duration_seconds, idle_timeout_seconds, persistent, user_id, lease_renewed_at, updated_at"+
 		") VALUES ("+
-		"$1, $2, $3, $4, $5, $6, now()"+
+		"$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, now(), now()"+
 		") RETURNING id",
 		restapi.SessionQueued, sessionRequirements.Version, NewNullString(sessionRequirements.PoolId),
-		requirements, storage.TotalVramRequired(sessionRequirements)).Scan(&id)
+		sessionRequirements.Priority, requirements, storage.TotalVramRequired(sessionRequirements),
+		sessionRequirements.MaxDurationSeconds, sessionRequirements.IdleTimeoutSeconds,
+		sessionRequirements.Persistent, sessionRequirements.UserId).Scan(&id)
+	if err != nil {
+		return "", errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, `INSERT INTO usage_records (session_id, user_id, pool_id, vram_required)
+		VALUES ($1, $2, $3, $4)`, id, sessionRequirements.UserId, sessionRequirements.PoolId, storage.TotalVramRequired(sessionRequirements))
 	if err != nil {
 		return "", errors.Join(err, tx.Rollback())
 	}
@@ -658,7 +804,7 @@ func (driver *storageDriver) RequestSession(sessionRequirements restapi.SessionR
 		}
 	}
 
-	return id, tx.Commit()
+	return id, driver.notifyChanges(tx.Commit(), storage.SessionChanged(id))
 }
 
 func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu) error {
@@ -681,21 +827,175 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 
 	_, err = tx.ExecContext(driver.ctx, `UPDATE sessions SET agent_id = $1, state = $2, address = (
 			SELECT address FROM agents WHERE id = $1
-		), gpus = $3, updated_at = now() WHERE id = $4`, agentId, restapi.SessionAssigned, gpusData, sessionId)
+		), gpus = $3, reason = '', assigned_at = now(), updated_at = now() WHERE id = $4`, agentId, restapi.SessionAssigned, gpusData, sessionId)
 	if err != nil {
 		return errors.Join(err, tx.Rollback())
 	}
 
-	return tx.Commit()
+	_, err = tx.ExecContext(driver.ctx, `UPDATE usage_records SET agent_id = $1, gpus = $2, assigned_at = now(), active_at = NULL
+		WHERE session_id = $3`, agentId, gpusData, sessionId)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return driver.notifyChanges(tx.Commit(), storage.SessionOfAgentChanged(sessionId, agentId))
 }
 
 func (driver *storageDriver) CancelSession(sessionId string) error {
-	_, err := driver.db.ExecContext(driver.ctx, `UPDATE sessions s SET
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, `UPDATE sessions s SET
 		state = CASE WHEN s.agent_id IS NULL
 					THEN 'closed'::session_state
 					ELSE 'canceling'::session_state
 				END
 		WHERE s.id = $1`, sessionId)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, `UPDATE usage_records SET closed_at = now()
+		WHERE session_id = $1 AND closed_at IS NULL
+		AND (SELECT state FROM sessions WHERE id = $1) = 'closed'`, sessionId)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return driver.notifyChanges(tx.Commit(), storage.SessionChanged(sessionId))
+}
+
+func (driver *storageDriver) GetSessionsOfMissingAgents(duration time.Duration) ([]restapi.Session, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, selectSessionsWhere(`state IN ('assigned', 'active')
+		AND agent_id IN (SELECT id FROM agents WHERE state = 'missing'
+			OR (state = 'disabled' AND updated_at <= now()-make_interval(secs=>$1)))`), duration.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []restapi.Session{}
+	for rows.Next() {
+		session, err := unmarshalSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (driver *storageDriver) DetachSession(sessionId string, requeue bool) error {
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, `UPDATE agents a SET vram_available = a.vram_available + s.vram_required
+		FROM sessions s WHERE s.id = $1 AND a.id = s.agent_id AND s.state != 'closed'`, sessionId)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	state := restapi.SessionClosed
+	requeues := 0
+	if requeue {
+		state = restapi.SessionQueued
+		requeues = 1
+	}
+
+	_, err = tx.ExecContext(driver.ctx, `UPDATE sessions SET agent_id = NULL, address = NULL, gpus = NULL,
+		assigned_at = NULL, idle_since = NULL, state = $1, requeues = requeues + $2, updated_at = now()
+		WHERE id = $3 AND agent_id IS NOT NULL`, state, requeues, sessionId)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	if !requeue {
+		_, err = tx.ExecContext(driver.ctx, "UPDATE usage_records SET closed_at = now() WHERE session_id = $1 AND closed_at IS NULL", sessionId)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+
+	return driver.notifyChanges(tx.Commit(), storage.SessionChanged(sessionId))
+}
+
+func unmarshalUsageRecord(row sqlRow) (restapi.UsageRecord, error) {
+	var record restapi.UsageRecord
+	var gpus, exitCodesData []byte
+	var assignedAt, activeAt, closedAt sql.NullTime
+
+	err := row.Scan(&record.SessionId, &record.UserId, &record.PoolId, &record.AgentId, &gpus, &record.VramRequired,
+		&record.QueuedAt, &assignedAt, &activeAt, &closedAt, &exitCodesData)
+	if err != nil {
+		return restapi.UsageRecord{}, err
+	}
+
+	if assignedAt.Valid {
+		record.AssignedAt = &assignedAt.Time
+	}
+	if activeAt.Valid {
+		record.ActiveAt = &activeAt.Time
+	}
+	if closedAt.Valid {
+		record.ClosedAt = &closedAt.Time
+	}
+
+	if gpus != nil {
+		err = json.Unmarshal(gpus, &record.Gpus)
+		if err != nil {
+			return restapi.UsageRecord{}, err
+		}
+	}
+
+	exitCodes := map[string]int{}
+	err = json.Unmarshal(exitCodesData, &exitCodes)
+	if err != nil {
+		return restapi.UsageRecord{}, err
+	}
+
+	ids := make([]string, 0, len(exitCodes))
+	for id := range exitCodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	record.Connections = len(ids)
+	record.ExitCodes = make([]int, 0, len(ids))
+	for _, id := range ids {
+		record.ExitCodes = append(record.ExitCodes, exitCodes[id])
+	}
+
+	return record, nil
+}
+
+func (driver *storageDriver) GetUsageRecords(start time.Time, end time.Time) (storage.Iterator[restapi.UsageRecord], error) {
+	rows, err := driver.db.QueryContext(driver.ctx, `SELECT session_id, user_id, pool_id, agent_id, gpus, vram_required,
+		queued_at, assigned_at, active_at, closed_at, exit_codes FROM usage_records
+		WHERE queued_at < $1 AND (closed_at IS NULL OR closed_at >= $2) ORDER BY queued_at ASC`, end, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []restapi.UsageRecord{}
+	for rows.Next() {
+		record, err := unmarshalUsageRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return storage.NewDefaultIterator(records), rows.Err()
+}
+
+func (driver *storageDriver) SetSessionReason(sessionId string, reason string) error {
+	_, err := driver.db.ExecContext(driver.ctx, "UPDATE sessions SET reason = $1 WHERE id = $2", reason, sessionId)
 	return err
 }
 
@@ -721,65 +1021,429 @@ func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error)
 
 }
 
-func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
-	return unmarshalQueuedSession(driver.db.QueryRowContext(driver.ctx, selectQueuedSessionsWhere("id = $1"), id))
-}
-
-func (driver *storageDriver) GetAgents(poolId string) (storage.Iterator[restapi.Agent], error) {
-	var statement *sql.Stmt
-	var err error
+func (driver *storageDriver) RenewSessionLease(sessionId string) error {
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE sessions SET lease_renewed_at = now() WHERE id = $1", sessionId)
+	if err != nil {
+		return err
+	}
 
-	if poolId != "" {
-		statement, err = driver.db.PrepareContext(driver.ctx, selectAgentsIteratorWhere(fmt.Sprintf("pool_id = '%s' AND state = 'active'", poolId), 20))
-	} else {
-		statement, err = driver.db.PrepareContext(driver.ctx, selectAgentsIteratorWhere("state = 'active'", 20))
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = storage.ErrNotFound
 	}
+	return err
+}
 
+func (driver *storageDriver) GetSessionsWithExpiredLease(defaultLease time.Duration) ([]string, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, `SELECT s.id FROM sessions s LEFT JOIN pools p ON p.id = s.pool_id
+		WHERE s.state IN ('queued', 'assigned', 'active') AND NOT s.persistent
+			AND COALESCE(NULLIF(p.lease_seconds, 0)::double precision, $1) > 0
+			AND s.lease_renewed_at <= now() - make_interval(secs => COALESCE(NULLIF(p.lease_seconds, 0)::double precision, $1))`,
+		defaultLease.Seconds())
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
 
-	return newIterator(driver.ctx, statement, unmarshalAgent)
+	return ids, rows.Err()
 }
 
-func (driver *storageDriver) GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
-	statement, err := driver.db.PrepareContext(driver.ctx, selectAgentsIteratorWhere(
-		fmt.Sprint("state = 'active' AND vram_available >= ", totalAvailableVramAtLeast), 20))
+func (driver *storageDriver) GetPersistentSessions(userId string) (storage.Iterator[restapi.Session], error) {
+	rows, err := driver.db.QueryContext(driver.ctx, selectSessionsWhere("persistent AND user_id = $1 AND state != 'closed'"), userId)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return newIterator(driver.ctx, statement, unmarshalAgent)
-}
+	sessions := []restapi.Session{}
+	for rows.Next() {
+		session, err := unmarshalSession(rows)
+		if err != nil {
+			return nil, err
+		}
 
-func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
-	statement, err := driver.db.PrepareContext(driver.ctx, selectQueuedSessionsIteratorWhere("state = 'queued'", 20))
+		sessions = append(sessions, session)
+	}
+
+	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	return newIterator(driver.ctx, statement, unmarshalQueuedSession)
+	return storage.NewDefaultIterator(sessions), nil
 }
 
-func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
-	_, err := driver.db.ExecContext(driver.ctx, "UPDATE agents SET state = 'missing', updated_at = now() WHERE state = 'active' AND updated_at <= now()-make_interval(secs=>$1)", duration.Seconds())
-	return err
-}
+// Returns the conditions and order of the session query and their arguments
+func sessionQueryWhere(query storage.SessionQuery) (string, string, []any) {
+	where := "TRUE"
+	args := []any{}
 
-func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
-	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM agents WHERE state = 'missing' AND updated_at <= now()-make_interval(secs=>$1)", duration.Seconds())
-	return err
-}
+	arg := func(value any) int {
+		args = append(args, value)
+		return len(args)
+	}
+
+	if len(query.States) > 0 {
+		where = fmt.Sprintf("%s AND state::text = ANY($%d)", where, arg(pq.Array(query.States)))
+	}
+	if query.PoolId != "" {
+		where = fmt.Sprintf("%s AND pool_id::text = $%d", where, arg(query.PoolId))
+	}
+	if query.AgentId != "" {
+		where = fmt.Sprintf("%s AND agent_id::text = $%d", where, arg(query.AgentId))
+	}
+	if query.UserId != "" {
+		where = fmt.Sprintf("%s AND user_id = $%d", where, arg(query.UserId))
+	}
+	if query.CreatedAfter != nil {
+		where = fmt.Sprintf("%s AND created_at > $%d", where, arg(*query.CreatedAfter))
+	}
+	if query.CreatedBefore != nil {
+		where = fmt.Sprintf("%s AND created_at < $%d", where, arg(*query.CreatedBefore))
+	}
+
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if query.After != nil {
+		if query.Sort == restapi.SessionSortPriority {
+			where = fmt.Sprintf("%s AND (priority, created_at, id::text) %s ($%d, $%d, $%d)",
+				where, comparison, arg(query.After.Priority), arg(query.After.CreatedAt), arg(query.After.Id))
+		} else {
+			where = fmt.Sprintf("%s AND (created_at, id::text) %s ($%d, $%d)",
+				where, comparison, arg(query.After.CreatedAt), arg(query.After.Id))
+		}
+	}
+
+	orderBy := fmt.Sprintf(" ORDER BY created_at %s, id::text %s", direction, direction)
+	if query.Sort == restapi.SessionSortPriority {
+		orderBy = fmt.Sprintf(" ORDER BY priority %s, created_at %s, id::text %s", direction, direction, direction)
+	}
+
+	if query.Limit > 0 {
+		orderBy = fmt.Sprint(orderBy, " LIMIT ", query.Limit)
+	}
+
+	return where, orderBy, args
+}
+
+func (driver *storageDriver) GetSessions(query storage.SessionQuery) (storage.Iterator[restapi.SessionListItem], error) {
+	where, orderBy, args := sessionQueryWhere(query)
+
+	rows, err := driver.db.QueryContext(driver.ctx, fmt.Sprint("SELECT ", sessionColumns, ", agent_id, created_at FROM sessions WHERE ", where, orderBy), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []restapi.SessionListItem{}
+	for rows.Next() {
+		var agentId sql.NullString
+		var createdAt time.Time
+
+		session, err := unmarshalSession(rows, &agentId, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, restapi.SessionListItem{
+			Session:   session,
+			AgentId:   agentId.String,
+			CreatedAt: createdAt,
+		})
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (driver *storageDriver) GetSessionRequirements(id string) (restapi.SessionRequirements, error) {
+	var data string
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT requirements FROM sessions WHERE id = $1", id).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+		return restapi.SessionRequirements{}, err
+	}
+
+	var requirements restapi.SessionRequirements
+	err = json.Unmarshal([]byte(data), &requirements)
+	if err != nil {
+		return restapi.SessionRequirements{}, err
+	}
+
+	return requirements, nil
+}
+
+func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	return unmarshalQueuedSession(driver.db.QueryRowContext(driver.ctx, selectQueuedSessionsWhere("id = $1"), id))
+}
+
+// Returns the conditions restricting the agents to the query and their arguments
+func agentQueryWhere(query storage.AgentQuery) (string, []any) {
+	args := []any{}
+
+	arg := func(value any) int {
+		args = append(args, value)
+		return len(args)
+	}
+
+	where := fmt.Sprintf("state::text = ANY($%d) AND vram_available >= %d", arg(pq.Array(query.StatesOrDefault())), query.VramAvailableAtLeast)
+
+	if query.PoolId != "" {
+		where = fmt.Sprintf("%s AND pool_id::text = $%d", where, arg(query.PoolId))
+	}
+
+	if query.HostnamePrefix != "" {
+		index := arg(query.HostnamePrefix)
+		where = fmt.Sprintf("%s AND left(hostname, char_length($%d)) = $%d", where, index, index)
+	}
+
+	if query.GpuName != "" {
+		where = fmt.Sprintf("%s AND EXISTS (SELECT 1 FROM jsonb_array_elements(gpus) gpu WHERE gpu->>'name' = $%d)", where, arg(query.GpuName))
+	}
+
+	if query.After != nil {
+		where = fmt.Sprintf("%s AND id::text > $%d", where, arg(query.After.Id))
+	}
+
+	return agentLabelsWhere(where, query.Selector(), arg), args
+}
+
+func (driver *storageDriver) GetAgents(query storage.AgentQuery) (storage.Iterator[restapi.Agent], error) {
+	where, args := agentQueryWhere(query)
+
+	statement := fmt.Sprint(selectAgents, " WHERE ", where, " ORDER BY id::text ASC")
+	if query.Limit > 0 {
+		statement = fmt.Sprint(statement, " LIMIT ", query.Limit)
+	}
+
+	rows, err := driver.db.QueryContext(driver.ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	agents := []restapi.Agent{}
+	for rows.Next() {
+		agent, err := unmarshalAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		agents = append(agents, agent)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+const agentHasLabel = "EXISTS (SELECT 1 FROM agent_labels JOIN key_values ON key_values.id = agent_labels.key_value_id " +
+	"WHERE agent_labels.agent_id = agents.id AND key_values.key = $%d"
+
+// Returns the conditions restricting the agents to the selector and their
+// arguments, numbered after the offset of the iterator
+func agentSelectorWhere(selector storage.AgentSelector) (string, []any) {
+	where := fmt.Sprint("state = 'active' AND vram_available >= ", selector.TotalAvailableVramAtLeast)
+	if selector.IncludeDisabled {
+		where = fmt.Sprint("state IN ('active', 'disabled') AND vram_available >= ", selector.TotalAvailableVramAtLeast)
+	}
+	args := []any{}
+
+	arg := func(value any) int {
+		args = append(args, value)
+		return len(args) + 1
+	}
+
+	if selector.PoolId != "" {
+		where = fmt.Sprintf("%s AND pool_id = $%d", where, arg(selector.PoolId))
+	}
+
+	return agentLabelsWhere(where, selector, arg), args
+}
+
+// Appends the conditions matching the labels of the selector, numbering the
+// arguments through arg. Gt and Lt only match label values that are integers.
+func agentLabelsWhere(where string, selector storage.AgentSelector, arg func(value any) int) string {
+	for key, value := range selector.MatchLabels {
+		where = fmt.Sprintf("%s AND "+agentHasLabel+" AND key_values.value = $%d)", where, arg(key), arg(value))
+	}
+
+	for _, expression := range selector.MatchExpressions {
+		switch expression.Operator {
+		case restapi.SelectorOpIn:
+			where = fmt.Sprintf("%s AND "+agentHasLabel+" AND key_values.value = ANY($%d))", where, arg(expression.Key), arg(pq.Array(expression.Values)))
+		case restapi.SelectorOpNotIn:
+			where = fmt.Sprintf("%s AND NOT "+agentHasLabel+" AND key_values.value = ANY($%d))", where, arg(expression.Key), arg(pq.Array(expression.Values)))
+		case restapi.SelectorOpExists:
+			where = fmt.Sprintf("%s AND "+agentHasLabel+")", where, arg(expression.Key))
+		case restapi.SelectorOpGt, restapi.SelectorOpLt:
+			operator := ">"
+			if expression.Operator == restapi.SelectorOpLt {
+				operator = "<"
+			}
+
+			value := ""
+			if len(expression.Values) > 0 {
+				value = expression.Values[0]
+			}
+
+			where = fmt.Sprintf("%s AND "+agentHasLabel+" AND key_values.value ~ '^-?[0-9]+$' AND "+
+				"(CASE WHEN key_values.value ~ '^-?[0-9]+$' THEN key_values.value::bigint END) %s $%d::bigint)",
+				where, arg(expression.Key), operator, arg(value))
+		case restapi.SelectorOpDoesNotExist:
+			where = fmt.Sprintf("%s AND NOT "+agentHasLabel+")", where, arg(expression.Key))
+		}
+	}
+
+	return where
+}
+
+func (driver *storageDriver) GetAvailableAgentsMatching(selector storage.AgentSelector) (storage.Iterator[restapi.Agent], error) {
+	where, args := agentSelectorWhere(selector)
+
+	statement, err := driver.db.PrepareContext(driver.ctx, selectAgentsIteratorWhere(where, 20))
+	if err != nil {
+		return nil, err
+	}
+
+	return newIterator(driver.ctx, statement, unmarshalAgent, args...)
+}
+
+func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	statement, err := driver.db.PrepareContext(driver.ctx, selectQueuedSessionsIteratorWhere("state = 'queued'", 20))
+	if err != nil {
+		return nil, err
+	}
+
+	return newIterator(driver.ctx, statement, unmarshalQueuedSession)
+}
+
+func (driver *storageDriver) CountQueuedSessionsAhead(sessionId string) (int, error) {
+	var count int
+	err := driver.db.QueryRowContext(driver.ctx, `SELECT COUNT(*) FROM sessions s, sessions q
+		WHERE s.id = $1 AND q.state = 'queued'
+			AND (s.pool_id IS NULL OR q.pool_id = s.pool_id)
+			AND (q.priority > s.priority OR (q.priority = s.priority AND q.created_at < s.created_at))`, sessionId).Scan(&count)
+	return count, err
+}
+
+func (driver *storageDriver) CountSessionsAssignedSince(poolId string, since time.Time) (int, error) {
+	var count int
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT COUNT(*) FROM sessions WHERE assigned_at >= $1 AND ($2 = '' OR pool_id::text = $2)",
+		since, poolId).Scan(&count)
+	return count, err
+}
+
+func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
+	rows, err := driver.db.QueryContext(driver.ctx, "UPDATE agents SET state = 'missing', updated_at = now() WHERE state = 'active' AND updated_at <= now()-make_interval(secs=>$1) RETURNING id", duration.Seconds())
+	if err != nil {
+		return err
+	}
+
+	return driver.notifyAgentsChanged(rows)
+}
+
+func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
+	rows, err := driver.db.QueryContext(driver.ctx, "DELETE FROM agents WHERE state IN ('missing', 'disabled') AND updated_at <= now()-make_interval(secs=>$1) RETURNING id", duration.Seconds())
+	if err != nil {
+		return err
+	}
+
+	return driver.notifyAgentsChanged(rows)
+}
+
+// Notifies the changes of the agents whose ids are the rows, if any
+func (driver *storageDriver) notifyAgentsChanged(rows *sql.Rows) error {
+	defer rows.Close()
+
+	changes := []storage.Change{}
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		changes = append(changes, storage.AgentChanged(id))
+	}
+
+	err := rows.Err()
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	return driver.notifyChanges(nil, changes...)
+}
+
+func (driver *storageDriver) AcquireLease(name string, holder string, duration time.Duration) (bool, error) {
+	var acquired string
+	err := driver.db.QueryRowContext(driver.ctx, `INSERT INTO leases (name, holder, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+			WHERE leases.holder = EXCLUDED.holder OR leases.expires_at < now()
+		RETURNING holder`, name, holder, duration.Seconds()).Scan(&acquired)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (driver *storageDriver) ReleaseLease(name string, holder string) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM leases WHERE name = $1 AND holder = $2", name, holder)
+	return err
+}
 
 func (driver *storageDriver) DeletePool(id string) error {
 	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM pools WHERE id = $1", id)
 	return err
 }
 
+// The sessions allocated in a pool, sessions without a pool count towards the pool of their agent
+const poolSessionsWhere = `(pool_id = pools.id OR (pool_id IS NULL AND agent_id IN (SELECT id FROM agents WHERE agents.pool_id = pools.id)))
+		AND state IN ('assigned', 'active', 'canceling')`
+
+func (driver *storageDriver) CountPools() (int, error) {
+	var count int
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT COUNT(*) FROM pools").Scan(&count)
+	return count, err
+}
+
 func (driver *storageDriver) GetPool(id string) (restapi.Pool, error) {
-	row := driver.db.QueryRowContext(driver.ctx, "SELECT id, pool_name FROM pools WHERE id = $1", id)
+	row := driver.db.QueryRowContext(driver.ctx, `SELECT id, pool_name, max_sessions, max_vram, max_gpus,
+		default_max_duration_seconds, max_duration_cap_seconds, default_idle_timeout_seconds, idle_timeout_cap_seconds, lease_seconds, max_priority,
+		(SELECT COUNT(*) FROM sessions WHERE `+poolSessionsWhere+`),
+		(SELECT COALESCE(SUM(vram_required), 0) FROM sessions WHERE `+poolSessionsWhere+`),
+		(SELECT COALESCE(SUM(jsonb_array_length(gpus)), 0) FROM sessions WHERE `+poolSessionsWhere+`)
+		FROM pools WHERE id = $1`, id)
 	var pool restapi.Pool
-	err := row.Scan(&pool.Id, &pool.Name)
+	err := row.Scan(&pool.Id, &pool.Name, &pool.Quotas.MaxSessions, &pool.Quotas.MaxVram, &pool.Quotas.MaxGpus,
+		&pool.SessionLimits.DefaultMaxDurationSeconds, &pool.SessionLimits.MaxDurationCapSeconds,
+		&pool.SessionLimits.DefaultIdleTimeoutSeconds, &pool.SessionLimits.IdleTimeoutCapSeconds, &pool.SessionLimits.LeaseSeconds,
+		&pool.SessionLimits.MaxPriority, &pool.Usage.Sessions, &pool.Usage.Vram, &pool.Usage.Gpus)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = storage.ErrNotFound
@@ -789,6 +1453,36 @@ func (driver *storageDriver) GetPool(id string) (restapi.Pool, error) {
 	return pool, nil
 }
 
+func (driver *storageDriver) SetPoolQuotas(id string, quotas restapi.PoolQuotas) error {
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE pools SET max_sessions = $1, max_vram = $2, max_gpus = $3 WHERE id = $4",
+		quotas.MaxSessions, quotas.MaxVram, quotas.MaxGpus, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
+func (driver *storageDriver) SetPoolSessionLimits(id string, limits restapi.PoolSessionLimits) error {
+	result, err := driver.db.ExecContext(driver.ctx, `UPDATE pools SET default_max_duration_seconds = $1, max_duration_cap_seconds = $2,
+		default_idle_timeout_seconds = $3, idle_timeout_cap_seconds = $4, lease_seconds = $5, max_priority = $6 WHERE id = $7`,
+		limits.DefaultMaxDurationSeconds, limits.MaxDurationCapSeconds, limits.DefaultIdleTimeoutSeconds, limits.IdleTimeoutCapSeconds,
+		limits.LeaseSeconds, limits.MaxPriority, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
 func (driver *storageDriver) CreatePool(name string) (restapi.Pool, error) {
 	tx, err := driver.db.BeginTx(driver.ctx, nil)
 	if err != nil {
@@ -809,6 +1503,255 @@ func (driver *storageDriver) CreatePool(name string) (restapi.Pool, error) {
 	return pool, nil
 }
 
+const selectReservations = "SELECT id, COALESCE(pool_id::text, ''), COALESCE(agent_id::text, ''), gpus, starts_at, ends_at FROM reservations"
+
+func unmarshalReservation(row sqlRow) (restapi.Reservation, error) {
+	reservation := restapi.Reservation{}
+
+	var gpus []byte
+	err := row.Scan(&reservation.Id, &reservation.PoolId, &reservation.AgentId, &gpus, &reservation.Start, &reservation.End)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+		return restapi.Reservation{}, err
+	}
+
+	err = json.Unmarshal(gpus, &reservation.Gpus)
+	if err != nil {
+		return restapi.Reservation{}, err
+	}
+
+	return reservation, nil
+}
+
+func (driver *storageDriver) CreateReservation(reservation restapi.Reservation) (restapi.Reservation, error) {
+	gpus, err := json.Marshal(reservation.Gpus)
+	if err != nil {
+		return restapi.Reservation{}, err
+	}
+
+	// The columns do not store a time zone
+	reservation.Start = reservation.Start.UTC()
+	reservation.End = reservation.End.UTC()
+
+	err = driver.db.QueryRowContext(driver.ctx, "INSERT INTO reservations ("+
+		"pool_id, agent_id, gpus, starts_at, ends_at"+
+		") VALUES ("+
+		"NULLIF($1, '')::uuid, NULLIF($2, '')::uuid, $3, $4, $5"+
+		") RETURNING id", reservation.PoolId, reservation.AgentId, gpus, reservation.Start, reservation.End).Scan(&reservation.Id)
+	if err != nil {
+		return restapi.Reservation{}, err
+	}
+
+	return reservation, nil
+}
+
+func (driver *storageDriver) GetReservation(id string) (restapi.Reservation, error) {
+	return unmarshalReservation(driver.db.QueryRowContext(driver.ctx, fmt.Sprint(selectReservations, " WHERE id = $1"), id))
+}
+
+func (driver *storageDriver) GetReservations(endingAfter time.Time) (storage.Iterator[restapi.Reservation], error) {
+	rows, err := driver.db.QueryContext(driver.ctx, fmt.Sprint(selectReservations, " WHERE ends_at > $1 ORDER BY starts_at ASC"), endingAfter.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []restapi.Reservation{}
+	for rows.Next() {
+		reservation, err := unmarshalReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return storage.NewDefaultIterator(reservations), rows.Err()
+}
+
+func (driver *storageDriver) DeleteReservation(id string) error {
+	result, err := driver.db.ExecContext(driver.ctx, "DELETE FROM reservations WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
+const selectWebhookSubscriptions = "SELECT id, url, event_types, COALESCE(pool_id::text, ''), format, secret, created_at FROM webhook_subscriptions"
+
+func unmarshalWebhookSubscription(row sqlRow) (restapi.WebhookSubscription, error) {
+	subscription := restapi.WebhookSubscription{}
+
+	var eventTypes []byte
+	err := row.Scan(&subscription.Id, &subscription.Url, &eventTypes, &subscription.PoolId, &subscription.Format, &subscription.Secret, &subscription.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+		return restapi.WebhookSubscription{}, err
+	}
+
+	err = json.Unmarshal(eventTypes, &subscription.EventTypes)
+	if err != nil {
+		return restapi.WebhookSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+func (driver *storageDriver) CreateWebhookSubscription(subscription restapi.WebhookSubscription) (restapi.WebhookSubscription, error) {
+	eventTypes, err := json.Marshal(subscription.EventTypes)
+	if err != nil {
+		return restapi.WebhookSubscription{}, err
+	}
+
+	err = driver.db.QueryRowContext(driver.ctx, "INSERT INTO webhook_subscriptions ("+
+		"url, event_types, pool_id, format, secret"+
+		") VALUES ("+
+		"$1, $2, NULLIF($3, '')::uuid, $4, $5"+
+		") RETURNING id, created_at", subscription.Url, eventTypes, subscription.PoolId, subscription.Format, subscription.Secret).Scan(&subscription.Id, &subscription.CreatedAt)
+	if err != nil {
+		return restapi.WebhookSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+func (driver *storageDriver) GetWebhookSubscription(id string) (restapi.WebhookSubscription, error) {
+	return unmarshalWebhookSubscription(driver.db.QueryRowContext(driver.ctx, fmt.Sprint(selectWebhookSubscriptions, " WHERE id = $1"), id))
+}
+
+func (driver *storageDriver) GetWebhookSubscriptions() (storage.Iterator[restapi.WebhookSubscription], error) {
+	rows, err := driver.db.QueryContext(driver.ctx, fmt.Sprint(selectWebhookSubscriptions, " ORDER BY created_at ASC"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []restapi.WebhookSubscription{}
+	for rows.Next() {
+		subscription, err := unmarshalWebhookSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return storage.NewDefaultIterator(subscriptions), rows.Err()
+}
+
+// The deliveries of the subscription are deleted along with it
+func (driver *storageDriver) DeleteWebhookSubscription(id string) error {
+	result, err := driver.db.ExecContext(driver.ctx, "DELETE FROM webhook_subscriptions WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
+const selectWebhookDeliveries = "SELECT id, subscription_id, event, state, attempts, created_at, next_attempt_at, last_attempt_at, status_code, error FROM webhook_deliveries"
+
+func unmarshalWebhookDelivery(row sqlRow) (restapi.WebhookDelivery, error) {
+	delivery := restapi.WebhookDelivery{}
+
+	var event []byte
+	err := row.Scan(&delivery.Id, &delivery.SubscriptionId, &event, &delivery.State, &delivery.Attempts, &delivery.CreatedAt,
+		&delivery.NextAttemptAt, &delivery.LastAttemptAt, &delivery.StatusCode, &delivery.Error)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+		return restapi.WebhookDelivery{}, err
+	}
+
+	err = json.Unmarshal(event, &delivery.Event)
+	if err != nil {
+		return restapi.WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+func (driver *storageDriver) queryWebhookDeliveries(query string, args ...any) (storage.Iterator[restapi.WebhookDelivery], error) {
+	rows, err := driver.db.QueryContext(driver.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []restapi.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := unmarshalWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return storage.NewDefaultIterator(deliveries), rows.Err()
+}
+
+func (driver *storageDriver) CreateWebhookDelivery(delivery restapi.WebhookDelivery) (restapi.WebhookDelivery, error) {
+	event, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return restapi.WebhookDelivery{}, err
+	}
+
+	if delivery.NextAttemptAt.IsZero() {
+		delivery.NextAttemptAt = time.Now()
+	}
+
+	// Selecting the subscription returns no rows when it does not exist
+	return unmarshalWebhookDelivery(driver.db.QueryRowContext(driver.ctx, "INSERT INTO webhook_deliveries ("+
+		"subscription_id, event, next_attempt_at"+
+		") SELECT id, $2, $3 FROM webhook_subscriptions WHERE id = $1"+
+		" RETURNING id, subscription_id, event, state, attempts, created_at, next_attempt_at, last_attempt_at, status_code, error",
+		delivery.SubscriptionId, event, delivery.NextAttemptAt))
+}
+
+func (driver *storageDriver) UpdateWebhookDelivery(delivery restapi.WebhookDelivery) error {
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE webhook_deliveries SET "+
+		"state = $2, attempts = $3, next_attempt_at = $4, last_attempt_at = $5, status_code = $6, error = $7"+
+		" WHERE id = $1",
+		delivery.Id, delivery.State, delivery.Attempts, delivery.NextAttemptAt, delivery.LastAttemptAt, delivery.StatusCode, delivery.Error)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
+func (driver *storageDriver) GetDueWebhookDeliveries(now time.Time, limit int) (storage.Iterator[restapi.WebhookDelivery], error) {
+	return driver.queryWebhookDeliveries(fmt.Sprint(selectWebhookDeliveries, " WHERE state = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at ASC LIMIT $3"),
+		restapi.WebhookDeliveryPending, now, limit)
+}
+
+func (driver *storageDriver) GetWebhookDeliveries(subscriptionId string, limit int) (storage.Iterator[restapi.WebhookDelivery], error) {
+	return driver.queryWebhookDeliveries(fmt.Sprint(selectWebhookDeliveries, " WHERE subscription_id = $1 ORDER BY created_at DESC LIMIT $2"),
+		subscriptionId, limit)
+}
+
+func (driver *storageDriver) DeleteWebhookDeliveriesBefore(before time.Time) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM webhook_deliveries WHERE state <> $1 AND created_at < $2",
+		restapi.WebhookDeliveryPending, before)
+	return err
+}
+
 func (driver *storageDriver) AddPermission(poolId string, userId string, permission restapi.Permission) error {
 	tx, err := driver.db.BeginTx(driver.ctx, nil)
 	if err != nil {
@@ -838,7 +1781,7 @@ func (driver *storageDriver) RemovePermission(poolId string, userId string, perm
 		return errors.Join(err, tx.Rollback())
 	}
 	if rowsAffected == 0 {
-		return errors.New("No permission found")
+		return errors.Join(storage.ErrNotFound, tx.Rollback())
 	}
 
 	return tx.Commit()
@@ -864,7 +1807,7 @@ func (driver *storageDriver) GetPermissions(userId string) (restapi.UserPermissi
 	JOIN pools ON pools.id = permissions.pool_id
 	LEFT JOIN agents ON agents.pool_id = pools.id AND agents.state = 'active'
 	LEFT JOIN sessions ON sessions.agent_id = agents.id AND sessions.state = 'active'
-	WHERE user_id = $1
+	WHERE permissions.user_id = $1
 	GROUP BY permissions.pool_id, permissions.permission, pools.pool_name`, userId)
 
 	if err != nil {
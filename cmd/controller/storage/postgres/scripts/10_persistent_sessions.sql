@@ -0,0 +1,5 @@
+ALTER TABLE sessions
+ADD COLUMN persistent BOOLEAN NOT NULL DEFAULT false,
+ADD COLUMN user_id TEXT NOT NULL DEFAULT '';
+
+create index on sessions (user_id) WHERE persistent;
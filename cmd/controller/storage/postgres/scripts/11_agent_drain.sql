@@ -0,0 +1,2 @@
+ALTER TABLE agents
+ADD COLUMN drain_deadline TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+ALTER TABLE sessions
+ADD COLUMN requeues INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,16 @@
+create table usage_records (
+    session_id uuid PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    pool_id TEXT NOT NULL,
+    agent_id TEXT NOT NULL DEFAULT '',
+    gpus jsonb,
+    vram_required bigint NOT NULL,
+    queued_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    assigned_at TIMESTAMPTZ,
+    active_at TIMESTAMPTZ,
+    closed_at TIMESTAMPTZ,
+    exit_codes jsonb NOT NULL DEFAULT '{}'
+);
+
+create index on usage_records (queued_at);
+create index on usage_records (closed_at);
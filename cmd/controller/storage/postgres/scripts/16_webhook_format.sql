@@ -0,0 +1,2 @@
+ALTER TABLE webhook_subscriptions
+ADD COLUMN format TEXT NOT NULL DEFAULT '';
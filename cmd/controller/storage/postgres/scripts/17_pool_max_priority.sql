@@ -0,0 +1,2 @@
+ALTER TABLE pools
+ADD COLUMN max_priority INT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+ALTER TABLE sessions
+ADD COLUMN priority INT NOT NULL DEFAULT 0;
+
+create index on sessions (state, priority, created_at);
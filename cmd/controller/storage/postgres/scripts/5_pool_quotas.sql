@@ -0,0 +1,9 @@
+ALTER TABLE pools
+ADD COLUMN max_sessions INT NOT NULL DEFAULT 0,
+ADD COLUMN max_vram BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN max_gpus INT NOT NULL DEFAULT 0;
+
+ALTER TABLE sessions
+ADD COLUMN reason text NOT NULL DEFAULT '';
+
+create index on sessions (pool_id, state);
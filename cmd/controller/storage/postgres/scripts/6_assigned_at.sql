@@ -0,0 +1,4 @@
+ALTER TABLE sessions
+ADD COLUMN assigned_at TIMESTAMP;
+
+create index on sessions (pool_id, assigned_at);
@@ -0,0 +1,13 @@
+create table reservations (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    pool_id uuid,
+    agent_id uuid,
+    gpus jsonb NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    FOREIGN KEY (pool_id) REFERENCES pools(id) ON DELETE CASCADE,
+    FOREIGN KEY (agent_id) REFERENCES agents(id) ON DELETE CASCADE
+);
+
+create index on reservations (ends_at);
@@ -0,0 +1,10 @@
+ALTER TABLE pools
+ADD COLUMN default_max_duration_seconds BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN max_duration_cap_seconds BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN default_idle_timeout_seconds BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN idle_timeout_cap_seconds BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE sessions
+ADD COLUMN max_duration_seconds BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN idle_timeout_seconds BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN idle_since TIMESTAMPTZ;
@@ -0,0 +1,7 @@
+ALTER TABLE pools
+ADD COLUMN lease_seconds BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE sessions
+ADD COLUMN lease_renewed_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+create index on sessions (state, lease_renewed_at);
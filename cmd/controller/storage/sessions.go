@@ -0,0 +1,69 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Xdevlab/Run/pkg/restapi"
+)
+
+// The position of a session within a listing, encoded as the cursor of the next page
+type SessionCursor struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Priority  int       `json:"priority"`
+	Id        string    `json:"id"`
+}
+
+func CursorOfSession(session restapi.SessionListItem) SessionCursor {
+	return SessionCursor{
+		CreatedAt: session.CreatedAt,
+		Priority:  session.Priority,
+		Id:        session.Id,
+	}
+}
+
+func (cursor SessionCursor) String() string {
+	return encodeCursor(cursor)
+}
+
+func ParseSessionCursor(value string) (SessionCursor, error) {
+	var cursor SessionCursor
+	err := decodeCursor(value, &cursor)
+	if err != nil || cursor.Id == "" {
+		return SessionCursor{}, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+type SessionQuery struct {
+	restapi.SessionFilter
+
+	// restapi.SessionSortCreated or restapi.SessionSortPriority, ties are ordered by creation then id
+	Sort       string
+	Descending bool
+	// Lists the sessions following the cursor in the order of the query, from the first when nil
+	After *SessionCursor
+	// Every session when 0
+	Limit int
+}
+
+// Compares the positions of two sessions in the order of the query, negative when a comes first
+func (query SessionQuery) Compare(a, b SessionCursor) int {
+	result := 0
+	if query.Sort == restapi.SessionSortPriority && a.Priority != b.Priority {
+		result = a.Priority - b.Priority
+	} else if !a.CreatedAt.Equal(b.CreatedAt) {
+		result = a.CreatedAt.Compare(b.CreatedAt)
+	} else {
+		result = strings.Compare(a.Id, b.Id)
+	}
+
+	if query.Descending {
+		return -result
+	}
+	return result
+}
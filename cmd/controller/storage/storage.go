@@ -5,6 +5,7 @@ package storage
 
 import (
 	"errors"
+	"sort"
 	"time"
 
 	"github.com/Xdevlab/Run/pkg/restapi"
@@ -19,6 +20,56 @@ type Percentile[T any] struct {
 	P10  T
 }
 
+// Returns the percentiles of values counted by value, using the nearest-rank method
+func PercentilesOfCounts(counts map[int]int, total int) Percentile[int] {
+	if len(counts) == 0 {
+		return Percentile[int]{}
+	}
+
+	sortedKeys := []int{}
+	for key := range counts {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Ints(sortedKeys)
+
+	percentile := Percentile[int]{
+		P100: sortedKeys[len(sortedKeys)-1],
+	}
+
+	index := 0
+	keysIndex := 0
+	key := sortedKeys[keysIndex]
+	for _, rank := range []struct {
+		value *int
+		ratio float64
+	}{
+		{&percentile.P10, 0.10},
+		{&percentile.P25, 0.25},
+		{&percentile.P50, 0.50},
+		{&percentile.P75, 0.75},
+		{&percentile.P90, 0.90},
+	} {
+		for keysIndex < len(sortedKeys) && index < int(float64(total)*rank.ratio) {
+			key = sortedKeys[keysIndex]
+			index += counts[key]
+			keysIndex++
+		}
+		*rank.value = key
+	}
+
+	return percentile
+}
+
+// The whole GB of VRAM not used on the GPU, the used VRAM reported may exceed
+// the VRAM of the GPU
+func VramGBAvailable(gpu restapi.Gpu) int {
+	if gpu.Metrics.VramUsed >= gpu.Vram {
+		return 0
+	}
+
+	return int((gpu.Vram - gpu.Metrics.VramUsed) / (1024 * 1024 * 1024))
+}
+
 type AggregatedData struct {
 	Agents                   int
 	AgentsByStatus           map[string]int
@@ -41,6 +92,40 @@ type AggregatedData struct {
 type QueuedSession struct {
 	Id           string
 	Requirements restapi.SessionRequirements
+	Reason       string
+}
+
+// Narrows down the agents retrieved from storage before the backend checks
+// every requirement of a session against them
+type AgentSelector struct {
+	TotalAvailableVramAtLeast uint64
+	PoolId                    string
+	MatchLabels               map[string]string
+	MatchExpressions          []restapi.LabelSelectorRequirement
+
+	// Includes the disabled agents, for checks of the sessions already on them
+	IncludeDisabled bool
+}
+
+func AgentSelectorFromRequirements(requirements restapi.SessionRequirements) AgentSelector {
+	return AgentSelector{
+		TotalAvailableVramAtLeast: TotalVramRequired(requirements),
+		PoolId:                    requirements.PoolId,
+		MatchLabels:               requirements.MatchLabels,
+		MatchExpressions:          requirements.MatchExpressions,
+	}
+}
+
+// Checks the labels of an agent against the selector
+func (selector AgentSelector) MatchesLabels(labels map[string]string) bool {
+	for key, value := range selector.MatchLabels {
+		checkValue, present := labels[key]
+		if !present || value != checkValue {
+			return false
+		}
+	}
+
+	return restapi.MatchesExpressions(labels, selector.MatchExpressions)
 }
 
 type Iterator[T any] interface {
@@ -77,27 +162,103 @@ func (iterator *DefaultIterator[T]) Value() T {
 type Storage interface {
 	Close() error
 
+	// Returns a channel signaled when sessions or agents change, such as a session being requested or an
+	// agent updating, and the function ending the subscription. Signals are coalesced.
+	SubscribeChanges() (<-chan struct{}, func())
+	// Returns the watcher of the sessions and agents changed, such as a session being assigned or an agent
+	// going missing, and the function ending the watch
+	WatchChanges() (*ChangeWatcher, func())
+
 	AggregateData() (AggregatedData, error)
 
 	RegisterAgent(agent restapi.Agent) (string, error)
 	GetAgentById(id string) (restapi.Agent, error)
 	UpdateAgent(update restapi.AgentUpdate) error
+	// Replaces the taints of the agent
+	SetAgentTaints(agentId string, taints map[string]string) error
+	// Disables an active agent so no sessions are scheduled on it, or enables a disabled agent. The sessions
+	// on a disabled agent are canceled once its drain deadline passes, they are left to end when it is nil.
+	// Agents reporting themselves active remain disabled.
+	SetAgentDisabled(agentId string, disabled bool, drainDeadline *time.Time) error
+	// Retrieves the ids of the assigned and active sessions on disabled agents whose drain deadline passed
+	GetSessionsOfDrainedAgents() ([]string, error)
 
 	RequestSession(requirements restapi.SessionRequirements) (string, error)
 	AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu) error
 	CancelSession(sessionId string) error
+	SetSessionReason(sessionId string, reason string) error
 	GetSessionById(id string) (restapi.Session, error)
+	// Retrieves the sessions matching the query in its order
+	GetSessions(query SessionQuery) (Iterator[restapi.SessionListItem], error)
+	// Retrieves the accounting records of the sessions queued before end that were not closed before start,
+	// oldest first
+	GetUsageRecords(start time.Time, end time.Time) (Iterator[restapi.UsageRecord], error)
+	// Retrieves the assigned and active sessions on missing agents, and on disabled agents not updated for the
+	// duration, which are never marked missing so they remain disabled when they return
+	GetSessionsOfMissingAgents(duration time.Duration) ([]restapi.Session, error)
+	// Detaches the session from its agent, which is lost. The session is returned to the queue, counting
+	// the re-queue, when requeue is set, otherwise it is closed without waiting for the agent.
+	DetachSession(sessionId string, requeue bool) error
+	RenewSessionLease(sessionId string) error
+	// Retrieves the ids of the queued, assigned and active sessions whose lease was not renewed within the
+	// lease of their pool, or the default lease when their pool has none. A lease of 0 never expires and
+	// persistent sessions have no lease.
+	GetSessionsWithExpiredLease(defaultLease time.Duration) ([]string, error)
+	// Retrieves the persistent sessions of the user that are not closed
+	GetPersistentSessions(userId string) (Iterator[restapi.Session], error)
+	// Retrieves the requirements of a session in any state
+	GetSessionRequirements(id string) (restapi.SessionRequirements, error)
 	GetQueuedSessionById(id string) (QueuedSession, error) // For Testing
 
-	GetAgents(poolId string) (Iterator[restapi.Agent], error)
-	GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (Iterator[restapi.Agent], error)
+	// Retrieves the agents matching the query ordered by id
+	GetAgents(query AgentQuery) (Iterator[restapi.Agent], error)
+	GetAvailableAgentsMatching(selector AgentSelector) (Iterator[restapi.Agent], error)
 	GetQueuedSessionsIterator() (Iterator[QueuedSession], error)
 
+	// Counts the queued sessions of the same pool that are scheduled before the session
+	CountQueuedSessionsAhead(sessionId string) (int, error)
+	// Counts the sessions of the pool assigned to an agent since the time, all pools if poolId is empty
+	CountSessionsAssignedSince(poolId string, since time.Time) (int, error)
+
 	SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error
+	// Removes the missing agents, and the disabled agents that are never marked missing so they remain
+	// disabled when they return
 	RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error
 
 	CreatePool(name string) (restapi.Pool, error)
 	GetPool(id string) (restapi.Pool, error)
+	CountPools() (int, error)
+	SetPoolQuotas(id string, quotas restapi.PoolQuotas) error
+	SetPoolSessionLimits(id string, limits restapi.PoolSessionLimits) error
+
+	CreateReservation(reservation restapi.Reservation) (restapi.Reservation, error)
+	GetReservation(id string) (restapi.Reservation, error)
+	// Retrieves the reservations ending after the time ordered by their start
+	GetReservations(endingAfter time.Time) (Iterator[restapi.Reservation], error)
+	DeleteReservation(id string) error
+	CreateWebhookSubscription(subscription restapi.WebhookSubscription) (restapi.WebhookSubscription, error)
+	GetWebhookSubscription(id string) (restapi.WebhookSubscription, error)
+	// Retrieves the webhook subscriptions oldest first
+	GetWebhookSubscriptions() (Iterator[restapi.WebhookSubscription], error)
+	// Deletes the subscription along with its deliveries
+	DeleteWebhookSubscription(id string) error
+	CreateWebhookDelivery(delivery restapi.WebhookDelivery) (restapi.WebhookDelivery, error)
+	// Records the outcome of an attempt of the delivery: its state, attempts, next attempt, last attempt,
+	// status code and error
+	UpdateWebhookDelivery(delivery restapi.WebhookDelivery) error
+	// Retrieves up to limit pending deliveries whose next attempt is due at the time, earliest first
+	GetDueWebhookDeliveries(now time.Time, limit int) (Iterator[restapi.WebhookDelivery], error)
+	// Retrieves up to limit of the latest deliveries of the subscription, newest first
+	GetWebhookDeliveries(subscriptionId string, limit int) (Iterator[restapi.WebhookDelivery], error)
+	// Removes the deliveries created before the time that are no longer pending
+	DeleteWebhookDeliveriesBefore(before time.Time) error
+
+	// Acquires the lease for the holder, or renews it when the holder already holds it, until the duration
+	// passes. Returns whether the holder holds the lease, which another holder may only acquire once expired.
+	AcquireLease(name string, holder string, duration time.Duration) (bool, error)
+	// Releases the lease when held by the holder so another holder can acquire it without waiting
+	ReleaseLease(name string, holder string) error
+
 	GetPoolPermissions(id string) (restapi.PoolPermissions, error)
 	DeletePool(id string) error
 	RemovePermission(poolId string, userId string, permission restapi.Permission) error
@@ -118,6 +279,11 @@ func TotalVram(gpus []restapi.Gpu) uint64 {
 	return vram
 }
 
+// Sessions in these states hold GPUs on an agent
+func IsSessionAllocated(state string) bool {
+	return state == restapi.SessionAssigned || state == restapi.SessionActive || state == restapi.SessionCanceling
+}
+
 func TotalVramRequired(requirements restapi.SessionRequirements) uint64 {
 	var vramRequired uint64
 	for _, gpu := range requirements.Gpus {
@@ -10,9 +10,12 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/Xdevlab/Run/cmd/controller/storage"
 	"github.com/Xdevlab/Run/cmd/controller/storage/gorm"
 	"github.com/Xdevlab/Run/cmd/controller/storage/memdb"
@@ -87,6 +90,14 @@ func defaultAgent(gpuVram uint64) restapi.Agent {
 	}
 }
 
+// The default agent outside of any pool, as the gorm driver only stores the
+// pools of agents by their UUID
+func agentWithoutPool(gpuVram uint64) restapi.Agent {
+	agent := defaultAgent(gpuVram)
+	agent.PoolId = ""
+	return agent
+}
+
 func defaultSessionRequirements(gpuVram uint64) restapi.SessionRequirements {
 	return restapi.SessionRequirements{
 		Version: "Test",
@@ -328,12 +339,23 @@ func TestAssigningSessions(t *testing.T) {
 			t.FailNow()
 		}
 
+		// The time of the assignment is set by the storage
+		assigned, err := db.GetSessionById(sessionId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		if assigned.AssignedAt == nil {
+			t.Error("expected the assigned session to have an assignment time")
+		}
+
 		session := restapi.Session{
-			Id:      sessionId,
-			State:   restapi.SessionAssigned,
-			Address: agent.Address,
-			Version: requirements.Version,
-			Gpus:    selectedGpus,
+			Id:         sessionId,
+			State:      restapi.SessionAssigned,
+			Address:    agent.Address,
+			Version:    requirements.Version,
+			AssignedAt: assigned.AssignedAt,
+			Gpus:       selectedGpus,
 		}
 		checkSession(t, db, session)
 
@@ -396,6 +418,54 @@ func TestAssigningSessions(t *testing.T) {
 	})
 }
 
+func TestGetAvailableAgentsMatchingEveryAgent(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		ids := []string{}
+		for index := 0; index < 30; index++ {
+			ids = append(ids, registerAgent(t, db, agentWithoutPool(24*1024*1024*1024)).Id)
+		}
+
+		iterator, err := db.GetAvailableAgentsMatching(storage.AgentSelector{})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		found := []string{}
+		for iterator.Next() {
+			found = append(found, iterator.Value().Id)
+		}
+
+		sort.Strings(ids)
+		sort.Strings(found)
+		compare(t, ids, found, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
 func TestGetQueuedSessionsIterator(t *testing.T) {
 	run := func(t *testing.T, db storage.Storage) {
 		sessionIds := map[string]restapi.SessionRequirements{}
@@ -447,3 +517,2258 @@ func TestGetQueuedSessionsIterator(t *testing.T) {
 		run(t, db)
 	})
 }
+
+func TestGetQueuedSessionsIteratorPriority(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		priorities := []int{0, 10, -5, 10, 3}
+
+		sessionIds := []string{}
+		for _, priority := range priorities {
+			requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+			requirements.Priority = priority
+			sessionIds = append(sessionIds, queueSession(t, db, requirements))
+		}
+
+		// Highest priority first, sessions of the same priority in the order they were queued
+		expected := []string{sessionIds[1], sessionIds[3], sessionIds[4], sessionIds[0], sessionIds[2]}
+
+		iterator, err := db.GetQueuedSessionsIterator()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		queued := []string{}
+		for iterator.Next() {
+			queued = append(queued, iterator.Value().Id)
+		}
+
+		compare(t, expected, queued, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGetQueuedSessionsIteratorPages(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		expected := []string{}
+		for index := 0; index < 45; index++ {
+			expected = append(expected, queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024)))
+		}
+
+		iterator, err := db.GetQueuedSessionsIterator()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Sessions leaving the queue while iterating must not hide the sessions after them
+		queued := []string{}
+		for iterator.Next() {
+			id := iterator.Value().Id
+			queued = append(queued, id)
+
+			if len(queued)%2 == 0 {
+				err = db.CancelSession(id)
+				if err != nil {
+					t.Log(err)
+					t.FailNow()
+				}
+			}
+		}
+
+		compare(t, expected, queued, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestCountPools(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		// Pools of earlier tests may remain in a shared database
+		before, err := db.CountPools()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		_, err = db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		count, err := db.CountPools()
+		compare(t, before+2, count, err)
+
+		err = db.DeletePool(pool.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		count, err = db.CountPools()
+		compare(t, before+1, count, err)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPoolQuotas(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		quotas := restapi.PoolQuotas{
+			MaxSessions: 4,
+			MaxVram:     16 * 1024 * 1024 * 1024,
+			MaxGpus:     2,
+		}
+
+		err = db.SetPoolQuotas(pool.Id, quotas)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		pool, err = db.GetPool(pool.Id)
+		compare(t, quotas, pool.Quotas, err)
+
+		// Sessions without a pool count towards the pool of their agent
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.PoolId = pool.Id
+		agent = registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+		queueSession(t, db, requirements)
+
+		err = db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		pool, err = db.GetPool(pool.Id)
+		compare(t, restapi.PoolUsage{
+			Sessions: 1,
+			Vram:     4 * 1024 * 1024 * 1024,
+			Gpus:     1,
+		}, pool.Usage, err)
+
+		err = db.DeletePool(pool.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetPoolQuotas(pool.Id, quotas)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestQueuePosition(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+
+		start := time.Now().Add(-time.Second)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		firstId := queueSession(t, db, requirements)
+		secondId := queueSession(t, db, requirements)
+
+		requirements.Priority = 10
+		highPriorityId := queueSession(t, db, requirements)
+
+		for id, expected := range map[string]int{highPriorityId: 0, firstId: 1, secondId: 2} {
+			ahead, err := db.CountQueuedSessionsAhead(id)
+			compare(t, expected, ahead, err)
+		}
+
+		err := db.AssignSession(highPriorityId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		ahead, err := db.CountQueuedSessionsAhead(secondId)
+		compare(t, 1, ahead, err)
+
+		assigned, err := db.CountSessionsAssignedSince("", start)
+		compare(t, 1, assigned, err)
+
+		assigned, err = db.CountSessionsAssignedSince("", time.Now().Add(time.Minute))
+		compare(t, 0, assigned, err)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestCompareLabelsBeyondFirstAgents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		for index := 0; index < 25; index++ {
+			agent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+			agent.Labels = map[string]string{"cores": "16"}
+			registerAgent(t, db, agent)
+		}
+
+		for _, cores := range []string{"-64", "many", "0x40"} {
+			agent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+			agent.Labels = map[string]string{"cores": cores}
+			registerAgent(t, db, agent)
+		}
+
+		ids := []string{}
+		for index := 0; index < 3; index++ {
+			agent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+			agent.Labels = map[string]string{"cores": "64"}
+			ids = append(ids, registerAgent(t, db, agent).Id)
+		}
+		sort.Strings(ids)
+
+		expressions := []restapi.LabelSelectorRequirement{{Key: "cores", Operator: restapi.SelectorOpGt, Values: []string{"32"}}}
+
+		iterator, err := db.GetAvailableAgentsMatching(storage.AgentSelector{MatchExpressions: expressions})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		found := []string{}
+		for iterator.Next() {
+			found = append(found, iterator.Value().Id)
+		}
+		sort.Strings(found)
+		compare(t, ids, found, nil)
+
+		iterator, err = db.GetAgents(storage.AgentQuery{MatchExpressions: expressions, Limit: 2})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		found = []string{}
+		for iterator.Next() {
+			found = append(found, iterator.Value().Id)
+		}
+		compare(t, ids[:2], found, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGetAvailableAgentsMatchingSelector(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		gpuAgent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+		gpuAgent.Labels = map[string]string{"gpu": "a100", "cores": "64"}
+		gpuAgent = registerAgent(t, db, gpuAgent)
+
+		otherAgent := agentWithoutPool(8 * 1024 * 1024 * 1024)
+		otherAgent.Labels = map[string]string{"gpu": "t4", "cores": "16", "spot": "true"}
+		otherAgent = registerAgent(t, db, otherAgent)
+
+		for _, test := range []struct {
+			selector storage.AgentSelector
+			expected []string
+		}{
+			{storage.AgentSelector{}, []string{gpuAgent.Id, otherAgent.Id}},
+			{storage.AgentSelector{TotalAvailableVramAtLeast: 16 * 1024 * 1024 * 1024}, []string{gpuAgent.Id}},
+			{storage.AgentSelector{MatchLabels: map[string]string{"gpu": "t4"}}, []string{otherAgent.Id}},
+			{storage.AgentSelector{MatchExpressions: []restapi.LabelSelectorRequirement{
+				{Key: "gpu", Operator: restapi.SelectorOpIn, Values: []string{"a100", "h100"}},
+			}}, []string{gpuAgent.Id}},
+			{storage.AgentSelector{MatchExpressions: []restapi.LabelSelectorRequirement{
+				{Key: "gpu", Operator: restapi.SelectorOpNotIn, Values: []string{"a100"}},
+			}}, []string{otherAgent.Id}},
+			{storage.AgentSelector{MatchExpressions: []restapi.LabelSelectorRequirement{
+				{Key: "spot", Operator: restapi.SelectorOpDoesNotExist},
+			}}, []string{gpuAgent.Id}},
+			{storage.AgentSelector{MatchExpressions: []restapi.LabelSelectorRequirement{
+				{Key: "cores", Operator: restapi.SelectorOpGt, Values: []string{"32"}},
+			}}, []string{gpuAgent.Id}},
+			{storage.AgentSelector{MatchExpressions: []restapi.LabelSelectorRequirement{
+				{Key: "cores", Operator: restapi.SelectorOpLt, Values: []string{"32"}},
+				{Key: "spot", Operator: restapi.SelectorOpExists},
+			}}, []string{otherAgent.Id}},
+		} {
+			iterator, err := db.GetAvailableAgentsMatching(test.selector)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+
+			found := []string{}
+			for iterator.Next() {
+				found = append(found, iterator.Value().Id)
+			}
+			sort.Strings(found)
+
+			expected := append([]string{}, test.expected...)
+			sort.Strings(expected)
+
+			compare(t, expected, found, nil)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSetAgentTaints(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+		agent.Taints["Reserved"] = "Yes"
+		agent = registerAgent(t, db, agent)
+
+		taints := map[string]string{
+			"Draining": "Yes:NoExecute",
+			"Spot":     "Yes:PreferNoSchedule",
+		}
+
+		err := db.SetAgentTaints(agent.Id, taints)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, taints, agent.Taints, err)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Tolerates["Draining"] = "Yes"
+		sessionId := queueSession(t, db, requirements)
+
+		err = db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		sessionRequirements, err := db.GetSessionRequirements(sessionId)
+		compare(t, requirements.Tolerates, sessionRequirements.Tolerates, err)
+
+		err = db.SetAgentTaints(uuid.NewString(), taints)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestReservations(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		now := time.Now().Truncate(time.Second)
+
+		ended, err := db.CreateReservation(restapi.Reservation{
+			Gpus:  []restapi.GpuRequirements{{VramRequired: 1024}},
+			Start: now.Add(-2 * time.Hour),
+			End:   now.Add(-time.Hour),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		later, err := db.CreateReservation(restapi.Reservation{
+			Gpus:  []restapi.GpuRequirements{{VramRequired: 2048}},
+			Start: now.Add(2 * time.Hour),
+			End:   now.Add(3 * time.Hour),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		sooner, err := db.CreateReservation(restapi.Reservation{
+			Gpus:  []restapi.GpuRequirements{{VramRequired: 4096}, {VramRequired: 4096}},
+			Start: now.Add(time.Hour),
+			End:   now.Add(2 * time.Hour),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		reservation, err := db.GetReservation(sooner.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		compare(t, sooner.Gpus, reservation.Gpus, nil)
+		if !reservation.Start.Equal(sooner.Start) || !reservation.End.Equal(sooner.End) {
+			t.Errorf("expected window %v to %v, instead received %v to %v", sooner.Start, sooner.End, reservation.Start, reservation.End)
+		}
+
+		iterator, err := db.GetReservations(now)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		ids := []string{}
+		for iterator.Next() {
+			ids = append(ids, iterator.Value().Id)
+		}
+		compare(t, []string{sooner.Id, later.Id}, ids, nil)
+
+		err = db.DeleteReservation(ended.Id)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = db.GetReservation(ended.Id)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		err = db.DeleteReservation(ended.Id)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPermissions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = errors.Join(
+			db.AddPermission(pool.Id, "user", restapi.PermissionCreateSession),
+			db.AddPermission(pool.Id, "user", restapi.PermissionRegisterAgent),
+			db.AddPermission(pool.Id, "admin", restapi.PermissionAdmin))
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		permissions, err := db.GetPoolPermissions(pool.Id)
+		compare(t, []restapi.Permission{restapi.PermissionAdmin}, permissions.UserIds["admin"], err)
+		if len(permissions.UserIds["user"]) != 2 {
+			t.Errorf("expected 2 permissions for the user, instead received %v", permissions.UserIds["user"])
+		}
+
+		err = db.RemovePermission(pool.Id, "user", restapi.PermissionRegisterAgent)
+		if err != nil {
+			t.Error(err)
+		}
+
+		permissions, err = db.GetPoolPermissions(pool.Id)
+		compare(t, []restapi.Permission{restapi.PermissionCreateSession}, permissions.UserIds["user"], err)
+
+		err = db.RemovePermission(pool.Id, "user", restapi.PermissionRegisterAgent)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		userPermissions, err := db.GetPermissions("admin")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		pools := userPermissions.Permissions[restapi.PermissionAdmin]
+		if len(pools) != 1 || pools[0].Id != pool.Id || pools[0].Name != "Test" {
+			t.Errorf("expected admin of pool %s, instead received %v", pool.Id, pools)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		now := time.Now()
+
+		sessions, err := db.CreateWebhookSubscription(restapi.WebhookSubscription{
+			Url:        "https://example.com/sessions",
+			EventTypes: []string{restapi.EventSessionState},
+			Format:     restapi.WebhookFormatLegacy,
+			Secret:     "secret",
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		everything, err := db.CreateWebhookSubscription(restapi.WebhookSubscription{
+			Url:    "https://example.com/everything",
+			Secret: "another secret",
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		subscription, err := db.GetWebhookSubscription(sessions.Id)
+		compare(t, sessions.Url, subscription.Url, err)
+		compare(t, sessions.EventTypes, subscription.EventTypes, nil)
+		compare(t, sessions.Format, subscription.Format, nil)
+		compare(t, sessions.Secret, subscription.Secret, nil)
+
+		subscriptions, err := db.GetWebhookSubscriptions()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		ids := []string{}
+		for subscriptions.Next() {
+			ids = append(ids, subscriptions.Value().Id)
+		}
+		compare(t, []string{sessions.Id, everything.Id}, ids, nil)
+
+		createDelivery := func(subscriptionId string, sessionId string, nextAttemptAt time.Time) restapi.WebhookDelivery {
+			delivery, err := db.CreateWebhookDelivery(restapi.WebhookDelivery{
+				SubscriptionId: subscriptionId,
+				Event: restapi.Event{
+					Id:        1,
+					Type:      restapi.EventSessionState,
+					SessionId: sessionId,
+				},
+				NextAttemptAt: nextAttemptAt,
+			})
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			compare(t, restapi.WebhookDeliveryPending, delivery.State, nil)
+			compare(t, sessionId, delivery.Event.SessionId, nil)
+
+			// Keeps the creation times of the deliveries apart for the delivery log order
+			time.Sleep(10 * time.Millisecond)
+			return delivery
+		}
+
+		later := createDelivery(sessions.Id, uuid.NewString(), now.Add(-time.Minute))
+		sooner := createDelivery(sessions.Id, uuid.NewString(), now.Add(-time.Hour))
+		retry := createDelivery(sessions.Id, uuid.NewString(), now.Add(time.Hour))
+		other := createDelivery(everything.Id, uuid.NewString(), now.Add(-time.Second))
+
+		_, err = db.CreateWebhookDelivery(restapi.WebhookDelivery{SubscriptionId: uuid.NewString()})
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		dueIds := func(limit int) []string {
+			iterator, err := db.GetDueWebhookDeliveries(time.Now(), limit)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			ids := []string{}
+			for iterator.Next() {
+				ids = append(ids, iterator.Value().Id)
+			}
+			return ids
+		}
+
+		compare(t, []string{sooner.Id, later.Id, other.Id}, dueIds(10), nil)
+		compare(t, []string{sooner.Id, later.Id}, dueIds(2), nil)
+
+		attemptedAt := time.Now()
+		sooner.State = restapi.WebhookDeliverySucceeded
+		sooner.Attempts = 1
+		sooner.LastAttemptAt = &attemptedAt
+		sooner.StatusCode = 204
+		err = db.UpdateWebhookDelivery(sooner)
+		if err != nil {
+			t.Error(err)
+		}
+
+		later.Attempts = 1
+		later.LastAttemptAt = &attemptedAt
+		later.NextAttemptAt = now.Add(time.Hour)
+		later.StatusCode = 500
+		later.Error = "webhook responded with 500 Internal Server Error"
+		err = db.UpdateWebhookDelivery(later)
+		if err != nil {
+			t.Error(err)
+		}
+
+		compare(t, []string{other.Id}, dueIds(10), nil)
+
+		iterator, err := db.GetWebhookDeliveries(sessions.Id, 10)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		deliveries := []restapi.WebhookDelivery{}
+		for iterator.Next() {
+			deliveries = append(deliveries, iterator.Value())
+		}
+
+		ids = []string{}
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.Id)
+		}
+		compare(t, []string{retry.Id, sooner.Id, later.Id}, ids, nil)
+		compare(t, restapi.WebhookDeliverySucceeded, deliveries[1].State, nil)
+		compare(t, 204, deliveries[1].StatusCode, nil)
+		compare(t, 1, deliveries[2].Attempts, nil)
+		compare(t, later.Error, deliveries[2].Error, nil)
+		if deliveries[2].LastAttemptAt == nil {
+			t.Error("expected the last attempt of the delivery to be recorded")
+		}
+
+		// Only the deliveries no longer pending are removed
+		err = db.DeleteWebhookDeliveriesBefore(time.Now().Add(time.Minute))
+		if err != nil {
+			t.Error(err)
+		}
+
+		iterator, err = db.GetWebhookDeliveries(sessions.Id, 10)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		ids = []string{}
+		for iterator.Next() {
+			ids = append(ids, iterator.Value().Id)
+		}
+		compare(t, []string{retry.Id, later.Id}, ids, nil)
+
+		err = db.DeleteWebhookSubscription(sessions.Id)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = db.GetWebhookSubscription(sessions.Id)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		err = db.DeleteWebhookSubscription(sessions.Id)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		iterator, err = db.GetWebhookDeliveries(sessions.Id, 10)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if iterator.Next() {
+			t.Errorf("expected the deliveries of the subscription to be deleted, instead received %s", iterator.Value().Id)
+		}
+
+		compare(t, []string{other.Id}, dueIds(10), nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionLimits(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		limits := restapi.PoolSessionLimits{
+			DefaultMaxDurationSeconds: 3600,
+			MaxDurationCapSeconds:     7200,
+			DefaultIdleTimeoutSeconds: 300,
+			IdleTimeoutCapSeconds:     600,
+			MaxPriority:               5,
+		}
+
+		err = db.SetPoolSessionLimits(pool.Id, limits)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		pool, err = db.GetPool(pool.Id)
+		compare(t, limits, pool.SessionLimits, err)
+
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MaxDurationSeconds = 60
+		requirements.IdleTimeoutSeconds = 30
+		sessionId := queueSession(t, db, requirements)
+
+		err = db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, [2]int64{60, 30}, [2]int64{session.MaxDurationSeconds, session.IdleTimeoutSeconds}, err)
+
+		update := func(sessionUpdate restapi.SessionUpdate) restapi.Session {
+			err := db.UpdateAgent(restapi.AgentUpdate{
+				Id:             agent.Id,
+				State:          restapi.AgentActive,
+				SessionsUpdate: map[string]restapi.SessionUpdate{sessionId: sessionUpdate},
+			})
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			session, err := db.GetSessionById(sessionId)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			return session
+		}
+
+		session = update(restapi.SessionUpdate{State: restapi.SessionActive, Idle: true})
+		if session.IdleSince == nil {
+			t.Error("expected an idle session to have an idle time")
+		}
+
+		session = update(restapi.SessionUpdate{State: restapi.SessionActive})
+		if session.IdleSince != nil {
+			t.Errorf("expected a connected session to have no idle time, instead received %v", session.IdleSince)
+		}
+
+		session = update(restapi.SessionUpdate{State: restapi.SessionClosed, Reason: "Test"})
+		compare(t, "Test", session.Reason, nil)
+
+		err = db.DeletePool(pool.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetPoolSessionLimits(pool.Id, limits)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionLeases(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		pool, err := db.CreatePool("Test")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.SetPoolSessionLimits(pool.Id, restapi.PoolSessionLimits{
+			LeaseSeconds: 3600,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		defaultLeaseId := queueSession(t, db, requirements)
+
+		// The lease of the pool overrides the default
+		requirements.PoolId = pool.Id
+		queueSession(t, db, requirements)
+
+		expired := func(defaultLease time.Duration) []string {
+			ids, err := db.GetSessionsWithExpiredLease(defaultLease)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			return ids
+		}
+
+		// A lease of 0 never expires
+		compare(t, []string{}, expired(0), nil)
+
+		time.Sleep(10 * time.Millisecond)
+		compare(t, []string{defaultLeaseId}, expired(time.Millisecond), nil)
+
+		err = db.RenewSessionLease(defaultLeaseId)
+		if err != nil {
+			t.Error(err)
+		}
+		compare(t, []string{}, expired(time.Minute), nil)
+
+		err = db.CancelSession(defaultLeaseId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		compare(t, []string{}, expired(time.Millisecond), nil)
+
+		err = db.RenewSessionLease(uuid.NewString())
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPersistentSessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.UserId = "user"
+		queueSession(t, db, requirements)
+
+		requirements.Persistent = true
+		firstId := queueSession(t, db, requirements)
+		secondId := queueSession(t, db, requirements)
+		closedId := queueSession(t, db, requirements)
+
+		requirements.UserId = "other"
+		otherId := queueSession(t, db, requirements)
+
+		err := db.CancelSession(closedId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		persistent := func(userId string) []string {
+			iterator, err := db.GetPersistentSessions(userId)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			ids := []string{}
+			for iterator.Next() {
+				session := iterator.Value()
+				if !session.Persistent || session.UserId != userId {
+					t.Errorf("expected session %s to be a persistent session of %s", session.Id, userId)
+				}
+				ids = append(ids, session.Id)
+			}
+			return ids
+		}
+
+		compare(t, []string{firstId, secondId}, persistent("user"), nil)
+		compare(t, []string{otherId}, persistent("other"), nil)
+		compare(t, []string{}, persistent("nobody"), nil)
+
+		// Persistent sessions have no lease
+		time.Sleep(10 * time.Millisecond)
+		ids, err := db.GetSessionsWithExpiredLease(time.Millisecond)
+		compare(t, 1, len(ids), err)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAgentDisabled(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agentIds := func(selector storage.AgentSelector) []string {
+			iterator, err := db.GetAvailableAgentsMatching(selector)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			ids := []string{}
+			for iterator.Next() {
+				ids = append(ids, iterator.Value().Id)
+			}
+			return ids
+		}
+
+		drained := func() []string {
+			ids, err := db.GetSessionsOfDrainedAgents()
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			return ids
+		}
+
+		err = db.SetAgentDisabled(agent.Id, true, nil)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		compare(t, []string{}, agentIds(storage.AgentSelector{}), nil)
+		compare(t, []string{agent.Id}, agentIds(storage.AgentSelector{IncludeDisabled: true}), nil)
+
+		// Disabled agents remain visible
+		iterator, err := db.GetAgents(storage.AgentQuery{})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if !iterator.Next() || iterator.Value().State != restapi.AgentDisabled {
+			t.Error("expected the disabled agent to be retrieved")
+		}
+
+		// The agent reporting itself active does not enable it
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, restapi.AgentDisabled, agent.State, err)
+
+		// A cordoned agent is never drained
+		compare(t, []string{}, drained(), nil)
+
+		deadline := time.Now().Add(time.Hour)
+		err = db.SetAgentDisabled(agent.Id, true, &deadline)
+		if err != nil {
+			t.Error(err)
+		}
+		compare(t, []string{}, drained(), nil)
+
+		deadline = time.Now().Add(-time.Second)
+		err = db.SetAgentDisabled(agent.Id, true, &deadline)
+		if err != nil {
+			t.Error(err)
+		}
+		compare(t, []string{sessionId}, drained(), nil)
+
+		agent, err = db.GetAgentById(agent.Id)
+		if err != nil || agent.DrainDeadline == nil {
+			t.Errorf("expected the agent to have a drain deadline, %v", err)
+		}
+
+		err = db.SetAgentDisabled(agent.Id, false, &deadline)
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, restapi.AgentActive, agent.State, err)
+		if agent.DrainDeadline != nil {
+			t.Error("expected the drain deadline to be cleared")
+		}
+		compare(t, []string{agent.Id}, agentIds(storage.AgentSelector{}), nil)
+		compare(t, []string{}, drained(), nil)
+
+		err = db.SetAgentDisabled(uuid.NewString(), true, nil)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestLeases(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		acquire := func(holder string, duration time.Duration) bool {
+			acquired, err := db.AcquireLease("test", holder, duration)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			return acquired
+		}
+
+		compare(t, true, acquire("first", time.Hour), nil)
+		compare(t, false, acquire("second", time.Hour), nil)
+
+		// Renewing keeps the lease with its holder
+		compare(t, true, acquire("first", 10*time.Millisecond), nil)
+		compare(t, false, acquire("second", time.Hour), nil)
+
+		// An expired lease is acquired by another holder
+		time.Sleep(20 * time.Millisecond)
+		compare(t, true, acquire("second", time.Hour), nil)
+		compare(t, false, acquire("first", time.Hour), nil)
+
+		// Only the holder releases the lease
+		err := db.ReleaseLease("test", "first")
+		if err != nil {
+			t.Error(err)
+		}
+		compare(t, false, acquire("first", time.Hour), nil)
+
+		err = db.ReleaseLease("test", "second")
+		if err != nil {
+			t.Error(err)
+		}
+		compare(t, true, acquire("first", time.Hour), nil)
+
+		// Leases are independent of each other
+		acquired, err := db.AcquireLease("other", "second", time.Hour)
+		compare(t, true, acquired, err)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestDetachSessionOfDisabledAgent(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Cordoned agents are never marked missing
+		err = db.SetAgentDisabled(agent.Id, true, nil)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		time.Sleep(time.Second)
+
+		err = db.SetAgentsMissingIfNotUpdatedFor(0)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		lost := func(duration time.Duration) []string {
+			sessions, err := db.GetSessionsOfMissingAgents(duration)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			ids := []string{}
+			for _, session := range sessions {
+				ids = append(ids, session.Id)
+			}
+			return ids
+		}
+
+		compare(t, []string{}, lost(time.Hour), nil)
+		compare(t, []string{sessionId}, lost(0), nil)
+
+		err = db.DetachSession(sessionId, true)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		compare(t, []string{}, lost(0), nil)
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, restapi.SessionQueued, session.State, err)
+		compare(t, 1, session.Requeues, nil)
+
+		// The agent remains disabled when it returns
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, restapi.AgentDisabled, agent.State, err)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestDetachSession(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		assignedId := queueSession(t, db, requirements)
+		activeId := queueSession(t, db, requirements)
+
+		for _, id := range []string{assignedId, activeId} {
+			err := db.AssignSession(id, agent.Id, []restapi.SessionGpu{
+				{
+					Index:        agent.Gpus[0].Index,
+					VramRequired: requirements.Gpus[0].VramRequired,
+				},
+			})
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+		}
+
+		err := db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{
+				activeId: {State: restapi.SessionActive},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		lost := func() []string {
+			sessions, err := db.GetSessionsOfMissingAgents(time.Hour)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			ids := []string{}
+			for _, session := range sessions {
+				ids = append(ids, session.Id)
+			}
+			sort.Strings(ids)
+			return ids
+		}
+
+		compare(t, []string{}, lost(), nil)
+
+		time.Sleep(time.Second)
+
+		err = db.SetAgentsMissingIfNotUpdatedFor(0)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		expected := []string{assignedId, activeId}
+		sort.Strings(expected)
+		compare(t, expected, lost(), nil)
+
+		err = db.DetachSession(assignedId, true)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = db.DetachSession(activeId, false)
+		if err != nil {
+			t.Error(err)
+		}
+
+		compare(t, []string{}, lost(), nil)
+
+		session, err := db.GetSessionById(assignedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+		compare(t, 1, session.Requeues, nil)
+		compare(t, "", session.Address, nil)
+		compare(t, 0, len(session.Gpus), nil)
+		if session.AssignedAt != nil {
+			t.Error("expected the assignment of the requeued session to be cleared")
+		}
+
+		session, err = db.GetSessionById(activeId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, 0, session.Requeues, nil)
+		compare(t, 0, len(session.Gpus), nil)
+
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, 0, len(agent.Sessions), err)
+
+		// The VRAM of both sessions is available once the agent reconnects
+		err = db.UpdateAgent(restapi.AgentUpdate{Id: agent.Id, State: restapi.AgentActive})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		iterator, err := db.GetAvailableAgentsMatching(storage.AgentSelector{TotalAvailableVramAtLeast: 24 * 1024 * 1024 * 1024})
+		compare(t, true, iterator.Next(), err)
+
+		// The requeued session is scheduled again
+		queued, err := db.GetQueuedSessionById(assignedId)
+		compare(t, assignedId, queued.Id, err)
+
+		err = db.AssignSession(assignedId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(assignedId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+		compare(t, 1, len(session.Gpus), nil)
+
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, 1, len(agent.Sessions), err)
+
+		err = db.DetachSession(uuid.NewString(), true)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAggregateData(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+		agent = registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			Gpus: []restapi.GpuMetrics{
+				{
+					UtilizationGpu: 50,
+					VramUsed:       4 * 1024 * 1024 * 1024,
+					PowerDraw:      150000,
+				},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		data, err := db.AggregateData()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		vramGBAvailable := storage.Percentile[int]{P100: 20, P90: 20, P75: 20, P50: 20, P25: 20, P10: 20}
+
+		compare(t, storage.AggregatedData{
+			Agents:                   1,
+			AgentsByStatus:           map[string]int{restapi.AgentActive: 1},
+			Sessions:                 1,
+			SessionsByStatus:         map[string]int{restapi.SessionAssigned: 1},
+			Gpus:                     1,
+			GpusByGpuName:            map[string]int{"Test": 1},
+			Vram:                     24 * 1024 * 1024 * 1024,
+			VramByGpuName:            map[string]uint64{"Test": 24 * 1024 * 1024 * 1024},
+			VramUsed:                 4 * 1024 * 1024 * 1024,
+			VramUsedByGpuName:        map[string]uint64{"Test": 4 * 1024 * 1024 * 1024},
+			VramGBAvailable:          vramGBAvailable,
+			VramGBAvailableByGpuName: map[string]storage.Percentile[int]{"Test": vramGBAvailable},
+			Utilization:              50,
+			UtilizationByGpuName:     map[string]float64{"Test": 50},
+			PowerDraw:                150,
+			PowerDrawByGpuName:       map[string]float64{"Test": 150},
+		}, data, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAggregateDataOfGpus(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := agentWithoutPool(16 * 1024 * 1024 * 1024)
+		for index, name := range []string{"A", "A", "A", "B"} {
+			gpu := agent.Gpus[0]
+			gpu.Index = index
+			gpu.Name = name
+			agent.Gpus = append(agent.Gpus[:index], gpu)
+		}
+		agent = registerAgent(t, db, agent)
+
+		// The VRAM used reported by the third GPU exceeds its VRAM
+		err := db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			Gpus: []restapi.GpuMetrics{
+				{UtilizationGpu: 10, VramUsed: 2 * 1024 * 1024 * 1024, PowerDraw: 1000},
+				{UtilizationGpu: 20, VramUsed: 8 * 1024 * 1024 * 1024, PowerDraw: 1000},
+				{UtilizationGpu: 30, VramUsed: 20 * 1024 * 1024 * 1024, PowerDraw: 1000},
+				{UtilizationGpu: 40, PowerDraw: 1000},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		data, err := db.AggregateData()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		compare(t, 4, data.Gpus, nil)
+		compare(t, map[string]int{"A": 3, "B": 1}, data.GpusByGpuName, nil)
+		compare(t, uint64(64*1024*1024*1024), data.Vram, nil)
+		compare(t, map[string]uint64{"A": 48 * 1024 * 1024 * 1024, "B": 16 * 1024 * 1024 * 1024}, data.VramByGpuName, nil)
+		compare(t, uint64(30*1024*1024*1024), data.VramUsed, nil)
+		compare(t, storage.Percentile[int]{P100: 16, P90: 14, P75: 14, P50: 8, P25: 0, P10: 0}, data.VramGBAvailable, nil)
+		compare(t, map[string]storage.Percentile[int]{
+			"A": {P100: 14, P90: 8, P75: 8, P50: 0, P25: 0, P10: 0},
+			"B": {P100: 16, P90: 16, P75: 16, P50: 16, P25: 16, P10: 16},
+		}, data.VramGBAvailableByGpuName, nil)
+		compare(t, 25.0, data.Utilization, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestUsageRecords(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		start := time.Now().Add(-time.Minute)
+
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		closedId := queueSession(t, db, requirements)
+		canceledId := queueSession(t, db, requirements)
+
+		gpus := []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}
+
+		err := db.AssignSession(closedId, agent.Id, gpus)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		connections := map[string]restapi.Connection{
+			"connection": {
+				ConnectionData: restapi.ConnectionData{
+					Id:          "connection",
+					Pid:         "1",
+					ProcessName: "test",
+				},
+				ExitCode: 3,
+			},
+		}
+
+		for _, state := range []string{restapi.SessionActive, restapi.SessionClosed} {
+			err = db.UpdateAgent(restapi.AgentUpdate{
+				Id:    agent.Id,
+				State: restapi.AgentActive,
+				SessionsUpdate: map[string]restapi.SessionUpdate{
+					closedId: {
+						State:       state,
+						Connections: connections,
+					},
+				},
+			})
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+		}
+
+		err = db.CancelSession(canceledId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		iterator, err := db.GetUsageRecords(start, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		records := map[string]restapi.UsageRecord{}
+		for iterator.Next() {
+			record := iterator.Value()
+			records[record.SessionId] = record
+		}
+		compare(t, 2, len(records), nil)
+
+		closed := records[closedId]
+		compare(t, agent.Id, closed.AgentId, nil)
+		compare(t, requirements.PoolId, closed.PoolId, nil)
+		compare(t, gpus, closed.Gpus, nil)
+		compare(t, 1, closed.Connections, nil)
+		compare(t, []int{3}, closed.ExitCodes, nil)
+		if closed.AssignedAt == nil || closed.ActiveAt == nil || closed.ClosedAt == nil {
+			t.Errorf("expected the closed session to have been assigned, active and closed, instead received %+v", closed)
+		}
+
+		canceled := records[canceledId]
+		compare(t, "", canceled.AgentId, nil)
+		compare(t, 0, canceled.Connections, nil)
+		if canceled.AssignedAt != nil || canceled.ClosedAt == nil {
+			t.Errorf("expected the canceled session to be closed without an assignment, instead received %+v", canceled)
+		}
+
+		// Records closed before the time range are excluded
+		iterator, err = db.GetUsageRecords(time.Now().Add(time.Minute), time.Now().Add(2*time.Minute))
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		compare(t, false, iterator.Next(), nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGetSessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := agentWithoutPool(24 * 1024 * 1024 * 1024)
+		agent = registerAgent(t, db, agent)
+
+		createdAfter := time.Now().Add(-time.Minute)
+
+		ids := []string{}
+		for index, userId := range []string{"A", "B", "A"} {
+			requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+			requirements.UserId = userId
+			requirements.Priority = index % 2
+			ids = append(ids, queueSession(t, db, requirements))
+		}
+
+		err := db.AssignSession(ids[0], agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: 4 * 1024 * 1024 * 1024,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		list := func(query storage.SessionQuery) []string {
+			t.Helper()
+
+			iterator, err := db.GetSessions(query)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			listed := []string{}
+			for iterator.Next() {
+				session := iterator.Value()
+				if session.Id == ids[0] {
+					compare(t, agent.Id, session.AgentId, nil)
+					compare(t, restapi.SessionAssigned, session.State, nil)
+				}
+				listed = append(listed, session.Id)
+			}
+			return listed
+		}
+
+		compare(t, ids, list(storage.SessionQuery{}), nil)
+		compare(t, []string{ids[2], ids[1], ids[0]}, list(storage.SessionQuery{Descending: true}), nil)
+		compare(t, []string{ids[0], ids[2], ids[1]}, list(storage.SessionQuery{Sort: restapi.SessionSortPriority}), nil)
+
+		compare(t, []string{ids[1], ids[2]}, list(storage.SessionQuery{
+			SessionFilter: restapi.SessionFilter{States: []string{restapi.SessionQueued}},
+		}), nil)
+		compare(t, []string{ids[0]}, list(storage.SessionQuery{
+			SessionFilter: restapi.SessionFilter{AgentId: agent.Id},
+		}), nil)
+		compare(t, []string{ids[0], ids[2]}, list(storage.SessionQuery{
+			SessionFilter: restapi.SessionFilter{UserId: "A"},
+		}), nil)
+		compare(t, ids, list(storage.SessionQuery{
+			SessionFilter: restapi.SessionFilter{CreatedAfter: &createdAfter},
+		}), nil)
+		compare(t, []string{}, list(storage.SessionQuery{
+			SessionFilter: restapi.SessionFilter{CreatedBefore: &createdAfter},
+		}), nil)
+
+		// Pages of a single session follow each other through their cursors
+		for _, query := range []storage.SessionQuery{{}, {Sort: restapi.SessionSortPriority, Descending: true}} {
+			paged := []string{}
+			query.Limit = 1
+			for {
+				iterator, err := db.GetSessions(query)
+				if err != nil {
+					t.Log(err)
+					t.FailNow()
+				}
+
+				if !iterator.Next() {
+					break
+				}
+
+				session := iterator.Value()
+				paged = append(paged, session.Id)
+
+				cursor, err := storage.ParseSessionCursor(storage.CursorOfSession(session).String())
+				compare(t, session.Id, cursor.Id, err)
+				query.After = &cursor
+			}
+
+			query.Limit = 0
+			query.After = nil
+			compare(t, list(query), paged, nil)
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGetAgents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		ids := []string{}
+		for index, hostname := range []string{"gpu-node-1", "gpu-node-2", "cpu-node"} {
+			agent := agentWithoutPool(uint64(index+1) * 8 * 1024 * 1024 * 1024)
+			agent.Hostname = hostname
+			agent.Labels = map[string]string{"Index": fmt.Sprint(index)}
+			if index == 2 {
+				agent.Gpus[0].Name = "Other"
+			}
+
+			agent = registerAgent(t, db, agent)
+			ids = append(ids, agent.Id)
+		}
+
+		sorted := func(ids ...string) []string {
+			ids = append([]string{}, ids...)
+			sort.Strings(ids)
+			return ids
+		}
+
+		list := func(query storage.AgentQuery) []string {
+			t.Helper()
+
+			iterator, err := db.GetAgents(query)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			listed := []string{}
+			for iterator.Next() {
+				listed = append(listed, iterator.Value().Id)
+			}
+			sort.Strings(listed)
+			return listed
+		}
+
+		compare(t, sorted(ids...), list(storage.AgentQuery{}), nil)
+
+		compare(t, sorted(ids[0], ids[1]), list(storage.AgentQuery{HostnamePrefix: "gpu-"}), nil)
+		compare(t, sorted(ids[0], ids[1]), list(storage.AgentQuery{GpuName: "Test"}), nil)
+		compare(t, sorted(ids[1]), list(storage.AgentQuery{MatchLabels: map[string]string{"Index": "1"}}), nil)
+		compare(t, sorted(ids[1], ids[2]), list(storage.AgentQuery{
+			MatchExpressions: []restapi.LabelSelectorRequirement{{Key: "Index", Operator: restapi.SelectorOpGt, Values: []string{"0"}}},
+		}), nil)
+		compare(t, sorted(ids[1], ids[2]), list(storage.AgentQuery{VramAvailableAtLeast: 16 * 1024 * 1024 * 1024}), nil)
+
+		err := db.SetAgentDisabled(ids[0], true, nil)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		compare(t, []string{ids[0]}, list(storage.AgentQuery{States: []string{restapi.AgentDisabled}}), nil)
+		compare(t, sorted(ids[1], ids[2]), list(storage.AgentQuery{States: []string{restapi.AgentActive}}), nil)
+
+		// Pages of a single agent follow each other in the order of their ids
+		paged := []string{}
+		query := storage.AgentQuery{Limit: 1}
+		for {
+			iterator, err := db.GetAgents(query)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			if !iterator.Next() {
+				break
+			}
+
+			agent := iterator.Value()
+			paged = append(paged, agent.Id)
+
+			cursor, err := storage.ParseAgentCursor(storage.CursorOfAgent(agent).String())
+			compare(t, agent.Id, cursor.Id, err)
+			query.After = &cursor
+		}
+		compare(t, sorted(ids...), paged, nil)
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestWatchChanges(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		watcher, unwatch := db.WatchChanges()
+		defer unwatch()
+
+		// Changes notified through the database arrive asynchronously
+		expect := func(expected ...storage.Change) {
+			changes := []storage.Change{}
+			timeout := time.After(5 * time.Second)
+			for len(changes) < len(expected) {
+				select {
+				case <-watcher.Signal():
+					changes = append(changes, watcher.Changes()...)
+				case <-timeout:
+					t.Log("timed out waiting for the changes")
+					t.FailNow()
+				}
+			}
+
+			compare(t, expected, changes, nil)
+		}
+
+		agent := registerAgent(t, db, agentWithoutPool(24*1024*1024*1024))
+		expect(storage.AgentChanged(agent.Id))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+		expect(storage.SessionChanged(sessionId))
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		expect(storage.SessionOfAgentChanged(sessionId, agent.Id))
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			SessionsUpdate: map[string]restapi.SessionUpdate{
+				sessionId: {State: restapi.SessionActive},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		expect(storage.AgentChanged(agent.Id), storage.SessionOfAgentChanged(sessionId, agent.Id))
+
+		err = db.CancelSession(sessionId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		expect(storage.SessionChanged(sessionId))
+
+		err = db.SetAgentTaints(agent.Id, map[string]string{"key": "value"})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		expect(storage.AgentChanged(agent.Id))
+
+		// Only the agents not updated since are notified as missing
+		err = db.SetAgentsMissingIfNotUpdatedFor(time.Hour)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		select {
+		case <-watcher.Signal():
+			t.Errorf("unexpected changes %v", watcher.Changes())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Run("gorm sqlite", func(t *testing.T) {
+		db := openGorm(t, "sqlite")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("gorm postgres", func(t *testing.T) {
+		db := openGorm(t, "postgres")
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
@@ -33,11 +33,25 @@ var (
 
 	test           = flag.Bool("test", false, "Deprecated: Use --test-connection instead")
 	testConnection = flag.Bool("test-connection", false, "Tests the reachability of the controller or server(s)")
+	dryRun         = flag.Bool("dry-run", false, "Explains how the controller would schedule the session without requesting it")
 
 	queueTimeout      = flag.Uint("queue-timeout", 0, "Maximum number of seconds to wait for a GPU")
 	onQueueTimeout    = flag.String("on-queue-timeout", "fail", "When a queue timeout happens, [fail, continue]")
 	onConnectionError = flag.String("on-connection-error", "fail", "When a connection error happens, [fail, continue]")
 
+	priority    = flag.Int("priority", 0, "The priority of the session, higher priority sessions are scheduled first")
+	reservation = flag.String("reservation", "", "The id of the reservation whose capacity the session uses")
+
+	maxDuration = flag.Duration("max-duration", 0, "How long the session may run before it is canceled, the default of the pool when 0")
+	idleTimeout = flag.Duration("idle-timeout", 0, "How long the session may remain without connections before it is canceled, the default of the pool when 0")
+
+	requeueLimit = flag.Int("requeue-limit", -1, "How many times the session is returned to the queue when its agent is lost before it becomes active, the default of the controller when negative")
+
+	persistent     = flag.Bool("persistent", false, "Keeps the session after the application exits so it can be attached to again")
+	attach         = flag.String("attach", "", "The id of a persistent session to attach to instead of requesting a new session")
+	release        = flag.String("release", "", "The id of a persistent session to release")
+	listPersistent = flag.Bool("list-persistent", false, "Lists the persistent sessions of the user")
+
 	juicePath = flag.String("juice-path", "", "Path to the juice executables if different than current executable path")
 
 	errInvalidSessionState  = errors.New("session state is invalid")
@@ -89,11 +103,19 @@ func waitForSession(group task.Group, api restapi.Client, id string) (restapi.Se
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
 
+		var lastQueueStatus restapi.QueueStatus
 		for session.State != restapi.SessionActive {
 			if session.State == restapi.SessionCanceling || session.State == restapi.SessionClosed {
+				if session.Reason != "" {
+					return restapi.Session{}, errors.Newf("session state is %s, %s", session.State, session.Reason).Wrap(errInvalidSessionState)
+				}
 				return restapi.Session{}, errors.Newf("session state is %s", session.State).Wrap(errInvalidSessionState)
 			}
 
+			if session.State == restapi.SessionQueued {
+				lastQueueStatus = logQueueStatus(group, api, session, lastQueueStatus)
+			}
+
 			select {
 			case <-group.Ctx().Done():
 				err = errCancelled
@@ -116,17 +138,92 @@ func waitForSession(group task.Group, api restapi.Client, id string) (restapi.Se
 	return session, nil
 }
 
+// Logs the position of the session within the queue whenever it changes
+func logQueueStatus(group task.Group, api restapi.Client, session restapi.Session, lastStatus restapi.QueueStatus) restapi.QueueStatus {
+	status, err := api.GetQueueStatusWithContext(group.Ctx(), session.Id)
+	if err != nil {
+		// Older controllers do not report the queue status
+		logger.Debugf("unable to get the queue status of session %s, %v", session.Id, err)
+		return lastStatus
+	}
+
+	if status.Position != lastStatus.Position {
+		message := fmt.Sprintf("Session %s is queued at position %d with %d sessions ahead", session.Id, status.Position, status.SessionsAhead)
+		if status.EstimatedWaitSeconds >= 0 {
+			message = fmt.Sprint(message, ", estimated wait ", time.Duration(status.EstimatedWaitSeconds)*time.Second)
+		}
+
+		if session.Reason != "" {
+			message = fmt.Sprint(message, ", ", session.Reason)
+		}
+
+		logger.Info(message)
+	}
+
+	return status
+}
+
+// Renews the lease of the session until juicify exits, so the controller
+// reclaims the session once the process is gone
+func renewSessionLease(group task.Group, api restapi.Client, id string) {
+	group.GoFn("Session lease", func(g task.Group) error {
+		renewed := false
+		for {
+			interval := 10 * time.Second
+
+			lease, err := api.RenewSessionLeaseWithContext(g.Ctx(), id)
+			if err != nil {
+				if !renewed {
+					// Older controllers do not support leases
+					logger.Debugf("unable to renew the lease of session %s, %v", id, err)
+					return nil
+				}
+
+				logger.Warningf("unable to renew the lease of session %s, %v", id, err)
+			} else {
+				renewed = true
+
+				// Renew well before the lease expires to tolerate failed heartbeats
+				if lease.LeaseSeconds > 0 && time.Duration(lease.LeaseSeconds)*time.Second/3 < interval {
+					interval = time.Duration(lease.LeaseSeconds) * time.Second / 3
+				}
+			}
+
+			select {
+			case <-g.Ctx().Done():
+				return nil
+
+			case <-time.After(interval):
+			}
+		}
+	})
+}
+
 func requestSession(group task.Group, api *restapi.Client, config *Configuration) error {
 	logger.Infof("Connecting to %s", config.Servers[0])
 
-	id, err := api.RequestSessionWithContext(group.Ctx(), config.Requirements)
-	if err != nil {
-		return err
+	// Persistent sessions are kept on errors so they can be attached to again
+	keep := config.Requirements.Persistent || *attach != ""
+
+	id := *attach
+	if id == "" {
+		var err error
+		id, err = api.RequestSessionWithContext(group.Ctx(), config.Requirements)
+		if err != nil {
+			return err
+		}
+	}
+
+	if keep {
+		logger.Infof("Session %s is persistent, attach to it again with --attach %s or release it with --release %s", id, id, id)
+	} else {
+		// The lease is renewed with the controller, the client is redirected to the agent below
+		renewSessionLease(group, *api, id)
 	}
 
 	session, err := waitForSession(group, *api, id)
 	if err != nil {
-		if !errors.Is(err, errInvalidSessionState) {
+		if !keep && !errors.Is(err, errInvalidSessionState) {
 			err = errors.Join(err, api.CancelSession(id))
 		}
 
@@ -144,6 +241,35 @@ func requestSession(group task.Group, api *restapi.Client, config *Configuration
 	return nil
 }
 
+func explainSchedule(group task.Group, api restapi.Client, config Configuration) error {
+	explanation, err := api.ExplainScheduleWithContext(group.Ctx(), config.Requirements)
+	if err != nil {
+		return errors.New("unable to explain the schedule").Wrap(err)
+	}
+
+	for _, agent := range explanation.Agents {
+		logger.Infof("Agent %s (%s), matches: %t", agent.AgentId, agent.Hostname, agent.Matches)
+
+		for _, predicate := range agent.Predicates {
+			if predicate.Passed {
+				logger.Infof("  %s: passed", predicate.Name)
+			} else {
+				logger.Infof("  %s: failed, %s", predicate.Name, predicate.Message)
+			}
+		}
+	}
+
+	if explanation.Reason != "" {
+		logger.Infof("The session would remain queued, %s", explanation.Reason)
+	} else if explanation.ChosenAgentId != "" {
+		logger.Infof("The session would be assigned to agent %s", explanation.ChosenAgentId)
+	} else {
+		logger.Info("The session would remain queued, no agent matches the requirements")
+	}
+
+	return nil
+}
+
 func cancelSession(api restapi.Client, config Configuration) error {
 	err := api.CancelSession(config.Id)
 	if err != nil {
@@ -153,13 +279,40 @@ func cancelSession(api restapi.Client, config Configuration) error {
 	return err
 }
 
+func releaseSession(api restapi.Client, id string) error {
+	err := api.ReleaseSession(id)
+	if err != nil {
+		return errors.Newf("failed to release session %s", id).Wrap(err)
+	}
+
+	logger.Infof("Released session %s", id)
+	return nil
+}
+
+func listPersistentSessions(group task.Group, api restapi.Client) error {
+	sessions, err := api.GetPersistentSessionsWithContext(group.Ctx())
+	if err != nil {
+		return errors.New("unable to list the persistent sessions").Wrap(err)
+	}
+
+	if len(sessions) == 0 {
+		logger.Info("No persistent sessions")
+	}
+
+	for _, session := range sessions {
+		logger.Infof("Session %s, state: %s, address: %s", session.Id, session.State, session.Address)
+	}
+
+	return nil
+}
+
 func Run(group task.Group) error {
 	if *test {
 		*testConnection = true
 	}
 
 	// Make sure we have an application to execute
-	if len(flag.Args()) == 0 && !*testConnection {
+	if len(flag.Args()) == 0 && !*testConnection && !*dryRun && *release == "" && !*listPersistent {
 		return errors.New("usage: juicify [options] <application> [<application args>]")
 	}
 
@@ -217,6 +370,30 @@ func Run(group task.Group) error {
 
 	config.Requirements.Version = version
 
+	if *reservation != "" {
+		config.Requirements.ReservationId = *reservation
+	}
+
+	if *priority != 0 {
+		config.Requirements.Priority = *priority
+	}
+
+	if *maxDuration != 0 {
+		config.Requirements.MaxDurationSeconds = int64(maxDuration.Seconds())
+	}
+
+	if *idleTimeout != 0 {
+		config.Requirements.IdleTimeoutSeconds = int64(idleTimeout.Seconds())
+	}
+
+	if *persistent {
+		config.Requirements.Persistent = true
+	}
+
+	if *requeueLimit >= 0 {
+		config.Requirements.RequeueLimit = requeueLimit
+	}
+
 	server := *address
 	if server != "" {
 		// SplitHostPort() rejects addresses that don't have a port or a
@@ -260,6 +437,18 @@ func Run(group task.Group) error {
 		return err
 	}
 
+	if *dryRun {
+		return explainSchedule(group, api, config)
+	}
+
+	if *release != "" {
+		return releaseSession(api, *release)
+	}
+
+	if *listPersistent {
+		return listPersistentSessions(group, api)
+	}
+
 	if err == nil {
 		err = requestSession(group, &api, &config)
 		if err != nil {
@@ -270,7 +459,9 @@ func Run(group task.Group) error {
 			return nil
 		}
 
-		defer cancelSession(api, config)
+		if !config.Requirements.Persistent && *attach == "" {
+			defer cancelSession(api, config)
+		}
 
 		group.GoFn("Check session", func(g task.Group) error {
 			ticker := time.NewTicker(10 * time.Second)
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/Xdevlab/Run/pkg/logger"
 	"github.com/Xdevlab/Run/pkg/restapi"
@@ -129,52 +130,146 @@ func (gpuSet *SelectedGpuSet) GetPciBusString() string {
 	return pciBus
 }
 
-func (gpuSet *GpuSet) Find(requirements []restapi.GpuRequirements) (*SelectedGpuSet, error) {
-	if len(requirements) == 0 {
-		logger.Panic("GpuSet.Find: expected at least one GPU requirement")
+func ValidateSharing(sharing string) error {
+	switch sharing {
+	case "", restapi.GpuSharingExclusive, restapi.GpuSharingWhenNeeded, restapi.GpuSharingAlways:
+		return nil
 	}
 
-	// Currently, this algorithm will choose the first GPU that matches both VRAM and the PCIBus, if specified.
-	// This algorithm does not allow GPUs to be reused though there is no reason why the GPUs could not be reused,
-	// though not preferrable if other GPUs are available.
+	return fmt.Errorf("invalid GPU sharing policy '%s', [%s, %s, %s]", sharing,
+		restapi.GpuSharingExclusive, restapi.GpuSharingWhenNeeded, restapi.GpuSharingAlways)
+}
 
-	// TODO: Better matching algorithm. Reuse of the same GPU can be done but should be the last option
+func (gpu *Gpu) satisfies(requirement restapi.GpuRequirements) bool {
+	if requirement.PciBus != "" && NewPCIAddressFromString(gpu.PciBus) != NewPCIAddressFromString(requirement.PciBus) {
+		return false
+	}
 
-	availableGpus := map[int]*Gpu{}
-	for index, gpu := range gpuSet.gpus {
-		availableGpus[index] = gpu
+	return requirement.MatchesAttributes(gpu.Gpu)
+}
+
+// Returns the GPUs able to satisfy the requirement in the order they should be
+// tried. GPUs with the least free VRAM that still fit are tried first, ties go
+// to the GPU listed first. The used GPUs are the GPUs already chosen for the
+// other requirements of the same request.
+func (gpuSet *GpuSet) candidates(requirement restapi.GpuRequirements, used map[*Gpu]int, sharing string) []*Gpu {
+	candidates := []*Gpu{}
+	for _, gpu := range gpuSet.gpus {
+		if sharing == restapi.GpuSharingExclusive && used[gpu] > 0 {
+			continue
+		}
+
+		if gpu.vramAvailable < requirement.VramRequired || !gpu.satisfies(requirement) {
+			continue
+		}
+
+		candidates = append(candidates, gpu)
 	}
 
-	selectedGpus := make([]SelectedGpu, 0)
-	for _, requirement := range requirements {
-		for index, potentialGpu := range availableGpus {
-			if requirement.VramRequired != 0 && potentialGpu.vramAvailable < requirement.VramRequired {
-				continue
+	sort.SliceStable(candidates, func(i, j int) bool {
+		usedI, usedJ := used[candidates[i]] > 0, used[candidates[j]] > 0
+		if usedI != usedJ {
+			// Reuse GPUs as a last resort unless always sharing
+			return usedI == (sharing == restapi.GpuSharingAlways)
+		}
+
+		return candidates[i].vramAvailable < candidates[j].vramAvailable
+	})
+
+	return candidates
+}
+
+// Chooses a GPU for every requirement, backtracking when a choice leaves the
+// remaining requirements unsatisfiable. Returns nil if there is no solution.
+func (gpuSet *GpuSet) search(requirements []restapi.GpuRequirements, sharing string) []*Gpu {
+	chosen := make([]*Gpu, len(requirements))
+	used := map[*Gpu]int{}
+
+	var choose func(index int) bool
+	choose = func(index int) bool {
+		if index == len(requirements) {
+			return true
+		}
+
+		requirement := requirements[index]
+		for _, gpu := range gpuSet.candidates(requirement, used, sharing) {
+			gpu.vramAvailable -= requirement.VramRequired
+			used[gpu]++
+
+			found := choose(index + 1)
+
+			gpu.vramAvailable += requirement.VramRequired
+			used[gpu]--
+
+			if found {
+				chosen[index] = gpu
+				return true
 			}
+		}
+
+		return false
+	}
+
+	if choose(0) {
+		return chosen
+	}
+
+	return nil
+}
 
-			if requirement.PciBus != "" {
-				potential := NewPCIAddressFromString(potentialGpu.PciBus)
-				required := NewPCIAddressFromString(requirement.PciBus)
-				if potential != required {
-					continue
-				}
+// Selects a GPU for every requirement, in the order of the requirements. The
+// selection only depends on the order and the state of the GPUs, so the same
+// GPUs are chosen by the agent and the controller. The sharing policy decides
+// whether several requirements may be satisfied by the same GPU.
+func (gpuSet *GpuSet) Find(requirements []restapi.GpuRequirements, sharing string) (*SelectedGpuSet, error) {
+	if len(requirements) == 0 {
+		logger.Panic("GpuSet.Find: expected at least one GPU requirement")
+	}
+
+	err := ValidateSharing(sharing)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail before searching if a requirement cannot be satisfied by any GPU
+	for _, requirement := range requirements {
+		found := false
+		for _, gpu := range gpuSet.gpus {
+			if gpu.vramAvailable >= requirement.VramRequired && gpu.satisfies(requirement) {
+				found = true
+				break
 			}
+		}
 
-			selectedGpus = append(selectedGpus, SelectedGpu{
-				gpu:          potentialGpu,
-				vramRequired: requirement.VramRequired,
-			})
+		if !found {
+			return nil, errors.New("unable to find a matching set of GPUs")
+		}
+	}
 
-			delete(availableGpus, index)
+	var chosen []*Gpu
+	switch sharing {
+	case "", restapi.GpuSharingExclusive:
+		chosen = gpuSet.search(requirements, restapi.GpuSharingExclusive)
+	case restapi.GpuSharingWhenNeeded:
+		chosen = gpuSet.search(requirements, restapi.GpuSharingExclusive)
+		if chosen == nil {
+			chosen = gpuSet.search(requirements, restapi.GpuSharingWhenNeeded)
 		}
+	case restapi.GpuSharingAlways:
+		chosen = gpuSet.search(requirements, restapi.GpuSharingAlways)
 	}
 
-	if len(selectedGpus) < len(requirements) {
+	if chosen == nil {
 		return nil, errors.New("unable to find a matching set of GPUs")
 	}
 
-	for _, gpu := range selectedGpus {
-		gpu.gpu.vramAvailable -= gpu.vramRequired
+	selectedGpus := make([]SelectedGpu, 0, len(chosen))
+	for index, gpu := range chosen {
+		selectedGpus = append(selectedGpus, SelectedGpu{
+			gpu:          gpu,
+			vramRequired: requirements[index].VramRequired,
+		})
+		gpu.vramAvailable -= requirements[index].VramRequired
 	}
 
 	return &SelectedGpuSet{
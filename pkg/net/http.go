@@ -195,13 +195,22 @@ func ReadBodyAsBytes(header http.Header, statusCode int, body io.ReadCloser, con
 	return message, nil
 }
 
+// The largest body read, in bytes
+const MaxBodyLength = 32 * 1024 * 1024
+
+// Reads the body of the content length, which readers may return over
+// several reads
 func ParseBody(body io.Reader, length int64) ([]byte, error) {
+	if length > MaxBodyLength {
+		return nil, fmt.Errorf("body length %d exceeds the limit of %d", length, MaxBodyLength)
+	}
+
 	message := make([]byte, length)
-	n, err := body.Read(message)
-	if err != io.EOF {
-		return nil, err
-	} else if length != int64(n) {
+	n, err := io.ReadFull(body, message)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return nil, fmt.Errorf("body length %d did not match expected content length %d", n, length)
+	} else if err != nil {
+		return nil, err
 	}
 
 	return message, nil
@@ -0,0 +1,66 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The filters and page of agents listed through GET /v1/agents, empty fields
+// match every agent
+type AgentListOptions struct {
+	PoolId string
+	// The active and disabled agents when empty
+	States []string
+	// A label selector in the syntax of kubectl, see ParseLabelSelector
+	Selector       string
+	HostnamePrefix string
+	// Agents with at least one GPU of the name
+	GpuName          string
+	MinVramAvailable uint64
+
+	// The NextCursor of the previous page, the first page when empty
+	Cursor string
+	// The server default when 0 with a cursor, every agent in a single page
+	// when 0 without one
+	Limit int
+}
+
+// Whether the agents are listed in pages rather than all at once
+func (options AgentListOptions) paged() bool {
+	return options.Cursor != "" || options.Limit > 0
+}
+
+// Encodes the options as the query of GET /v1/agents
+func (options AgentListOptions) Values() url.Values {
+	values := url.Values{}
+	if options.PoolId != "" {
+		values.Set("pool_id", options.PoolId)
+	}
+	if len(options.States) > 0 {
+		values.Set("state", strings.Join(options.States, ","))
+	}
+	if options.Selector != "" {
+		values.Set("selector", options.Selector)
+	}
+	if options.HostnamePrefix != "" {
+		values.Set("hostname_prefix", options.HostnamePrefix)
+	}
+	if options.GpuName != "" {
+		values.Set("gpu_name", options.GpuName)
+	}
+	if options.MinVramAvailable > 0 {
+		values.Set("min_vram_available", strconv.FormatUint(options.MinVramAvailable, 10))
+	}
+	if options.Cursor != "" {
+		values.Set("cursor", options.Cursor)
+	}
+	if options.Limit > 0 {
+		values.Set("limit", strconv.Itoa(options.Limit))
+	}
+
+	return values
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/Xdevlab/Run/pkg/errors"
 )
@@ -139,6 +141,25 @@ func (api Client) GetSessionWithContext(ctx context.Context, id string) (Session
 	return result, nil
 }
 
+func (api Client) GetQueueStatus(id string) (QueueStatus, error) {
+	return api.GetQueueStatusWithContext(context.Background(), id)
+}
+
+func (api Client) GetQueueStatusWithContext(ctx context.Context, id string) (QueueStatus, error) {
+	response, err := api.Get(ctx, fmt.Sprint("/v1/session/", id, "/queue"))
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[QueueStatus](response)
+	if err != nil {
+		return QueueStatus{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
 func (api Client) UpdateSession(session Session) error {
 	return api.UpdateSessionWithContext(context.Background(), session)
 }
@@ -177,6 +198,49 @@ func (api Client) RequestSessionWithContext(ctx context.Context, requirements Se
 	return parseStringResponse(response)
 }
 
+func (api Client) ExplainSchedule(requirements SessionRequirements) (ScheduleExplanation, error) {
+	return api.ExplainScheduleWithContext(context.Background(), requirements)
+}
+
+func (api Client) ExplainScheduleWithContext(ctx context.Context, requirements SessionRequirements) (ScheduleExplanation, error) {
+	body, err := jsonReaderFromObject(requirements)
+	if err != nil {
+		return ScheduleExplanation{}, ErrInvalidInput.Wrap(err)
+	}
+
+	response, err := api.PostWithJson(ctx, "/v1/schedule/explain", body)
+	if err != nil {
+		return ScheduleExplanation{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[ScheduleExplanation](response)
+	if err != nil {
+		return ScheduleExplanation{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) RenewSessionLease(id string) (SessionLease, error) {
+	return api.RenewSessionLeaseWithContext(context.Background(), id)
+}
+
+func (api Client) RenewSessionLeaseWithContext(ctx context.Context, id string) (SessionLease, error) {
+	response, err := api.Post(ctx, fmt.Sprint("/v1/session/", id, "/heartbeat"))
+	if err != nil {
+		return SessionLease{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[SessionLease](response)
+	if err != nil {
+		return SessionLease{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
 func (api Client) CancelSession(id string) error {
 	return api.CancelSessionWithContext(context.Background(), id)
 }
@@ -205,6 +269,266 @@ func (api Client) ReleaseSessionWithContext(ctx context.Context, id string) erro
 	return validateResponse(response)
 }
 
+func (api Client) GetPersistentSessions() ([]Session, error) {
+	return api.GetPersistentSessionsWithContext(context.Background())
+}
+
+func (api Client) GetPersistentSessionsWithContext(ctx context.Context) ([]Session, error) {
+	response, err := api.Get(ctx, "/v1/sessions/persistent")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[[]Session](response)
+	if err != nil {
+		return nil, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) GetSessions(options SessionListOptions) (SessionPage, error) {
+	return api.GetSessionsWithContext(context.Background(), options)
+}
+
+func (api Client) GetSessionsWithContext(ctx context.Context, options SessionListOptions) (SessionPage, error) {
+	response, err := api.Get(ctx, fmt.Sprint("/v1/sessions?", options.Values().Encode()))
+	if err != nil {
+		return SessionPage{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[SessionPage](response)
+	if err != nil {
+		return SessionPage{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+// Streams the events matching the filter to the handler until the stream ends
+// or the handler returns an error, resuming after the last event id when it is
+// not 0. Returns the id of the last event handled to resume from.
+func (api Client) Watch(filter WatchFilter, lastEventId uint64, handler func(Event) error) (uint64, error) {
+	return api.WatchWithContext(context.Background(), filter, lastEventId, handler)
+}
+
+func (api Client) WatchWithContext(ctx context.Context, filter WatchFilter, lastEventId uint64, handler func(Event) error) (uint64, error) {
+	query := filter.Values()
+	if lastEventId != 0 {
+		query.Set("last_event_id", strconv.FormatUint(lastEventId, 10))
+	}
+
+	response, err := api.Get(ctx, fmt.Sprint("/v1/watch?", query.Encode()))
+	if err != nil {
+		return lastEventId, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return lastEventId, validateResponse(response)
+	}
+
+	err = readEvents(response.Body, func(event Event) error {
+		err := handler(event)
+		if err == nil {
+			lastEventId = event.Id
+		}
+		return err
+	})
+	if ctx.Err() != nil {
+		return lastEventId, ctx.Err()
+	}
+
+	return lastEventId, err
+}
+
+func (api Client) GetUsage(start, end time.Time, groupBy string) (Usage, error) {
+	return api.GetUsageWithContext(context.Background(), start, end, groupBy)
+}
+
+func (api Client) GetUsageWithContext(ctx context.Context, start, end time.Time, groupBy string) (Usage, error) {
+	query := url.Values{}
+	query.Set("start", start.Format(time.RFC3339))
+	query.Set("end", end.Format(time.RFC3339))
+	if groupBy != "" {
+		query.Set("group_by", groupBy)
+	}
+
+	response, err := api.Get(ctx, fmt.Sprint("/v1/usage?", query.Encode()))
+	if err != nil {
+		return Usage{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[Usage](response)
+	if err != nil {
+		return Usage{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) CreateReservation(reservation Reservation) (Reservation, error) {
+	return api.CreateReservationWithContext(context.Background(), reservation)
+}
+
+func (api Client) CreateReservationWithContext(ctx context.Context, reservation Reservation) (Reservation, error) {
+	body, err := jsonReaderFromObject(reservation)
+	if err != nil {
+		return Reservation{}, ErrInvalidInput.Wrap(err)
+	}
+
+	response, err := api.PostWithJson(ctx, "/v1/reservation", body)
+	if err != nil {
+		return Reservation{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[Reservation](response)
+	if err != nil {
+		return Reservation{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) GetReservation(id string) (Reservation, error) {
+	return api.GetReservationWithContext(context.Background(), id)
+}
+
+func (api Client) GetReservationWithContext(ctx context.Context, id string) (Reservation, error) {
+	response, err := api.Get(ctx, fmt.Sprint("/v1/reservation/", id))
+	if err != nil {
+		return Reservation{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[Reservation](response)
+	if err != nil {
+		return Reservation{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) DeleteReservation(id string) error {
+	return api.DeleteReservationWithContext(context.Background(), id)
+}
+
+func (api Client) DeleteReservationWithContext(ctx context.Context, id string) error {
+	response, err := api.Delete(ctx, fmt.Sprint("/v1/reservation/", id))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
+func (api Client) CreateWebhookSubscription(subscription WebhookSubscription) (WebhookSubscription, error) {
+	return api.CreateWebhookSubscriptionWithContext(context.Background(), subscription)
+}
+
+func (api Client) CreateWebhookSubscriptionWithContext(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	body, err := jsonReaderFromObject(subscription)
+	if err != nil {
+		return WebhookSubscription{}, ErrInvalidInput.Wrap(err)
+	}
+
+	response, err := api.PostWithJson(ctx, "/v1/webhook", body)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[WebhookSubscription](response)
+	if err != nil {
+		return WebhookSubscription{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) GetWebhookSubscription(id string) (WebhookSubscription, error) {
+	return api.GetWebhookSubscriptionWithContext(context.Background(), id)
+}
+
+func (api Client) GetWebhookSubscriptionWithContext(ctx context.Context, id string) (WebhookSubscription, error) {
+	response, err := api.Get(ctx, fmt.Sprint("/v1/webhook/", id))
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[WebhookSubscription](response)
+	if err != nil {
+		return WebhookSubscription{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) GetWebhookSubscriptions() ([]WebhookSubscription, error) {
+	return api.GetWebhookSubscriptionsWithContext(context.Background())
+}
+
+func (api Client) GetWebhookSubscriptionsWithContext(ctx context.Context) ([]WebhookSubscription, error) {
+	response, err := api.Get(ctx, "/v1/webhooks")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[[]WebhookSubscription](response)
+	if err != nil {
+		return nil, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+// Retrieves up to limit of the latest deliveries of the subscription, newest
+// first, or the default number of deliveries when limit is 0
+func (api Client) GetWebhookDeliveries(id string, limit int) ([]WebhookDelivery, error) {
+	return api.GetWebhookDeliveriesWithContext(context.Background(), id, limit)
+}
+
+func (api Client) GetWebhookDeliveriesWithContext(ctx context.Context, id string, limit int) ([]WebhookDelivery, error) {
+	path := fmt.Sprint("/v1/webhook/", id, "/deliveries")
+	if limit > 0 {
+		path = fmt.Sprint(path, "?limit=", limit)
+	}
+
+	response, err := api.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[[]WebhookDelivery](response)
+	if err != nil {
+		return nil, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) DeleteWebhookSubscription(id string) error {
+	return api.DeleteWebhookSubscriptionWithContext(context.Background(), id)
+}
+
+func (api Client) DeleteWebhookSubscriptionWithContext(ctx context.Context, id string) error {
+	response, err := api.Delete(ctx, fmt.Sprint("/v1/webhook/", id))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
 func (api Client) GetAgent(id string) (Agent, error) {
 	return api.GetAgentWithContext(context.Background(), id)
 }
@@ -224,6 +548,35 @@ func (api Client) GetAgentWithContext(ctx context.Context, id string) (Agent, er
 	return result, nil
 }
 
+func (api Client) GetAgents(options AgentListOptions) (AgentPage, error) {
+	return api.GetAgentsWithContext(context.Background(), options)
+}
+
+func (api Client) GetAgentsWithContext(ctx context.Context, options AgentListOptions) (AgentPage, error) {
+	response, err := api.Get(ctx, fmt.Sprint("/v1/agents?", options.Values().Encode()))
+	if err != nil {
+		return AgentPage{}, err
+	}
+	defer response.Body.Close()
+
+	// Without a page requested, the agents are returned as a plain array
+	if !options.paged() {
+		agents, err := parseJsonResponse[[]Agent](response)
+		if err != nil {
+			return AgentPage{}, ErrInvalidResponse.Wrap(err)
+		}
+
+		return AgentPage{Agents: agents}, nil
+	}
+
+	result, err := parseJsonResponse[AgentPage](response)
+	if err != nil {
+		return AgentPage{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
 func (api Client) UpdateAgent(update AgentUpdate) error {
 	return api.UpdateAgentWithContext(context.Background(), update)
 }
@@ -243,6 +596,73 @@ func (api Client) UpdateAgentWithContext(ctx context.Context, update AgentUpdate
 	return validateResponse(response)
 }
 
+func (api Client) SetAgentTaints(id string, taints map[string]string) (Agent, error) {
+	return api.SetAgentTaintsWithContext(context.Background(), id, taints)
+}
+
+func (api Client) SetAgentTaintsWithContext(ctx context.Context, id string, taints map[string]string) (Agent, error) {
+	body, err := jsonReaderFromObject(taints)
+	if err != nil {
+		return Agent{}, ErrInvalidInput.Wrap(err)
+	}
+
+	response, err := api.PutWithJson(ctx, fmt.Sprint("/v1/agent/", id, "/taints"), body)
+	if err != nil {
+		return Agent{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[Agent](response)
+	if err != nil {
+		return Agent{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func agentFromResponse(response *http.Response, err error) (Agent, error) {
+	if err != nil {
+		return Agent{}, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseJsonResponse[Agent](response)
+	if err != nil {
+		return Agent{}, ErrInvalidResponse.Wrap(err)
+	}
+
+	return result, nil
+}
+
+func (api Client) CordonAgent(id string) (Agent, error) {
+	return api.CordonAgentWithContext(context.Background(), id)
+}
+
+func (api Client) CordonAgentWithContext(ctx context.Context, id string) (Agent, error) {
+	return agentFromResponse(api.Post(ctx, fmt.Sprint("/v1/agent/", id, "/cordon")))
+}
+
+func (api Client) DrainAgent(id string, drain AgentDrain) (Agent, error) {
+	return api.DrainAgentWithContext(context.Background(), id, drain)
+}
+
+func (api Client) DrainAgentWithContext(ctx context.Context, id string, drain AgentDrain) (Agent, error) {
+	body, err := jsonReaderFromObject(drain)
+	if err != nil {
+		return Agent{}, ErrInvalidInput.Wrap(err)
+	}
+
+	return agentFromResponse(api.PostWithJson(ctx, fmt.Sprint("/v1/agent/", id, "/drain"), body))
+}
+
+func (api Client) UncordonAgent(id string) (Agent, error) {
+	return api.UncordonAgentWithContext(context.Background(), id)
+}
+
+func (api Client) UncordonAgentWithContext(ctx context.Context, id string) (Agent, error) {
+	return agentFromResponse(api.Post(ctx, fmt.Sprint("/v1/agent/", id, "/uncordon")))
+}
+
 func (api Client) RegisterAgent(agent Agent) (string, error) {
 	return api.RegisterAgentWithContext(context.Background(), agent)
 }
@@ -0,0 +1,77 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+func validateLimit(name string, seconds int64) error {
+	if seconds < 0 {
+		return fmt.Errorf("%s must not be negative, received %d", name, seconds)
+	}
+
+	return nil
+}
+
+func applyLimit(requested, defaultLimit, capLimit int64) int64 {
+	if requested == 0 {
+		requested = defaultLimit
+	}
+
+	if capLimit > 0 && (requested == 0 || requested > capLimit) {
+		requested = capLimit
+	}
+
+	return requested
+}
+
+func (requirements SessionRequirements) ValidateLimits() error {
+	err := errors.Join(
+		validateLimit("maximum duration", requirements.MaxDurationSeconds),
+		validateLimit("idle timeout", requirements.IdleTimeoutSeconds))
+
+	if requirements.RequeueLimit != nil && *requirements.RequeueLimit < 0 {
+		err = errors.Join(err, fmt.Errorf("requeue limit must not be negative, received %d", *requirements.RequeueLimit))
+	}
+
+	return err
+}
+
+func (limits PoolSessionLimits) Validate() error {
+	return errors.Join(
+		validateLimit("default maximum duration", limits.DefaultMaxDurationSeconds),
+		validateLimit("maximum duration cap", limits.MaxDurationCapSeconds),
+		validateLimit("default idle timeout", limits.DefaultIdleTimeoutSeconds),
+		validateLimit("idle timeout cap", limits.IdleTimeoutCapSeconds),
+		validateLimit("lease", limits.LeaseSeconds))
+}
+
+// Returns the limits of the session after applying the defaults and caps of the pool
+func (limits PoolSessionLimits) Apply(maxDurationSeconds, idleTimeoutSeconds int64) (int64, int64) {
+	return applyLimit(maxDurationSeconds, limits.DefaultMaxDurationSeconds, limits.MaxDurationCapSeconds),
+		applyLimit(idleTimeoutSeconds, limits.DefaultIdleTimeoutSeconds, limits.IdleTimeoutCapSeconds)
+}
+
+// Returns why the session exceeded one of its limits at the time, or an empty
+// string when it has not
+func (session Session) ExceededLimit(now time.Time) string {
+	if session.MaxDurationSeconds > 0 && session.AssignedAt != nil {
+		maxDuration := time.Duration(session.MaxDurationSeconds) * time.Second
+		if now.Sub(*session.AssignedAt) >= maxDuration {
+			return fmt.Sprintf("session exceeded its maximum duration of %s", maxDuration)
+		}
+	}
+
+	if session.IdleTimeoutSeconds > 0 && session.IdleSince != nil {
+		idleTimeout := time.Duration(session.IdleTimeoutSeconds) * time.Second
+		if now.Sub(*session.IdleSince) >= idleTimeout {
+			return fmt.Sprintf("session was idle for longer than its idle timeout of %s", idleTimeout)
+		}
+	}
+
+	return ""
+}
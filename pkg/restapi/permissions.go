@@ -0,0 +1,20 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import "fmt"
+
+func (params PermissionParams) Validate() error {
+	switch params.Permission {
+	case PermissionCreateSession, PermissionRegisterAgent, PermissionAdmin:
+	default:
+		return fmt.Errorf("unknown permission '%s', expected one of %s, %s, %s", params.Permission, PermissionCreateSession, PermissionRegisterAgent, PermissionAdmin)
+	}
+
+	if params.UserId == "" || params.PoolId == "" {
+		return fmt.Errorf("permission requires a user and a pool")
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var versionRegex = regexp.MustCompile(`[0-9]+(\.[0-9]+)*`)
+
+// Parses the first version within the string, such as 535.104.05 within a
+// driver description
+func ParseVersion(version string) ([]uint64, bool) {
+	match := versionRegex.FindString(version)
+	if match == "" {
+		return nil, false
+	}
+
+	components := []uint64{}
+	for _, component := range strings.Split(match, ".") {
+		value, err := strconv.ParseUint(component, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		components = append(components, value)
+	}
+
+	return components, true
+}
+
+// Missing components are treated as 0, so 535 is equal to 535.0
+func compareVersions(a, b []uint64) int {
+	for index := 0; index < len(a) || index < len(b); index++ {
+		var componentA, componentB uint64
+		if index < len(a) {
+			componentA = a[index]
+		}
+		if index < len(b) {
+			componentB = b[index]
+		}
+
+		if componentA < componentB {
+			return -1
+		} else if componentA > componentB {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func matchesPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+func meetsVersion(minimum, version string) bool {
+	if minimum == "" {
+		return true
+	}
+
+	required, ok := ParseVersion(minimum)
+	if !ok {
+		return false
+	}
+
+	actual, ok := ParseVersion(version)
+	return ok && compareVersions(actual, required) >= 0
+}
+
+func (requirement GpuRequirements) patterns() [][2]string {
+	return [][2]string{
+		{"uuid", requirement.Uuid},
+		{"name", requirement.Name},
+		{"vendor", requirement.Vendor},
+		{"model", requirement.Model},
+	}
+}
+
+func (requirement GpuRequirements) Validate() error {
+	for _, pattern := range requirement.patterns() {
+		_, err := path.Match(pattern[1], "")
+		if err != nil {
+			return fmt.Errorf("GPU requirement has an invalid %s pattern '%s', %v", pattern[0], pattern[1], err)
+		}
+	}
+
+	if requirement.MinDriverVersion != "" {
+		_, ok := ParseVersion(requirement.MinDriverVersion)
+		if !ok {
+			return fmt.Errorf("GPU requirement has an invalid minimum driver version '%s'", requirement.MinDriverVersion)
+		}
+	}
+
+	if requirement.MinComputeCapability != "" {
+		_, ok := ParseVersion(requirement.MinComputeCapability)
+		if !ok {
+			return fmt.Errorf("GPU requirement has an invalid minimum compute capability '%s'", requirement.MinComputeCapability)
+		}
+	}
+
+	return nil
+}
+
+// Returns why the GPU does not have the attributes required, or an empty
+// string when it does. VRAM and the PCI bus are not checked.
+func (requirement GpuRequirements) AttributeMismatch(gpu Gpu) string {
+	values := map[string]string{
+		"uuid":   gpu.Uuid,
+		"name":   gpu.Name,
+		"vendor": gpu.Vendor,
+		"model":  gpu.Model,
+	}
+
+	for _, pattern := range requirement.patterns() {
+		if !matchesPattern(pattern[1], values[pattern[0]]) {
+			return fmt.Sprintf("GPU %d %s '%s' does not match '%s'", gpu.Index, pattern[0], values[pattern[0]], pattern[1])
+		}
+	}
+
+	if requirement.VendorId != 0 && requirement.VendorId != gpu.VendorId {
+		return fmt.Sprintf("GPU %d vendor ID %#04x is not %#04x", gpu.Index, gpu.VendorId, requirement.VendorId)
+	}
+
+	if requirement.DeviceId != 0 && requirement.DeviceId != gpu.DeviceId {
+		return fmt.Sprintf("GPU %d device ID %#04x is not %#04x", gpu.Index, gpu.DeviceId, requirement.DeviceId)
+	}
+
+	if !meetsVersion(requirement.MinDriverVersion, gpu.Driver) {
+		return fmt.Sprintf("GPU %d driver '%s' is older than %s", gpu.Index, gpu.Driver, requirement.MinDriverVersion)
+	}
+
+	if !meetsVersion(requirement.MinComputeCapability, gpu.ComputeCapability) {
+		return fmt.Sprintf("GPU %d compute capability '%s' is lower than %s", gpu.Index, gpu.ComputeCapability, requirement.MinComputeCapability)
+	}
+
+	return ""
+}
+
+func (requirement GpuRequirements) MatchesAttributes(gpu Gpu) bool {
+	return requirement.AttributeMismatch(gpu) == ""
+}
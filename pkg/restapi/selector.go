@@ -0,0 +1,213 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SelectorOpIn           = "In"
+	SelectorOpNotIn        = "NotIn"
+	SelectorOpExists       = "Exists"
+	SelectorOpDoesNotExist = "DoesNotExist"
+	SelectorOpGt           = "Gt"
+	SelectorOpLt           = "Lt"
+)
+
+// Matches the labels of an agent in the same manner as a Kubernetes label
+// selector requirement, Gt and Lt compare the label value as an integer
+type LabelSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values"`
+}
+
+func (requirement LabelSelectorRequirement) Validate() error {
+	if requirement.Key == "" {
+		return fmt.Errorf("label selector requirement must have a key")
+	}
+
+	switch requirement.Operator {
+	case SelectorOpIn, SelectorOpNotIn:
+		if len(requirement.Values) == 0 {
+			return fmt.Errorf("label selector requirement for '%s' with operator %s must have at least one value", requirement.Key, requirement.Operator)
+		}
+
+	case SelectorOpExists, SelectorOpDoesNotExist:
+		if len(requirement.Values) != 0 {
+			return fmt.Errorf("label selector requirement for '%s' with operator %s must not have values", requirement.Key, requirement.Operator)
+		}
+
+	case SelectorOpGt, SelectorOpLt:
+		if len(requirement.Values) != 1 {
+			return fmt.Errorf("label selector requirement for '%s' with operator %s must have exactly one value", requirement.Key, requirement.Operator)
+		}
+
+		_, err := strconv.ParseInt(requirement.Values[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("label selector requirement for '%s' with operator %s must have an integer value, %v", requirement.Key, requirement.Operator, err)
+		}
+
+	default:
+		return fmt.Errorf("label selector requirement for '%s' has an invalid operator '%s', [%s, %s, %s, %s, %s, %s]", requirement.Key, requirement.Operator,
+			SelectorOpIn, SelectorOpNotIn, SelectorOpExists, SelectorOpDoesNotExist, SelectorOpGt, SelectorOpLt)
+	}
+
+	return nil
+}
+
+func (requirement LabelSelectorRequirement) Matches(labels map[string]string) bool {
+	value, present := labels[requirement.Key]
+
+	switch requirement.Operator {
+	case SelectorOpIn:
+		return present && contains(requirement.Values, value)
+
+	case SelectorOpNotIn:
+		return !present || !contains(requirement.Values, value)
+
+	case SelectorOpExists:
+		return present
+
+	case SelectorOpDoesNotExist:
+		return !present
+
+	case SelectorOpGt, SelectorOpLt:
+		if !present || len(requirement.Values) != 1 {
+			return false
+		}
+
+		labelValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+
+		requiredValue, err := strconv.ParseInt(requirement.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+
+		if requirement.Operator == SelectorOpGt {
+			return labelValue > requiredValue
+		}
+		return labelValue < requiredValue
+	}
+
+	return false
+}
+
+func (requirement LabelSelectorRequirement) String() string {
+	switch requirement.Operator {
+	case SelectorOpExists:
+		return requirement.Key
+	case SelectorOpDoesNotExist:
+		return fmt.Sprint("!", requirement.Key)
+	}
+
+	return fmt.Sprintf("%s %s %v", requirement.Key, requirement.Operator, requirement.Values)
+}
+
+func MatchesExpressions(labels map[string]string, expressions []LabelSelectorRequirement) bool {
+	for _, expression := range expressions {
+		if !expression.Matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, check := range values {
+		if check == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+var setRequirementRegex = regexp.MustCompile(`^([^\s!=<>(),]+)\s+(in|notin)\s+\(([^()]*)\)$`)
+
+// Splits the selector at the commas outside of parentheses
+func splitSelector(selector string) []string {
+	terms := []string{}
+	depth, start := 0, 0
+	for index, character := range selector {
+		switch character {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:index])
+				start = index + 1
+			}
+		}
+	}
+
+	return append(terms, selector[start:])
+}
+
+// Parses a label selector in the syntax of kubectl, such as
+// "gpu=a100,zone in (east,west),!spot,cores>8", into the labels that must be
+// equal and the requirements of the other terms
+func ParseLabelSelector(selector string) (map[string]string, []LabelSelectorRequirement, error) {
+	labels := map[string]string{}
+	requirements := []LabelSelectorRequirement{}
+
+	if strings.TrimSpace(selector) == "" {
+		return labels, requirements, nil
+	}
+
+	for _, term := range splitSelector(selector) {
+		term = strings.TrimSpace(term)
+
+		var requirement LabelSelectorRequirement
+		if match := setRequirementRegex.FindStringSubmatch(term); match != nil {
+			requirement = LabelSelectorRequirement{Key: match[1], Operator: SelectorOpIn}
+			if match[2] == "notin" {
+				requirement.Operator = SelectorOpNotIn
+			}
+
+			for _, value := range strings.Split(match[3], ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					requirement.Values = append(requirement.Values, value)
+				}
+			}
+		} else if strings.HasPrefix(term, "!") {
+			requirement = LabelSelectorRequirement{Key: strings.TrimSpace(term[1:]), Operator: SelectorOpDoesNotExist}
+		} else if key, value, found := strings.Cut(term, "!="); found {
+			requirement = LabelSelectorRequirement{Key: strings.TrimSpace(key), Operator: SelectorOpNotIn, Values: []string{strings.TrimSpace(value)}}
+		} else if key, value, found := strings.Cut(term, "="); found {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				return nil, nil, fmt.Errorf("label selector term '%s' must have a key", term)
+			}
+
+			labels[key] = strings.TrimSpace(strings.TrimPrefix(value, "="))
+			continue
+		} else if key, value, found := strings.Cut(term, ">"); found {
+			requirement = LabelSelectorRequirement{Key: strings.TrimSpace(key), Operator: SelectorOpGt, Values: []string{strings.TrimSpace(value)}}
+		} else if key, value, found := strings.Cut(term, "<"); found {
+			requirement = LabelSelectorRequirement{Key: strings.TrimSpace(key), Operator: SelectorOpLt, Values: []string{strings.TrimSpace(value)}}
+		} else {
+			requirement = LabelSelectorRequirement{Key: term, Operator: SelectorOpExists}
+		}
+
+		err := requirement.Validate()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		requirements = append(requirements, requirement)
+	}
+
+	return labels, requirements, nil
+}
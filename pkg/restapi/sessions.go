@@ -0,0 +1,119 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sessionStates = []string{SessionQueued, SessionAssigned, SessionActive, SessionCanceling, SessionClosed}
+
+// Selects sessions by their fields, empty fields match every session
+type SessionFilter struct {
+	States        []string
+	PoolId        string
+	AgentId       string
+	UserId        string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+func (filter SessionFilter) Validate() error {
+	for _, state := range filter.States {
+		if !contains(sessionStates, state) {
+			return fmt.Errorf("invalid session state '%s', expected one of %s", state, strings.Join(sessionStates, ", "))
+		}
+	}
+
+	if filter.CreatedAfter != nil && filter.CreatedBefore != nil && !filter.CreatedAfter.Before(*filter.CreatedBefore) {
+		return fmt.Errorf("sessions created after %s cannot be created before %s",
+			filter.CreatedAfter.Format(time.RFC3339), filter.CreatedBefore.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (filter SessionFilter) Matches(session SessionListItem) bool {
+	if len(filter.States) > 0 && !contains(filter.States, session.State) {
+		return false
+	}
+
+	if filter.PoolId != "" && filter.PoolId != session.PoolId {
+		return false
+	}
+
+	if filter.AgentId != "" && filter.AgentId != session.AgentId {
+		return false
+	}
+
+	if filter.UserId != "" && filter.UserId != session.UserId {
+		return false
+	}
+
+	if filter.CreatedAfter != nil && !session.CreatedAt.After(*filter.CreatedAfter) {
+		return false
+	}
+
+	return filter.CreatedBefore == nil || session.CreatedAt.Before(*filter.CreatedBefore)
+}
+
+func (filter SessionFilter) values() url.Values {
+	values := url.Values{}
+	if len(filter.States) > 0 {
+		values.Set("state", strings.Join(filter.States, ","))
+	}
+	if filter.PoolId != "" {
+		values.Set("pool_id", filter.PoolId)
+	}
+	if filter.AgentId != "" {
+		values.Set("agent_id", filter.AgentId)
+	}
+	if filter.UserId != "" {
+		values.Set("user_id", filter.UserId)
+	}
+	if filter.CreatedAfter != nil {
+		values.Set("created_after", filter.CreatedAfter.Format(time.RFC3339Nano))
+	}
+	if filter.CreatedBefore != nil {
+		values.Set("created_before", filter.CreatedBefore.Format(time.RFC3339Nano))
+	}
+
+	return values
+}
+
+// The filter, order and page of sessions listed through GET /v1/sessions
+type SessionListOptions struct {
+	SessionFilter
+
+	// SessionSortCreated when empty, ties are ordered by creation then id
+	Sort       string
+	Descending bool
+	// The NextCursor of the previous page, the first page when empty
+	Cursor string
+	// The server default when 0
+	Limit int
+}
+
+// Encodes the options as the query of GET /v1/sessions
+func (options SessionListOptions) Values() url.Values {
+	values := options.SessionFilter.values()
+	if options.Sort != "" {
+		values.Set("sort", options.Sort)
+	}
+	if options.Descending {
+		values.Set("order", "desc")
+	}
+	if options.Cursor != "" {
+		values.Set("cursor", options.Cursor)
+	}
+	if options.Limit > 0 {
+		values.Set("limit", strconv.Itoa(options.Limit))
+	}
+
+	return values
+}
@@ -0,0 +1,80 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// Sessions that do not tolerate the taint are not scheduled on the agent
+	TaintEffectNoSchedule = "NoSchedule"
+	// Sessions that do not tolerate the taint are only scheduled on the agent
+	// when no other agent fits
+	TaintEffectPreferNoSchedule = "PreferNoSchedule"
+	// Sessions that do not tolerate the taint are not scheduled on the agent and
+	// those already on the agent are canceled
+	TaintEffectNoExecute = "NoExecute"
+)
+
+// Taints are stored in Agent.Taints as key=value pairs where the value may end
+// with the effect, value:effect, in the same manner as kubectl taint. Taints
+// without an effect are NoSchedule.
+type Taint struct {
+	Key    string
+	Value  string
+	Effect string
+}
+
+func ParseTaint(key, value string) Taint {
+	index := strings.LastIndex(value, ":")
+	if index >= 0 {
+		effect := value[index+1:]
+		switch effect {
+		case TaintEffectNoSchedule, TaintEffectPreferNoSchedule, TaintEffectNoExecute:
+			return Taint{
+				Key:    key,
+				Value:  value[:index],
+				Effect: effect,
+			}
+		}
+	}
+
+	return Taint{
+		Key:    key,
+		Value:  value,
+		Effect: TaintEffectNoSchedule,
+	}
+}
+
+// Parses the taints of an agent sorted by key
+func ParseTaints(taints map[string]string) []Taint {
+	parsed := make([]Taint, 0, len(taints))
+	for key, value := range taints {
+		parsed = append(parsed, ParseTaint(key, value))
+	}
+
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].Key < parsed[j].Key
+	})
+
+	return parsed
+}
+
+// A session tolerates a taint when it tolerates the key with either the value,
+// tolerating every effect, or the value and the effect
+func (taint Taint) ToleratedBy(tolerates map[string]string) bool {
+	value, present := tolerates[taint.Key]
+	if !present {
+		return false
+	}
+
+	return value == taint.Value || value == fmt.Sprint(taint.Value, ":", taint.Effect)
+}
+
+func (taint Taint) String() string {
+	return fmt.Sprintf("%s=%s:%s", taint.Key, taint.Value, taint.Effect)
+}
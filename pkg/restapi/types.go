@@ -3,6 +3,8 @@
  */
 package restapi
 
+import "time"
+
 const (
 	SessionClosed    = "closed"
 	SessionQueued    = "queued"
@@ -18,6 +20,16 @@ const (
 	AgentMissing  = "missing"
 )
 
+// Whether several GPU requirements of the same session may be satisfied by the same GPU
+const (
+	// Every requirement uses a different GPU, the default
+	GpuSharingExclusive = "exclusive"
+	// Requirements use different GPUs when possible and share GPUs otherwise
+	GpuSharingWhenNeeded = "shared-when-needed"
+	// Requirements are packed onto as few GPUs as possible
+	GpuSharingAlways = "always-shared"
+)
+
 type Permission string
 
 const (
@@ -29,16 +41,55 @@ const (
 type GpuRequirements struct {
 	VramRequired uint64 `json:"vramRequired"`
 	PciBus       string `json:"pciBus"`
+
+	// Matched case insensitively against the GPU, either exactly or as a pattern
+	// containing * or ?
+	Uuid   string `json:"uuid"`
+	Name   string `json:"name"`
+	Vendor string `json:"vendor"`
+	Model  string `json:"model"`
+
+	// Matched exactly when not 0
+	VendorId uint32 `json:"vendorId"`
+	DeviceId uint32 `json:"deviceId"`
+
+	// Minimum versions compared component by component, such as 535 or 8.6
+	MinDriverVersion     string `json:"minDriverVersion"`
+	MinComputeCapability string `json:"minComputeCapability"`
 }
 
 type SessionRequirements struct {
 	Version string `json:"version"`
 	PoolId  string `json:"poolId"`
 
-	Gpus []GpuRequirements `json:"gpus"`
+	// Sessions with a higher priority are scheduled first and may preempt sessions with a lower priority
+	Priority int `json:"priority"`
+
+	// Sessions carrying the id of a reservation use the capacity it holds during its window
+	ReservationId string `json:"reservationId"`
+
+	Gpus       []GpuRequirements `json:"gpus"`
+	GpuSharing string            `json:"gpuSharing"`
+
+	MatchLabels      map[string]string          `json:"matchLabels"`
+	MatchExpressions []LabelSelectorRequirement `json:"matchExpressions"`
+	Tolerates        map[string]string          `json:"tolerates"`
+
+	// How long the session may remain assigned and how long it may remain without
+	// connections before it is canceled, 0 uses the default of the pool
+	MaxDurationSeconds int64 `json:"maxDurationSeconds"`
+	IdleTimeoutSeconds int64 `json:"idleTimeoutSeconds"`
 
-	MatchLabels map[string]string `json:"matchLabels"`
-	Tolerates   map[string]string `json:"tolerates"`
+	// Persistent sessions remain assigned after their last connection closes
+	// until they are released, clients reattach to them by id. They have no
+	// idle timeout or lease.
+	Persistent bool `json:"persistent"`
+	// Set by the controller to the user requesting the session
+	UserId string `json:"userId"`
+
+	// How many times the session is returned to the queue when its agent is lost before it becomes
+	// active, the default of the controller when nil
+	RequeueLimit *int `json:"requeueLimit,omitempty"`
 }
 
 type SessionGpu struct {
@@ -48,16 +99,163 @@ type SessionGpu struct {
 }
 
 type Session struct {
-	Id      string `json:"id"`
-	State   string `json:"state"`
-	Address string `json:"address"`
-	Version string `json:"version"`
-	PoolId  string `json:"poolId"`
+	Id       string `json:"id"`
+	State    string `json:"state"`
+	Address  string `json:"address"`
+	Version  string `json:"version"`
+	PoolId   string `json:"poolId"`
+	Priority int    `json:"priority"`
+
+	// Why the session is in its current state, for example why it remains queued
+	Reason string `json:"reason"`
+
+	Persistent bool   `json:"persistent"`
+	UserId     string `json:"userId,omitempty"`
+
+	// The limits applied to the session, 0 is unlimited
+	MaxDurationSeconds int64 `json:"maxDurationSeconds"`
+	IdleTimeoutSeconds int64 `json:"idleTimeoutSeconds"`
+
+	AssignedAt *time.Time `json:"assignedAt,omitempty"`
+	// When the session was last left without connections, nil while connected
+	IdleSince *time.Time `json:"idleSince,omitempty"`
+
+	// How many times the session was returned to the queue after its agent was lost
+	Requeues int `json:"requeues"`
 
 	Gpus        []SessionGpu `json:"gpus"`
 	Connections []Connection `json:"connections"`
 }
 
+type AgentPage struct {
+	Agents []Agent `json:"agents"`
+	// Retrieves the next page when passed as the cursor, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+const (
+	SessionSortCreated  = "created"
+	SessionSortPriority = "priority"
+)
+
+// A session listed with the agent it is assigned to and when it was requested
+type SessionListItem struct {
+	Session
+
+	AgentId   string    `json:"agentId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type SessionPage struct {
+	Sessions []SessionListItem `json:"sessions"`
+	// Retrieves the next page when passed as the cursor, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Capacity held free for the sessions carrying the id of the reservation
+// between Start and End
+type Reservation struct {
+	Id     string `json:"id"`
+	PoolId string `json:"poolId"`
+	// The agent the capacity is held on, any agent of the pool when empty
+	AgentId string `json:"agentId"`
+
+	Gpus []GpuRequirements `json:"gpus"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+const (
+	UsageGroupByUser = "user"
+	UsageGroupByPool = "pool"
+)
+
+// The accounting record of a session, kept after the session and its agent
+// are gone
+type UsageRecord struct {
+	SessionId string `json:"sessionId"`
+	UserId    string `json:"userId"`
+	PoolId    string `json:"poolId"`
+	// The agent the session was last assigned to
+	AgentId string `json:"agentId"`
+
+	Gpus         []SessionGpu `json:"gpus"`
+	VramRequired uint64       `json:"vramRequired"`
+
+	QueuedAt   time.Time  `json:"queuedAt"`
+	AssignedAt *time.Time `json:"assignedAt,omitempty"`
+	ActiveAt   *time.Time `json:"activeAt,omitempty"`
+	ClosedAt   *time.Time `json:"closedAt,omitempty"`
+
+	Connections int   `json:"connections"`
+	ExitCodes   []int `json:"exitCodes"`
+}
+
+// The usage of the sessions of a user or pool within a time range
+type UsageGroup struct {
+	Key      string `json:"key"`
+	Sessions int    `json:"sessions"`
+
+	// The GPUs of the sessions multiplied by the seconds they were held
+	GpuSeconds float64 `json:"gpuSeconds"`
+	// The VRAM required by the sessions in GB multiplied by the seconds it was held
+	VramGBSeconds float64 `json:"vramGBSeconds"`
+}
+
+type Usage struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	GroupBy string    `json:"groupBy,omitempty"`
+
+	// Set when grouping by user or pool, otherwise the records are returned
+	Groups  []UsageGroup  `json:"groups,omitempty"`
+	Records []UsageRecord `json:"records,omitempty"`
+}
+
+// The lease a client holds on its session, renewed through heartbeats
+type SessionLease struct {
+	// 0 when leases are disabled and the session does not expire
+	LeaseSeconds int64      `json:"leaseSeconds"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+}
+
+type QueueStatus struct {
+	// Position of the session within the queue of its pool starting at 1, 0 when the session is not queued
+	Position      int `json:"position"`
+	SessionsAhead int `json:"sessionsAhead"`
+
+	// Estimated from the recent rate of assignments within the pool, -1 when it cannot be estimated
+	EstimatedWaitSeconds int64 `json:"estimatedWaitSeconds"`
+}
+
+type PredicateResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+type AgentExplanation struct {
+	AgentId  string `json:"agentId"`
+	Hostname string `json:"hostname"`
+	Matches  bool   `json:"matches"`
+	// Only valid when the agent matches, the agent with the highest score is chosen
+	Score float64 `json:"score"`
+
+	Predicates []PredicateResult `json:"predicates"`
+}
+
+type ScheduleExplanation struct {
+	// Empty when no agent would be chosen
+	ChosenAgentId string       `json:"chosenAgentId"`
+	Gpus          []SessionGpu `json:"gpus"`
+
+	// Why the session would remain queued regardless of the agents, for example a pool quota
+	Reason string `json:"reason,omitempty"`
+
+	Agents []AgentExplanation `json:"agents"`
+}
+
 type ConnectionData struct {
 	Id          string `json:"id"`
 	Pid         string `json:"pid"`
@@ -68,6 +266,8 @@ type Connection struct {
 	ConnectionData
 
 	ExitCode int `json:"exitCode"`
+	// Whether the connection ended, with the exit code
+	Closed bool `json:"closed,omitempty"`
 }
 
 type GpuMetrics struct {
@@ -95,6 +295,9 @@ type Gpu struct {
 	Vram        uint64 `json:"vram"`
 	PciBus      string `json:"pciBus"`
 
+	// Empty when not reported by the agent
+	ComputeCapability string `json:"computeCapability"`
+
 	Metrics GpuMetrics `json:"metrics"`
 }
 
@@ -106,6 +309,9 @@ type Agent struct {
 	Version  string `json:"version"`
 	PoolId   string `json:"poolId"`
 
+	// When the agent is draining, the time the sessions remaining on it are canceled
+	DrainDeadline *time.Time `json:"drainDeadline,omitempty"`
+
 	Gpus []Gpu `json:"gpus"`
 
 	Labels map[string]string `json:"labels"`
@@ -114,6 +320,12 @@ type Agent struct {
 	Sessions []Session `json:"sessions"`
 }
 
+type AgentDrain struct {
+	// How long the sessions on the agent may run before they are canceled,
+	// immediately when 0
+	TimeoutSeconds int64 `json:"timeoutSeconds"`
+}
+
 type Status struct {
 	State    string `json:"state"`
 	Version  string `json:"version"`
@@ -123,6 +335,11 @@ type Status struct {
 type SessionUpdate struct {
 	State       string                `json:"State"`
 	Connections map[string]Connection `json:"connections"`
+
+	// Whether the session is without connections
+	Idle bool `json:"idle"`
+	// Why the agent changed the state of the session, empty when unchanged
+	Reason string `json:"reason"`
 }
 
 type AgentUpdate struct {
@@ -132,12 +349,58 @@ type AgentUpdate struct {
 	Gpus           []GpuMetrics             `json:"gpus"`
 }
 
+// Events matching the subscription are delivered to its URL, signed with its
+// secret. The secret is only returned when the subscription is created.
+type WebhookSubscription struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// Delivers every event type when empty
+	EventTypes []string `json:"eventTypes,omitempty"`
+	// Delivers the events of every pool when empty
+	PoolId string `json:"poolId,omitempty"`
+	// The payload posted, events when empty
+	Format string `json:"format,omitempty"`
+	// Generated when empty
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	// Posts the events as streamed by GET /v1/watch
+	WebhookFormatEvent = "event"
+	// Posts a WebhookMessage for each session state, as --webhook-url did
+	// before subscriptions
+	WebhookFormatLegacy = "legacy"
+)
+
+// The payload of the deliveries of legacy subscriptions
 type WebhookMessage struct {
 	Agent   string `json:"agent"`
 	Session string `json:"session"`
 	State   string `json:"state"`
 }
 
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	// The delivery was attempted as many times as allowed without succeeding
+	WebhookDeliveryFailed = "failed"
+)
+
+type WebhookDelivery struct {
+	Id             string    `json:"id"`
+	SubscriptionId string    `json:"subscriptionId"`
+	Event          Event     `json:"event"`
+	State          string    `json:"state"`
+	Attempts       int       `json:"attempts"`
+	CreatedAt      time.Time `json:"createdAt"`
+	NextAttemptAt  time.Time `json:"nextAttemptAt"`
+	// The outcome of the last attempt
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	StatusCode    int        `json:"statusCode,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
 type CreatePoolParams struct {
 	Name string `json:"name"`
 }
@@ -148,12 +411,48 @@ type PermissionParams struct {
 	PoolId     string     `json:"poolId"`
 }
 
+// Limits on the sessions assigned to the agents of a pool, a limit of 0 is unlimited
+type PoolQuotas struct {
+	MaxSessions int    `json:"maxSessions"`
+	MaxVram     uint64 `json:"maxVram"`
+	MaxGpus     int    `json:"maxGpus"`
+}
+
+// The resources used by the sessions of a pool that count against its quotas
+type PoolUsage struct {
+	Sessions int    `json:"sessions"`
+	Vram     uint64 `json:"vram"`
+	Gpus     int    `json:"gpus"`
+}
+
+// Limits on the lifetime of the sessions of a pool, a limit of 0 is unlimited.
+// The defaults apply to sessions not requesting a limit and the caps apply to
+// every session.
+type PoolSessionLimits struct {
+	DefaultMaxDurationSeconds int64 `json:"defaultMaxDurationSeconds"`
+	MaxDurationCapSeconds     int64 `json:"maxDurationCapSeconds"`
+	DefaultIdleTimeoutSeconds int64 `json:"defaultIdleTimeoutSeconds"`
+	IdleTimeoutCapSeconds     int64 `json:"idleTimeoutCapSeconds"`
+
+	// How long the sessions of the pool remain without a heartbeat from their
+	// client before they are canceled, 0 uses the lease of the controller
+	LeaseSeconds int64 `json:"leaseSeconds"`
+
+	// The highest priority of the sessions of the pool, only admins of the
+	// pool may request a higher one
+	MaxPriority int `json:"maxPriority"`
+}
+
 type Pool struct {
 	Id           string `json:"id"`
 	Name         string `json:"name"`
 	SessionCount int    `json:"sessionCount"`
 	AgentCount   int    `json:"agentCount"`
 	UserCount    int    `json:"userCount"`
+
+	Quotas        PoolQuotas        `json:"quotas"`
+	Usage         PoolUsage         `json:"usage"`
+	SessionLimits PoolSessionLimits `json:"sessionLimits"`
 }
 
 type UserPermissions struct {
@@ -0,0 +1,85 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Returns the seconds the session held its GPUs within the time range, from
+// its assignment until it closed
+func (record UsageRecord) HeldSeconds(start, end time.Time) float64 {
+	if record.AssignedAt == nil {
+		return 0
+	}
+
+	from := *record.AssignedAt
+	if from.Before(start) {
+		from = start
+	}
+
+	to := end
+	if record.ClosedAt != nil && record.ClosedAt.Before(end) {
+		to = *record.ClosedAt
+	}
+
+	if !to.After(from) {
+		return 0
+	}
+
+	return to.Sub(from).Seconds()
+}
+
+func ValidateUsageGroupBy(groupBy string) error {
+	switch groupBy {
+	case "", UsageGroupByUser, UsageGroupByPool:
+		return nil
+	}
+
+	return fmt.Errorf("usage cannot be grouped by '%s', expected %s or %s", groupBy, UsageGroupByUser, UsageGroupByPool)
+}
+
+// Sums the usage of the records within the time range by user or pool, sorted
+// by key
+func GroupUsage(records []UsageRecord, groupBy string, start, end time.Time) ([]UsageGroup, error) {
+	err := ValidateUsageGroupBy(groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*UsageGroup{}
+	for _, record := range records {
+		key := record.UserId
+		if groupBy == UsageGroupByPool {
+			key = record.PoolId
+		}
+
+		group, found := groups[key]
+		if !found {
+			group = &UsageGroup{
+				Key: key,
+			}
+			groups[key] = group
+		}
+
+		seconds := record.HeldSeconds(start, end)
+
+		group.Sessions++
+		group.GpuSeconds += float64(len(record.Gpus)) * seconds
+		group.VramGBSeconds += float64(record.VramRequired) / (1024 * 1024 * 1024) * seconds
+	}
+
+	sorted := make([]UsageGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	return sorted, nil
+}
@@ -0,0 +1,116 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// The session was requested or changed state
+	EventSessionState      = "session.state"
+	EventConnectionCreated = "connection.created"
+	EventConnectionClosed  = "connection.closed"
+	EventAgentRegistered   = "agent.registered"
+	EventAgentMissing      = "agent.missing"
+	// The state, pool, labels, taints or GPUs of the agent changed, including
+	// the agent closing
+	EventAgentUpdated = "agent.updated"
+	// The stream could not resume after the last event id, events may have been
+	// missed so the sessions and agents should be retrieved again
+	EventResync = "resync"
+)
+
+// An event streamed by GET /v1/watch. Session events carry the session and
+// connection events the connection, agent events carry the agent. The agent
+// of a session event is the agent the session is assigned to, if any.
+type Event struct {
+	Id   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	SessionId string `json:"sessionId,omitempty"`
+	AgentId   string `json:"agentId,omitempty"`
+	PoolId    string `json:"poolId,omitempty"`
+
+	Session    *Session    `json:"session,omitempty"`
+	Connection *Connection `json:"connection,omitempty"`
+	Agent      *Agent      `json:"agent,omitempty"`
+}
+
+// Selects the events of a session, agent or pool, empty fields match every
+// event. Resync events match every filter.
+type WatchFilter struct {
+	SessionId string
+	AgentId   string
+	PoolId    string
+}
+
+func (filter WatchFilter) Matches(event Event) bool {
+	if event.Type == EventResync {
+		return true
+	}
+
+	return (filter.SessionId == "" || filter.SessionId == event.SessionId) &&
+		(filter.AgentId == "" || filter.AgentId == event.AgentId) &&
+		(filter.PoolId == "" || filter.PoolId == event.PoolId)
+}
+
+// Encodes the filter as the query of GET /v1/watch
+func (filter WatchFilter) Values() url.Values {
+	values := url.Values{}
+	if filter.SessionId != "" {
+		values.Set("session_id", filter.SessionId)
+	}
+	if filter.AgentId != "" {
+		values.Set("agent_id", filter.AgentId)
+	}
+	if filter.PoolId != "" {
+		values.Set("pool_id", filter.PoolId)
+	}
+
+	return values
+}
+
+// Reads server-sent events, passing the data of each to the handler until the
+// stream ends or the handler returns an error
+func readEvents(reader io.Reader, handler func(Event) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	data := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if len(data) > 0 {
+				var event Event
+				err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event)
+				if err != nil {
+					return err
+				}
+
+				err = handler(event)
+				if err != nil {
+					return err
+				}
+			}
+
+			data = data[:0]
+			continue
+		}
+
+		// Other fields, such as the id and event type, are repeated within the data
+		if value, found := strings.CutPrefix(line, "data:"); found {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+
+	return scanner.Err()
+}
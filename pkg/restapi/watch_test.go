@@ -0,0 +1,123 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		": keep-alive",
+		"",
+		"id: 1",
+		"event: session.state",
+		`data: {"id":1,"type":"session.state","sessionId":"a"}`,
+		"",
+		// The data of an event may span several lines
+		"id: 2",
+		"event: agent.registered",
+		`data: {"id":2,`,
+		`data:"type":"agent.registered",`,
+		`data: "agentId":"b"}`,
+		"",
+		"",
+		"id: 3",
+		"event: resync",
+		`data: {"id":3,"type":"resync"}`,
+		"",
+		// An event without the blank line ending it is discarded
+		`data: {"id":4,"type":"resync"}`,
+	}, "\n")
+
+	events := []Event{}
+	err := readEvents(strings.NewReader(stream), func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{Id: 1, Type: EventSessionState, SessionId: "a"},
+		{Id: 2, Type: EventAgentRegistered, AgentId: "b"},
+		{Id: 3, Type: EventResync},
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestReadEventsStopsOnError(t *testing.T) {
+	stream := "data: {\"id\":1}\n\ndata: {\"id\":2}\n\n"
+
+	stop := errors.New("stop")
+	count := 0
+	err := readEvents(strings.NewReader(stream), func(event Event) error {
+		count++
+		return stop
+	})
+	if !errors.Is(err, stop) || count != 1 {
+		t.Errorf("expected to stop after the first event, got %d events and %v", count, err)
+	}
+
+	err = readEvents(strings.NewReader("data: {\n\n"), func(event Event) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("expected an error for invalid data")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/v1/watch" || query.Get("last_event_id") != "41" || query.Get("pool_id") != "pool" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for id := 42; id <= 44; id++ {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {\"id\":%d,\"type\":\"%s\",\"poolId\":\"pool\"}\n\n", id, EventSessionState, id, EventSessionState)
+		}
+	}))
+	defer server.Close()
+
+	api := Client{
+		Client:  server.Client(),
+		Address: server.Listener.Addr().String(),
+	}
+
+	ids := []uint64{}
+	lastEventId, err := api.Watch(WatchFilter{PoolId: "pool"}, 41, func(event Event) error {
+		ids = append(ids, event.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(ids) != "[42 43 44]" || lastEventId != 44 {
+		t.Errorf("expected events 42 to 44, got %v and last event id %d", ids, lastEventId)
+	}
+
+	// The last event id is the last event handled without an error
+	stop := errors.New("stop")
+	lastEventId, err = api.Watch(WatchFilter{PoolId: "pool"}, 41, func(event Event) error {
+		if event.Id == 43 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || lastEventId != 42 {
+		t.Errorf("expected to stop after event 42, got last event id %d and %v", lastEventId, err)
+	}
+}
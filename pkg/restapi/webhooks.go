@@ -0,0 +1,135 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The headers of a webhook delivery. The signature is the HMAC-SHA256 of the
+// timestamp, a period and the body, keyed with the secret of the subscription.
+const (
+	WebhookDeliveryHeader  = "X-Juice-Webhook-Delivery"
+	WebhookEventHeader     = "X-Juice-Webhook-Event"
+	WebhookTimestampHeader = "X-Juice-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Juice-Webhook-Signature"
+)
+
+const webhookSignaturePrefix = "sha256="
+
+// The event types delivered to webhooks, resync events only concern streams
+var WebhookEventTypes = []string{
+	EventSessionState,
+	EventConnectionCreated,
+	EventConnectionClosed,
+	EventAgentRegistered,
+	EventAgentMissing,
+	EventAgentUpdated,
+}
+
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// The legacy message of a session state event
+func WebhookMessageFromEvent(event Event) WebhookMessage {
+	message := WebhookMessage{
+		Agent:   event.AgentId,
+		Session: event.SessionId,
+	}
+
+	if event.Session != nil {
+		message.State = event.Session.State
+	}
+
+	return message
+}
+
+// Checks the signature and timestamp headers of a delivery received by a
+// webhook. Deliveries signed longer than the tolerance ago are rejected so
+// they cannot be replayed.
+func VerifyWebhook(secret string, timestampHeader string, signatureHeader string, body []byte, tolerance time.Duration) error {
+	seconds, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp '%s'", timestampHeader)
+	}
+
+	timestamp := time.Unix(seconds, 0)
+	if tolerance > 0 && time.Since(timestamp).Abs() > tolerance {
+		return fmt.Errorf("webhook timestamp %s is outside of the tolerance", timestamp.Format(time.RFC3339))
+	}
+
+	if !hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signatureHeader)) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+
+	return nil
+}
+
+func (subscription WebhookSubscription) Validate() error {
+	parsed, err := url.Parse(subscription.Url)
+	if err != nil {
+		return fmt.Errorf("webhook has an invalid URL '%s', %v", subscription.Url, err)
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook URL '%s' must be an absolute http or https URL", subscription.Url)
+	}
+
+	if subscription.Format != "" && subscription.Format != WebhookFormatEvent && subscription.Format != WebhookFormatLegacy {
+		return fmt.Errorf("webhook has an unknown format '%s', expected %s or %s", subscription.Format, WebhookFormatEvent, WebhookFormatLegacy)
+	}
+
+	for _, eventType := range subscription.EventTypes {
+		known := false
+		for _, webhookEventType := range WebhookEventTypes {
+			known = known || eventType == webhookEventType
+		}
+
+		if !known {
+			return fmt.Errorf("webhook has an unknown event type '%s', expected one of %s", eventType, strings.Join(WebhookEventTypes, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (subscription WebhookSubscription) Matches(event Event) bool {
+	if event.Type == EventResync {
+		return false
+	}
+
+	if subscription.PoolId != "" && subscription.PoolId != event.PoolId {
+		return false
+	}
+
+	// Legacy messages only describe session states
+	if subscription.Format == WebhookFormatLegacy && event.Type != EventSessionState {
+		return false
+	}
+
+	if len(subscription.EventTypes) == 0 {
+		return true
+	}
+
+	for _, eventType := range subscription.EventTypes {
+		if eventType == event.Type {
+			return true
+		}
+	}
+
+	return false
+}